@@ -16,107 +16,390 @@
 
 // Logging library for Canopy.
 //
-// Warnings and errors are always logged to /var/log/canopy/ccs-error.log
-// Additional trace and debug info is logged to /var/log/canopy/ccs.log
+// Messages have a level (error, warn, info or trace) and may come from a
+// subsystem, such as "ws" or "rest", and carry key/value fields:
 //
-// If the files above cannot be written to, then falls back to logging to
-// STDOUT.
+//      var logger = canolog.Subsystem("ws")
+//      logger.With("device", id).Info("Connected")
+//
+// SetLevel chooses the least severe level that is logged, and
+// SetSubsystemLevels overrides it for particular subsystems.  Messages are
+// written as text or, with SetFormat("json"), as one JSON object per line.
+//
+// Configure chooses where messages go: any combination of a log file, which
+// can be rotated, stderr and the local syslog, plus an optional separate
+// file for errors and warnings.  Until then, messages go to STDOUT.
 package canolog
 
 import (
-    "log"
-    //"io"
-    "os"
+    "bytes"
+    "encoding/json"
     "fmt"
+    "os"
+    "path/filepath"
+    "runtime"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Log levels, as given by the "log-level" option.  Each level also logs
+// everything that the levels before it do.
+const (
+    LevelError = iota
+    LevelWarn
+    LevelInfo
+    LevelTrace
+)
+
+var levelsByName = map[string]int{
+    "error": LevelError,
+    "warn": LevelWarn,
+    "info": LevelInfo,
+    "trace": LevelTrace,
+}
+
+var levelNames = []string{"error", "warn", "info", "trace"}
+
+// Output formats, as given by the "log-format" option.
+const (
+    FormatText = "text"
+    FormatJSON = "json"
 )
 
 type CanopyLogger struct {
-    logger *log.Logger
-    logFile *os.File
-    errorLogger *log.Logger
-    errorLogFile *os.File
-    warnLogger *log.Logger
-    logRequests bool
-    logTraces bool
+    sinks []sink
+
+    // Also gets errors and warnings, if set.
+    errorSink sink
+
+    format string
+    level int
+
+    // Levels that override <level> for particular subsystems.
+    subsystemLevels map[string]int
 }
 
-var std = CanopyLogger{}
+// Guards std, which is replaced when the log file is reopened.
+var stdLock sync.RWMutex
+var std = CanopyLogger{sinks: []sink{&streamSink{os.Stdout}}, format: FormatText, level: LevelTrace}
 
-//var noopLogger = log.New(io.MultiWriter(), "", log.LstdFlags | log.Lshortfile)
+// Keeps lines from different goroutines from being interleaved.
+var writeLock sync.Mutex
+
+// Logger logs messages from one subsystem, adding the same fields to each.
+// Loggers are cheap, and safe to use from several goroutines.
+type Logger struct {
+    subsystem string
+
+    // Alternating keys and values.
+    fields []interface{}
+}
+
+// Used by the package-level logging functions.
+var root = &Logger{}
+var restLogger = &Logger{subsystem: "rest"}
+var wsLogger = &Logger{subsystem: "ws"}
+
+// Get the logger for <subsystem>, such as "ws", "rest", "datalayer" or
+// "pigeon".
+func Subsystem(subsystem string) *Logger {
+    return &Logger{subsystem: subsystem}
+}
+
+// Get a logger that adds <keyvals>, which alternate between keys and
+// values, to every message.
+func (logger *Logger) With(keyvals ...interface{}) *Logger {
+    fields := make([]interface{}, 0, len(logger.fields) + len(keyvals))
+    fields = append(fields, logger.fields...)
+    fields = append(fields, keyvals...)
+    return &Logger{subsystem: logger.subsystem, fields: fields}
+}
 
 // If /var/log/canopy files cannot be opened, then fallback to just logging to STDOUT
 func InitFallback() error {
-    std.logger = log.New(os.Stdout, "", log.LstdFlags | log.Lshortfile)
-    std.errorLogger = log.New(os.Stdout, "ERROR ", log.LstdFlags | log.Lshortfile)
-    std.warnLogger = log.New(os.Stdout, "WARN ", log.LstdFlags | log.Lshortfile)
+    stdLock.Lock()
+    defer stdLock.Unlock()
+    closeSinks()
+    std.sinks = []sink{&streamSink{os.Stdout}}
 
     return nil
 }
 
-// Initialize Canopy logger
+// Initialize Canopy logger to log to <logFilename> alone, without rotation.
+// See Configure for more choices.
 func Init(logFilename string) error {
-    var err error
-    std.logFile, err = os.OpenFile(logFilename, os.O_RDWR | os.O_CREATE | os.O_APPEND, 0666);
-    if err != nil {
-        fmt.Println("Error opening file " + logFilename + ": ", err)
-        fmt.Println("Falling back to STDOUT for logging")
-        return InitFallback()
+    return Configure(Options{Sinks: []string{SinkFile}, File: logFilename})
+}
+
+// Only log messages at <level> ("error", "warn", "info" or "trace") and
+// more severe levels.
+func SetLevel(level string) error {
+    value, ok := levelsByName[level]
+    if !ok {
+        return fmt.Errorf("Unknown log level: %s", level)
     }
-    std.logger = log.New(std.logFile, "", log.LstdFlags | log.Lshortfile)
+    stdLock.Lock()
+    std.level = value
+    stdLock.Unlock()
+    return nil
+}
 
-    std.errorLogger = log.New(std.logFile, "ERROR ", log.LstdFlags | log.Lshortfile)
-    std.warnLogger = log.New(std.logFile, "WARN ", log.LstdFlags | log.Lshortfile)
-    /*std.errorLogFile, err = os.OpenFile("/var/log/canopy/ccs-errors.log", os.O_RDWR | os.O_CREATE | os.O_APPEND, 0666);
+// Parse a list of per-subsystem levels, like "ws=warn,datalayer=info".
+func ParseSubsystemLevels(spec string) (map[string]int, error) {
+    levels := map[string]int{}
+    for _, item := range strings.Split(spec, ",") {
+        item = strings.TrimSpace(item)
+        if item == "" {
+            continue
+        }
+        parts := strings.SplitN(item, "=", 2)
+        if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+            return nil, fmt.Errorf("Expected <subsystem>=<level>, not %q", item)
+        }
+        level, ok := levelsByName[strings.TrimSpace(parts[1])]
+        if !ok {
+            return nil, fmt.Errorf("Unknown log level for %s: %s", parts[0], parts[1])
+        }
+        levels[strings.TrimSpace(parts[0])] = level
+    }
+    return levels, nil
+}
+
+// Override the level set with SetLevel for some subsystems.  <spec> is
+// parsed by ParseSubsystemLevels, and replaces any earlier overrides.
+func SetSubsystemLevels(spec string) error {
+    levels, err := ParseSubsystemLevels(spec)
     if err != nil {
-        fmt.Println("Error opening file /var/log/canopy/ccs-errors.log: ", err)
-        fmt.Println("Falling back to STDOUT for logging")
-        return InitFallback()
+        return err
     }
-    std.errorLogger = log.New(io.MultiWriter(std.errorLogFile, std.logFile), "ERROR ", log.LstdFlags | log.Lshortfile)
-    std.warnLogger = log.New(io.MultiWriter(std.errorLogFile, std.logFile), "WARN ", log.LstdFlags | log.Lshortfile)*/
+    stdLock.Lock()
+    std.subsystemLevels = levels
+    stdLock.Unlock()
+    return nil
+}
 
+// Write messages as <format>: "text" or "json".
+func SetFormat(format string) error {
+    if !(format == FormatText || format == FormatJSON) {
+        return fmt.Errorf("Unknown log format: %s", format)
+    }
+    stdLock.Lock()
+    std.format = format
+    stdLock.Unlock()
     return nil
 }
 
-// Close Canopy log file
+// Close Canopy log files
 func Shutdown() {
-    std.logger.Output(2, fmt.Sprintln("Goodbye"));
-    if (std.logFile != nil) {
-        std.logFile.Close()
+    root.log(2, LevelInfo, "Goodbye")
+    stdLock.Lock()
+    defer stdLock.Unlock()
+    closeSinks()
+    std.sinks = []sink{&streamSink{os.Stdout}}
+}
+
+// Format a message the way the package has always done, with spaces
+// between all operands.
+func sprint(v []interface{}) string {
+    return strings.TrimSuffix(fmt.Sprintln(v...), "\n")
+}
+
+// Write a message at <level>, if that level is enabled for the logger's
+// subsystem.  <calldepth> is the number of stack frames between the
+// caller to report and this function.
+func (logger *Logger) log(calldepth int, level int, msg string) {
+    stdLock.RLock()
+    defer stdLock.RUnlock()
+    enabled, ok := std.subsystemLevels[logger.subsystem]
+    if !ok {
+        enabled = std.level
+    }
+    if level > enabled {
+        return
     }
-    if (std.errorLogFile != nil) {
-        std.errorLogFile.Close()
+
+    caller := "???:0"
+    _, file, line, ok := runtime.Caller(calldepth)
+    if ok {
+        caller = filepath.Base(file) + ":" + strconv.Itoa(line)
+    }
+
+    // The message, subsystem and fields, without the time, level or caller.
+    plain := msg
+    if logger.subsystem != "" {
+        plain = "[" + logger.subsystem + "] " + plain
     }
+    if len(logger.fields) > 0 {
+        plain += " " + formatFields(logger.fields)
+    }
+
+    var buf bytes.Buffer
+    now := time.Now()
+    if std.format == FormatJSON {
+        entry := map[string]interface{}{
+            "time": now.Format(time.RFC3339Nano),
+            "level": levelNames[level],
+            "caller": caller,
+            "msg": msg,
+        }
+        if logger.subsystem != "" {
+            entry["subsystem"] = logger.subsystem
+        }
+        if len(logger.fields) > 0 {
+            fields := map[string]interface{}{}
+            for i := 0; i < len(logger.fields); i += 2 {
+                fields[fieldKey(logger.fields, i)] = fieldValue(logger.fields, i)
+            }
+            entry["fields"] = fields
+        }
+        data, err := json.Marshal(entry)
+        if err != nil {
+            // A field can't be marshalled, so fall back to strings.
+            data, _ = json.Marshal(map[string]interface{}{
+                "time": entry["time"],
+                "level": entry["level"],
+                "caller": caller,
+                "msg": msg + " " + formatFields(logger.fields),
+            })
+        }
+        buf.Write(data)
+    } else {
+        buf.WriteString(strings.ToUpper(levelNames[level]) + " ")
+        buf.WriteString(now.Format("2006/01/02 15:04:05") + " " + caller + ": ")
+        buf.WriteString(plain)
+    }
+    buf.WriteString("\n")
+
+    writeLock.Lock()
+    for _, s := range std.sinks {
+        s.write(level, buf.Bytes(), plain)
+    }
+    if std.errorSink != nil && level <= LevelWarn {
+        std.errorSink.write(level, buf.Bytes(), plain)
+    }
+    writeLock.Unlock()
 }
 
-// Log a request or response body
-func Request(v ...interface{}) {
-    if (std.logRequests) {
-        std.logger.Output(2, fmt.Sprintln(v...))
+func fieldKey(fields []interface{}, i int) string {
+    return fmt.Sprint(fields[i])
+}
+
+// A key without a value gets "(MISSING)", like fmt does.
+func fieldValue(fields []interface{}, i int) interface{} {
+    if i + 1 < len(fields) {
+        if err, ok := fields[i + 1].(error); ok {
+            return err.Error()
+        }
+        return fields[i + 1]
     }
+    return "(MISSING)"
+}
+
+// Format fields as key=value pairs, sorted by key, quoting values that
+// contain spaces or quotes.
+func formatFields(fields []interface{}) string {
+    pairs := []string{}
+    for i := 0; i < len(fields); i += 2 {
+        value := fmt.Sprint(fieldValue(fields, i))
+        if value == "" || strings.ContainsAny(value, " \t\n\"=") {
+            value = strconv.Quote(value)
+        }
+        pairs = append(pairs, fieldKey(fields, i) + "=" + value)
+    }
+    sort.Strings(pairs)
+    return strings.Join(pairs, " ")
+}
+
+// Log an error
+func (logger *Logger) Error(v ...interface{}) {
+    logger.log(2, LevelError, sprint(v))
+}
+
+// Log an error, formatted with fmt.Sprintf
+func (logger *Logger) Errorf(format string, v ...interface{}) {
+    logger.log(2, LevelError, fmt.Sprintf(format, v...))
+}
+
+// Log a warning
+func (logger *Logger) Warn(v ...interface{}) {
+    logger.log(2, LevelWarn, sprint(v))
+}
+
+// Log a warning, formatted with fmt.Sprintf
+func (logger *Logger) Warnf(format string, v ...interface{}) {
+    logger.log(2, LevelWarn, fmt.Sprintf(format, v...))
+}
+
+// Log an information statement
+func (logger *Logger) Info(v ...interface{}) {
+    logger.log(2, LevelInfo, sprint(v))
+}
+
+// Log an information statement, formatted with fmt.Sprintf
+func (logger *Logger) Infof(format string, v ...interface{}) {
+    logger.log(2, LevelInfo, fmt.Sprintf(format, v...))
+}
+
+// Log a debug trace message
+func (logger *Logger) Trace(v ...interface{}) {
+    logger.log(2, LevelTrace, sprint(v))
+}
+
+// Log a debug trace message, formatted with fmt.Sprintf
+func (logger *Logger) Tracef(format string, v ...interface{}) {
+    logger.log(2, LevelTrace, fmt.Sprintf(format, v...))
+}
+
+// Log a request or response body, as a trace message from the "rest"
+// subsystem.
+func Request(v ...interface{}) {
+    restLogger.log(2, LevelTrace, sprint(v))
 }
 
 // Log an error
 func Error(v ...interface{}) {
-    std.errorLogger.Output(2, fmt.Sprintln(v...))
+    root.log(2, LevelError, sprint(v))
+}
+
+// Log an error, formatted with fmt.Sprintf
+func Errorf(format string, v ...interface{}) {
+    root.log(2, LevelError, fmt.Sprintf(format, v...))
 }
 
 // Log a warning
 func Warn(v ...interface{}) {
-    std.warnLogger.Output(2, fmt.Sprintln(v...))
+    root.log(2, LevelWarn, sprint(v))
+}
+
+// Log a warning, formatted with fmt.Sprintf
+func Warnf(format string, v ...interface{}) {
+    root.log(2, LevelWarn, fmt.Sprintf(format, v...))
 }
 
 // Log an information statement
 func Info(v ...interface{}) {
-    std.logger.Output(2, fmt.Sprintln(v...))
+    root.log(2, LevelInfo, sprint(v))
+}
+
+// Log an information statement, formatted with fmt.Sprintf
+func Infof(format string, v ...interface{}) {
+    root.log(2, LevelInfo, fmt.Sprintf(format, v...))
 }
 
 // Log a debug trace message
 func Trace(v ...interface{}) {
-    std.logger.Output(2, fmt.Sprintln(v...))
+    root.log(2, LevelTrace, sprint(v))
 }
 
-// Log a debug trace message
+// Log a debug trace message, formatted with fmt.Sprintf
+func Tracef(format string, v ...interface{}) {
+    root.log(2, LevelTrace, fmt.Sprintf(format, v...))
+}
+
+// Log a websocket trace message, from the "ws" subsystem.
 func Websocket(v ...interface{}) {
-    std.logger.Output(2, fmt.Sprintln(v...))
+    wsLogger.log(2, LevelTrace, sprint(v))
 }
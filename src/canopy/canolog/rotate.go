@@ -0,0 +1,292 @@
+// Copyright 2015 SimpleThings, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+package canolog
+
+import (
+    "compress/gzip"
+    "errors"
+    "fmt"
+    "io"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Log files are readable by the canopy group, but not by everyone.
+const logFileMode = 0640
+
+// How often a RotatingFile starts a new file, regardless of size.
+const (
+    RotateNever = "none"
+    RotateHourly = "hourly"
+    RotateDaily = "daily"
+)
+
+// RotatingFile is a log file that is moved aside once it grows too large or
+// gets too old.  Old files are named <path>.<timestamp>, and end in .gz if
+// they are compressed.
+type RotatingFile struct {
+    path string
+    maxSize int64
+    interval string
+    maxBackups int
+    maxAge time.Duration
+    compress bool
+
+    lock sync.Mutex
+    file *os.File
+    size int64
+    nextRotation time.Time
+
+    // Held while old files are compressed and pruned, so that one rotation
+    // doesn't delete a file that another is compressing.
+    maintenance sync.Mutex
+}
+
+// Open the log file at <path> for appending, creating it if necessary.  It
+// is rotated when it would grow beyond <maxSize> bytes (0 for no limit) and
+// at the start of each <interval>.  Of the old files, only the newest
+// <maxBackups> (0 to keep them all) that are younger than <maxAge> (0 to
+// keep them forever) are kept.
+func OpenRotatingFile(path string, maxSize int64, interval string, maxBackups int, maxAge time.Duration, compress bool) (*RotatingFile, error) {
+    if !(interval == RotateNever || interval == RotateHourly || interval == RotateDaily || interval == "") {
+        return nil, fmt.Errorf("Unknown log rotation interval: %s", interval)
+    }
+    f := &RotatingFile{
+        path: path,
+        maxSize: maxSize,
+        interval: interval,
+        maxBackups: maxBackups,
+        maxAge: maxAge,
+        compress: compress,
+    }
+    err := f.open()
+    if err != nil {
+        return nil, err
+    }
+    return f, nil
+}
+
+func (f *RotatingFile) open() error {
+    file, err := os.OpenFile(f.path, os.O_WRONLY | os.O_CREATE | os.O_APPEND, logFileMode)
+    if err != nil {
+        return err
+    }
+    info, err := file.Stat()
+    if err != nil {
+        file.Close()
+        return err
+    }
+    f.file = file
+    f.size = info.Size()
+    f.nextRotation = nextRotation(time.Now(), f.interval)
+    return nil
+}
+
+// Get the time at which the file started at <now> should be rotated, or
+// the zero time if it is only rotated by size.
+func nextRotation(now time.Time, interval string) time.Time {
+    year, month, day := now.Date()
+    switch interval {
+    case RotateHourly:
+        return time.Date(year, month, day, now.Hour() + 1, 0, 0, 0, now.Location())
+    case RotateDaily:
+        return time.Date(year, month, day + 1, 0, 0, 0, 0, now.Location())
+    }
+    return time.Time{}
+}
+
+func (f *RotatingFile) Write(p []byte) (int, error) {
+    f.lock.Lock()
+    defer f.lock.Unlock()
+    if f.file == nil {
+        return 0, errors.New("Log file is closed")
+    }
+
+    now := time.Now()
+    tooBig := f.maxSize > 0 && f.size > 0 && f.size + int64(len(p)) > f.maxSize
+    tooOld := !f.nextRotation.IsZero() && !now.Before(f.nextRotation)
+    if tooBig || tooOld {
+        err := f.rotate(now)
+        if err != nil {
+            return 0, err
+        }
+    }
+
+    n, err := f.file.Write(p)
+    f.size += int64(n)
+    return n, err
+}
+
+// Move the current file aside and start a new one.  Old files are
+// compressed and pruned in the background, so that logging isn't held up.
+func (f *RotatingFile) rotate(now time.Time) error {
+    f.file.Close()
+    f.file = nil
+
+    backup := f.path + "." + now.Format("20060102-150405")
+    for i := 1; fileExists(backup) || fileExists(backup + ".gz"); i++ {
+        backup = fmt.Sprintf("%s.%s-%d", f.path, now.Format("20060102-150405"), i)
+    }
+    err := os.Rename(f.path, backup)
+    if err != nil && !os.IsNotExist(err) {
+        // Keep logging to the same file rather than losing messages.
+        fmt.Fprintln(os.Stderr, "Error rotating log file: ", err)
+    }
+
+    err = f.open()
+    if err != nil {
+        return err
+    }
+
+    // Each run handles every old file, because runs for earlier rotations
+    // may not have happened yet.
+    go func(path string, compress bool, maxBackups int, maxAge time.Duration) {
+        f.maintenance.Lock()
+        defer f.maintenance.Unlock()
+        pruneBackups(path, maxBackups, maxAge)
+        if compress {
+            for _, backup := range listBackups(path) {
+                if strings.HasSuffix(backup, ".gz") {
+                    continue
+                }
+                err := compressFile(backup)
+                if err != nil {
+                    fmt.Fprintln(os.Stderr, "Error compressing log file: ", err)
+                }
+            }
+        }
+    }(f.path, f.compress, f.maxBackups, f.maxAge)
+    return nil
+}
+
+// Close and reopen the file, so that logging continues in a new file after
+// an external tool such as logrotate has moved the old one.
+func (f *RotatingFile) Reopen() error {
+    f.lock.Lock()
+    defer f.lock.Unlock()
+    if f.file != nil {
+        f.file.Close()
+        f.file = nil
+    }
+    return f.open()
+}
+
+func (f *RotatingFile) Close() error {
+    f.lock.Lock()
+    defer f.lock.Unlock()
+    if f.file == nil {
+        return nil
+    }
+    err := f.file.Close()
+    f.file = nil
+    return err
+}
+
+func fileExists(path string) bool {
+    _, err := os.Stat(path)
+    return err == nil
+}
+
+// Replace <path> with a gzipped copy, <path>.gz.
+func compressFile(path string) error {
+    in, err := os.Open(path)
+    if err != nil {
+        return err
+    }
+    defer in.Close()
+
+    tmpPath := path + ".gz.tmp"
+    out, err := os.OpenFile(tmpPath, os.O_WRONLY | os.O_CREATE | os.O_TRUNC, logFileMode)
+    if err != nil {
+        return err
+    }
+    gz := gzip.NewWriter(out)
+    _, err = io.Copy(gz, in)
+    if err == nil {
+        err = gz.Close()
+    }
+    if err == nil {
+        err = out.Close()
+    } else {
+        out.Close()
+    }
+    if err != nil {
+        os.Remove(tmpPath)
+        return err
+    }
+    err = os.Rename(tmpPath, path + ".gz")
+    if err != nil {
+        return err
+    }
+    return os.Remove(path)
+}
+
+// Get the old files for the log at <path>, oldest first.
+func listBackups(path string) []string {
+    matches, err := filepath.Glob(path + ".*")
+    if err != nil {
+        return nil
+    }
+    backups := []string{}
+    for _, match := range matches {
+        // Only names that start with a timestamp are backups.
+        stamp := match[len(path) + 1:]
+        if stamp != "" && stamp[0] >= '0' && stamp[0] <= '9' && !strings.HasSuffix(match, ".tmp") {
+            backups = append(backups, match)
+        }
+    }
+    // Timestamps in the names sort oldest first, once ".gz" is ignored.
+    sort.Sort(byBackupAge(backups))
+    return backups
+}
+
+// Remove old files for the log at <path> beyond the newest <maxBackups>, or
+// older than <maxAge>.
+func pruneBackups(path string, maxBackups int, maxAge time.Duration) {
+    if maxBackups <= 0 && maxAge <= 0 {
+        return
+    }
+    backups := listBackups(path)
+    cutoff := time.Now().Add(-maxAge)
+    for i, backup := range backups {
+        remove := maxBackups > 0 && i < len(backups) - maxBackups
+        if !remove && maxAge > 0 {
+            info, err := os.Stat(backup)
+            remove = err == nil && info.ModTime().Before(cutoff)
+        }
+        if remove {
+            os.Remove(backup)
+        }
+    }
+}
+
+type byBackupAge []string
+
+func (names byBackupAge) Len() int {
+    return len(names)
+}
+
+func (names byBackupAge) Less(i, j int) bool {
+    return strings.TrimSuffix(names[i], ".gz") < strings.TrimSuffix(names[j], ".gz")
+}
+
+func (names byBackupAge) Swap(i, j int) {
+    names[i], names[j] = names[j], names[i]
+}
@@ -0,0 +1,236 @@
+// Copyright 2015 SimpleThings, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+package canolog
+
+import (
+    "fmt"
+    "io"
+    "log/syslog"
+    "os"
+    "strings"
+    "time"
+)
+
+// Places to log to, as given by the "log-sinks" option.
+const (
+    SinkFile = "file"
+    SinkStderr = "stderr"
+    SinkSyslog = "syslog"
+)
+
+// Options for Configure.
+type Options struct {
+    // Any combination of SinkFile, SinkStderr and SinkSyslog.
+    Sinks []string
+
+    // Log file for SinkFile.
+    File string
+
+    // If set, errors and warnings are also written to this file.
+    ErrorFile string
+
+    // Rotation of File and ErrorFile.  See OpenRotatingFile.
+    MaxSizeMB int
+    RotateInterval string
+    MaxBackups int
+    MaxAgeDays int
+    Compress bool
+}
+
+// sink is somewhere that log lines are written.  <line> is the formatted
+// line, and <msg> is just the message and its fields, for sinks that record
+// the time and level themselves.
+type sink interface {
+    write(level int, line []byte, msg string)
+    reopen() error
+    close() error
+}
+
+type fileSink struct {
+    file *RotatingFile
+}
+
+func (s *fileSink) write(level int, line []byte, msg string) {
+    s.file.Write(line)
+}
+
+func (s *fileSink) reopen() error {
+    return s.file.Reopen()
+}
+
+func (s *fileSink) close() error {
+    return s.file.Close()
+}
+
+// Writes to stdout or stderr, which are never closed.
+type streamSink struct {
+    w io.Writer
+}
+
+func (s *streamSink) write(level int, line []byte, msg string) {
+    s.w.Write(line)
+}
+
+func (s *streamSink) reopen() error {
+    return nil
+}
+
+func (s *streamSink) close() error {
+    return nil
+}
+
+// Writes to the local syslog daemon, at the priority matching each
+// message's level.  Syslog records the time itself, so only the message and
+// its fields are sent.
+type syslogSink struct {
+    w *syslog.Writer
+}
+
+func (s *syslogSink) write(level int, line []byte, msg string) {
+    switch level {
+    case LevelError:
+        s.w.Err(msg)
+    case LevelWarn:
+        s.w.Warning(msg)
+    case LevelInfo:
+        s.w.Info(msg)
+    default:
+        s.w.Debug(msg)
+    }
+}
+
+func (s *syslogSink) reopen() error {
+    return nil
+}
+
+func (s *syslogSink) close() error {
+    return s.w.Close()
+}
+
+// Parse a comma-separated list of sinks, like "file,syslog".
+func ParseSinks(spec string) ([]string, error) {
+    sinks := []string{}
+    for _, name := range strings.Split(spec, ",") {
+        name = strings.TrimSpace(name)
+        if !(name == SinkFile || name == SinkStderr || name == SinkSyslog) {
+            return nil, fmt.Errorf("Unknown log sink %q.  Expected file, stderr or syslog", name)
+        }
+        sinks = append(sinks, name)
+    }
+    return sinks, nil
+}
+
+func (opts Options) openFile(path string) (*RotatingFile, error) {
+    return OpenRotatingFile(path,
+        int64(opts.MaxSizeMB) * 1024 * 1024,
+        opts.RotateInterval,
+        opts.MaxBackups,
+        time.Duration(opts.MaxAgeDays) * 24 * time.Hour,
+        opts.Compress)
+}
+
+// Log to the sinks given by <opts>.  May be called again to change them, in
+// which case the old files are closed.  Sinks that can't be opened are
+// skipped, and the problem is reported on stderr and in the log.  If none
+// can be opened, logs to stderr.  Returns an error, without changing
+// anything, if <opts> is invalid.
+func Configure(opts Options) error {
+    if !(opts.RotateInterval == "" || opts.RotateInterval == RotateNever || opts.RotateInterval == RotateHourly || opts.RotateInterval == RotateDaily) {
+        return fmt.Errorf("Unknown log rotation interval: %s", opts.RotateInterval)
+    }
+
+    sinks := []sink{}
+    problems := []string{}
+    for _, name := range opts.Sinks {
+        switch name {
+        case SinkFile:
+            file, err := opts.openFile(opts.File)
+            if err != nil {
+                problems = append(problems, "Error opening log file " + opts.File + ": " + err.Error())
+                continue
+            }
+            sinks = append(sinks, &fileSink{file})
+        case SinkStderr:
+            sinks = append(sinks, &streamSink{os.Stderr})
+        case SinkSyslog:
+            w, err := syslog.New(syslog.LOG_INFO | syslog.LOG_DAEMON, "canopy")
+            if err != nil {
+                problems = append(problems, "Error connecting to syslog: " + err.Error())
+                continue
+            }
+            sinks = append(sinks, &syslogSink{w})
+        default:
+            return fmt.Errorf("Unknown log sink: %s", name)
+        }
+    }
+    if len(sinks) == 0 {
+        sinks = append(sinks, &streamSink{os.Stderr})
+    }
+
+    var errorSink sink
+    if opts.ErrorFile != "" {
+        file, err := opts.openFile(opts.ErrorFile)
+        if err != nil {
+            problems = append(problems, "Error opening error log file " + opts.ErrorFile + ": " + err.Error())
+        } else {
+            errorSink = &fileSink{file}
+        }
+    }
+
+    stdLock.Lock()
+    closeSinks()
+    std.sinks = sinks
+    std.errorSink = errorSink
+    stdLock.Unlock()
+
+    for _, problem := range problems {
+        fmt.Fprintln(os.Stderr, problem)
+        root.log(2, LevelError, problem)
+    }
+    return nil
+}
+
+// Reopen the log files, so that logging continues in new files after
+// logrotate has moved the old ones.
+func Reopen() error {
+    stdLock.RLock()
+    defer stdLock.RUnlock()
+    sinks := []sink{}
+    sinks = append(sinks, std.sinks...)
+    if std.errorSink != nil {
+        sinks = append(sinks, std.errorSink)
+    }
+    var firstErr error
+    for _, s := range sinks {
+        err := s.reopen()
+        if err != nil && firstErr == nil {
+            firstErr = err
+        }
+    }
+    return firstErr
+}
+
+// Must be called with stdLock held for writing.
+func closeSinks() {
+    for _, s := range std.sinks {
+        s.close()
+    }
+    if std.errorSink != nil {
+        std.errorSink.close()
+    }
+    std.sinks = nil
+    std.errorSink = nil
+}
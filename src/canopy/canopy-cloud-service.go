@@ -14,6 +14,7 @@
 package main
 
 import (
+    "crypto/tls"
     "fmt"
     "net/http"
     "net/http/httputil"
@@ -23,12 +24,23 @@ import (
     "github.com/gorilla/mux"
     "canopy/canolog"
     "canopy/config"
+    "canopy/events"
+    "canopy/mail"
+    "canopy/mail/messages"
+    "canopy/mail/outbox"
+    "canopy/notify"
     "canopy/pigeon"
+    "canopy/quota"
     "canopy/rest"
+    "canopy/rules"
+    "canopy/scheduler"
     "canopy/webapp"
+    "canopy/webhooks"
+    "canopy/util/tlscert"
     "canopy/ws"
     "os"
     "os/signal"
+    "strings"
     "syscall"
 )
 
@@ -38,12 +50,92 @@ func shutdown() {
     canolog.Shutdown()
 }
 
+// Apply the log options in <cfg>, which were checked when it was loaded.
+func configureLog(cfg config.Config) error {
+    sinks, err := canolog.ParseSinks(cfg.OptLogSinks())
+    if err != nil {
+        return err
+    }
+    err = canolog.Configure(canolog.Options{
+        Sinks: sinks,
+        File: cfg.OptLogFile(),
+        ErrorFile: cfg.OptLogErrorFile(),
+        MaxSizeMB: int(cfg.OptLogMaxSizeMB()),
+        RotateInterval: cfg.OptLogRotate(),
+        MaxBackups: int(cfg.OptLogMaxBackups()),
+        MaxAgeDays: int(cfg.OptLogMaxAgeDays()),
+        Compress: cfg.OptLogCompress(),
+    })
+    if err != nil {
+        return err
+    }
+    canolog.SetLevel(cfg.OptLogLevel())
+    canolog.SetSubsystemLevels(cfg.OptLogLevels())
+    canolog.SetFormat(cfg.OptLogFormat())
+    return nil
+}
+
+// Re-read the config and apply the options that can be changed without a
+// restart.  Everything that can fail is done first, so that a bad config
+// leaves the server as it was.
+func reloadConfig(live *config.LiveConfig, quotas *quota.Enforcer, mailOutbox *outbox.Outbox, certs *tlscert.Store) {
+    canolog.Info("Reloading config")
+    newCfg := config.NewDefaultConfig()
+    err := newCfg.LoadConfig()
+    if err != nil {
+        canolog.Error("Not reloading config: ", err)
+        return
+    }
+
+    mailer, err := mail.NewMailClient(newCfg)
+    if err != nil {
+        canolog.Error("Not reloading config: problem creating mail client: ", err)
+        return
+    }
+    var cert tls.Certificate
+    if certs != nil {
+        cert, err = tls.LoadX509KeyPair(newCfg.OptHTTPSCertFile(), newCfg.OptHTTPSPrivKeyFile())
+        if err != nil {
+            canolog.Error("Not reloading config: problem loading TLS certificate: ", err)
+            return
+        }
+    }
+    templates, err := messages.LoadTemplates(newCfg.OptEmailTemplateDir())
+    if err != nil {
+        canolog.Error("Not reloading config: problem loading email templates: ", err)
+        return
+    }
+
+    applied, needRestart, err := live.Reload(newCfg)
+    if err != nil {
+        canolog.Error("Not reloading config: ", err)
+        return
+    }
+    cfg := live.Current()
+    err = configureLog(cfg)
+    if err != nil {
+        canolog.Error("Problem configuring log: ", err)
+    }
+    quotas.Reconfigure()
+    messages.UseTemplates(templates)
+    mailOutbox.SetClient(mailer)
+    if certs != nil {
+        certs.Set(cert)
+    }
+
+    canolog.Info("Config reloaded.  Changed options: ", strings.Join(applied, ", "))
+    if len(needRestart) > 0 {
+        canolog.Warn("These options changed, but need a restart to take effect: ", strings.Join(needRestart, ", "))
+    }
+}
+
 func main() {
     r := mux.NewRouter()
 
     cfg := config.NewDefaultConfig()
     err := cfg.LoadConfig()
     if err != nil {
+        fmt.Fprintln(os.Stderr, err)
         logFilename := config.JustGetOptLogFile()
 
         err2 := canolog.Init(logFilename)
@@ -52,17 +144,26 @@ func main() {
             return
         }
         canolog.Info("Starting Canopy Cloud Service")
-        canolog.Error("Configuration error: %s", err)
+        canolog.Error("Configuration error: ", err)
         canolog.Info("Exiting")
         return
     }
 
-    err = canolog.Init(cfg.OptLogFile())
+    err = configureLog(cfg)
     if err != nil {
         fmt.Println(err)
         return
     }
 
+    // Everything reads the config through <live>, so that SIGHUP can change
+    // it.
+    live, err := config.NewLiveConfig(cfg)
+    if err != nil {
+        canolog.Error(err)
+        return
+    }
+    cfg = live
+
     canolog.Info("Starting Canopy Cloud Service")
 
     pigeonSys, err := pigeon.InitPigeonSystem()
@@ -95,12 +196,17 @@ func main() {
         return
     }
 
-    if (cfg.OptPasswordSecretSalt() == "") {
-        canolog.Error("You must set the configuration option \"password-secret-salt\"")
+    err = config.CheckSecrets(cfg)
+    if err != nil {
+        canolog.Error(err)
         return
     }
     canolog.Info(cfg.ToString())
 
+    if cfg.OptDevMode() {
+        canolog.Warn("Development mode is enabled.  Do not use it in production!")
+    }
+
     if (cfg.OptForwardOtherHosts() != "") {
         canolog.Info("Requests to hosts other than ", cfg.OptHostname(), " will be forwarded to ", cfg.OptForwardOtherHosts())
         targetUrl, _ := url.Parse(cfg.OptForwardOtherHosts())
@@ -113,13 +219,91 @@ func main() {
     hostname := cfg.OptHostname()
     webManagerPath := cfg.OptWebManagerPath()
     jsClientPath := cfg.OptJavascriptClientPath()
-    http.Handle(hostname + "/echo", websocket.Handler(ws.NewCanopyWebsocketServer(cfg, pigeonSys)))
+    quotas := quota.NewEnforcer(cfg)
+    err = quota.NewUsagePurger(cfg).Start()
+    if err != nil {
+        canolog.Error("Error starting usage purger: ", err)
+        return
+    }
+    hub := events.NewHub()
+    err = webhooks.NewDispatcher(cfg).Start(hub)
+    if err != nil {
+        canolog.Error("Error starting webhook dispatcher: ", err)
+        return
+    }
+    templates, err := messages.LoadTemplates(cfg.OptEmailTemplateDir())
+    if err != nil {
+        canolog.Error("Error loading email templates: ", err)
+        return
+    }
+    messages.UseTemplates(templates)
+    mailer, err := mail.NewMailClient(cfg)
+    if err != nil {
+        canolog.Error("Error creating mail client: ", err)
+        return
+    }
+    mailOutbox := outbox.NewOutbox(cfg, mailer)
+    err = mailOutbox.Start()
+    if err != nil {
+        canolog.Error("Error starting mail outbox: ", err)
+        return
+    }
+    senders, err := notify.NewSenders(cfg, mailOutbox)
+    if err != nil {
+        canolog.Error("Error creating notification senders: ", err)
+        return
+    }
+    err = senders.Start()
+    if err != nil {
+        canolog.Error("Error starting notification senders: ", err)
+        return
+    }
+    err = notify.NewDeliverer(cfg, senders).Start()
+    if err != nil {
+        canolog.Error("Error starting notification deliverer: ", err)
+        return
+    }
+    err = rules.NewEngine(cfg, senders).Start(hub)
+    if err != nil {
+        canolog.Error("Error starting alarm rule engine: ", err)
+        return
+    }
+    err = scheduler.NewScheduler(cfg, pigeonSys).Start(hub)
+    if err != nil {
+        canolog.Error("Error starting scheduler: ", err)
+        return
+    }
+    http.Handle(hostname + "/echo", websocket.Handler(ws.NewCanopyWebsocketServer(cfg, hub, senders, pigeonSys, quotas)))
 
     webapp.AddRoutes(r)
-    rest.AddRoutes(r, cfg, pigeonSys)
+    rest.AddRoutes(r, cfg, hub, pigeonSys, quotas, senders)
 
     http.Handle(hostname + "/", r)
 
+    var certs *tlscert.Store
+    if cfg.OptEnableHTTPS() {
+        certs, err = tlscert.NewStore(cfg.OptHTTPSCertFile(), cfg.OptHTTPSPrivKeyFile())
+        if err != nil {
+            canolog.Error("Error loading TLS certificate: ", err)
+            return
+        }
+    }
+
+    // handle SIGHUP by reopening the log files, for logrotate, and
+    // reloading the config
+    c3 := make (chan os.Signal, 1)
+    signal.Notify(c3, syscall.SIGHUP)
+    go func() {
+        for range c3 {
+            err := canolog.Reopen()
+            if err != nil {
+                fmt.Fprintln(os.Stderr, "Error reopening log files: ", err)
+            }
+            canolog.Info("SIGHUP recieved")
+            reloadConfig(live, quotas, mailOutbox, certs)
+        }
+    }()
+
     if (webManagerPath != "") {
         http.Handle(hostname + "/mgr/", http.StripPrefix("/mgr/", http.FileServer(http.Dir(webManagerPath))))
     }
@@ -145,13 +329,16 @@ func main() {
     if cfg.OptEnableHTTPS() {
         go func() {
             httpsPort := cfg.OptHTTPSPort()
-            httpsCertFile := cfg.OptHTTPSCertFile()
-            httpsPrivKeyFile := cfg.OptHTTPSPrivKeyFile()
             srv := &http.Server{
                 Addr: fmt.Sprintf(":%d", httpsPort),
                 Handler: context.ClearHandler(http.DefaultServeMux),
+                TLSConfig: &tls.Config{
+                    // Certificates come from <certs>, so that reloading
+                    // the config can replace them.
+                    GetCertificate: certs.GetCertificate,
+                },
             }
-            err := srv.ListenAndServeTLS(httpsCertFile, httpsPrivKeyFile)
+            err := srv.ListenAndServeTLS("", "")
             httpsResultChan <- err
         }()
     }
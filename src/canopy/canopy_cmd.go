@@ -22,16 +22,38 @@ import (
     "canopy/datalayer"
     "canopy/datalayer/cassandra_datalayer"
     "canopy/mail"
+    "canopy/mail/outbox"
     "flag"
     "fmt"
-//    "time"
+    "io/ioutil"
+    "sort"
+    "strconv"
+    "strings"
+    "syscall"
+    "time"
 )
 
+const defaultPidFile = "/var/run/canopy/canopy-cloud-service.pid"
+
+type outboxMailByCreated []datalayer.OutboxMail
+
+func (mails outboxMailByCreated) Len() int {
+    return len(mails)
+}
+
+func (mails outboxMailByCreated) Less(i, j int) bool {
+    return mails[i].Created.Before(mails[j].Created)
+}
+
+func (mails outboxMailByCreated) Swap(i, j int) {
+    mails[i], mails[j] = mails[j], mails[i]
+}
+
 func main() {
     cfg := config.NewDefaultConfig()
     err := cfg.LoadConfig()
     if err != nil {
-        fmt.Printf("Error loading config")
+        fmt.Println("Error loading config: ", err)
     }
 
     err = canolog.Init("/var/log/canopy/canotool.log")
@@ -58,7 +80,11 @@ func main() {
     } else if flag.Arg(0) == "delete-account" {
         dl := cassandra_datalayer.NewDatalayer(cfg)
         conn, _ := dl.Connect("canopy")
-        conn.DeleteAccount(flag.Arg(1))
+        err = conn.DeleteAccount(flag.Arg(1))
+        if err != nil {
+            fmt.Println("Unable to delete account ", flag.Arg(1), ":", err)
+            return
+        }
     } else if flag.Arg(0) == "reset-db" {
         dl := cassandra_datalayer.NewDatalayer(cfg)
         dl.EraseDb("canopy")
@@ -150,6 +176,96 @@ func main() {
             return
         }
         fmt.Println("Email sent.")
+    } else if flag.Arg(0) == "list-mail" {
+        // Optional argument: only list messages with this status.
+        dl := cassandra_datalayer.NewDatalayer(cfg)
+        conn, _ := dl.Connect("canopy")
+        mails, err := conn.AllOutboxMail()
+        if err != nil {
+            fmt.Println("Error reading mail outbox: ", err)
+            return
+        }
+        sort.Sort(outboxMailByCreated(mails))
+        for _, m := range mails {
+            if flag.Arg(1) != "" && m.Status != flag.Arg(1) {
+                continue
+            }
+            fmt.Printf("%s %s %-7s %2d %s %q\n", m.ID, m.Created.Format(time.RFC3339), m.Status, m.Attempts, strings.Join(m.ToEmails, ","), m.Subject)
+        }
+    } else if flag.Arg(0) == "show-mail" {
+        dl := cassandra_datalayer.NewDatalayer(cfg)
+        conn, _ := dl.Connect("canopy")
+        id, err := gocql.ParseUUID(flag.Arg(1))
+        if err != nil {
+            fmt.Println("Error parsing UUID: ", flag.Arg(1), ":", err)
+            return
+        }
+        m, err := conn.LookupOutboxMail(id)
+        if err != nil {
+            fmt.Println("Mail not found: ", flag.Arg(1), ":", err)
+            return
+        }
+        fmt.Println("ID:          ", m.ID)
+        fmt.Println("Status:      ", m.Status)
+        fmt.Println("Created:     ", m.Created.Format(time.RFC3339))
+        fmt.Println("Attempts:    ", m.Attempts)
+        if m.Status == datalayer.OutboxMailPending {
+            fmt.Println("Next attempt:", m.NextAttempt.Format(time.RFC3339))
+        }
+        if !m.Sent.IsZero() {
+            fmt.Println("Sent:        ", m.Sent.Format(time.RFC3339))
+        }
+        if m.LastError != "" {
+            fmt.Println("Last error:  ", m.LastError)
+        }
+        fmt.Println("From:        ", m.FromName, "<" + m.FromEmail + ">")
+        fmt.Println("To:          ", strings.Join(m.ToEmails, ", "))
+        if m.ReplyTo != "" {
+            fmt.Println("Reply-To:    ", m.ReplyTo)
+        }
+        fmt.Println("Subject:     ", m.Subject)
+        if m.Text != "" {
+            fmt.Println("\n" + m.Text)
+        }
+        if m.HTML != "" {
+            fmt.Println("\n" + m.HTML)
+        }
+    } else if flag.Arg(0) == "resend-mail" {
+        dl := cassandra_datalayer.NewDatalayer(cfg)
+        conn, _ := dl.Connect("canopy")
+        id, err := gocql.ParseUUID(flag.Arg(1))
+        if err != nil {
+            fmt.Println("Error parsing UUID: ", flag.Arg(1), ":", err)
+            return
+        }
+        err = outbox.Resend(conn, id)
+        if err != nil {
+            fmt.Println("Unable to resend mail ", flag.Arg(1), ":", err)
+            return
+        }
+        fmt.Println("Mail queued to be resent.")
+    } else if flag.Arg(0) == "reload-config" {
+        // Optional argument: pid file of the running server.
+        pidFile := flag.Arg(1)
+        if pidFile == "" {
+            pidFile = defaultPidFile
+        }
+        data, err := ioutil.ReadFile(pidFile)
+        if err != nil {
+            fmt.Println("Error reading pid file: ", err)
+            return
+        }
+        pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+        if err != nil {
+            fmt.Println("Invalid pid in ", pidFile, ":", err)
+            return
+        }
+        err = syscall.Kill(pid, syscall.SIGHUP)
+        if err != nil {
+            fmt.Println("Unable to signal canopy-cloud-service: ", err)
+            return
+        }
+        fmt.Println("Reload requested.  The server's log lists the options applied and any that need a restart.")
     } else if flag.Arg(0) == "migrate-db" {
         startVersion := flag.Arg(1)
         if startVersion == "" {
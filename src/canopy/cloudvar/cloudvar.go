@@ -130,3 +130,36 @@ func JsonToCloudVarValue(varDef sddl.VarDef, value interface{}) (interface{}, er
         return nil, fmt.Errorf("InsertSample unsupported datatype ", varDef.Datatype())
     }
 }
+
+// Get a Cloud Variable value as a float64, for arithmetic.  Booleans are 1
+// or 0.  Returns false for values of other datatypes.
+func ToFloat64(value CloudVarValue) (float64, bool) {
+    switch v := value.(type) {
+    case float64:
+        return v, true
+    case float32:
+        return float64(v), true
+    case int:
+        return float64(v), true
+    case int8:
+        return float64(v), true
+    case uint8:
+        return float64(v), true
+    case int16:
+        return float64(v), true
+    case uint16:
+        return float64(v), true
+    case int32:
+        return float64(v), true
+    case uint32:
+        return float64(v), true
+    case int64:
+        return float64(v), true
+    case bool:
+        if v {
+            return 1, true
+        }
+        return 0, true
+    }
+    return 0, false
+}
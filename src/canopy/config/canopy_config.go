@@ -20,13 +20,19 @@ import (
     "fmt"
     "io/ioutil"
     "os"
-    "strconv"
+    "sort"
+    "strings"
 )
 
 type CanopyConfig struct {
+    adminAccounts string
     allowAnonDevices bool
     allowOrigin string
+    devMode bool
+    emailFileDir string
+    emailFileFormat string
     emailService string
+    emailTemplateDir string
     enableHTTP bool
     enableHTTPS bool
     forwardOtherHosts string
@@ -35,450 +41,276 @@ type CanopyConfig struct {
     httpsCertFile string
     httpsPrivKeyFile string
     httpsPort int16
+    logCompress bool
+    logErrorFile string
     logFile string
+    logFormat string
+    logLevel string
+    logLevels string
+    logMaxAgeDays int32
+    logMaxBackups int32
+    logMaxSizeMB int32
+    logRotate string
+    logSinks string
     webManagerPath string
     passwordHashCost int16
     passwordSecretSalt string
     productionSecret string
+    pushFile string
+    pushHTTPAuthKey string
+    pushHTTPURL string
+    pushService string
+    quotaDailyNotifications int32
+    quotaDailyRequests int32
+    quotaDailySamples int32
+    quotaMaxDevices int32
+    rateLimitRequestsPerMinute int32
     sendgridSecretKey string
     sendgridUsername string
+    smsFile string
+    smsFrom string
+    smsHTTPAuthToken string
+    smsHTTPURL string
+    smsService string
+    smtpHost string
+    smtpPassword string
+    smtpPort int16
+    smtpSecurity string
+    smtpUsername string
     javascriptClientPath string
 }
 
+// Secret options are redacted, so the result can be logged.
 func (config *CanopyConfig) ToString() string {
-    return fmt.Sprint(`SERVER CONFIG SETTINGS:
-allow-anon-devices:  `, config.allowAnonDevices, `
-allow-origin:        `, config.allowOrigin, `
-email-service:       `, config.emailService, `
-enable-http:         `, config.enableHTTP, `
-enable-https:        `, config.enableHTTPS, `
-forward-other-hosts: `, config.forwardOtherHosts, `
-hostname:            `, config.hostname, `
-http-port:           `, config.httpPort, `
-https-cert-file:     `, config.httpsCertFile, `
-https-port:          `, config.httpsPort, `
-https-priv-key-file: `, config.httpsPrivKeyFile, `
-js-client-path:      `, config.javascriptClientPath, `
-log-file:            `, config.logFile, `
-sendgrid-username:   `, config.sendgridUsername, `
-web-manager-path:    `, config.webManagerPath)
-}
-
-func (config *CanopyConfig) ToJsonObject() map[string]interface{}{
-    return map[string]interface{} {
-        "allow-anon-devices" : config.allowAnonDevices,
-        "allow-origin" : config.allowOrigin,
-        "email-service" : config.emailService,
-        "enable-http" : config.enableHTTP,
-        "enable-https" : config.enableHTTPS,
-        "forward-other-hosts" : config.forwardOtherHosts,
-        "hostname" : config.hostname,
-        "http-port" : config.httpPort,
-        "https-cert-file" : config.httpsCertFile,
-        "https-port" : config.httpsPort,
-        "https-priv-key-file" : config.httpsPrivKeyFile,
-        "js-client-path" : config.javascriptClientPath,
-        "log-file" : config.logFile,
-        "sendgrid-username" : config.sendgridUsername,
-        "web-manager-path" : config.webManagerPath,
-    }
-}
-
-func (config *CanopyConfig) LoadConfig() error {
-    err := config.LoadConfigFile("/etc/canopy/server.conf")
-    if os.IsNotExist(err) {
-        // If file doesn't exist, just move on to the next one.
-    } else if err != nil {
-        return err
+    obj := Redact(config.ToFullJsonObject())
+    names := []string{}
+    for name := range obj {
+        names = append(names, name)
     }
+    sort.Strings(names)
 
-    homeDir := os.Getenv("HOME")
-    if homeDir != "" {
-        err = config.LoadConfigFile(homeDir + "/.canopy/server.conf")
-        if os.IsNotExist(err) {
-            // If file doesn't exist, just move on to the next one.
-        } else if err != nil {
-            return err
-        }
+    out := "SERVER CONFIG SETTINGS:"
+    for _, name := range names {
+        out += fmt.Sprintf("\n%-20s %v", name + ":", obj[name])
     }
+    return out
+}
 
-    confFile := os.Getenv("CANOPY_SERVER_CONFIG_FILE")
-    if confFile != "" {
-        err = config.LoadConfigFile(confFile)
-        if err != nil {
-            // If config file is specified explicitely, it must be readable
-            return err
+// Only public options are included, so the result can be shown to anyone.
+func (config *CanopyConfig) ToJsonObject() map[string]interface{} {
+    out := map[string]interface{}{}
+    for i := range options {
+        if options[i].public && !options[i].secret {
+            out[options[i].name] = options[i].get(config)
         }
     }
+    return out
+}
 
-    err = config.LoadConfigEnv()
-    if err != nil {
-        return err
-    }
-
-    err = config.LoadConfigCLI()
-    if err != nil {
-        return err
+// Includes the values of secret options.  Only for administrators.
+func (config *CanopyConfig) ToFullJsonObject() map[string]interface{} {
+    out := map[string]interface{}{}
+    for i := range options {
+        out[options[i].name] = options[i].get(config)
     }
-
-    return nil
+    return out
 }
 
-func (config *CanopyConfig) LoadConfigEnv() error {
-    allowAnonDevices := os.Getenv("CCS_ALLOW_ANON_DEVICES")
-    if allowAnonDevices == "1" || allowAnonDevices == "true" {
-        config.allowAnonDevices = true
-    } else if allowAnonDevices == "0" || allowAnonDevices == "false" {
-        config.allowAnonDevices = false
-    } else if allowAnonDevices != "" {
-        return fmt.Errorf("Invalid value for CCS_ALLOW_ANON_DEVICES: %s",  allowAnonDevices)
+// Load every config file, then the environment, then the command line.
+// Every problem found is reported, as OptionErrors, rather than only the
+// first.
+func (config *CanopyConfig) LoadConfig() error {
+    errs := OptionErrors{}
+    addErr := func(source string, err error) {
+        if optErrs, ok := err.(OptionErrors); ok {
+            errs = append(errs, optErrs...)
+        } else if err != nil {
+            errs = append(errs, OptionError{Source: source, Message: err.Error()})
+        }
     }
 
-    allowOrigin := os.Getenv("CCS_ALLOW_ORIGIN")
-    if allowOrigin != "" {
-        config.allowOrigin = allowOrigin
+    // If a file doesn't exist, just move on to the next one.
+    err := config.LoadConfigFile("/etc/canopy/server.conf")
+    if !os.IsNotExist(err) {
+        addErr("/etc/canopy/server.conf", err)
     }
 
-    emailService := os.Getenv("CCS_EMAIL_SERVICE")
-    if emailService != "" {
-        if !(emailService == "none" || emailService == "sendgrid") {
-            return fmt.Errorf("Unknown email service: %s",  emailService)
+    homeDir := os.Getenv("HOME")
+    if homeDir != "" {
+        err = config.LoadConfigFile(homeDir + "/.canopy/server.conf")
+        if !os.IsNotExist(err) {
+            addErr(homeDir + "/.canopy/server.conf", err)
         }
-        config.emailService = emailService
     }
 
-    enableHTTP := os.Getenv("CCS_ENABLE_HTTP")
-    if enableHTTP == "1" || enableHTTP == "true" {
-        config.enableHTTP = true
-    } else if enableHTTP == "0" || enableHTTP == "false" {
-        config.enableHTTP = false
-    } else if enableHTTP != "" {
-        return fmt.Errorf("Invalid value for CCS_ENABLE_HTTP: %s",  enableHTTP)
-    }
-
-    enableHTTPS := os.Getenv("CCS_ENABLE_HTTPS")
-    if enableHTTPS == "1" || enableHTTPS == "true" {
-        config.enableHTTPS = true
-    } else if enableHTTPS == "0" || enableHTTPS == "false" {
-        config.enableHTTPS = false
-    } else if enableHTTPS != "" {
-        return fmt.Errorf("Invalid value for CCS_ENABLE_HTTPS: %s",  enableHTTPS)
+    confFile := os.Getenv("CANOPY_SERVER_CONFIG_FILE")
+    if confFile != "" {
+        // If config file is specified explicitely, it must be readable
+        addErr(confFile, config.LoadConfigFile(confFile))
     }
 
-    forwardOtherHosts := os.Getenv("CCS_FORWARD_OTHER_HOSTS")
-    if forwardOtherHosts != "" {
-        config.forwardOtherHosts = forwardOtherHosts
-    }
+    addErr("environment", config.LoadConfigEnv())
+    addErr("command line", config.LoadConfigCLI())
+    return errs.asError()
+}
 
-    hostname := os.Getenv("CCS_HOSTNAME")
-    if hostname != "" {
-        config.hostname = hostname
-    }
+// Environment variables that start with this but don't name an option are
+// reported, since they are probably misspelled.
+const envPrefix = "CCS_"
 
-    httpPort := os.Getenv("CCS_HTTP_PORT")
-    if httpPort != "" {
-        port, err := strconv.ParseInt(httpPort, 0, 16)
-        if err != nil {
-            return fmt.Errorf("Invalid value for CCS_HTTP_PORT: %s",  httpPort)
+func (config *CanopyConfig) LoadConfigEnv() error {
+    errs := OptionErrors{}
+    known := map[string]bool{}
+    for i := range options {
+        opt := &options[i]
+        known[opt.envVar()] = true
+        value := os.Getenv(opt.envVar())
+        if value == "" {
+            continue
         }
-        config.httpPort = int16(port)
-    }
-
-    httpsCertFile := os.Getenv("CCS_HTTPS_CERT_FILE")
-    if httpsCertFile != "" {
-        config.httpsCertFile = httpsCertFile
-    }
-
-    httpsPort := os.Getenv("CCS_HTTPS_PORT")
-    if httpPort != "" {
-        port, err := strconv.ParseInt(httpsPort, 0, 16)
+        err := opt.parse(config, value)
         if err != nil {
-            return fmt.Errorf("Invalid value for CCS_HTTPS_PORT: %s",  httpsPort)
+            errs = append(errs, OptionError{"$" + opt.envVar(), opt.name, err.Error()})
         }
-        config.httpsPort = int16(port)
-    }
-
-    httpsPrivKeyFile := os.Getenv("CCS_HTTPS_PRIV_KEY_FILE")
-    if httpsPrivKeyFile != "" {
-        config.httpsPrivKeyFile = httpsPrivKeyFile
     }
 
-    jsClientPath := os.Getenv("CCS_JS_CLIENT_PATH")
-    if jsClientPath != "" {
-        config.javascriptClientPath = jsClientPath
-    }
-
-    logFile := os.Getenv("CCS_LOG_FILE")
-    if logFile != "" {
-        config.logFile = logFile
-    }
-
-    passwordHashCost := os.Getenv("CCS_PASSWORD_HASH_COST")
-    if passwordHashCost != "" {
-        hashCost, err := strconv.ParseInt(passwordHashCost, 0, 16)
-        if err != nil {
-            return fmt.Errorf("Invalid value for CCS_PASSWORD_HASH_COST: %s", passwordHashCost)
+    unknown := []string{}
+    for _, env := range os.Environ() {
+        name := strings.SplitN(env, "=", 2)[0]
+        if strings.HasPrefix(name, envPrefix) && !known[name] {
+            unknown = append(unknown, name)
         }
-        config.passwordHashCost = int16(hashCost)
-    }
-
-    passwordSecretSalt := os.Getenv("CCS_PASSWORD_SECRET_SALT")
-    if passwordSecretSalt != "" {
-        config.passwordSecretSalt = passwordSecretSalt
     }
-
-    productionSecret := os.Getenv("CCS_PRODUCTION_SECRET")
-    if productionSecret != "" {
-        config.productionSecret = productionSecret
-    }
-
-    sendgridSecretKey := os.Getenv("CCS_SENDGRID_SECRET_KEY")
-    if sendgridSecretKey != "" {
-        config.sendgridSecretKey = sendgridSecretKey
+    sort.Strings(unknown)
+    for _, name := range unknown {
+        optName := strings.ToLower(strings.Replace(strings.TrimPrefix(name, envPrefix), "_", "-", -1))
+        errs = append(errs, OptionError{"$" + name, "", unknownOptionMessage(optName)})
     }
+    return errs.asError()
+}
 
-    sendgridUsername := os.Getenv("CCS_SENDGRID_USERNAME")
-    if sendgridUsername != "" {
-        config.sendgridUsername = sendgridUsername
-    }
+// cliValue holds the text of one command-line flag until it is parsed by
+// the option.  Flags for boolean options can be given without a value.
+type cliValue struct {
+    text string
+    isBool bool
+}
 
-    webMgrPath := os.Getenv("CCS_WEB_MANAGER_PATH")
-    if webMgrPath != "" {
-        config.webManagerPath = webMgrPath
+func (v *cliValue) String() string {
+    if v == nil {
+        return ""
     }
+    return v.text
+}
 
+func (v *cliValue) Set(text string) error {
+    v.text = text
     return nil
 }
 
-func (config *CanopyConfig) LoadConfigCLI() error {
-    allowAnonDevices := flag.String("allow-anon-devices", "", "")
-    allowOrigin := flag.String("allow-origin", "", "")
-    emailService := flag.String("email-service", "", "")
-    enableHTTP := flag.String("enable-http", "", "")
-    enableHTTPS := flag.String("enable-https", "", "")
-    forwardOtherHosts := flag.String("forward-other-hosts", "", "")
-    hostname := flag.String("hostname", "", "")
-    httpPort := flag.String("http-port", "", "")
-    httpsCertFile := flag.String("https-cert-file", "", "")
-    httpsPort := flag.String("https-port", "", "")
-    httpsPrivKeyFile := flag.String("https-priv-key-file", "", "")
-    jsClientPath := flag.String("js-client-path", "", "")
-    logFile := flag.String("log-file", "", "")
-    passwordHashCost := flag.String("password-hash-cost", "", "")
-    passwordSecretSalt := flag.String("password-secret-salt", "", "")
-    productionSecret := flag.String("production-secret", "", "")
-    sendgridSecretKey := flag.String("sendgrid-secret-key", "", "")
-    sendgridUsername := flag.String("sendgrid-username", "", "")
-    webMgrPath := flag.String("web-manager-path", "", "")
-
-    flag.Parse()
-
-    if *allowAnonDevices != "" {
-        if *allowAnonDevices == "1" || *allowAnonDevices == "true" {
-            config.allowAnonDevices = true
-        } else if *allowAnonDevices == "0" || *allowAnonDevices == "false" {
-            config.allowAnonDevices = false
-        } else if *allowAnonDevices != "" {
-            return fmt.Errorf("Invalid value for --allow-anon-devices: %s",  *allowAnonDevices)
-        }
-    }
-
-    if *allowOrigin != "" {
-        config.allowOrigin = *allowOrigin
-    }
-
-    if *emailService != "" {
-        if !(*emailService == "none" || *emailService == "sendgrid") {
-            return fmt.Errorf("Unknown email service: %s",  *emailService)
-        }
-        config.emailService = *emailService
-    }
+func (v *cliValue) IsBoolFlag() bool {
+    return v.isBool
+}
 
-    if *enableHTTP != "" {
-        if *enableHTTP == "1" || *enableHTTP == "true" {
-            config.enableHTTP = true
-        } else if *enableHTTP == "0" || *enableHTTP == "false" {
-            config.enableHTTP = false
-        } else if *enableHTTP != "" {
-            return fmt.Errorf("Invalid value for --enable-http: %s",  *enableHTTP)
-        }
-    }
+// Command-line flags can only be defined once, but the config is loaded
+// again each time it is reloaded.
+var cliFlags = map[string]*cliValue{}
 
-    if *enableHTTPS != "" {
-        if *enableHTTPS == "1" || *enableHTTPS == "true" {
-            config.enableHTTPS = true
-        } else if *enableHTTPS == "0" || *enableHTTPS == "false" {
-            config.enableHTTPS = false
-        } else if *enableHTTPS != "" {
-            return fmt.Errorf("Invalid value for --enable-http: %s",  *enableHTTPS)
+func defineCLIFlags() {
+    for i := range options {
+        opt := &options[i]
+        if _, ok := cliFlags[opt.name]; ok {
+            continue
         }
+        _, isBool := opt.field(&CanopyConfig{}).(*bool)
+        value := &cliValue{isBool: isBool}
+        flag.Var(value, opt.name, opt.description)
+        cliFlags[opt.name] = value
     }
+}
 
-    if *forwardOtherHosts != "" {
-        config.forwardOtherHosts = *forwardOtherHosts
-    }
-
-    if *hostname != "" {
-        config.hostname = *hostname
-    }
-
-    if *httpPort != "" {
-        port, err := strconv.ParseInt(*httpPort, 0, 16)
-        if err != nil {
-            return fmt.Errorf("Invalid value for --http-port: %s",  *httpPort)
+func (config *CanopyConfig) LoadConfigCLI() error {
+    defineCLIFlags()
+    if !flag.Parsed() {
+        flag.Usage = func() {
+            fmt.Fprint(os.Stderr, HelpText(os.Args[0]))
         }
-        config.httpPort = int16(port)
-    }
-
-    if *httpsCertFile != "" {
-        config.httpsCertFile = *httpsCertFile
+        flag.Parse()
     }
 
-    if *httpsPort != "" {
-        port, err := strconv.ParseInt(*httpsPort, 0, 16)
-        if err != nil {
-            return fmt.Errorf("Invalid value for --http-ports: %s",  *httpsPort)
+    errs := OptionErrors{}
+    flag.Visit(func(f *flag.Flag) {
+        opt := lookupOption(f.Name)
+        if opt == nil {
+            return
         }
-        config.httpsPort = int16(port)
-    }
-
-    if *httpsPrivKeyFile != "" {
-        config.httpsPrivKeyFile = *httpsPrivKeyFile
-    }
-
-    if *jsClientPath != "" {
-        config.javascriptClientPath = *jsClientPath
-    }
-
-    if *logFile != "" {
-        config.logFile = *logFile
-    }
-
-    if *passwordHashCost != "" {
-        hashCost, err := strconv.ParseInt(*passwordHashCost, 0, 16)
+        err := opt.parse(config, cliFlags[f.Name].text)
         if err != nil {
-            return fmt.Errorf("Invalid value for --password-hash-cost: %s",  *passwordHashCost)
+            errs = append(errs, OptionError{"--" + opt.name, opt.name, err.Error()})
         }
-        config.passwordHashCost = int16(hashCost)
-    }
-
-    if *passwordSecretSalt != "" {
-        config.passwordSecretSalt = *passwordSecretSalt
-    }
-
-    if *productionSecret != "" {
-        config.productionSecret = *productionSecret
-    }
-
-    if *sendgridSecretKey != "" {
-        config.sendgridSecretKey = *sendgridSecretKey
-    }
-
-    if *sendgridUsername != "" {
-        config.sendgridUsername = *sendgridUsername
-    }
-
-    if *webMgrPath != "" {
-        config.webManagerPath = *webMgrPath
-    }
-
-    return nil
+    })
+    return errs.asError()
 }
 
+// Errors reading <filename> are returned as they are, so that callers can
+// check os.IsNotExist.  Problems with its contents are returned as
+// OptionErrors.
 func (config *CanopyConfig) LoadConfigFile(filename string) error {
     bytes, err := ioutil.ReadFile(filename)
     if err != nil {
         return err
     }
-
-    s := string(bytes)
-
-    return config.LoadConfigJsonString(s)
+    return config.loadJsonString(filename, string(bytes))
 }
 
 func (config *CanopyConfig) LoadConfigJsonString(jsonString string) error {
+    return config.loadJsonString("JSON", jsonString)
+}
+
+func (config *CanopyConfig) loadJsonString(source, jsonString string) error {
     var jsonObj map[string]interface{}
 
     err := json.Unmarshal([]byte(jsonString), &jsonObj)
-    if err != nil {
-        return err
+    if syntaxErr, ok := err.(*json.SyntaxError); ok {
+        line := 1 + strings.Count(jsonString[:syntaxErr.Offset], "\n")
+        return OptionErrors{{Source: fmt.Sprintf("%s:%d", source, line), Message: err.Error()}}
+    } else if err != nil {
+        return OptionErrors{{Source: source, Message: err.Error()}}
     }
 
-    return config.LoadConfigJson(jsonObj)
-
+    return config.loadJson(source, jsonObj)
 }
 
 func (config *CanopyConfig) LoadConfigJson(jsonObj map[string]interface{}) error {
-    for k, v := range jsonObj {
-        ok := false
-        switch k {
-        case "allow-anon-devices":
-            config.allowAnonDevices, ok = v.(bool)
-        case "allow-origin":
-            config.allowOrigin, ok = v.(string)
-        case "email-service":
-            var emailService string
-            emailService, ok = v.(string)
-            if !(emailService == "none" || emailService == "sendgrid") {
-                return fmt.Errorf("Unknown email service: %s", emailService)
-            }
-            config.emailService = emailService
-        case "enable-http":
-            config.enableHTTP, ok = v.(bool)
-        case "enable-https":
-            config.enableHTTPS, ok = v.(bool)
-        case "forward-other-hosts": 
-            config.forwardOtherHosts, ok = v.(string)
-        case "hostname": 
-            config.hostname, ok = v.(string)
-        case "http-port": 
-            var port float64
-            port, ok := v.(float64)
-            if ok {
-                config.httpPort = int16(port)
-            }
-        case "https-cert-file": 
-            config.httpsCertFile, ok = v.(string)
-        case "https-port": 
-            var port float64
-            port, ok = v.(float64)
-            if ok {
-                // TODO: verify integer provided
-                config.httpsPort = int16(port)
-            }
-        case "https-priv-key-file": 
-            config.httpsPrivKeyFile, ok = v.(string)
-        case "js-client-path": 
-            config.javascriptClientPath, ok = v.(string)
-        case "log-file": 
-            config.logFile, ok = v.(string)
-        case "password-hash-cost": 
-            var passwordHashCost float64
-            passwordHashCost, ok = v.(float64)
-            if ok {
-                // TODO: verify integer provided
-                config.passwordHashCost = int16(passwordHashCost)
-            }
-        case "password-secret-salt": 
-            config.passwordSecretSalt, ok = v.(string)
-        case "production-secret": 
-            config.productionSecret, ok = v.(string)
-        case "sendgrid-secret-key": 
-            config.sendgridSecretKey, ok = v.(string)
-        case "sendgrid-username": 
-            config.sendgridUsername, ok = v.(string)
-        case "web-manager-path": 
-            config.webManagerPath, ok = v.(string)
-        default:
-            return fmt.Errorf("Unknown configuration option: %s", k)
-        }
+    return config.loadJson("JSON", jsonObj)
+}
 
-        if !ok {
-            return fmt.Errorf("Incorrect JSON type for %s", k)
+func (config *CanopyConfig) loadJson(source string, jsonObj map[string]interface{}) error {
+    names := []string{}
+    for name := range jsonObj {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+
+    errs := OptionErrors{}
+    for _, name := range names {
+        opt := lookupOption(name)
+        if opt == nil {
+            errs = append(errs, OptionError{source, name, unknownOptionMessage(name)})
+            continue
+        }
+        err := opt.setJson(config, jsonObj[name])
+        if err != nil {
+            errs = append(errs, OptionError{source, name, err.Error()})
         }
     }
-    return nil
+    return errs.asError()
+}
+
+func (config *CanopyConfig) OptAdminAccounts() string {
+    return config.adminAccounts
 }
+
 func (config *CanopyConfig) OptAllowAnonDevices() bool {
     return config.allowAnonDevices
 }
@@ -487,10 +319,26 @@ func (config *CanopyConfig) OptAllowOrigin() string {
     return config.allowOrigin
 }
 
+func (config *CanopyConfig) OptDevMode() bool {
+    return config.devMode
+}
+
+func (config *CanopyConfig) OptEmailFileDir() string {
+    return config.emailFileDir
+}
+
+func (config *CanopyConfig) OptEmailFileFormat() string {
+    return config.emailFileFormat
+}
+
 func (config *CanopyConfig) OptEmailService() string {
     return config.emailService
 }
 
+func (config *CanopyConfig) OptEmailTemplateDir() string {
+    return config.emailTemplateDir
+}
+
 func (config *CanopyConfig) OptEnableHTTP() bool {
     return config.enableHTTP
 }
@@ -527,10 +375,50 @@ func (config *CanopyConfig) OptJavascriptClientPath() string {
     return config.javascriptClientPath
 }
 
+func (config *CanopyConfig) OptLogCompress() bool {
+    return config.logCompress
+}
+
+func (config *CanopyConfig) OptLogErrorFile() string {
+    return config.logErrorFile
+}
+
 func (config *CanopyConfig) OptLogFile() string {
     return config.logFile
 }
 
+func (config *CanopyConfig) OptLogFormat() string {
+    return config.logFormat
+}
+
+func (config *CanopyConfig) OptLogLevel() string {
+    return config.logLevel
+}
+
+func (config *CanopyConfig) OptLogLevels() string {
+    return config.logLevels
+}
+
+func (config *CanopyConfig) OptLogMaxAgeDays() int32 {
+    return config.logMaxAgeDays
+}
+
+func (config *CanopyConfig) OptLogMaxBackups() int32 {
+    return config.logMaxBackups
+}
+
+func (config *CanopyConfig) OptLogMaxSizeMB() int32 {
+    return config.logMaxSizeMB
+}
+
+func (config *CanopyConfig) OptLogRotate() string {
+    return config.logRotate
+}
+
+func (config *CanopyConfig) OptLogSinks() string {
+    return config.logSinks
+}
+
 func (config *CanopyConfig) OptPasswordHashCost() int16 {
     return config.passwordHashCost
 }
@@ -543,6 +431,42 @@ func (config *CanopyConfig) OptProductionSecret() string {
     return config.productionSecret
 }
 
+func (config *CanopyConfig) OptPushFile() string {
+    return config.pushFile
+}
+
+func (config *CanopyConfig) OptPushHTTPAuthKey() string {
+    return config.pushHTTPAuthKey
+}
+
+func (config *CanopyConfig) OptPushHTTPURL() string {
+    return config.pushHTTPURL
+}
+
+func (config *CanopyConfig) OptPushService() string {
+    return config.pushService
+}
+
+func (config *CanopyConfig) OptQuotaDailyNotifications() int32 {
+    return config.quotaDailyNotifications
+}
+
+func (config *CanopyConfig) OptQuotaDailyRequests() int32 {
+    return config.quotaDailyRequests
+}
+
+func (config *CanopyConfig) OptQuotaDailySamples() int32 {
+    return config.quotaDailySamples
+}
+
+func (config *CanopyConfig) OptQuotaMaxDevices() int32 {
+    return config.quotaMaxDevices
+}
+
+func (config *CanopyConfig) OptRateLimitRequestsPerMinute() int32 {
+    return config.rateLimitRequestsPerMinute
+}
+
 func (config *CanopyConfig) OptSendgridUsername() string {
     return config.sendgridUsername
 }
@@ -551,12 +475,52 @@ func (config *CanopyConfig) OptSendgridSecretKey() string {
     return config.sendgridSecretKey
 }
 
+func (config *CanopyConfig) OptSMSFile() string {
+    return config.smsFile
+}
+
+func (config *CanopyConfig) OptSMSFrom() string {
+    return config.smsFrom
+}
+
+func (config *CanopyConfig) OptSMSHTTPAuthToken() string {
+    return config.smsHTTPAuthToken
+}
+
+func (config *CanopyConfig) OptSMSHTTPURL() string {
+    return config.smsHTTPURL
+}
+
+func (config *CanopyConfig) OptSMSService() string {
+    return config.smsService
+}
+
+func (config *CanopyConfig) OptSMTPHost() string {
+    return config.smtpHost
+}
+
+func (config *CanopyConfig) OptSMTPPassword() string {
+    return config.smtpPassword
+}
+
+func (config *CanopyConfig) OptSMTPPort() int16 {
+    return config.smtpPort
+}
+
+func (config *CanopyConfig) OptSMTPSecurity() string {
+    return config.smtpSecurity
+}
+
+func (config *CanopyConfig) OptSMTPUsername() string {
+    return config.smtpUsername
+}
+
 func (config *CanopyConfig) OptWebManagerPath() string {
     return config.webManagerPath
 }
 
 func justGetOptLogFile() string {
-    out := "/var/log/canopy/canopy-server.log"
+    out := lookupOption("log-file").def
 
     logFile := os.Getenv("CCS_LOG_FILE")
     if logFile != "" {
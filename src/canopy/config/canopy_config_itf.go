@@ -17,6 +17,7 @@ package config
 type Config interface {
     ToString() string
     ToJsonObject() map[string]interface{}
+    ToFullJsonObject() map[string]interface{}
 
     LoadConfig() error
     LoadConfigFile(filename string) error
@@ -24,9 +25,14 @@ type Config interface {
     LoadConfigCLI() error
     LoadConfigEnv() error
 
+    OptAdminAccounts() string
     OptAllowAnonDevices() bool
     OptAllowOrigin() string
+    OptDevMode() bool
+    OptEmailFileDir() string
+    OptEmailFileFormat() string
     OptEmailService() string
+    OptEmailTemplateDir() string
     OptEnableHTTP() bool
     OptEnableHTTPS() bool
     OptForwardOtherHosts() string
@@ -36,23 +42,64 @@ type Config interface {
     OptHTTPSPrivKeyFile() string
     OptHTTPSPort() int16
     OptJavascriptClientPath() string
+    OptLogCompress() bool
+    OptLogErrorFile() string
     OptLogFile() string
+    OptLogFormat() string
+    OptLogLevel() string
+    OptLogLevels() string
+    OptLogMaxAgeDays() int32
+    OptLogMaxBackups() int32
+    OptLogMaxSizeMB() int32
+    OptLogRotate() string
+    OptLogSinks() string
     OptPasswordHashCost() int16
     OptPasswordSecretSalt() string
     OptProductionSecret() string
+    OptPushFile() string
+    OptPushHTTPAuthKey() string
+    OptPushHTTPURL() string
+    OptPushService() string
+    OptQuotaDailyNotifications() int32
+    OptQuotaDailyRequests() int32
+    OptQuotaDailySamples() int32
+    OptQuotaMaxDevices() int32
+    OptRateLimitRequestsPerMinute() int32
     OptSendgridUsername() string
     OptSendgridSecretKey() string
+    OptSMSFile() string
+    OptSMSFrom() string
+    OptSMSHTTPAuthToken() string
+    OptSMSHTTPURL() string
+    OptSMSService() string
+    OptSMTPHost() string
+    OptSMTPPassword() string
+    OptSMTPPort() int16
+    OptSMTPSecurity() string
+    OptSMTPUsername() string
     OptWebManagerPath() string
 }
 
 func NewDefaultConfig() Config {
-    return &CanopyConfig{
-        enableHTTPS: true,
-        httpPort: 80,
-        httpsPort: 443,
-        logFile: "/var/log/canopy/canopy-server.log",
-        passwordHashCost: 10,
+    config := &CanopyConfig{}
+    for i := range options {
+        if options[i].def != "" {
+            err := options[i].parse(config, options[i].def)
+            if err != nil {
+                panic("Bad default for option " + options[i].name + ": " + err.Error())
+            }
+        }
     }
+    return config
+}
+
+// Get the server's base URL, "https://<hostname>" (or "http://" if HTTPS is
+// disabled), for links in email.
+func BaseURL(cfg Config) string {
+    if cfg.OptEnableHTTPS() {
+        return "https://" + cfg.OptHostname()
+    }
+    return "http://" + cfg.OptHostname()
 }
 
 // Reads the "log-file" option without reading the whole config.  This allows
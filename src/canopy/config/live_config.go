@@ -0,0 +1,346 @@
+// Copyright 2015 SimpleThings, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+    "errors"
+    "fmt"
+    "sort"
+    "sync"
+)
+
+// LiveConfig is a Config whose settings can be replaced while the server is
+// running.  Each method reads the settings current at the time of the
+// call, so code that reads several options and needs them to agree (such
+// as a request handler) should work from a Snapshot.
+type LiveConfig struct {
+    lock sync.RWMutex
+    current *CanopyConfig
+}
+
+// Create a LiveConfig that starts out with the settings in <cfg>, which
+// must have been created with NewDefaultConfig.
+func NewLiveConfig(cfg Config) (*LiveConfig, error) {
+    current, ok := cfg.(*CanopyConfig)
+    if !ok {
+        return nil, errors.New("LiveConfig requires a CanopyConfig")
+    }
+    copied := *current
+    return &LiveConfig{current: &copied}, nil
+}
+
+// Get the current settings, which will not change even if the LiveConfig
+// is reloaded.
+func (live *LiveConfig) Current() Config {
+    live.lock.RLock()
+    defer live.lock.RUnlock()
+    return live.current
+}
+
+// Get a Config that will not change, for use while handling one request.
+// If <cfg> is a LiveConfig this is its current settings; otherwise it is
+// <cfg> itself.
+func Snapshot(cfg Config) Config {
+    live, ok := cfg.(*LiveConfig)
+    if !ok {
+        return cfg
+    }
+    return live.Current()
+}
+
+// Take the options that can be changed at runtime from <newCfg>, which must
+// have been created with NewDefaultConfig, and switch to them all at once.
+// Returns the names of the options that changed, and of those that changed
+// in <newCfg> but were not applied because they need a restart.
+func (live *LiveConfig) Reload(newCfg Config) (applied []string, needRestart []string, err error) {
+    loaded, ok := newCfg.(*CanopyConfig)
+    if !ok {
+        return nil, nil, errors.New("LiveConfig requires a CanopyConfig")
+    }
+
+    live.lock.Lock()
+    defer live.lock.Unlock()
+
+    merged := *live.current
+    applied = []string{}
+    for i := range options {
+        if !options[i].reloadable {
+            continue
+        }
+        before := merged
+        options[i].copy(&merged, loaded)
+        if merged != before {
+            applied = append(applied, options[i].name)
+        }
+    }
+
+    // Whatever still differs needs a restart.
+    needRestart = []string{}
+    current, wanted := merged.ToFullJsonObject(), loaded.ToFullJsonObject()
+    for name, value := range wanted {
+        if current[name] != value {
+            needRestart = append(needRestart, name)
+        }
+    }
+    sort.Strings(needRestart)
+
+    live.current = &merged
+    return applied, needRestart, nil
+}
+
+func (live *LiveConfig) ToString() string {
+    return live.Current().ToString()
+}
+
+func (live *LiveConfig) ToJsonObject() map[string]interface{} {
+    return live.Current().ToJsonObject()
+}
+
+func (live *LiveConfig) ToFullJsonObject() map[string]interface{} {
+    return live.Current().ToFullJsonObject()
+}
+
+// A LiveConfig is only changed with Reload.
+func (live *LiveConfig) LoadConfig() error {
+    return fmt.Errorf("Use Reload to change a LiveConfig")
+}
+
+func (live *LiveConfig) LoadConfigFile(filename string) error {
+    return fmt.Errorf("Use Reload to change a LiveConfig")
+}
+
+func (live *LiveConfig) LoadConfigJson(jsonObj map[string]interface{}) error {
+    return fmt.Errorf("Use Reload to change a LiveConfig")
+}
+
+func (live *LiveConfig) LoadConfigCLI() error {
+    return fmt.Errorf("Use Reload to change a LiveConfig")
+}
+
+func (live *LiveConfig) LoadConfigEnv() error {
+    return fmt.Errorf("Use Reload to change a LiveConfig")
+}
+
+func (live *LiveConfig) OptAdminAccounts() string {
+    return live.Current().OptAdminAccounts()
+}
+
+func (live *LiveConfig) OptAllowAnonDevices() bool {
+    return live.Current().OptAllowAnonDevices()
+}
+
+func (live *LiveConfig) OptAllowOrigin() string {
+    return live.Current().OptAllowOrigin()
+}
+
+func (live *LiveConfig) OptDevMode() bool {
+    return live.Current().OptDevMode()
+}
+
+func (live *LiveConfig) OptEmailFileDir() string {
+    return live.Current().OptEmailFileDir()
+}
+
+func (live *LiveConfig) OptEmailFileFormat() string {
+    return live.Current().OptEmailFileFormat()
+}
+
+func (live *LiveConfig) OptEmailService() string {
+    return live.Current().OptEmailService()
+}
+
+func (live *LiveConfig) OptEmailTemplateDir() string {
+    return live.Current().OptEmailTemplateDir()
+}
+
+func (live *LiveConfig) OptEnableHTTP() bool {
+    return live.Current().OptEnableHTTP()
+}
+
+func (live *LiveConfig) OptEnableHTTPS() bool {
+    return live.Current().OptEnableHTTPS()
+}
+
+func (live *LiveConfig) OptForwardOtherHosts() string {
+    return live.Current().OptForwardOtherHosts()
+}
+
+func (live *LiveConfig) OptHostname() string {
+    return live.Current().OptHostname()
+}
+
+func (live *LiveConfig) OptHTTPPort() int16 {
+    return live.Current().OptHTTPPort()
+}
+
+func (live *LiveConfig) OptHTTPSCertFile() string {
+    return live.Current().OptHTTPSCertFile()
+}
+
+func (live *LiveConfig) OptHTTPSPrivKeyFile() string {
+    return live.Current().OptHTTPSPrivKeyFile()
+}
+
+func (live *LiveConfig) OptHTTPSPort() int16 {
+    return live.Current().OptHTTPSPort()
+}
+
+func (live *LiveConfig) OptJavascriptClientPath() string {
+    return live.Current().OptJavascriptClientPath()
+}
+
+func (live *LiveConfig) OptLogCompress() bool {
+    return live.Current().OptLogCompress()
+}
+
+func (live *LiveConfig) OptLogErrorFile() string {
+    return live.Current().OptLogErrorFile()
+}
+
+func (live *LiveConfig) OptLogFile() string {
+    return live.Current().OptLogFile()
+}
+
+func (live *LiveConfig) OptLogFormat() string {
+    return live.Current().OptLogFormat()
+}
+
+func (live *LiveConfig) OptLogLevel() string {
+    return live.Current().OptLogLevel()
+}
+
+func (live *LiveConfig) OptLogLevels() string {
+    return live.Current().OptLogLevels()
+}
+
+func (live *LiveConfig) OptLogMaxAgeDays() int32 {
+    return live.Current().OptLogMaxAgeDays()
+}
+
+func (live *LiveConfig) OptLogMaxBackups() int32 {
+    return live.Current().OptLogMaxBackups()
+}
+
+func (live *LiveConfig) OptLogMaxSizeMB() int32 {
+    return live.Current().OptLogMaxSizeMB()
+}
+
+func (live *LiveConfig) OptLogRotate() string {
+    return live.Current().OptLogRotate()
+}
+
+func (live *LiveConfig) OptLogSinks() string {
+    return live.Current().OptLogSinks()
+}
+
+func (live *LiveConfig) OptPasswordHashCost() int16 {
+    return live.Current().OptPasswordHashCost()
+}
+
+func (live *LiveConfig) OptPasswordSecretSalt() string {
+    return live.Current().OptPasswordSecretSalt()
+}
+
+func (live *LiveConfig) OptProductionSecret() string {
+    return live.Current().OptProductionSecret()
+}
+
+func (live *LiveConfig) OptPushFile() string {
+    return live.Current().OptPushFile()
+}
+
+func (live *LiveConfig) OptPushHTTPAuthKey() string {
+    return live.Current().OptPushHTTPAuthKey()
+}
+
+func (live *LiveConfig) OptPushHTTPURL() string {
+    return live.Current().OptPushHTTPURL()
+}
+
+func (live *LiveConfig) OptPushService() string {
+    return live.Current().OptPushService()
+}
+
+func (live *LiveConfig) OptQuotaDailyNotifications() int32 {
+    return live.Current().OptQuotaDailyNotifications()
+}
+
+func (live *LiveConfig) OptQuotaDailyRequests() int32 {
+    return live.Current().OptQuotaDailyRequests()
+}
+
+func (live *LiveConfig) OptQuotaDailySamples() int32 {
+    return live.Current().OptQuotaDailySamples()
+}
+
+func (live *LiveConfig) OptQuotaMaxDevices() int32 {
+    return live.Current().OptQuotaMaxDevices()
+}
+
+func (live *LiveConfig) OptRateLimitRequestsPerMinute() int32 {
+    return live.Current().OptRateLimitRequestsPerMinute()
+}
+
+func (live *LiveConfig) OptSendgridUsername() string {
+    return live.Current().OptSendgridUsername()
+}
+
+func (live *LiveConfig) OptSendgridSecretKey() string {
+    return live.Current().OptSendgridSecretKey()
+}
+
+func (live *LiveConfig) OptSMSFile() string {
+    return live.Current().OptSMSFile()
+}
+
+func (live *LiveConfig) OptSMSFrom() string {
+    return live.Current().OptSMSFrom()
+}
+
+func (live *LiveConfig) OptSMSHTTPAuthToken() string {
+    return live.Current().OptSMSHTTPAuthToken()
+}
+
+func (live *LiveConfig) OptSMSHTTPURL() string {
+    return live.Current().OptSMSHTTPURL()
+}
+
+func (live *LiveConfig) OptSMSService() string {
+    return live.Current().OptSMSService()
+}
+
+func (live *LiveConfig) OptSMTPHost() string {
+    return live.Current().OptSMTPHost()
+}
+
+func (live *LiveConfig) OptSMTPPassword() string {
+    return live.Current().OptSMTPPassword()
+}
+
+func (live *LiveConfig) OptSMTPPort() int16 {
+    return live.Current().OptSMTPPort()
+}
+
+func (live *LiveConfig) OptSMTPSecurity() string {
+    return live.Current().OptSMTPSecurity()
+}
+
+func (live *LiveConfig) OptSMTPUsername() string {
+    return live.Current().OptSMTPUsername()
+}
+
+func (live *LiveConfig) OptWebManagerPath() string {
+    return live.Current().OptWebManagerPath()
+}
@@ -0,0 +1,514 @@
+// Copyright 2015 SimpleThings, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+package config
+
+import (
+    "canopy/canolog"
+    "fmt"
+    "math"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+)
+
+// optionDef describes one configuration option.  The registry below is the
+// only list of options: it drives the JSON, environment and command-line
+// loaders, NewDefaultConfig, ToFullJsonObject, redaction, reloading and the
+// --help text.
+//
+// Each option <name> is set by "<name>" in config files, by --<name> on the
+// command line and by the environment variable CCS_<NAME>, with dashes
+// replaced by underscores.
+type optionDef struct {
+    name string
+
+    // Default, written the way it would be in an environment variable.
+    // "" for the type's zero value.
+    def string
+
+    // Allowed values, if the option is limited to a few.
+    choices []string
+
+    // Checks the value of a string option, if set.
+    check func(value string) error
+
+    // The value is only shown to administrators.
+    secret bool
+
+    // The value is shown to anyone, by GET /info.  Other options, such as
+    // file paths and account names, are only shown to administrators.
+    public bool
+
+    // The option takes effect when the config is reloaded, without a
+    // restart.
+    reloadable bool
+
+    description string
+
+    // Pointer to the option's field: *bool, *int16, *int32 or *string.
+    field func(config *CanopyConfig) interface{}
+}
+
+var options = []optionDef{
+    {name: "admin-accounts", reloadable: true,
+        description: "Comma-separated usernames of accounts that may use the admin endpoints, such as GET /api/admin/config.",
+        field: func(c *CanopyConfig) interface{} { return &c.adminAccounts }},
+    {name: "allow-anon-devices", public: true,
+        description: "Allow anonymous devices, which no account owns.",
+        field: func(c *CanopyConfig) interface{} { return &c.allowAnonDevices }},
+    {name: "allow-origin", reloadable: true,
+        description: "Value of the Access-Control-Allow-Origin header on REST responses.  Empty to leave the header out.",
+        field: func(c *CanopyConfig) interface{} { return &c.allowOrigin }},
+    {name: "dev-mode",
+        description: "Enable development features, such as GET /api/dev/mail, and skip the checks on secrets.  Never use in production.",
+        field: func(c *CanopyConfig) interface{} { return &c.devMode }},
+    {name: "email-file-dir", reloadable: true,
+        description: "Directory where the \"file\" email service writes mail.",
+        field: func(c *CanopyConfig) interface{} { return &c.emailFileDir }},
+    {name: "email-file-format", def: "eml", choices: []string{"eml", "mbox"}, reloadable: true,
+        description: "How the \"file\" email service writes mail: one .eml file per message, or a single mbox file.",
+        field: func(c *CanopyConfig) interface{} { return &c.emailFileFormat }},
+    {name: "email-service", choices: []string{"none", "file", "sendgrid", "smtp"}, public: true, reloadable: true,
+        description: "How email is sent.",
+        field: func(c *CanopyConfig) interface{} { return &c.emailService }},
+    {name: "email-template-dir", reloadable: true,
+        description: "Directory of email templates that override the built-in ones, with a subdirectory for each language.",
+        field: func(c *CanopyConfig) interface{} { return &c.emailTemplateDir }},
+    {name: "enable-http", public: true,
+        description: "Serve plain HTTP on http-port.",
+        field: func(c *CanopyConfig) interface{} { return &c.enableHTTP }},
+    {name: "enable-https", def: "true", public: true,
+        description: "Serve HTTPS on https-port.",
+        field: func(c *CanopyConfig) interface{} { return &c.enableHTTPS }},
+    {name: "forward-other-hosts",
+        description: "URL to forward requests to when they are for a host other than hostname.",
+        field: func(c *CanopyConfig) interface{} { return &c.forwardOtherHosts }},
+    {name: "hostname", public: true,
+        description: "Hostname of this server, used in links and to pick which requests to serve.  Required.",
+        field: func(c *CanopyConfig) interface{} { return &c.hostname }},
+    {name: "http-port", def: "80", public: true,
+        description: "Port for plain HTTP.",
+        field: func(c *CanopyConfig) interface{} { return &c.httpPort }},
+    {name: "https-cert-file", reloadable: true,
+        description: "PEM file holding the TLS certificate chain.",
+        field: func(c *CanopyConfig) interface{} { return &c.httpsCertFile }},
+    {name: "https-port", def: "443", public: true,
+        description: "Port for HTTPS.",
+        field: func(c *CanopyConfig) interface{} { return &c.httpsPort }},
+    {name: "https-priv-key-file", reloadable: true,
+        description: "PEM file holding the TLS private key.",
+        field: func(c *CanopyConfig) interface{} { return &c.httpsPrivKeyFile }},
+    {name: "js-client-path",
+        description: "Directory of the JavaScript client library, served under /canopy-js-client.",
+        field: func(c *CanopyConfig) interface{} { return &c.javascriptClientPath }},
+    {name: "log-compress", reloadable: true,
+        description: "Gzip log files after they are rotated.",
+        field: func(c *CanopyConfig) interface{} { return &c.logCompress }},
+    {name: "log-error-file", reloadable: true,
+        description: "File that errors and warnings are also written to.  Rotated like log-file.",
+        field: func(c *CanopyConfig) interface{} { return &c.logErrorFile }},
+    {name: "log-file", def: "/var/log/canopy/canopy-server.log", reloadable: true,
+        description: "File to log to, if log-sinks includes \"file\".",
+        field: func(c *CanopyConfig) interface{} { return &c.logFile }},
+    {name: "log-format", def: "text", choices: []string{"text", "json"}, reloadable: true,
+        description: "Write the log as plain text, or as one JSON object per line.",
+        field: func(c *CanopyConfig) interface{} { return &c.logFormat }},
+    {name: "log-level", def: "trace", choices: []string{"error", "warn", "info", "trace"}, reloadable: true,
+        description: "Least severe messages that are logged.",
+        field: func(c *CanopyConfig) interface{} { return &c.logLevel }},
+    {name: "log-levels", reloadable: true,
+        check: func(value string) error {
+            _, err := canolog.ParseSubsystemLevels(value)
+            return err
+        },
+        description: "Levels for particular subsystems (ws, rest, datalayer or pigeon) that override log-level, like \"ws=warn,datalayer=info\".",
+        field: func(c *CanopyConfig) interface{} { return &c.logLevels }},
+    {name: "log-max-age-days", reloadable: true,
+        description: "Delete rotated log files after this many days.  0 to keep them.",
+        field: func(c *CanopyConfig) interface{} { return &c.logMaxAgeDays }},
+    {name: "log-max-backups", reloadable: true,
+        description: "Rotated log files to keep, deleting the oldest.  0 to keep them all.",
+        field: func(c *CanopyConfig) interface{} { return &c.logMaxBackups }},
+    {name: "log-max-size-mb", reloadable: true,
+        description: "Rotate log files when they reach this many megabytes.  0 for no limit.",
+        field: func(c *CanopyConfig) interface{} { return &c.logMaxSizeMB }},
+    {name: "log-rotate", def: "none", choices: []string{"none", "hourly", "daily"}, reloadable: true,
+        description: "Also rotate log files at the start of every hour or day.  For logrotate, leave this as \"none\" and send SIGHUP after rotating, which reopens the files.",
+        field: func(c *CanopyConfig) interface{} { return &c.logRotate }},
+    {name: "log-sinks", def: "file", reloadable: true,
+        check: func(value string) error {
+            _, err := canolog.ParseSinks(value)
+            return err
+        },
+        description: "Where to log: a comma-separated combination of \"file\", \"stderr\" and \"syslog\" (the local syslog daemon).",
+        field: func(c *CanopyConfig) interface{} { return &c.logSinks }},
+    {name: "password-hash-cost", def: "10",
+        description: "bcrypt cost for hashing passwords.",
+        field: func(c *CanopyConfig) interface{} { return &c.passwordHashCost }},
+    {name: "password-secret-salt", secret: true,
+        description: "Secret added to every password before hashing.  Changing it invalidates every password.  Required unless dev-mode is enabled.",
+        field: func(c *CanopyConfig) interface{} { return &c.passwordSecretSalt }},
+    {name: "production-secret", secret: true,
+        description: "Key used to sign session cookies.  Required unless dev-mode is enabled.",
+        field: func(c *CanopyConfig) interface{} { return &c.productionSecret }},
+    {name: "push-file",
+        description: "File the \"file\" push service appends notifications to.",
+        field: func(c *CanopyConfig) interface{} { return &c.pushFile }},
+    {name: "push-http-auth-key", secret: true,
+        description: "Key sent to push-http-url in the Authorization header.",
+        field: func(c *CanopyConfig) interface{} { return &c.pushHTTPAuthKey }},
+    {name: "push-http-url",
+        description: "URL the \"http\" push service posts notifications to.",
+        field: func(c *CanopyConfig) interface{} { return &c.pushHTTPURL }},
+    {name: "push-service", def: "none", choices: []string{"none", "file", "http"}, public: true,
+        description: "How push notifications are sent.",
+        field: func(c *CanopyConfig) interface{} { return &c.pushService }},
+    {name: "quota-daily-notifications", def: "100", public: true, reloadable: true,
+        description: "Notifications each device may raise per day.  Each one may be sent by email, SMS or push to every account with access to the device.  0 for no limit.",
+        field: func(c *CanopyConfig) interface{} { return &c.quotaDailyNotifications }},
+    {name: "quota-daily-requests", public: true, reloadable: true,
+        description: "Requests each account or device may make per day.  0 for no limit.",
+        field: func(c *CanopyConfig) interface{} { return &c.quotaDailyRequests }},
+    {name: "quota-daily-samples", public: true, reloadable: true,
+        description: "Sensor samples each device may report per day.  0 for no limit.",
+        field: func(c *CanopyConfig) interface{} { return &c.quotaDailySamples }},
+    {name: "quota-max-devices", public: true, reloadable: true,
+        description: "Devices each account may own.  0 for no limit.",
+        field: func(c *CanopyConfig) interface{} { return &c.quotaMaxDevices }},
+    {name: "rate-limit-requests-per-minute", def: "600", public: true, reloadable: true,
+        description: "Requests each account, device or anonymous IP address may make per minute.  0 for no limit.",
+        field: func(c *CanopyConfig) interface{} { return &c.rateLimitRequestsPerMinute }},
+    {name: "sendgrid-secret-key", secret: true, reloadable: true,
+        description: "SendGrid API key.",
+        field: func(c *CanopyConfig) interface{} { return &c.sendgridSecretKey }},
+    {name: "sendgrid-username", reloadable: true,
+        description: "SendGrid username.",
+        field: func(c *CanopyConfig) interface{} { return &c.sendgridUsername }},
+    {name: "sms-file",
+        description: "File the \"file\" SMS service appends messages to.",
+        field: func(c *CanopyConfig) interface{} { return &c.smsFile }},
+    {name: "sms-from",
+        description: "Number text messages are sent from.",
+        field: func(c *CanopyConfig) interface{} { return &c.smsFrom }},
+    {name: "sms-http-auth-token", secret: true,
+        description: "Token sent to sms-http-url in the Authorization header.",
+        field: func(c *CanopyConfig) interface{} { return &c.smsHTTPAuthToken }},
+    {name: "sms-http-url",
+        description: "URL the \"http\" SMS service posts messages to.",
+        field: func(c *CanopyConfig) interface{} { return &c.smsHTTPURL }},
+    {name: "sms-service", def: "none", choices: []string{"none", "file", "http"}, public: true,
+        description: "How text messages are sent.",
+        field: func(c *CanopyConfig) interface{} { return &c.smsService }},
+    {name: "smtp-host", reloadable: true,
+        description: "SMTP server for the \"smtp\" email service.",
+        field: func(c *CanopyConfig) interface{} { return &c.smtpHost }},
+    {name: "smtp-password", secret: true, reloadable: true,
+        description: "SMTP password.",
+        field: func(c *CanopyConfig) interface{} { return &c.smtpPassword }},
+    {name: "smtp-port", reloadable: true,
+        description: "SMTP port.  0 for the usual port for smtp-security.",
+        field: func(c *CanopyConfig) interface{} { return &c.smtpPort }},
+    {name: "smtp-security", def: "starttls", choices: []string{"starttls", "tls", "none"}, reloadable: true,
+        description: "How the connection to the SMTP server is secured.",
+        field: func(c *CanopyConfig) interface{} { return &c.smtpSecurity }},
+    {name: "smtp-username", reloadable: true,
+        description: "SMTP username.  Empty to skip authentication.",
+        field: func(c *CanopyConfig) interface{} { return &c.smtpUsername }},
+    {name: "web-manager-path",
+        description: "Directory of the web manager, served under /mgr.",
+        field: func(c *CanopyConfig) interface{} { return &c.webManagerPath }},
+}
+
+// A problem with one option, and where it was set.
+type OptionError struct {
+    // A config file name, "$CCS_<NAME>" or "--<name>".
+    Source string
+
+    // "" if the problem isn't with a particular option.
+    Option string
+
+    Message string
+}
+
+func (e OptionError) Error() string {
+    if e.Option == "" {
+        return e.Source + ": " + e.Message
+    }
+    return fmt.Sprintf("%s: %s: %s", e.Source, e.Option, e.Message)
+}
+
+// Every problem found while loading the config, so that they can all be
+// fixed at once.
+type OptionErrors []OptionError
+
+func (errs OptionErrors) Error() string {
+    lines := []string{"Problems in the configuration:"}
+    for _, e := range errs {
+        lines = append(lines, "    " + e.Error())
+    }
+    return strings.Join(lines, "\n")
+}
+
+// Return <errs> as an error, or nil if there are none.
+func (errs OptionErrors) asError() error {
+    if len(errs) == 0 {
+        return nil
+    }
+    return errs
+}
+
+func lookupOption(name string) *optionDef {
+    for i := range options {
+        if options[i].name == name {
+            return &options[i]
+        }
+    }
+    return nil
+}
+
+func (opt *optionDef) envVar() string {
+    return "CCS_" + strings.ToUpper(strings.Replace(opt.name, "-", "_", -1))
+}
+
+// Describe the values the option takes, for --help.
+func (opt *optionDef) typeName() string {
+    if len(opt.choices) > 0 {
+        return strings.Join(opt.choices, "|")
+    }
+    switch opt.field(&CanopyConfig{}).(type) {
+    case *bool:
+        return "true|false"
+    case *int16, *int32:
+        return "int"
+    }
+    return "string"
+}
+
+func (opt *optionDef) checkValue(value string) error {
+    if opt.check != nil {
+        return opt.check(value)
+    }
+    if len(opt.choices) == 0 {
+        return nil
+    }
+    for _, choice := range opt.choices {
+        if value == choice {
+            return nil
+        }
+    }
+    return fmt.Errorf("must be one of %s, not %q", strings.Join(opt.choices, ", "), value)
+}
+
+// Set the option in <config> from <text>, as given in an environment
+// variable or on the command line.
+func (opt *optionDef) parse(config *CanopyConfig, text string) error {
+    switch p := opt.field(config).(type) {
+    case *bool:
+        if text == "1" || text == "true" {
+            *p = true
+        } else if text == "0" || text == "false" {
+            *p = false
+        } else {
+            return fmt.Errorf("must be true or false, not %q", text)
+        }
+    case *int16:
+        val, err := strconv.ParseInt(text, 0, 16)
+        if err != nil {
+            return fmt.Errorf("must be a whole number from %d to %d, not %q", math.MinInt16, math.MaxInt16, text)
+        }
+        *p = int16(val)
+    case *int32:
+        val, err := strconv.ParseInt(text, 0, 32)
+        if err != nil {
+            return fmt.Errorf("must be a whole number from %d to %d, not %q", math.MinInt32, math.MaxInt32, text)
+        }
+        *p = int32(val)
+    case *string:
+        err := opt.checkValue(text)
+        if err != nil {
+            return err
+        }
+        *p = text
+    }
+    return nil
+}
+
+// Set the option in <config> from <value>, as decoded from a JSON config
+// file.
+func (opt *optionDef) setJson(config *CanopyConfig, value interface{}) error {
+    switch p := opt.field(config).(type) {
+    case *bool:
+        val, ok := value.(bool)
+        if !ok {
+            return fmt.Errorf("must be true or false")
+        }
+        *p = val
+    case *int16:
+        val, ok := value.(float64)
+        if !ok || val != math.Trunc(val) || val < math.MinInt16 || val > math.MaxInt16 {
+            return fmt.Errorf("must be a whole number from %d to %d", math.MinInt16, math.MaxInt16)
+        }
+        *p = int16(val)
+    case *int32:
+        val, ok := value.(float64)
+        if !ok || val != math.Trunc(val) || val < math.MinInt32 || val > math.MaxInt32 {
+            return fmt.Errorf("must be a whole number from %d to %d", math.MinInt32, math.MaxInt32)
+        }
+        *p = int32(val)
+    case *string:
+        val, ok := value.(string)
+        if !ok {
+            return fmt.Errorf("must be a string")
+        }
+        err := opt.checkValue(val)
+        if err != nil {
+            return err
+        }
+        *p = val
+    }
+    return nil
+}
+
+// Get the option's value in <config>.
+func (opt *optionDef) get(config *CanopyConfig) interface{} {
+    switch p := opt.field(config).(type) {
+    case *bool:
+        return *p
+    case *int16:
+        return *p
+    case *int32:
+        return *p
+    case *string:
+        return *p
+    }
+    return nil
+}
+
+// Copy the option's value from <src> to <dst>.
+func (opt *optionDef) copy(dst, src *CanopyConfig) {
+    switch p := opt.field(dst).(type) {
+    case *bool:
+        *p = *opt.field(src).(*bool)
+    case *int16:
+        *p = *opt.field(src).(*int16)
+    case *int32:
+        *p = *opt.field(src).(*int32)
+    case *string:
+        *p = *opt.field(src).(*string)
+    }
+}
+
+// Message for an unknown option, suggesting the closest known option if
+// <name> looks like a misspelling of it.
+func unknownOptionMessage(name string) string {
+    best, bestDistance := "", 3
+    for _, opt := range options {
+        distance := editDistance(name, opt.name)
+        if distance < bestDistance {
+            best, bestDistance = opt.name, distance
+        }
+    }
+    if best != "" {
+        return fmt.Sprintf("unknown option (did you mean %q?)", best)
+    }
+    return "unknown option"
+}
+
+// Levenshtein distance between <a> and <b>.
+func editDistance(a, b string) int {
+    prev := make([]int, len(b) + 1)
+    cur := make([]int, len(b) + 1)
+    for j := range prev {
+        prev[j] = j
+    }
+    for i := 1; i <= len(a); i++ {
+        cur[0] = i
+        for j := 1; j <= len(b); j++ {
+            cost := 1
+            if a[i - 1] == b[j - 1] {
+                cost = 0
+            }
+            cur[j] = min3(prev[j] + 1, cur[j - 1] + 1, prev[j - 1] + cost)
+        }
+        prev, cur = cur, prev
+    }
+    return prev[len(b)]
+}
+
+func min3(a, b, c int) int {
+    if b < a {
+        a = b
+    }
+    if c < a {
+        a = c
+    }
+    return a
+}
+
+// Get the --help text for <program>, describing every option.
+func HelpText(program string) string {
+    lines := []string{
+        "Usage: " + filepath.Base(program) + " [--<option>=<value> ...]",
+        "",
+        "Options are read, in order, from /etc/canopy/server.conf,",
+        "~/.canopy/server.conf, the file named by $CANOPY_SERVER_CONFIG_FILE,",
+        "environment variables and the command line.  Later sources override",
+        "earlier ones.",
+        "",
+        "Options:",
+    }
+    names := []string{}
+    for _, opt := range options {
+        names = append(names, opt.name)
+    }
+    sort.Strings(names)
+    for _, name := range names {
+        opt := lookupOption(name)
+        notes := []string{"$" + opt.envVar()}
+        if opt.def != "" {
+            notes = append(notes, "default " + opt.def)
+        }
+        if opt.secret {
+            notes = append(notes, "secret")
+        }
+        if opt.reloadable {
+            notes = append(notes, "reloadable")
+        }
+        lines = append(lines, fmt.Sprintf("  --%s=<%s>", opt.name, opt.typeName()))
+        for _, line := range wrapWords(opt.description + "  (" + strings.Join(notes, ", ") + ")", 70) {
+            lines = append(lines, "        " + line)
+        }
+    }
+    return strings.Join(lines, "\n") + "\n"
+}
+
+// Split <text> into lines of at most <width> characters, where possible.
+func wrapWords(text string, width int) []string {
+    lines := []string{}
+    line := ""
+    for _, word := range strings.Split(text, " ") {
+        if line != "" && len(line) + 1 + len(word) > width {
+            lines = append(lines, strings.TrimRight(line, " "))
+            line = ""
+        }
+        if line != "" {
+            line += " "
+        }
+        line += word
+    }
+    return append(lines, line)
+}
@@ -0,0 +1,98 @@
+// Copyright 2015 SimpleThings, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+package config
+
+import (
+    "fmt"
+    "strings"
+)
+
+// Shown in place of the value of a secret option that is set.
+const Redacted = "********"
+
+// Secrets that must be set, and be strong, unless "dev-mode" is enabled.
+var requiredSecrets = []string{
+    "password-secret-salt",
+    "production-secret",
+}
+
+// Shortest acceptable length of a required secret.
+const minSecretLength = 16
+
+// Values that have appeared in documentation or examples, and so must not
+// be used in production.
+var knownDefaultSecrets = []string{
+    "HCZIloQgIzAq5USZ17dvg",
+    "changeme",
+    "secret",
+}
+
+// Is option <name> a secret?
+func IsSecret(name string) bool {
+    opt := lookupOption(name)
+    return opt != nil && opt.secret
+}
+
+// Get a copy of <obj>, as returned by ToFullJsonObject, with the values of
+// secret options replaced by Redacted.  Secrets that are not set are left
+// empty, so that it is still clear which ones are missing.
+func Redact(obj map[string]interface{}) map[string]interface{} {
+    out := map[string]interface{}{}
+    for name, value := range obj {
+        if IsSecret(name) && value != "" {
+            value = Redacted
+        }
+        out[name] = value
+    }
+    return out
+}
+
+// Check that the required secrets are set, long enough and not a known
+// default.  The check is skipped in development mode.
+func CheckSecrets(cfg Config) error {
+    if cfg.OptDevMode() {
+        return nil
+    }
+    obj := cfg.ToFullJsonObject()
+    for _, name := range requiredSecrets {
+        value, _ := obj[name].(string)
+        if value == "" {
+            return fmt.Errorf("You must set the configuration option \"%s\"", name)
+        }
+        for _, known := range knownDefaultSecrets {
+            if strings.EqualFold(value, known) {
+                return fmt.Errorf("The configuration option \"%s\" is set to a published example value.  Choose a new random value", name)
+            }
+        }
+        if len(value) < minSecretLength {
+            return fmt.Errorf("The configuration option \"%s\" must be at least %d characters long", name, minSecretLength)
+        }
+    }
+    return nil
+}
+
+// Is <username> listed in the "admin-accounts" option?
+func IsAdminAccount(cfg Config, username string) bool {
+    if username == "" {
+        return false
+    }
+    for _, admin := range strings.Split(cfg.OptAdminAccounts(), ",") {
+        if strings.TrimSpace(admin) == username {
+            return true
+        }
+    }
+    return false
+}
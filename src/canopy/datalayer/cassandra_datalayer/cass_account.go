@@ -18,9 +18,16 @@ package cassandra_datalayer
 import (
     "canopy/datalayer"
     "canopy/util/random"
+    "canopy/util/totp"
     "code.google.com/p/go.crypto/bcrypt"
+    "crypto/rand"
+    "crypto/sha256"
+    "crypto/subtle"
+    "encoding/base32"
+    "encoding/hex"
     "errors"
     "fmt"
+    "strings"
     "time"
     "github.com/gocql/gocql"
 )
@@ -34,8 +41,19 @@ type CassAccount struct {
     activation_code string
     password_reset_code string
     password_reset_code_expiry time.Time
+    totp_enabled bool
+    totp_secret string
+    totp_pending_secret string
+    totp_last_step int64
+    pending_email string
+    email_change_code string
+    email_change_code_expiry time.Time
+    sessions_valid_after time.Time
+    language string
 }
 
+const numRecoveryCodes = 10
+
 func (account *CassAccount) ActivationCode() string {
     return account.activation_code
 }
@@ -62,6 +80,244 @@ func (account *CassAccount) Activate(username, code string) error {
     return nil;
 }
 
+func (account *CassAccount) AppPasswordNames() ([]string, error) {
+    var name string
+    names := []string{}
+
+    iter := account.conn.session.Query(`
+            SELECT name FROM account_app_passwords
+            WHERE username = ?
+    `, account.Username()).Consistency(gocql.One).Iter()
+    for iter.Scan(&name) {
+        names = append(names, name)
+    }
+    if err := iter.Close(); err != nil {
+        return []string{}, err
+    }
+    return names, nil
+}
+
+func (account *CassAccount) BeginEmailChange(newEmail string) (string, error) {
+    err := validateEmail(newEmail)
+    if err != nil {
+        return "", err
+    }
+
+    var existing string
+    err = account.conn.session.Query(`
+            SELECT username FROM account_emails
+            WHERE email = ?
+            LIMIT 1
+    `, newEmail).Consistency(gocql.One).Scan(&existing)
+    if err == nil {
+        return "", datalayer.EmailTakenError
+    } else if err != gocql.ErrNotFound {
+        return "", err
+    }
+
+    code, err := random.Base64URLString(24)
+    if err != nil {
+        return "", err
+    }
+    expiry := time.Now().Add(time.Hour*24)
+
+    err = account.conn.session.Query(`
+            UPDATE accounts
+            SET pending_email = ?,
+                email_change_code = ?,
+                email_change_code_expiry = ?
+            WHERE username = ?
+    `, newEmail, code, expiry, account.Username()).Exec()
+    if err != nil {
+        return "", err
+    }
+    account.pending_email = newEmail
+    account.email_change_code = code
+    account.email_change_code_expiry = expiry
+    return code, nil
+}
+
+func (account *CassAccount) BeginTOTPEnrollment() (string, string, error) {
+    secret, err := totp.GenerateSecret()
+    if err != nil {
+        return "", "", err
+    }
+
+    err = account.conn.session.Query(`
+            UPDATE accounts
+            SET totp_pending_secret = ?
+            WHERE username = ?
+    `, secret, account.Username()).Exec()
+    if err != nil {
+        return "", "", err
+    }
+    account.totp_pending_secret = secret
+
+    hostname := account.conn.dl.cfg.OptHostname()
+    uri := totp.ProvisioningURI(secret, "Canopy", account.Username() + "@" + hostname)
+    return secret, uri, nil
+}
+
+// Normalize and hash a recovery code for storage.  Recovery codes are
+// displayed as "xxxx-xxxx" but are accepted without the dash, in any case.
+func hashRecoveryCode(code string) string {
+    code = strings.ToLower(strings.Replace(strings.TrimSpace(code), "-", "", -1))
+    sum := sha256.Sum256([]byte(code))
+    return hex.EncodeToString(sum[:])
+}
+
+func genRecoveryCode() (string, error) {
+    randBytes := make([]byte, 5)
+    _, err := rand.Read(randBytes)
+    if err != nil {
+        return "", err
+    }
+    code := strings.ToLower(base32.StdEncoding.EncodeToString(randBytes))
+    return code[:4] + "-" + code[4:], nil
+}
+
+func (account *CassAccount) ConfirmEmailChange(code string) (string, error) {
+    if code == "" || account.pending_email == "" ||
+            subtle.ConstantTimeCompare([]byte(account.email_change_code), []byte(code)) != 1 {
+        return "", datalayer.InvalidEmailChangeCodeError
+    }
+    if account.email_change_code_expiry.Before(time.Now()) {
+        return "", datalayer.InvalidEmailChangeCodeError
+    }
+
+    oldEmail := account.email
+    newEmail := account.pending_email
+
+    // Claim the new address with a lightweight transaction, so that two
+    // accounts cannot end up with the same email address.
+    applied, err := account.conn.session.Query(`
+            INSERT INTO account_emails (email, username)
+            VALUES (?, ?)
+            IF NOT EXISTS
+    `, newEmail, account.Username()).ScanCAS()
+    if err != nil {
+        return "", err
+    }
+    if !applied {
+        return "", datalayer.EmailTakenError
+    }
+
+    // Update the account and release the old address together.
+    batch := account.conn.session.NewBatch(gocql.LoggedBatch)
+    batch.Query(`
+            UPDATE accounts
+            SET email = ?,
+                pending_email = ?,
+                email_change_code = ?
+            WHERE username = ?
+    `, newEmail, "", "", account.Username())
+    batch.Query(`
+            DELETE FROM account_emails
+            WHERE email = ?
+    `, oldEmail)
+    err = account.conn.session.ExecuteBatch(batch)
+    if err != nil {
+        // Give up the claim on the new address.
+        account.conn.session.Query(`
+                DELETE FROM account_emails
+                WHERE email = ?
+        `, newEmail).Exec()
+        return "", err
+    }
+
+    account.email = newEmail
+    account.pending_email = ""
+    account.email_change_code = ""
+    return oldEmail, nil
+}
+
+func (account *CassAccount) ConfirmTOTPEnrollment(code string) ([]string, error) {
+    if account.totp_pending_secret == "" {
+        return nil, errors.New("Two-factor enrollment has not been started")
+    }
+
+    step, ok := totp.Verify(account.totp_pending_secret, code, time.Now(), 0)
+    if !ok {
+        return nil, datalayer.InvalidTOTPCodeError
+    }
+
+    err := account.conn.session.Query(`
+            UPDATE accounts
+            SET totp_enabled = true,
+                totp_secret = ?,
+                totp_pending_secret = ?,
+                totp_last_step = ?
+            WHERE username = ?
+    `, account.totp_pending_secret, "", step, account.Username()).Exec()
+    if err != nil {
+        return nil, err
+    }
+    account.totp_enabled = true
+    account.totp_secret = account.totp_pending_secret
+    account.totp_pending_secret = ""
+    account.totp_last_step = step
+
+    // Replace any previous recovery codes.
+    err = account.conn.session.Query(`
+            DELETE FROM account_recovery_codes
+            WHERE username = ?
+    `, account.Username()).Exec()
+    if err != nil {
+        return nil, err
+    }
+
+    codes := []string{}
+    for i := 0; i < numRecoveryCodes; i++ {
+        recoveryCode, err := genRecoveryCode()
+        if err != nil {
+            return nil, err
+        }
+        err = account.conn.session.Query(`
+                INSERT INTO account_recovery_codes (username, code_hash)
+                VALUES (?, ?)
+        `, account.Username(), hashRecoveryCode(recoveryCode)).Exec()
+        if err != nil {
+            return nil, err
+        }
+        codes = append(codes, recoveryCode)
+    }
+    return codes, nil
+}
+
+func (account *CassAccount) CreateAppPassword(name string) (string, error) {
+    if name == "" {
+        return "", errors.New("App password name required")
+    }
+
+    password, err := random.Base64URLString(18)
+    if err != nil {
+        return "", err
+    }
+
+    salt := account.conn.dl.cfg.OptPasswordSecretSalt()
+    hashCost := account.conn.dl.cfg.OptPasswordHashCost()
+    password_hash, err := bcrypt.GenerateFromPassword([]byte(password + salt), int(hashCost))
+    if err != nil {
+        return "", err
+    }
+
+    err = account.conn.session.Query(`
+            INSERT INTO account_app_passwords (username, name, password_hash, created)
+            VALUES (?, ?, ?, ?)
+    `, account.Username(), name, password_hash, time.Now()).Exec()
+    if err != nil {
+        return "", err
+    }
+    return password, nil
+}
+
+func (account *CassAccount) DeleteAppPassword(name string) error {
+    return account.conn.session.Query(`
+            DELETE FROM account_app_passwords
+            WHERE username = ? AND name = ?
+    `, account.Username(), name).Exec()
+}
+
 
 // Obtain list of devices I have access to.
 func (account *CassAccount) Devices() ([]datalayer.Device, error) {
@@ -116,6 +372,27 @@ func (account *CassAccount) Device(id gocql.UUID) (datalayer.Device, error) {
     return device, nil
 }
 
+func (account *CassAccount) DisableTOTP() error {
+    err := account.conn.session.Query(`
+            UPDATE accounts
+            SET totp_enabled = false,
+                totp_secret = ?,
+                totp_pending_secret = ?
+            WHERE username = ?
+    `, "", "", account.Username()).Exec()
+    if err != nil {
+        return err
+    }
+    account.totp_enabled = false
+    account.totp_secret = ""
+    account.totp_pending_secret = ""
+
+    return account.conn.session.Query(`
+            DELETE FROM account_recovery_codes
+            WHERE username = ?
+    `, account.Username()).Exec()
+}
+
 func (account *CassAccount)Email() string {
     return account.email
 }
@@ -147,6 +424,18 @@ func (account *CassAccount) IsActivated() bool {
     return account.activated
 }
 
+func (account *CassAccount) IsTOTPEnabled() bool {
+    return account.totp_enabled
+}
+
+func (account *CassAccount) Language() string {
+    return account.language
+}
+
+func (account *CassAccount) PendingEmail() string {
+    return account.pending_email
+}
+
 func (account *CassAccount) ResetPassword(code, newPassword string) error {
     // Verify the code is valid and not expired.
     
@@ -179,6 +468,29 @@ func (account *CassAccount) ResetPassword(code, newPassword string) error {
     return nil
 }
 
+func (account *CassAccount) SessionsValidAfter() time.Time {
+    return account.sessions_valid_after
+}
+
+func (account *CassAccount) SetLanguage(lang string) error {
+    lang = strings.Replace(strings.ToLower(lang), "_", "-", -1)
+    err := validateLanguage(lang)
+    if err != nil {
+        return err
+    }
+
+    err = account.conn.session.Query(`
+            UPDATE accounts
+            SET language = ?
+            WHERE username = ?
+    `, lang, account.Username()).Exec()
+    if err != nil {
+        return err
+    }
+    account.language = lang
+    return nil
+}
+
 func (account *CassAccount) SetPassword(password string) error {
     err := validatePassword(password)
     if err != nil {
@@ -215,3 +527,66 @@ func (account* CassAccount)VerifyPassword(password string) bool {
     err := bcrypt.CompareHashAndPassword(account.password_hash, []byte(password + salt))
     return (err == nil)
 }
+
+func (account *CassAccount) VerifyAppPassword(password string) bool {
+    var password_hash []byte
+    salt := account.conn.dl.cfg.OptPasswordSecretSalt()
+    verified := false
+
+    iter := account.conn.session.Query(`
+            SELECT password_hash FROM account_app_passwords
+            WHERE username = ?
+    `, account.Username()).Consistency(gocql.One).Iter()
+    for iter.Scan(&password_hash) {
+        if bcrypt.CompareHashAndPassword(password_hash, []byte(password + salt)) == nil {
+            verified = true
+            break
+        }
+    }
+    iter.Close()
+    return verified
+}
+
+func (account *CassAccount) VerifySecondFactor(code string) error {
+    if !account.totp_enabled {
+        return nil
+    }
+
+    step, ok := totp.Verify(account.totp_secret, code, time.Now(), account.totp_last_step)
+    if ok {
+        // The lightweight transaction ensures that if two requests use the
+        // same code at once, only one of them succeeds.  If the condition
+        // fails, the current value of "totp_last_step" is returned.
+        var currentStep int64
+        applied, err := account.conn.session.Query(`
+                UPDATE accounts
+                SET totp_last_step = ?
+                WHERE username = ?
+                IF totp_last_step = ?
+        `, step, account.Username(), account.totp_last_step).ScanCAS(&currentStep)
+        if err != nil {
+            return err
+        }
+        if !applied {
+            account.totp_last_step = currentStep
+            return datalayer.InvalidTOTPCodeError
+        }
+        account.totp_last_step = step
+        return nil
+    }
+
+    // Not a TOTP code.  Try it as a recovery code.  The lightweight
+    // transaction ensures each recovery code can only be used once.
+    applied, err := account.conn.session.Query(`
+            DELETE FROM account_recovery_codes
+            WHERE username = ? AND code_hash = ?
+            IF EXISTS
+    `, account.Username(), hashRecoveryCode(code)).ScanCAS()
+    if err != nil {
+        return err
+    }
+    if !applied {
+        return datalayer.InvalidTOTPCodeError
+    }
+    return nil
+}
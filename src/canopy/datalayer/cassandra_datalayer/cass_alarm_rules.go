@@ -0,0 +1,220 @@
+// Copyright 2015 SimpleThings, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cassandra_datalayer
+
+import (
+    "canopy/datalayer"
+    "canopy/util/random"
+    "github.com/gocql/gocql"
+    "time"
+)
+
+// Rules that need checking without a new sample, by AlarmRule.NextCheck.
+var alarmRulesDue = dueIndex{"alarm_rules_due", []string{"device_id", "rule_id"}}
+
+const alarmRuleColumns = `device_id, rule_id, bool_value, created, created_by,
+        duration_ms, firing, hysteresis, last_fired, last_sample_time,
+        last_value, message, name, notify_type, operator, pending_since,
+        rule_type, threshold, var_name`
+
+// Read the rows of a query that selects alarmRuleColumns.
+func scanAlarmRules(iter *gocql.Iter) ([]datalayer.AlarmRule, error) {
+    var rule datalayer.AlarmRule
+    var durationMs int64
+    rules := []datalayer.AlarmRule{}
+
+    for iter.Scan(
+            &rule.DeviceID,
+            &rule.ID,
+            &rule.BoolValue,
+            &rule.Created,
+            &rule.CreatedBy,
+            &durationMs,
+            &rule.Firing,
+            &rule.Hysteresis,
+            &rule.LastFired,
+            &rule.LastSampleTime,
+            &rule.LastValue,
+            &rule.Message,
+            &rule.Name,
+            &rule.NotifyType,
+            &rule.Operator,
+            &rule.PendingSince,
+            &rule.Type,
+            &rule.Threshold,
+            &rule.VarName) {
+        rule.Duration = time.Duration(durationMs)*time.Millisecond
+        rules = append(rules, rule)
+        rule = datalayer.AlarmRule{}
+    }
+    if err := iter.Close(); err != nil {
+        return []datalayer.AlarmRule{}, err
+    }
+    return rules, nil
+}
+
+func (conn *CassConnection) AlarmRules(deviceId gocql.UUID) ([]datalayer.AlarmRule, error) {
+    iter := conn.session.Query(`
+            SELECT ` + alarmRuleColumns + `
+            FROM alarm_rules
+            WHERE device_id = ?
+    `, deviceId).Consistency(gocql.One).Iter()
+    return scanAlarmRules(iter)
+}
+
+func (conn *CassConnection) CreateAlarmRule(rule datalayer.AlarmRule) (*datalayer.AlarmRule, error) {
+    var err error
+    rule.ID, err = random.Base64URLString(12)
+    if err != nil {
+        return nil, err
+    }
+    rule.Created = time.Now().UTC()
+    rule.Firing = false
+    rule.PendingSince = time.Time{}
+    rule.LastValue = 0
+    rule.LastSampleTime = time.Time{}
+    rule.LastFired = time.Time{}
+
+    // "firing" must not be null, because SaveAlarmRuleState's condition
+    // compares it.
+    batch := conn.session.NewBatch(gocql.LoggedBatch)
+    batch.Query(`
+            INSERT INTO alarm_rules (
+                device_id,
+                rule_id,
+                bool_value,
+                created,
+                created_by,
+                duration_ms,
+                firing,
+                hysteresis,
+                message,
+                name,
+                notify_type,
+                operator,
+                rule_type,
+                threshold,
+                var_name)
+            VALUES (?, ?, ?, ?, ?, ?, false, ?, ?, ?, ?, ?, ?, ?, ?)
+    `, rule.DeviceID, rule.ID, rule.BoolValue, rule.Created, rule.CreatedBy,
+        int64(rule.Duration/time.Millisecond), rule.Hysteresis, rule.Message,
+        rule.Name, rule.NotifyType, rule.Operator, rule.Type, rule.Threshold,
+        rule.VarName)
+    if nextCheck := rule.NextCheck(); !nextCheck.IsZero() {
+        batch.Query(alarmRulesDue.insertStatement(),
+            dueIndexValues(nextCheck, rule.DeviceID, rule.ID)...)
+    }
+    err = conn.session.ExecuteBatch(batch)
+    if err != nil {
+        logger.Error("Error creating alarm rule:", err)
+        return nil, err
+    }
+    return &rule, nil
+}
+
+func (conn *CassConnection) DeleteAlarmRule(deviceId gocql.UUID, ruleId string) error {
+    err := conn.session.Query(`
+            DELETE FROM alarm_rules
+            WHERE device_id = ? AND rule_id = ?
+    `, deviceId, ruleId).Exec()
+    if err != nil {
+        logger.Error("Error deleting alarm rule:", err)
+        return err
+    }
+    return nil
+}
+
+func (conn *CassConnection) DueAlarmRules(since, until time.Time) ([]datalayer.AlarmRule, error) {
+    var deviceId gocql.UUID
+    var ruleId string
+    rules := []datalayer.AlarmRule{}
+    seen := map[string]bool{}
+    err := conn.scanDueIndex(alarmRulesDue, since, until, []interface{}{&deviceId, &ruleId}, func(indexed time.Time) {
+        rule, err := conn.LookupAlarmRule(deviceId, ruleId)
+        if err == gocql.ErrNotFound {
+            conn.removeDueEntry(alarmRulesDue, indexed, deviceId, ruleId)
+            return
+        } else if err != nil {
+            return
+        }
+        key := deviceId.String() + "/" + ruleId
+        if conn.updateDueEntry(alarmRulesDue, indexed, rule.NextCheck(), until, deviceId, ruleId) && !seen[key] {
+            seen[key] = true
+            rules = append(rules, *rule)
+        }
+    })
+    return rules, err
+}
+
+func (conn *CassConnection) LookupAlarmRule(deviceId gocql.UUID, ruleId string) (*datalayer.AlarmRule, error) {
+    iter := conn.session.Query(`
+            SELECT ` + alarmRuleColumns + `
+            FROM alarm_rules
+            WHERE device_id = ? AND rule_id = ?
+            LIMIT 1
+    `, deviceId, ruleId).Consistency(gocql.One).Iter()
+    rules, err := scanAlarmRules(iter)
+    if err != nil {
+        return nil, err
+    }
+    if len(rules) == 0 {
+        return nil, gocql.ErrNotFound
+    }
+    return &rules[0], nil
+}
+
+// The sample columns are only ever written here, and the state columns only
+// by SaveAlarmRuleState's lightweight transaction, so that plain writes and
+// lightweight transactions never race on the same column.
+func (conn *CassConnection) SaveAlarmRuleSample(rule datalayer.AlarmRule) error {
+    err := conn.session.Query(`
+            UPDATE alarm_rules
+            SET last_value = ?,
+                last_sample_time = ?
+            WHERE device_id = ? AND rule_id = ?
+    `, rule.LastValue, rule.LastSampleTime, rule.DeviceID, rule.ID).Exec()
+    if err != nil {
+        logger.Error("Error saving alarm rule sample:", err)
+        return err
+    }
+    return nil
+}
+
+func (conn *CassConnection) SaveAlarmRuleState(rule datalayer.AlarmRule, wasFiring bool) (bool, error) {
+    // If the condition fails, the current value of "firing" is returned.
+    var currentFiring bool
+    applied, err := conn.session.Query(`
+            UPDATE alarm_rules
+            SET firing = ?,
+                pending_since = ?,
+                last_fired = ?
+            WHERE device_id = ? AND rule_id = ?
+            IF firing = ?
+    `, rule.Firing, rule.PendingSince, rule.LastFired, rule.DeviceID, rule.ID,
+        wasFiring).ScanCAS(&currentFiring)
+    if err != nil {
+        logger.Error("Error saving alarm rule state:", err)
+        return false, err
+    }
+
+    // A stale data rule's check moves later with every sample, so its entry
+    // is only moved when it comes due.  Otherwise, index the rule whenever
+    // it needs a check (re-adding an entry is harmless).
+    nextCheck := rule.NextCheck()
+    if applied && !nextCheck.IsZero() && (rule.Type != datalayer.AlarmRuleStaleData || wasFiring) {
+        conn.addDueEntry(alarmRulesDue, nextCheck, rule.DeviceID, rule.ID)
+    }
+    return applied, nil
+}
@@ -16,10 +16,10 @@
 package cassandra_datalayer
 
 import(
-    "canopy/canolog"
     "canopy/datalayer"
     "canopy/sddl"
     "canopy/util/random"
+    "crypto/subtle"
     "fmt"
     "github.com/gocql/gocql"
     "code.google.com/p/go.crypto/bcrypt"
@@ -47,7 +47,7 @@ func (conn *CassConnection) ClearSensorData() {
     for _, table := range tables {
         err := conn.session.Query(`TRUNCATE ` + table).Exec();
         if (err != nil) {
-            canolog.Error("Error truncating ", table, ":", err)
+            logger.Error("Error truncating ", table, ":", err)
         }
     }
 }
@@ -89,6 +89,14 @@ func validateEmail(email string) error {
     return nil
 }
 
+// "" is also valid, and means the default language.
+func validateLanguage(lang string) error {
+    if lang != "" && !datalayer.LanguagePattern.MatchString(lang) {
+        return fmt.Errorf("Invalid language")
+    }
+    return nil
+}
+
 func (conn *CassConnection) CreateAccount(
         username, 
         email, 
@@ -131,10 +139,11 @@ func (conn *CassConnection) CreateAccount(
                 activated, 
                 activation_code,
                 password_reset_code,
-                password_reset_code_expiry)
-            VALUES (?, ?, ?, ?, ?, ?, ?)
-    `, username, email, password_hash, false, activation_code, "", now).Exec(); err != nil {
-        canolog.Error("Error creating account:", err)
+                password_reset_code_expiry,
+                sessions_valid_after)
+            VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+    `, username, email, password_hash, false, activation_code, "", now, now).Exec(); err != nil {
+        logger.Error("Error creating account:", err)
         return nil, err
     }
 
@@ -142,11 +151,21 @@ func (conn *CassConnection) CreateAccount(
             INSERT INTO account_emails (email, username)
             VALUES (?, ?)
     `, email, username).Exec(); err != nil {
-        canolog.Error("Error setting account email:", err)
+        logger.Error("Error setting account email:", err)
         return nil, err
     }
 
-    return &CassAccount{conn, username, email, password_hash, false, activation_code, "", now}, nil
+    return &CassAccount{
+        conn: conn,
+        username: username,
+        email: email,
+        password_hash: password_hash,
+        activated: false,
+        activation_code: activation_code,
+        password_reset_code: "",
+        password_reset_code_expiry: now,
+        sessions_valid_after: now,
+    }, nil
 }
 
 func (conn *CassConnection) CreateDevice(
@@ -179,7 +198,7 @@ func (conn *CassConnection) CreateDevice(
             VALUES (?, ?, ?, ?)
     `, id, secretKey, name, publicAccessLevel).Exec()
     if err != nil {
-        canolog.Error("Error creating device:", err)
+        logger.Error("Error creating device:", err)
         return nil, err
     }
     return &CassDevice{
@@ -193,23 +212,276 @@ func (conn *CassConnection) CreateDevice(
     }, nil
 }
 
-func (conn *CassConnection) DeleteAccount(username string) {
-    account, _ := conn.LookupAccount(username)
-    email := account.Email()
+func (conn *CassConnection) DeleteAccount(username string) error {
+    account, err := conn.LookupAccount(username)
+    if err != nil {
+        return err
+    }
+    username = account.Username()
+
+    // Deal with the account's devices.
+    var deviceId gocql.UUID
+    var accessLevel int
+    deviceIds := []gocql.UUID{}
+    iter := conn.session.Query(`
+            SELECT device_id, access_level FROM device_permissions
+            WHERE username = ?
+    `, username).Consistency(gocql.One).Iter()
+    for iter.Scan(&deviceId, &accessLevel) {
+        deviceIds = append(deviceIds, deviceId)
+    }
+    if err := iter.Close(); err != nil {
+        return err
+    }
+    for _, deviceId := range deviceIds {
+        if err := conn.releaseDevice(username, deviceId); err != nil {
+            logger.Error("Error releasing device ", deviceId, ": ", err)
+            return err
+        }
+    }
 
-    if err := conn.session.Query(`
-            DELETE FROM accounts
+    // Revoke OAuth tokens issued to this account.
+    var tokenHash string
+    tokenHashes := []string{}
+    iter = conn.session.Query(`
+            SELECT token_hash FROM oauth_tokens_by_user
             WHERE username = ?
-    `, username).Exec(); err != nil {
-        canolog.Error("Error deleting account", err)
+    `, username).Consistency(gocql.One).Iter()
+    for iter.Scan(&tokenHash) {
+        tokenHashes = append(tokenHashes, tokenHash)
+    }
+    if err := iter.Close(); err != nil {
+        return err
+    }
+    for _, tokenHash := range tokenHashes {
+        err = conn.session.Query(`
+                DELETE FROM oauth_tokens
+                WHERE token_hash = ?
+        `, tokenHash).Exec()
+        if err != nil {
+            return err
+        }
     }
 
-    if err := conn.session.Query(`
+    // Remove OAuth clients this account registered.  Tokens already issued
+    // to them for other accounts can no longer be refreshed.
+    var clientId string
+    clientIds := []string{}
+    iter = conn.session.Query(`
+            SELECT client_id FROM oauth_clients
+            WHERE owner_username = ?
+    `, username).Consistency(gocql.One).Iter()
+    for iter.Scan(&clientId) {
+        clientIds = append(clientIds, clientId)
+    }
+    if err := iter.Close(); err != nil {
+        return err
+    }
+    for _, clientId := range clientIds {
+        err = conn.session.Query(`
+                DELETE FROM oauth_clients
+                WHERE client_id = ?
+        `, clientId).Exec()
+        if err != nil {
+            return err
+        }
+    }
+
+    // Remove webhooks and their delivery history.
+    hooks, err := conn.Webhooks(username)
+    if err != nil {
+        return err
+    }
+    for _, hook := range hooks {
+        err = conn.DeleteWebhook(username, hook.ID)
+        if err != nil {
+            return err
+        }
+    }
+
+    // Remove everything else keyed by username.
+    for _, table := range []string{
+            "oauth_tokens_by_user",
+            "device_group",
+            "account_recovery_codes",
+            "account_app_passwords",
+            "notification_prefs",
+            "queued_notifications",
+            "push_tokens"} {
+        err = conn.session.Query(`
+                DELETE FROM ` + table + `
+                WHERE username = ?
+        `, username).Exec()
+        if err != nil {
+            logger.Error("Error deleting from ", table, ": ", err)
+            return err
+        }
+    }
+
+    // Finally, remove the account itself.
+    batch := conn.session.NewBatch(gocql.LoggedBatch)
+    batch.Query(`
             DELETE FROM account_emails
             WHERE email = ?
-    `, email).Exec(); err != nil {
-        canolog.Error("Error deleting account email", err)
+    `, account.Email())
+    batch.Query(`
+            DELETE FROM accounts
+            WHERE username = ?
+    `, username)
+    err = conn.session.ExecuteBatch(batch)
+    if err != nil {
+        logger.Error("Error deleting account", err)
+        return err
     }
+    return nil
+}
+
+// Remove <username>'s access to a device.  If nobody else has access, the
+// device is deleted.  If others have access but none of them has read-write
+// access, the first of them is given it.
+func (conn *CassConnection) releaseDevice(username string, deviceId gocql.UUID) error {
+    var otherUsername string
+    var accessLevel int
+    newOwner := ""
+    hasOtherOwner := false
+    hasOthers := false
+
+    iter := conn.session.Query(`
+            SELECT username, access_level FROM device_permissions_by_device
+            WHERE device_id = ?
+    `, deviceId).Consistency(gocql.One).Iter()
+    for iter.Scan(&otherUsername, &accessLevel) {
+        if otherUsername == username || accessLevel == datalayer.NoAccess {
+            continue
+        }
+        hasOthers = true
+        if accessLevel >= datalayer.ReadWriteAccess {
+            hasOtherOwner = true
+        } else if newOwner == "" {
+            newOwner = otherUsername
+        }
+    }
+    if err := iter.Close(); err != nil {
+        return err
+    }
+
+    if !hasOthers {
+        return conn.DeleteDevice(deviceId)
+    }
+
+    if !hasOtherOwner {
+        logger.Info("Handing off device ", deviceId, " to ", newOwner)
+        err := conn.setDevicePermission(newOwner, deviceId, datalayer.ReadWriteAccess)
+        if err != nil {
+            return err
+        }
+    }
+
+    return conn.deleteDevicePermission(username, deviceId)
+}
+
+// Set an account's access to a device, in both the by-account and by-device
+// permission tables.
+func (conn *CassConnection) setDevicePermission(username string, deviceId gocql.UUID, access datalayer.AccessLevel) error {
+    batch := conn.session.NewBatch(gocql.LoggedBatch)
+    batch.Query(`
+            INSERT INTO device_permissions (username, device_id, access_level)
+            VALUES (?, ?, ?)
+    `, username, deviceId, access)
+    batch.Query(`
+            INSERT INTO device_permissions_by_device (device_id, username, access_level)
+            VALUES (?, ?, ?)
+    `, deviceId, username, access)
+    return conn.session.ExecuteBatch(batch)
+}
+
+func (conn *CassConnection) deleteDevicePermission(username string, deviceId gocql.UUID) error {
+    batch := conn.session.NewBatch(gocql.LoggedBatch)
+    batch.Query(`
+            DELETE FROM device_permissions
+            WHERE username = ? AND device_id = ?
+    `, username, deviceId)
+    batch.Query(`
+            DELETE FROM device_permissions_by_device
+            WHERE device_id = ? AND username = ?
+    `, deviceId, username)
+    return conn.session.ExecuteBatch(batch)
+}
+
+func (conn *CassConnection) DeleteDevice(deviceId gocql.UUID) error {
+    device, err := conn.LookupDevice(deviceId)
+    if err != nil {
+        return err
+    }
+
+    // Remove sample data.  Samples are partitioned by (device_id, propname),
+    // so each Cloud Variable is removed separately.
+    doc := device.SDDLDocument()
+    if doc != nil {
+        for _, varDef := range doc.VarDefs() {
+            table, err := tableNameByDatatype(varDef.Datatype())
+            if err != nil {
+                // Composite types have no samples of their own.
+                continue
+            }
+            err = conn.session.Query(`
+                    DELETE FROM ` + table + `
+                    WHERE device_id = ? AND propname = ?
+            `, deviceId, varDef.Name()).Exec()
+            if err != nil {
+                return err
+            }
+        }
+    }
+
+    for _, table := range []string{
+            "var_sample_counts",
+            "var_info",
+            "notifications",
+            "notification_counts",
+            "notification_deliveries",
+            "alarm_rules",
+            "schedules",
+            "control_event"} {
+        err = conn.session.Query(`
+                DELETE FROM ` + table + `
+                WHERE device_id = ?
+        `, deviceId).Exec()
+        if err != nil {
+            logger.Error("Error deleting from ", table, ": ", err)
+            return err
+        }
+    }
+
+    // Remove everybody's access.
+    var username string
+    usernames := []string{}
+    iter := conn.session.Query(`
+            SELECT username FROM device_permissions_by_device
+            WHERE device_id = ?
+    `, deviceId).Consistency(gocql.One).Iter()
+    for iter.Scan(&username) {
+        usernames = append(usernames, username)
+    }
+    if err := iter.Close(); err != nil {
+        return err
+    }
+    for _, username := range usernames {
+        err = conn.deleteDevicePermission(username, deviceId)
+        if err != nil {
+            return err
+        }
+    }
+
+    err = conn.session.Query(`
+            DELETE FROM devices
+            WHERE device_id = ?
+    `, deviceId).Exec()
+    if err != nil {
+        logger.Error("Error deleting device", err)
+        return err
+    }
+    return nil
 }
 
 func (conn *CassConnection) LookupAccount(
@@ -217,10 +489,10 @@ func (conn *CassConnection) LookupAccount(
     var account CassAccount
     var username string
 
-    canolog.Info("Looking up account: ", usernameOrEmail)
+    logger.Info("Looking up account: ", usernameOrEmail)
 
     if strings.Contains(usernameOrEmail, "@") {
-        canolog.Info("It is an email address")
+        logger.Info("It is an email address")
         // email address provided.  Lookup username based on email
         err := conn.session.Query(`
                 SELECT email, username FROM account_emails
@@ -230,15 +502,15 @@ func (conn *CassConnection) LookupAccount(
              &account.email, &username);
         
         if (err != nil) {
-            canolog.Error("Error looking up account", err)
+            logger.Error("Error looking up account", err)
             return nil, err
         }
     } else {
-        canolog.Info("It is not an email address")
+        logger.Info("It is not an email address")
         username = usernameOrEmail
     }
 
-    canolog.Info("fetching info for: ", username)
+    logger.Info("fetching info for: ", username)
     // Lookup account info based on username
     err := conn.session.Query(`
             SELECT 
@@ -248,7 +520,16 @@ func (conn *CassConnection) LookupAccount(
                 activated, 
                 activation_code, 
                 password_reset_code, 
-                password_reset_code_expiry 
+                password_reset_code_expiry,
+                totp_enabled,
+                totp_secret,
+                totp_pending_secret,
+                totp_last_step,
+                pending_email,
+                email_change_code,
+                email_change_code_expiry,
+                sessions_valid_after,
+                language
             FROM accounts 
             WHERE username = ?
             LIMIT 1
@@ -259,14 +540,23 @@ func (conn *CassConnection) LookupAccount(
          &account.activated, 
          &account.activation_code,
          &account.password_reset_code,
-         &account.password_reset_code_expiry)
+         &account.password_reset_code_expiry,
+         &account.totp_enabled,
+         &account.totp_secret,
+         &account.totp_pending_secret,
+         &account.totp_last_step,
+         &account.pending_email,
+         &account.email_change_code,
+         &account.email_change_code_expiry,
+         &account.sessions_valid_after,
+         &account.language)
     
     if (err != nil) {
-        canolog.Error("Error looking up account", err)
+        logger.Error("Error looking up account", err)
         return nil, err
     }
 
-    canolog.Info("Success")
+    logger.Info("Success")
     account.conn = conn
     return &account, nil
 }
@@ -281,7 +571,7 @@ func (conn *CassConnection) LookupAccountVerifyPassword(
 
     verified := account.VerifyPassword(password)
     if (!verified) {
-        canolog.Info("Incorrect password for ", usernameOrEmail)
+        logger.Info("Incorrect password for ", usernameOrEmail)
         return nil, datalayer.InvalidPasswordError
     }
 
@@ -306,7 +596,7 @@ func (conn *CassConnection) LookupDevice(
             &device.docString,
             &last_seen)
     if err != nil {
-        canolog.Error(err)
+        logger.Error(err)
         return nil, err
     }
 
@@ -320,7 +610,7 @@ func (conn *CassConnection) LookupDevice(
     if device.docString != "" {
         device.doc, err = sddl.Sys.ParseDocumentString(device.docString)
         if err != nil {
-            canolog.Error("Error parsing class string for device: ", device.docString, err)
+            logger.Error("Error parsing class string for device: ", device.docString, err)
             return nil, err
         }
     } else {
@@ -338,8 +628,8 @@ func (conn *CassConnection) LookupDeviceVerifySecretKey(
         return nil, err
     }
 
-    if device.SecretKey() != secret {
-        canolog.Error("Invalid secret key")
+    if subtle.ConstantTimeCompare([]byte(device.SecretKey()), []byte(secret)) != 1 {
+        logger.Error("Invalid secret key")
         return nil, datalayer.InvalidPasswordError
     }
 
@@ -351,7 +641,7 @@ func (conn *CassConnection) LookupDeviceByStringID(
 
     deviceId, err := gocql.ParseUUID(id)
     if err != nil {
-        canolog.Error(err)
+        logger.Error(err)
         return nil, err
     }
     return conn.LookupDevice(deviceId)
@@ -363,7 +653,7 @@ func (conn *CassConnection) LookupDeviceByStringIDVerifySecretKey(
 
     deviceId, err := gocql.ParseUUID(id)
     if err != nil {
-        canolog.Error(err)
+        logger.Error(err)
         return nil, err
     }
     return conn.LookupDeviceVerifySecretKey(deviceId, secret)
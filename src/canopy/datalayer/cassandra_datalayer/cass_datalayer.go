@@ -24,6 +24,8 @@ import (
     "github.com/gocql/gocql"
 )
 
+var logger = canolog.Subsystem("datalayer")
+
 //
 // Cassandra stores data in column families (aka tables).  Each column family
 // (table) has multiple rows.  Each row has a row key.  Each row also has an
@@ -274,6 +276,15 @@ var creationQueries []string = []string{
         PRIMARY KEY(username, device_id)
     ) WITH COMPACT STORAGE`,
 
+    // Reverse index of device_permissions, to find everybody with access
+    // to a device.
+    `CREATE TABLE device_permissions_by_device (
+        device_id uuid,
+        username text,
+        access_level int,
+        PRIMARY KEY(device_id, username)
+    )`,
+
     `CREATE TABLE accounts (
         username text,
         email text,
@@ -282,9 +293,52 @@ var creationQueries []string = []string{
         activation_code text,
         password_reset_code text,
         password_reset_code_expiry timestamp,
+        totp_enabled boolean,
+        totp_secret text,
+        totp_pending_secret text,
+        totp_last_step bigint,
+        pending_email text,
+        email_change_code text,
+        email_change_code_expiry timestamp,
+        sessions_valid_after timestamp,
+        language text,
         PRIMARY KEY(username)
     ) WITH COMPACT STORAGE`,
 
+    // Per-day usage counters, for enforcing quotas.  <day> is "YYYY-MM-DD"
+    // (UTC).
+    `CREATE TABLE daily_usage (
+        principal text,
+        day text,
+        metric text,
+        count counter,
+        PRIMARY KEY((principal, day), metric)
+    )`,
+
+    // Principals with daily_usage counters, by day, so that past days can
+    // be purged.
+    `CREATE TABLE daily_usage_principals (
+        day text,
+        principal text,
+        PRIMARY KEY(day, principal)
+    )`,
+
+    // Single-use two-factor recovery codes.  Only SHA-256 hashes are stored.
+    `CREATE TABLE account_recovery_codes (
+        username text,
+        code_hash text,
+        PRIMARY KEY(username, code_hash)
+    )`,
+
+    // App passwords, used for HTTP BASIC auth when 2FA is enabled.
+    `CREATE TABLE account_app_passwords (
+        username text,
+        name text,
+        password_hash blob,
+        created timestamp,
+        PRIMARY KEY(username, name)
+    )`,
+
     `CREATE TABLE account_emails (
         email text,
         username text,
@@ -299,6 +353,240 @@ var creationQueries []string = []string{
         notify_type int,
         PRIMARY KEY(device_id, time_issued)
     ) `,
+
+    `CREATE TABLE oauth_clients (
+        client_id text,
+        client_secret_hash blob,
+        name text,
+        owner_username text,
+        redirect_uris list<text>,
+        PRIMARY KEY(client_id)
+    )`,
+
+    `CREATE INDEX ON oauth_clients (owner_username)`,
+
+    `CREATE TABLE oauth_auth_codes (
+        code_hash text,
+        access_level int,
+        client_id text,
+        code_challenge text,
+        code_challenge_method text,
+        expiry timestamp,
+        redirect_uri text,
+        scope text,
+        username text,
+        PRIMARY KEY(code_hash)
+    )`,
+
+    `CREATE TABLE oauth_tokens (
+        token_hash text,
+        token_type text,
+        access_level int,
+        client_id text,
+        expiry timestamp,
+        scope text,
+        username text,
+        PRIMARY KEY(token_hash)
+    )`,
+
+    `CREATE TABLE oauth_tokens_by_user (
+        username text,
+        token_hash text,
+        PRIMARY KEY(username, token_hash)
+    )`,
+
+    `CREATE TABLE webhooks (
+        username text,
+        webhook_id text,
+        created timestamp,
+        device_ids list<text>,
+        event_types list<text>,
+        notify_types list<text>,
+        secret text,
+        url text,
+        var_names list<text>,
+        PRIMARY KEY(username, webhook_id)
+    )`,
+
+    `CREATE TABLE webhook_deliveries (
+        webhook_id text,
+        time timeuuid,
+        attempt int,
+        delivery_id text,
+        device_id text,
+        error text,
+        event_type text,
+        payload text,
+        response_code int,
+        status text,
+        PRIMARY KEY(webhook_id, time)
+    ) WITH CLUSTERING ORDER BY (time DESC)`,
+
+    `CREATE TABLE webhook_dead_letters (
+        webhook_id text,
+        time timeuuid,
+        attempt int,
+        delivery_id text,
+        device_id text,
+        error text,
+        event_type text,
+        payload text,
+        response_code int,
+        status text,
+        PRIMARY KEY(webhook_id, time)
+    ) WITH CLUSTERING ORDER BY (time DESC)`,
+
+    `CREATE TABLE alarm_rules (
+        device_id uuid,
+        rule_id text,
+        bool_value boolean,
+        created timestamp,
+        created_by text,
+        duration_ms bigint,
+        firing boolean,
+        hysteresis double,
+        last_fired timestamp,
+        last_sample_time timestamp,
+        last_value double,
+        message text,
+        name text,
+        notify_type text,
+        operator text,
+        pending_since timestamp,
+        rule_type text,
+        threshold double,
+        var_name text,
+        PRIMARY KEY(device_id, rule_id)
+    )`,
+
+    // Alarm rules that need checking without a new sample, by when they
+    // are due (see cass_due_index.go).
+    `CREATE TABLE alarm_rules_due (
+        bucket timestamp,
+        due timestamp,
+        device_id uuid,
+        rule_id text,
+        PRIMARY KEY(bucket, due, device_id, rule_id)
+    )`,
+
+    `CREATE TABLE schedules (
+        device_id uuid,
+        schedule_id text,
+        created timestamp,
+        created_by text,
+        cron text,
+        last_error text,
+        last_run timestamp,
+        name text,
+        next_run timestamp,
+        time_zone text,
+        vars text,
+        PRIMARY KEY(device_id, schedule_id)
+    )`,
+
+    // Schedules by when they next run (see cass_due_index.go).
+    `CREATE TABLE schedules_due (
+        bucket timestamp,
+        due timestamp,
+        device_id uuid,
+        schedule_id text,
+        PRIMARY KEY(bucket, due, device_id, schedule_id)
+    )`,
+
+    `CREATE TABLE notification_prefs (
+        username text,
+        channels map<text, text>,
+        email_delivery text,
+        quiet_start int,
+        quiet_end int,
+        sms_number text,
+        time_zone text,
+        PRIMARY KEY(username)
+    )`,
+
+    `CREATE TABLE queued_notifications (
+        username text,
+        queued_id timeuuid,
+        channel text,
+        device_id uuid,
+        device_name text,
+        due timestamp,
+        msg text,
+        notify_type text,
+        time_issued timestamp,
+        PRIMARY KEY(username, queued_id)
+    )`,
+
+    // Queued notifications by when they are due (see cass_due_index.go).
+    `CREATE TABLE queued_notifications_due (
+        bucket timestamp,
+        due timestamp,
+        username text,
+        queued_id timeuuid,
+        PRIMARY KEY(bucket, due, username, queued_id)
+    )`,
+
+    `CREATE TABLE notification_counts (
+        device_id uuid,
+        unread counter,
+        PRIMARY KEY(device_id)
+    )`,
+
+    `CREATE TABLE push_tokens (
+        username text,
+        token text,
+        created timestamp,
+        platform text,
+        PRIMARY KEY(username, token)
+    )`,
+
+    `CREATE TABLE notification_deliveries (
+        device_id uuid,
+        time_issued timestamp,
+        time timeuuid,
+        channel text,
+        error text,
+        provider_id text,
+        recipient text,
+        status text,
+        username text,
+        PRIMARY KEY(device_id, time_issued, time)
+    )`,
+
+    `CREATE TABLE mail_outbox (
+        mail_id timeuuid,
+        attempts int,
+        created timestamp,
+        dedup_key text,
+        from_email text,
+        from_name text,
+        html text,
+        last_error text,
+        next_attempt timestamp,
+        reply_to text,
+        sent timestamp,
+        status text,
+        subject text,
+        text text,
+        to_emails list<text>,
+        to_names list<text>,
+        PRIMARY KEY(mail_id)
+    )`,
+
+    `CREATE TABLE mail_outbox_dedup (
+        dedup_key text,
+        mail_id timeuuid,
+        PRIMARY KEY(dedup_key)
+    )`,
+
+    // Pending outbox mail by when it is next attempted (see
+    // cass_due_index.go).
+    `CREATE TABLE mail_outbox_due (
+        bucket timestamp,
+        due timestamp,
+        mail_id timeuuid,
+        PRIMARY KEY(bucket, due, mail_id)
+    )`,
 }
 
 type CassDatalayer struct {
@@ -316,7 +604,7 @@ func (dl *CassDatalayer) Connect(keyspace string) (datalayer.Connection, error)
 
     session, err := cluster.CreateSession()
     if err != nil {
-        canolog.Error("Error creating DB session: ", err)
+        logger.Error("Error creating DB session: ", err)
         return nil, err
     }
 
@@ -331,7 +619,7 @@ func (dl *CassDatalayer) EraseDb(keyspace string) error {
 
     session, err := cluster.CreateSession()
     if err != nil {
-        canolog.Error("Error creating DB session: ", err)
+        logger.Error("Error creating DB session: ", err)
         return err
     }
 
@@ -344,7 +632,7 @@ func (dl *CassDatalayer) PrepDb(keyspace string) error {
 
     session, err := cluster.CreateSession()
     if err != nil {
-        canolog.Error("Error creating DB session: ", err)
+        logger.Error("Error creating DB session: ", err)
         return err
     }
 
@@ -355,7 +643,7 @@ func (dl *CassDatalayer) PrepDb(keyspace string) error {
     `).Exec()
     if err != nil {
         // Ignore errors (just log them).
-        canolog.Warn("(IGNORED) ", err)
+        logger.Warn("(IGNORED) ", err)
     }
 
     // Create a new session connecting to that keyspace.
@@ -364,7 +652,7 @@ func (dl *CassDatalayer) PrepDb(keyspace string) error {
     cluster.Consistency = gocql.Quorum
     session, err = cluster.CreateSession()
     if err != nil {
-        canolog.Error("Error creating DB session: ", err)
+        logger.Error("Error creating DB session: ", err)
         return err
     }
 
@@ -374,7 +662,7 @@ func (dl *CassDatalayer) PrepDb(keyspace string) error {
             // Ignore errors (just print them).
             // This allows PrepDB to be used to add new tables.  Eventually, we
             // should come up with a proper migration strategy.
-            canolog.Warn("(IGNORED) ", query, ": ", err)
+            logger.Warn("(IGNORED) ", query, ": ", err)
         }
     }
     return nil
@@ -389,6 +677,12 @@ func (dl *CassDatalayer) migrateNext(session *gocql.Session, startVersion string
             return startVersion, err
         }
         return "0.9.1", nil
+    } else if startVersion == "0.9.1" {
+        err := migrations.Migrate_0_9_1_to_0_9_2(session)
+        if err != nil {
+            return startVersion, err
+        }
+        return "0.9.2", nil
     }
     return  startVersion, fmt.Errorf("Unknown DB version %s", startVersion)
 }
@@ -400,20 +694,20 @@ func (dl *CassDatalayer) MigrateDB(keyspace, startVersion, endVersion string) er
 
     session, err := cluster.CreateSession()
     if err != nil {
-        canolog.Error("Error creating DB session: ", err)
+        logger.Error("Error creating DB session: ", err)
         return err
     }
 
     curVersion := startVersion
     for curVersion != endVersion {
-        canolog.Info("Migrating from %s to next version", curVersion)
-        curVersion, err = dl.migrateNext(session, startVersion)
+        logger.Infof("Migrating from %s to next version", curVersion)
+        curVersion, err = dl.migrateNext(session, curVersion)
         if err != nil {
-            canolog.Error("Failed migrating from %s:", curVersion, err)
+            logger.Errorf("Failed migrating from %s: %s", curVersion, err)
             return err
         }
     }
-    canolog.Info("Migration complete!  DB is now version: %s", curVersion)
+    logger.Infof("Migration complete!  DB is now version: %s", curVersion)
     return nil
 }
 
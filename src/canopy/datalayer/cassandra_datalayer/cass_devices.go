@@ -20,7 +20,6 @@ import (
     "github.com/gocql/gocql"
     "time"
     "canopy/sddl"
-    "canopy/canolog"
     "canopy/cloudvar"
     "fmt"
 )
@@ -163,20 +162,40 @@ func (device *CassDevice) getHistoricData_generic(propname string, datatype sddl
     return samples, nil
 }
 
+func (device *CassDevice) AccountAccess() (map[string]datalayer.AccessLevel, error) {
+    var username string
+    var accessLevel int
+    out := map[string]datalayer.AccessLevel{}
+
+    iter := device.conn.session.Query(`
+            SELECT username, access_level FROM device_permissions_by_device
+            WHERE device_id = ?
+    `, device.ID()).Consistency(gocql.One).Iter()
+    for iter.Scan(&username, &accessLevel) {
+        if accessLevel != datalayer.NoAccess {
+            out[username] = datalayer.AccessLevel(accessLevel)
+        }
+    }
+    if err := iter.Close(); err != nil {
+        return nil, err
+    }
+    return out, nil
+}
+
 func (device *CassDevice) ExtendSDDL(jsn map[string]interface{}) error {
     // TODO: Race condition?
     doc := device.SDDLDocument()
 
     err := doc.Extend(jsn)
     if err != nil {
-        canolog.Error("Error extending class ", jsn, err)
+        logger.Error("Error extending class ", jsn, err)
         return err
     }
 
     // save modified SDDL class to DB
     err = device.SetSDDLDocument(doc)
     if err != nil {
-        canolog.Error("Error saving SDDL: ", err)
+        logger.Error("Error saving SDDL: ", err)
         return err
     }
     return nil
@@ -207,31 +226,12 @@ func (device *CassDevice) SecretKey() string {
 }
 
 func (device *CassDevice) HistoricNotifications() ([]datalayer.Notification, error) {
-    var uuid gocql.UUID
-    var timestamp time.Time
-    var dismissed bool
-    var msg string
-    var notifyType int
-
-    query := device.conn.session.Query(`
+    iter := device.conn.session.Query(`
             SELECT device_id, time_issued, dismissed, msg, notify_type
             FROM notifications
             WHERE device_id = ?
-    `, device.ID()).Consistency(gocql.One)
-
-    iter := query.Iter()
-    notifications := []datalayer.Notification{}
-
-    for iter.Scan(&uuid, &timestamp, &dismissed, &msg, &notifyType) {
-        notifications = append(notifications, &CassNotification{
-                uuid, timestamp, dismissed, msg, notifyType})
-    }
-
-    if err := iter.Close(); err != nil {
-        return []datalayer.Notification{}, err
-    }
-
-    return notifications, nil
+    `, device.ID()).Consistency(gocql.One).Iter()
+    return scanNotifications(device.conn, iter)
 }
 
 
@@ -243,6 +243,14 @@ func (device *CassDevice)InsertNotification(notifyType int, t time.Time, msg str
     if err != nil {
         return err;
     }
+    err = device.conn.session.Query(`
+            UPDATE notification_counts
+            SET unread = unread + 1
+            WHERE device_id = ?
+    `, device.ID()).Exec()
+    if err != nil {
+        return err;
+    }
     return nil
 }
 
@@ -502,6 +510,26 @@ func (device *CassDevice) LocationNote() string {
     return device.locationNote
 }
 
+func (device *CassDevice) LookupNotification(id string) (datalayer.Notification, error) {
+    t, err := parseNotificationID(id)
+    if err != nil {
+        return nil, gocql.ErrNotFound
+    }
+    iter := device.conn.session.Query(`
+            SELECT device_id, time_issued, dismissed, msg, notify_type
+            FROM notifications
+            WHERE device_id = ? AND time_issued = ?
+    `, device.ID(), t).Consistency(gocql.One).Iter()
+    notifications, err := scanNotifications(device.conn, iter)
+    if err != nil {
+        return nil, err
+    }
+    if len(notifications) == 0 {
+        return nil, gocql.ErrNotFound
+    }
+    return notifications[0], nil
+}
+
 func (device *CassDevice) LookupVarDef(varName string) (sddl.VarDef, error) {
     doc := device.SDDLDocument()
 
@@ -516,6 +544,28 @@ func (device *CassDevice) Name() string {
     return device.name
 }
 
+func (device *CassDevice) Notifications(before time.Time, limit int) ([]datalayer.Notification, error) {
+    var query *gocql.Query
+    if before.IsZero() {
+        query = device.conn.session.Query(`
+                SELECT device_id, time_issued, dismissed, msg, notify_type
+                FROM notifications
+                WHERE device_id = ?
+                ORDER BY time_issued DESC
+                LIMIT ?
+        `, device.ID(), limit)
+    } else {
+        query = device.conn.session.Query(`
+                SELECT device_id, time_issued, dismissed, msg, notify_type
+                FROM notifications
+                WHERE device_id = ? AND time_issued < ?
+                ORDER BY time_issued DESC
+                LIMIT ?
+        `, device.ID(), before, limit)
+    }
+    return scanNotifications(device.conn, query.Consistency(gocql.One).Iter())
+}
+
 func (device *CassDevice) PublicAccessLevel() datalayer.AccessLevel {
     return device.publicAccessLevel
 }
@@ -530,12 +580,7 @@ func (device *CassDevice) SDDLDocumentString() string {
 
 func (device *CassDevice) SetAccountAccess(account datalayer.Account, access datalayer.AccessLevel, sharing datalayer.ShareLevel) error {
     /* TODO: Incorporate sharing level */
-    err := device.conn.session.Query(`
-            INSERT INTO device_permissions (username, device_id, access_level)
-            VALUES (?, ?, ?)
-    `, account.Username(), device.ID(), access).Exec()
-
-    return err
+    return device.conn.setDevicePermission(account.Username(), device.ID(), access)
 }
 
 func (device *CassDevice) SetLocationNote(locationNote string) error {
@@ -582,6 +627,21 @@ func (device *CassDevice) SetSDDLDocument(doc sddl.Document) error {
     return nil;
 }
 
+func (device *CassDevice) UnreadNotificationCount() (int64, error) {
+    var unread int64
+    err := device.conn.session.Query(`
+            SELECT unread
+            FROM notification_counts
+            WHERE device_id = ?
+    `, device.ID()).Consistency(gocql.One).Scan(&unread)
+    if err == gocql.ErrNotFound {
+        return 0, nil
+    } else if err != nil {
+        return 0, err
+    }
+    return unread, nil
+}
+
 func (device *CassDevice) UpdateLastActivityTime(tp *time.Time) error {
     var t time.Time
     if tp == nil {
@@ -0,0 +1,121 @@
+// Copyright 2015 SimpleThings, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+package cassandra_datalayer
+
+import (
+    "github.com/gocql/gocql"
+    "strings"
+    "time"
+)
+
+// Due-time indexes let background workers find the rows that need
+// attention without reading whole tables.  An index table has the columns
+//
+//      bucket timestamp,
+//      due timestamp,
+//      <key columns of the indexed table>,
+//      PRIMARY KEY(bucket, due, <key columns>)
+//
+// where <bucket> is <due> truncated to dueBucketSize, so each partition
+// holds the entries due in one hour.  Only rows that are waiting for
+// something to happen are indexed.
+//
+// Entries are hints.  Conditional updates can't be batched with other
+// tables, so an entry may be left behind when a row's due time changes, or
+// the row is done with.  Each row is checked when its entry comes due, and
+// entries that are out of date are moved or removed.
+const dueBucketSize = time.Hour
+
+type dueIndex struct {
+    table string
+    keyColumns []string
+}
+
+func dueBucket(due time.Time) time.Time {
+    return due.UTC().Truncate(dueBucketSize)
+}
+
+func (idx dueIndex) insertStatement() string {
+    return `INSERT INTO ` + idx.table + ` (bucket, due, ` + strings.Join(idx.keyColumns, ", ") + `)
+            VALUES (?, ?` + strings.Repeat(", ?", len(idx.keyColumns)) + `)`
+}
+
+func (idx dueIndex) deleteStatement() string {
+    return `DELETE FROM ` + idx.table + `
+            WHERE bucket = ? AND due = ? AND ` + strings.Join(idx.keyColumns, " = ? AND ") + ` = ?`
+}
+
+// Get the values for an entry, for insertStatement or deleteStatement.
+func dueIndexValues(due time.Time, keys ...interface{}) []interface{} {
+    return append([]interface{}{dueBucket(due), due}, keys...)
+}
+
+func (conn *CassConnection) addDueEntry(idx dueIndex, due time.Time, keys ...interface{}) error {
+    err := conn.session.Query(idx.insertStatement(), dueIndexValues(due, keys...)...).Exec()
+    if err != nil {
+        logger.Error("Error adding to ", idx.table, ": ", err)
+        return err
+    }
+    return nil
+}
+
+func (conn *CassConnection) removeDueEntry(idx dueIndex, due time.Time, keys ...interface{}) error {
+    err := conn.session.Query(idx.deleteStatement(), dueIndexValues(due, keys...)...).Exec()
+    if err != nil {
+        logger.Error("Error removing from ", idx.table, ": ", err)
+        return err
+    }
+    return nil
+}
+
+// Make the entry for a row that was indexed at <indexed> match its current
+// due time <due> (zero if it no longer needs an entry).  Returns true if
+// the row is due by <until>.
+func (conn *CassConnection) updateDueEntry(idx dueIndex, indexed, due, until time.Time, keys ...interface{}) bool {
+    if due.Equal(indexed) {
+        return true
+    }
+    if !due.IsZero() {
+        conn.addDueEntry(idx, due, keys...)
+    }
+    conn.removeDueEntry(idx, indexed, keys...)
+    return !due.IsZero() && !due.After(until)
+}
+
+// Call <fn> with each entry in <idx> that is due by <until>, starting from
+// the bucket of <since>.  The bucket before that is read too, because an
+// entry can be written a little after it is due, for instance by a server
+// whose clock is behind.  <keys> are pointers that the entry's key columns
+// are read into.  <fn> may change the index.
+func (conn *CassConnection) scanDueIndex(idx dueIndex, since, until time.Time, keys []interface{}, fn func(indexed time.Time)) error {
+    var indexed time.Time
+    dest := append([]interface{}{&indexed}, keys...)
+    for bucket := dueBucket(since).Add(-dueBucketSize); !bucket.After(until); bucket = bucket.Add(dueBucketSize) {
+        iter := conn.session.Query(`
+                SELECT due, ` + strings.Join(idx.keyColumns, ", ") + `
+                FROM ` + idx.table + `
+                WHERE bucket = ? AND due <= ?
+        `, bucket, until).Consistency(gocql.One).Iter()
+        for iter.Scan(dest...) {
+            fn(indexed)
+        }
+        if err := iter.Close(); err != nil {
+            logger.Error("Error reading ", idx.table, ": ", err)
+            return err
+        }
+    }
+    return nil
+}
@@ -0,0 +1,203 @@
+// Copyright 2015 SimpleThings, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+package cassandra_datalayer
+
+import (
+    "canopy/datalayer"
+    "github.com/gocql/gocql"
+    "time"
+)
+
+// Pending messages by NextAttempt.
+var outboxMailDue = dueIndex{"mail_outbox_due", []string{"mail_id"}}
+
+const outboxMailColumns = `mail_id, attempts, created, dedup_key, from_email,
+        from_name, html, last_error, next_attempt, reply_to, sent, status,
+        subject, text, to_emails, to_names`
+
+// Read the rows of a query that selects outboxMailColumns.
+func scanOutboxMail(iter *gocql.Iter) ([]datalayer.OutboxMail, error) {
+    var mail datalayer.OutboxMail
+    mails := []datalayer.OutboxMail{}
+
+    for iter.Scan(
+            &mail.ID,
+            &mail.Attempts,
+            &mail.Created,
+            &mail.DedupKey,
+            &mail.FromEmail,
+            &mail.FromName,
+            &mail.HTML,
+            &mail.LastError,
+            &mail.NextAttempt,
+            &mail.ReplyTo,
+            &mail.Sent,
+            &mail.Status,
+            &mail.Subject,
+            &mail.Text,
+            &mail.ToEmails,
+            &mail.ToNames) {
+        mails = append(mails, mail)
+        mail = datalayer.OutboxMail{}
+    }
+    if err := iter.Close(); err != nil {
+        return []datalayer.OutboxMail{}, err
+    }
+    return mails, nil
+}
+
+func (conn *CassConnection) AllOutboxMail() ([]datalayer.OutboxMail, error) {
+    iter := conn.session.Query(`
+            SELECT ` + outboxMailColumns + `
+            FROM mail_outbox
+    `).Consistency(gocql.One).Iter()
+    return scanOutboxMail(iter)
+}
+
+func (conn *CassConnection) ClaimOutboxMailAttempt(mail datalayer.OutboxMail, nextAttempt time.Time) (bool, error) {
+    // If the condition fails, the current value of "attempts" is returned.
+    var currentAttempts int
+    applied, err := conn.session.Query(`
+            UPDATE mail_outbox
+            SET attempts = ?,
+                next_attempt = ?
+            WHERE mail_id = ?
+            IF attempts = ?
+    `, mail.Attempts + 1, nextAttempt, mail.ID,
+        mail.Attempts).ScanCAS(&currentAttempts)
+    if err != nil {
+        logger.Error("Error claiming outbox mail attempt:", err)
+        return false, err
+    }
+    if applied {
+        conn.addDueEntry(outboxMailDue, nextAttempt, mail.ID)
+        conn.removeDueEntry(outboxMailDue, mail.NextAttempt, mail.ID)
+    }
+    return applied, nil
+}
+
+func (conn *CassConnection) DueOutboxMail(since, until time.Time) ([]datalayer.OutboxMail, error) {
+    var mailId gocql.UUID
+    mails := []datalayer.OutboxMail{}
+    seen := map[gocql.UUID]bool{}
+    err := conn.scanDueIndex(outboxMailDue, since, until, []interface{}{&mailId}, func(indexed time.Time) {
+        mail, err := conn.LookupOutboxMail(mailId)
+        if err == gocql.ErrNotFound {
+            conn.removeDueEntry(outboxMailDue, indexed, mailId)
+            return
+        } else if err != nil {
+            return
+        }
+        due := time.Time{}
+        if mail.Status == datalayer.OutboxMailPending {
+            due = mail.NextAttempt
+        }
+        if conn.updateDueEntry(outboxMailDue, indexed, due, until, mailId) && !seen[mailId] {
+            seen[mailId] = true
+            mails = append(mails, *mail)
+        }
+    })
+    return mails, err
+}
+
+func (conn *CassConnection) EnqueueOutboxMail(mail datalayer.OutboxMail) (gocql.UUID, bool, error) {
+    mail.ID = gocql.TimeUUID()
+    mail.Created = time.Now().UTC()
+    mail.Status = datalayer.OutboxMailPending
+    mail.Attempts = 0
+    mail.NextAttempt = mail.Created
+
+    // If the condition fails, the existing row is returned.
+    var existingKey string
+    var existingId gocql.UUID
+    applied, err := conn.session.Query(`
+            INSERT INTO mail_outbox_dedup (dedup_key, mail_id)
+            VALUES (?, ?)
+            IF NOT EXISTS
+            USING TTL ?
+    `, mail.DedupKey, mail.ID,
+        int(datalayer.OutboxMailDedupWindow.Seconds())).ScanCAS(&existingKey, &existingId)
+    if err != nil {
+        logger.Error("Error checking for duplicate outbox mail:", err)
+        return gocql.UUID{}, false, err
+    }
+    if !applied {
+        return existingId, true, nil
+    }
+
+    err = conn.saveOutboxMail(mail)
+    if err != nil {
+        // Don't block the message from being enqueued again.
+        conn.session.Query(`
+                DELETE FROM mail_outbox_dedup
+                WHERE dedup_key = ?
+        `, mail.DedupKey).Exec()
+        return gocql.UUID{}, false, err
+    }
+    return mail.ID, false, nil
+}
+
+func (conn *CassConnection) LookupOutboxMail(id gocql.UUID) (*datalayer.OutboxMail, error) {
+    iter := conn.session.Query(`
+            SELECT ` + outboxMailColumns + `
+            FROM mail_outbox
+            WHERE mail_id = ?
+    `, id).Consistency(gocql.One).Iter()
+    mails, err := scanOutboxMail(iter)
+    if err != nil {
+        return nil, err
+    }
+    if len(mails) == 0 {
+        return nil, gocql.ErrNotFound
+    }
+    return &mails[0], nil
+}
+
+func (conn *CassConnection) SaveOutboxMail(mail datalayer.OutboxMail) error {
+    return conn.saveOutboxMail(mail)
+}
+
+// Write all of <mail>'s columns, and its entry in the due index at
+// NextAttempt.  Messages that are no longer pending expire after
+// OutboxMailHistoryLifetime.
+func (conn *CassConnection) saveOutboxMail(mail datalayer.OutboxMail) error {
+    ttl := 0
+    if mail.Status != datalayer.OutboxMailPending {
+        ttl = int(datalayer.OutboxMailHistoryLifetime.Seconds())
+    }
+    batch := conn.session.NewBatch(gocql.LoggedBatch)
+    batch.Query(`
+            INSERT INTO mail_outbox (` + outboxMailColumns + `)
+            VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+            USING TTL ?
+    `, mail.ID, mail.Attempts, mail.Created, mail.DedupKey, mail.FromEmail,
+        mail.FromName, mail.HTML, mail.LastError, mail.NextAttempt,
+        mail.ReplyTo, mail.Sent, mail.Status, mail.Subject, mail.Text,
+        mail.ToEmails, mail.ToNames, ttl)
+    if mail.Status == datalayer.OutboxMailPending {
+        batch.Query(outboxMailDue.insertStatement(),
+            dueIndexValues(mail.NextAttempt, mail.ID)...)
+    } else {
+        batch.Query(outboxMailDue.deleteStatement(),
+            dueIndexValues(mail.NextAttempt, mail.ID)...)
+    }
+    err := conn.session.ExecuteBatch(batch)
+    if err != nil {
+        logger.Error("Error saving outbox mail:", err)
+        return err
+    }
+    return nil
+}
@@ -0,0 +1,287 @@
+// Copyright 2015 SimpleThings, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+package cassandra_datalayer
+
+import (
+    "canopy/datalayer"
+    "github.com/gocql/gocql"
+    "time"
+)
+
+// Queued notifications by Due.
+var queuedNotificationsDue = dueIndex{"queued_notifications_due", []string{"username", "queued_id"}}
+
+func (conn *CassConnection) AddPushToken(token datalayer.PushToken) error {
+    err := conn.session.Query(`
+            INSERT INTO push_tokens (username, token, created, platform)
+            VALUES (?, ?, ?, ?)
+    `, token.Username, token.Token, token.Created, token.Platform).Exec()
+    if err != nil {
+        logger.Error("Error adding push token:", err)
+        return err
+    }
+    return nil
+}
+
+func (conn *CassConnection) DeleteQueuedNotification(username string, queuedId gocql.UUID) (bool, error) {
+    applied, err := conn.session.Query(`
+            DELETE FROM queued_notifications
+            WHERE username = ? AND queued_id = ?
+            IF EXISTS
+    `, username, queuedId).ScanCAS()
+    if err != nil {
+        logger.Error("Error deleting queued notification:", err)
+        return false, err
+    }
+    return applied, nil
+}
+
+func (conn *CassConnection) DueNotificationUsernames(since, until time.Time) ([]string, error) {
+    var username string
+    var queuedId gocql.UUID
+    usernames := []string{}
+    seen := map[string]bool{}
+    err := conn.scanDueIndex(queuedNotificationsDue, since, until, []interface{}{&username, &queuedId}, func(indexed time.Time) {
+        // Entries for notifications that have been delivered are removed
+        // here.
+        var due time.Time
+        err := conn.session.Query(`
+                SELECT due FROM queued_notifications
+                WHERE username = ? AND queued_id = ?
+        `, username, queuedId).Consistency(gocql.One).Scan(&due)
+        if err == gocql.ErrNotFound {
+            conn.removeDueEntry(queuedNotificationsDue, indexed, username, queuedId)
+            return
+        } else if err != nil {
+            logger.Error("Error reading queued notification:", err)
+            return
+        }
+        if conn.updateDueEntry(queuedNotificationsDue, indexed, due, until, username, queuedId) && !seen[username] {
+            seen[username] = true
+            usernames = append(usernames, username)
+        }
+    })
+    return usernames, err
+}
+
+func (conn *CassConnection) DeletePushToken(username, token string) error {
+    err := conn.session.Query(`
+            DELETE FROM push_tokens
+            WHERE username = ? AND token = ?
+    `, username, token).Exec()
+    if err != nil {
+        logger.Error("Error deleting push token:", err)
+        return err
+    }
+    return nil
+}
+
+func (conn *CassConnection) NotificationDeliveries(deviceId gocql.UUID, timeIssued time.Time) ([]datalayer.NotificationDelivery, error) {
+    var delivery datalayer.NotificationDelivery
+    var t gocql.UUID
+    deliveries := []datalayer.NotificationDelivery{}
+
+    iter := conn.session.Query(`
+            SELECT time, channel, error, provider_id, recipient, status,
+                username
+            FROM notification_deliveries
+            WHERE device_id = ? AND time_issued = ?
+    `, deviceId, timeIssued).Consistency(gocql.One).Iter()
+    for iter.Scan(
+            &t,
+            &delivery.Channel,
+            &delivery.Error,
+            &delivery.ProviderID,
+            &delivery.Recipient,
+            &delivery.Status,
+            &delivery.Username) {
+        delivery.DeviceID = deviceId
+        delivery.TimeIssued = timeIssued
+        delivery.Time = t.Time()
+        deliveries = append(deliveries, delivery)
+        delivery = datalayer.NotificationDelivery{}
+    }
+    if err := iter.Close(); err != nil {
+        return []datalayer.NotificationDelivery{}, err
+    }
+    return deliveries, nil
+}
+
+func (conn *CassConnection) NotificationPrefs(username string) (*datalayer.NotificationPrefs, error) {
+    prefs := datalayer.DefaultNotificationPrefs(username)
+    var channels map[string]string
+    var emailDelivery, smsNumber, timeZone string
+    var quietStart, quietEnd int
+
+    err := conn.session.Query(`
+            SELECT channels, email_delivery, quiet_start, quiet_end,
+                sms_number, time_zone
+            FROM notification_prefs
+            WHERE username = ?
+            LIMIT 1
+    `, username).Consistency(gocql.One).Scan(
+            &channels,
+            &emailDelivery,
+            &quietStart,
+            &quietEnd,
+            &smsNumber,
+            &timeZone)
+    if err == gocql.ErrNotFound {
+        return &prefs, nil
+    } else if err != nil {
+        logger.Error("Error reading notification preferences:", err)
+        return nil, err
+    }
+
+    // Channels not saved keep their defaults.
+    for notifyType, channel := range channels {
+        prefs.Channels[notifyType] = channel
+    }
+    if emailDelivery != "" {
+        prefs.EmailDelivery = emailDelivery
+    }
+    if timeZone != "" {
+        prefs.TimeZone = timeZone
+    }
+    prefs.QuietStart = quietStart
+    prefs.QuietEnd = quietEnd
+    prefs.SMSNumber = smsNumber
+    return &prefs, nil
+}
+
+func (conn *CassConnection) PushTokens(username string) ([]datalayer.PushToken, error) {
+    var token datalayer.PushToken
+    tokens := []datalayer.PushToken{}
+
+    iter := conn.session.Query(`
+            SELECT token, created, platform
+            FROM push_tokens
+            WHERE username = ?
+    `, username).Consistency(gocql.One).Iter()
+    for iter.Scan(&token.Token, &token.Created, &token.Platform) {
+        token.Username = username
+        tokens = append(tokens, token)
+        token = datalayer.PushToken{}
+    }
+    if err := iter.Close(); err != nil {
+        return []datalayer.PushToken{}, err
+    }
+    return tokens, nil
+}
+
+func (conn *CassConnection) QueueNotification(notification datalayer.QueuedNotification) error {
+    notification.ID = gocql.TimeUUID()
+    batch := conn.session.NewBatch(gocql.LoggedBatch)
+    batch.Query(`
+            INSERT INTO queued_notifications (
+                username,
+                queued_id,
+                channel,
+                device_id,
+                device_name,
+                due,
+                msg,
+                notify_type,
+                time_issued)
+            VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+    `, notification.Username, notification.ID, notification.Channel,
+        notification.DeviceID, notification.DeviceName, notification.Due,
+        notification.Msg, notification.NotifyType,
+        notification.TimeIssued)
+    batch.Query(queuedNotificationsDue.insertStatement(),
+        dueIndexValues(notification.Due, notification.Username, notification.ID)...)
+    err := conn.session.ExecuteBatch(batch)
+    if err != nil {
+        logger.Error("Error queueing notification:", err)
+        return err
+    }
+    return nil
+}
+
+func (conn *CassConnection) QueuedNotifications(username string) ([]datalayer.QueuedNotification, error) {
+    var notification datalayer.QueuedNotification
+    notifications := []datalayer.QueuedNotification{}
+
+    iter := conn.session.Query(`
+            SELECT username, queued_id, channel, device_id, device_name, due,
+                msg, notify_type, time_issued
+            FROM queued_notifications
+            WHERE username = ?
+    `, username).Consistency(gocql.One).Iter()
+    for iter.Scan(
+            &notification.Username,
+            &notification.ID,
+            &notification.Channel,
+            &notification.DeviceID,
+            &notification.DeviceName,
+            &notification.Due,
+            &notification.Msg,
+            &notification.NotifyType,
+            &notification.TimeIssued) {
+        notifications = append(notifications, notification)
+        notification = datalayer.QueuedNotification{}
+    }
+    if err := iter.Close(); err != nil {
+        return []datalayer.QueuedNotification{}, err
+    }
+    return notifications, nil
+}
+
+func (conn *CassConnection) RecordNotificationDelivery(delivery datalayer.NotificationDelivery) error {
+    ttl := int(datalayer.NotificationDeliveryHistoryLifetime.Seconds())
+    err := conn.session.Query(`
+            INSERT INTO notification_deliveries (
+                device_id,
+                time_issued,
+                time,
+                channel,
+                error,
+                provider_id,
+                recipient,
+                status,
+                username)
+            VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+            USING TTL ?
+    `, delivery.DeviceID, delivery.TimeIssued,
+        gocql.UUIDFromTime(delivery.Time), delivery.Channel, delivery.Error,
+        delivery.ProviderID, delivery.Recipient, delivery.Status,
+        delivery.Username, ttl).Exec()
+    if err != nil {
+        logger.Error("Error recording notification delivery:", err)
+        return err
+    }
+    return nil
+}
+
+func (conn *CassConnection) SaveNotificationPrefs(prefs datalayer.NotificationPrefs) error {
+    err := conn.session.Query(`
+            INSERT INTO notification_prefs (
+                username,
+                channels,
+                email_delivery,
+                quiet_start,
+                quiet_end,
+                sms_number,
+                time_zone)
+            VALUES (?, ?, ?, ?, ?, ?, ?)
+    `, prefs.Username, prefs.Channels, prefs.EmailDelivery, prefs.QuietStart,
+        prefs.QuietEnd, prefs.SMSNumber, prefs.TimeZone).Exec()
+    if err != nil {
+        logger.Error("Error saving notification preferences:", err)
+        return err
+    }
+    return nil
+}
@@ -16,16 +16,15 @@
 package cassandra_datalayer
 
 import (
-    //"canopy/datalayer"
+    "canopy/datalayer"
     "github.com/gocql/gocql"
+    "strconv"
     "time"
-    //"canopy/sddl"
-    //"canopy/canolog"
-    "fmt"
 )
 
 
 type CassNotification struct {
+    conn *CassConnection
     deviceId gocql.UUID
     t time.Time
     isDismissed bool
@@ -33,12 +32,75 @@ type CassNotification struct {
     notifyType int
 }
 
+// Notification IDs are the time issued, in milliseconds since the epoch,
+// which is the resolution of the notifications table's key.
+func notificationID(t time.Time) string {
+    return strconv.FormatInt(t.UnixNano()/int64(time.Millisecond), 10)
+}
+
+func parseNotificationID(id string) (time.Time, error) {
+    ms, err := strconv.ParseInt(id, 10, 64)
+    if err != nil {
+        return time.Time{}, err
+    }
+    return time.Unix(0, ms*int64(time.Millisecond)), nil
+}
+
+// Read the rows of a query that selects device_id, time_issued, dismissed,
+// msg and notify_type from the notifications table.
+func scanNotifications(conn *CassConnection, iter *gocql.Iter) ([]datalayer.Notification, error) {
+    var uuid gocql.UUID
+    var timestamp time.Time
+    var dismissed bool
+    var msg string
+    var notifyType int
+
+    notifications := []datalayer.Notification{}
+    for iter.Scan(&uuid, &timestamp, &dismissed, &msg, &notifyType) {
+        notifications = append(notifications, &CassNotification{
+                conn, uuid, timestamp, dismissed, msg, notifyType})
+    }
+    if err := iter.Close(); err != nil {
+        return []datalayer.Notification{}, err
+    }
+    return notifications, nil
+}
+
 func (note *CassNotification) Datetime() time.Time {
     return note.t;
 }
 
 func (note *CassNotification) Dismiss() error {
-    return fmt.Errorf("Not implemented")
+    // Conditional, so that the unread count is only decremented once.
+    var currentDismissed bool
+    applied, err := note.conn.session.Query(`
+            UPDATE notifications
+            SET dismissed = true
+            WHERE device_id = ? AND time_issued = ?
+            IF dismissed = false
+    `, note.deviceId, note.t).ScanCAS(&currentDismissed)
+    if err != nil {
+        logger.Error("Error dismissing notification:", err)
+        return err
+    }
+    note.isDismissed = true
+    if !applied {
+        return nil
+    }
+    err = note.conn.session.Query(`
+            UPDATE notification_counts
+            SET unread = unread - 1
+            WHERE device_id = ?
+    `, note.deviceId).Exec()
+    if err != nil {
+        logger.Error("Error updating unread notification count:", err)
+        return err
+    }
+    return nil
+}
+
+func (note *CassNotification) ID() string {
+    return notificationID(note.t)
 }
 
 func (note *CassNotification) IsDismissed() bool {
@@ -0,0 +1,325 @@
+// Copyright 2015 SimpleThings, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package cassandra_datalayer
+
+import (
+    "canopy/datalayer"
+    "canopy/util/random"
+    "code.google.com/p/go.crypto/bcrypt"
+    "crypto/sha256"
+    "encoding/hex"
+    "github.com/gocql/gocql"
+    "time"
+)
+
+// Authorization codes, access tokens and refresh tokens are bearer
+// credentials, so only their SHA-256 hashes are stored in the database.
+// Client secrets are bcrypt hashed, like account passwords.
+
+type CassOAuthClient struct {
+    conn *CassConnection
+    clientId string
+    secretHash []byte
+    name string
+    ownerUsername string
+    redirectURIs []string
+}
+
+func (client *CassOAuthClient) ClientID() string {
+    return client.clientId
+}
+
+func (client *CassOAuthClient) IsPublic() bool {
+    return len(client.secretHash) == 0
+}
+
+func (client *CassOAuthClient) Name() string {
+    return client.name
+}
+
+func (client *CassOAuthClient) OwnerUsername() string {
+    return client.ownerUsername
+}
+
+func (client *CassOAuthClient) RedirectURIs() []string {
+    return client.redirectURIs
+}
+
+func (client *CassOAuthClient) VerifySecret(secret string) bool {
+    if client.IsPublic() {
+        return false
+    }
+    salt := client.conn.dl.cfg.OptPasswordSecretSalt()
+    err := bcrypt.CompareHashAndPassword(client.secretHash, []byte(secret + salt))
+    return (err == nil)
+}
+
+func hashOAuthToken(token string) string {
+    sum := sha256.Sum256([]byte(token))
+    return hex.EncodeToString(sum[:])
+}
+
+func (conn *CassConnection) CreateOAuthClient(
+        owner datalayer.Account,
+        name string,
+        redirectURIs []string,
+        public bool) (datalayer.OAuthClient, string, error) {
+
+    clientId, err := random.Base64URLString(18)
+    if err != nil {
+        return nil, "", err
+    }
+
+    secret := ""
+    secretHash := []byte{}
+    if !public {
+        secret, err = random.Base64URLString(32)
+        if err != nil {
+            return nil, "", err
+        }
+
+        salt := conn.dl.cfg.OptPasswordSecretSalt()
+        hashCost := conn.dl.cfg.OptPasswordHashCost()
+        secretHash, err = bcrypt.GenerateFromPassword([]byte(secret + salt), int(hashCost))
+        if err != nil {
+            return nil, "", err
+        }
+    }
+
+    err = conn.session.Query(`
+            INSERT INTO oauth_clients (
+                client_id,
+                client_secret_hash,
+                name,
+                owner_username,
+                redirect_uris)
+            VALUES (?, ?, ?, ?, ?)
+    `, clientId, secretHash, name, owner.Username(), redirectURIs).Exec()
+    if err != nil {
+        logger.Error("Error creating OAuth client:", err)
+        return nil, "", err
+    }
+
+    return &CassOAuthClient{
+        conn: conn,
+        clientId: clientId,
+        secretHash: secretHash,
+        name: name,
+        ownerUsername: owner.Username(),
+        redirectURIs: redirectURIs,
+    }, secret, nil
+}
+
+func (conn *CassConnection) LookupOAuthClient(clientId string) (datalayer.OAuthClient, error) {
+    client := CassOAuthClient{
+        conn: conn,
+        clientId: clientId,
+    }
+
+    err := conn.session.Query(`
+            SELECT client_secret_hash, name, owner_username, redirect_uris
+            FROM oauth_clients
+            WHERE client_id = ?
+            LIMIT 1
+    `, clientId).Consistency(gocql.One).Scan(
+            &client.secretHash,
+            &client.name,
+            &client.ownerUsername,
+            &client.redirectURIs)
+    if err != nil {
+        logger.Error("Error looking up OAuth client", err)
+        return nil, err
+    }
+
+    return &client, nil
+}
+
+func (conn *CassConnection) CreateOAuthAuthCode(grant datalayer.OAuthGrant) (string, error) {
+    code, err := random.Base64URLString(32)
+    if err != nil {
+        return "", err
+    }
+
+    expiry := time.Now().Add(datalayer.OAuthAuthCodeLifetime)
+    ttl := int(datalayer.OAuthAuthCodeLifetime.Seconds())
+
+    err = conn.session.Query(`
+            INSERT INTO oauth_auth_codes (
+                code_hash,
+                access_level,
+                client_id,
+                code_challenge,
+                code_challenge_method,
+                expiry,
+                redirect_uri,
+                scope,
+                username)
+            VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+            USING TTL ?
+    `, hashOAuthToken(code), grant.AccessLevel, grant.ClientID,
+        grant.CodeChallenge, grant.CodeChallengeMethod, expiry,
+        grant.RedirectURI, grant.Scope, grant.Username, ttl).Exec()
+    if err != nil {
+        logger.Error("Error creating OAuth authorization code:", err)
+        return "", err
+    }
+    return code, nil
+}
+
+func (conn *CassConnection) ConsumeOAuthAuthCode(code string) (*datalayer.OAuthGrant, error) {
+    var grant datalayer.OAuthGrant
+    var accessLevel int
+    codeHash := hashOAuthToken(code)
+
+    err := conn.session.Query(`
+            SELECT access_level, client_id, code_challenge,
+                code_challenge_method, expiry, redirect_uri, scope, username
+            FROM oauth_auth_codes
+            WHERE code_hash = ?
+            LIMIT 1
+    `, codeHash).Consistency(gocql.One).Scan(
+            &accessLevel,
+            &grant.ClientID,
+            &grant.CodeChallenge,
+            &grant.CodeChallengeMethod,
+            &grant.Expiry,
+            &grant.RedirectURI,
+            &grant.Scope,
+            &grant.Username)
+    if err != nil {
+        return nil, datalayer.InvalidOAuthGrantError
+    }
+    grant.AccessLevel = datalayer.AccessLevel(accessLevel)
+
+    // Use a lightweight transaction so that two concurrent token requests
+    // cannot both redeem the same code.
+    applied, err := conn.session.Query(`
+            DELETE FROM oauth_auth_codes
+            WHERE code_hash = ?
+            IF EXISTS
+    `, codeHash).ScanCAS()
+    if err != nil {
+        return nil, err
+    }
+    if !applied || grant.Expiry.Before(time.Now()) {
+        return nil, datalayer.InvalidOAuthGrantError
+    }
+
+    return &grant, nil
+}
+
+func (conn *CassConnection) insertOAuthToken(tokenType string, grant datalayer.OAuthGrant, lifetime time.Duration) (string, error) {
+    token, err := random.Base64URLString(32)
+    if err != nil {
+        return "", err
+    }
+
+    expiry := time.Now().Add(lifetime)
+    ttl := int(lifetime.Seconds())
+
+    err = conn.session.Query(`
+            INSERT INTO oauth_tokens (
+                token_hash,
+                token_type,
+                access_level,
+                client_id,
+                expiry,
+                scope,
+                username)
+            VALUES (?, ?, ?, ?, ?, ?, ?)
+            USING TTL ?
+    `, hashOAuthToken(token), tokenType, grant.AccessLevel, grant.ClientID,
+        expiry, grant.Scope, grant.Username, ttl).Exec()
+    if err != nil {
+        logger.Error("Error creating OAuth token:", err)
+        return "", err
+    }
+
+    // Index by username, so that an account's tokens can be revoked.
+    err = conn.session.Query(`
+            INSERT INTO oauth_tokens_by_user (username, token_hash)
+            VALUES (?, ?)
+            USING TTL ?
+    `, grant.Username, hashOAuthToken(token), ttl).Exec()
+    if err != nil {
+        logger.Error("Error indexing OAuth token:", err)
+        return "", err
+    }
+    return token, nil
+}
+
+func (conn *CassConnection) CreateOAuthTokens(grant datalayer.OAuthGrant) (string, string, error) {
+    accessToken, err := conn.insertOAuthToken("access", grant, datalayer.OAuthAccessTokenLifetime)
+    if err != nil {
+        return "", "", err
+    }
+
+    refreshToken, err := conn.insertOAuthToken("refresh", grant, datalayer.OAuthRefreshTokenLifetime)
+    if err != nil {
+        return "", "", err
+    }
+
+    return accessToken, refreshToken, nil
+}
+
+func (conn *CassConnection) lookupOAuthToken(tokenType, token string) (*datalayer.OAuthGrant, error) {
+    var grant datalayer.OAuthGrant
+    var accessLevel int
+    var storedType string
+
+    err := conn.session.Query(`
+            SELECT token_type, access_level, client_id, expiry, scope, username
+            FROM oauth_tokens
+            WHERE token_hash = ?
+            LIMIT 1
+    `, hashOAuthToken(token)).Consistency(gocql.One).Scan(
+            &storedType,
+            &accessLevel,
+            &grant.ClientID,
+            &grant.Expiry,
+            &grant.Scope,
+            &grant.Username)
+    if err != nil {
+        return nil, datalayer.InvalidOAuthGrantError
+    }
+    if storedType != tokenType || grant.Expiry.Before(time.Now()) {
+        return nil, datalayer.InvalidOAuthGrantError
+    }
+    grant.AccessLevel = datalayer.AccessLevel(accessLevel)
+    return &grant, nil
+}
+
+func (conn *CassConnection) LookupOAuthAccessToken(token string) (*datalayer.OAuthGrant, error) {
+    return conn.lookupOAuthToken("access", token)
+}
+
+func (conn *CassConnection) ConsumeOAuthRefreshToken(token string) (*datalayer.OAuthGrant, error) {
+    grant, err := conn.lookupOAuthToken("refresh", token)
+    if err != nil {
+        return nil, err
+    }
+
+    applied, err := conn.session.Query(`
+            DELETE FROM oauth_tokens
+            WHERE token_hash = ?
+            IF EXISTS
+    `, hashOAuthToken(token)).ScanCAS()
+    if err != nil {
+        return nil, err
+    }
+    if !applied {
+        return nil, datalayer.InvalidOAuthGrantError
+    }
+    return grant, nil
+}
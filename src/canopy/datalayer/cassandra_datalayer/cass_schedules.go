@@ -0,0 +1,232 @@
+// Copyright 2015 SimpleThings, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+package cassandra_datalayer
+
+import (
+    "canopy/datalayer"
+    "canopy/util/random"
+    "encoding/json"
+    "github.com/gocql/gocql"
+    "time"
+)
+
+// Schedules by NextRun.
+var schedulesDue = dueIndex{"schedules_due", []string{"device_id", "schedule_id"}}
+
+const scheduleColumns = `device_id, schedule_id, created, created_by, cron,
+        last_error, last_run, name, next_run, time_zone, vars`
+
+// Read the rows of a query that selects scheduleColumns.
+func scanSchedules(iter *gocql.Iter) ([]datalayer.Schedule, error) {
+    var schedule datalayer.Schedule
+    var varsJson string
+    schedules := []datalayer.Schedule{}
+
+    for iter.Scan(
+            &schedule.DeviceID,
+            &schedule.ID,
+            &schedule.Created,
+            &schedule.CreatedBy,
+            &schedule.Cron,
+            &schedule.LastError,
+            &schedule.LastRun,
+            &schedule.Name,
+            &schedule.NextRun,
+            &schedule.TimeZone,
+            &varsJson) {
+        err := json.Unmarshal([]byte(varsJson), &schedule.Vars)
+        if err != nil {
+            logger.Warn("Invalid vars for schedule ", schedule.ID, ": ", err)
+            schedule.Vars = map[string]interface{}{}
+        }
+        schedules = append(schedules, schedule)
+        schedule = datalayer.Schedule{}
+    }
+    if err := iter.Close(); err != nil {
+        return []datalayer.Schedule{}, err
+    }
+    return schedules, nil
+}
+
+func (conn *CassConnection) ClaimScheduleRun(schedule datalayer.Schedule, nextRun, now time.Time) (bool, error) {
+    // If the condition fails, the current value of "next_run" is returned.
+    var currentNextRun time.Time
+    applied, err := conn.session.Query(`
+            UPDATE schedules
+            SET next_run = ?,
+                last_run = ?
+            WHERE device_id = ? AND schedule_id = ?
+            IF next_run = ?
+    `, nextRun, now, schedule.DeviceID, schedule.ID,
+        schedule.NextRun).ScanCAS(&currentNextRun)
+    if err != nil {
+        logger.Error("Error claiming schedule run:", err)
+        return false, err
+    }
+    if applied {
+        if !nextRun.IsZero() {
+            conn.addDueEntry(schedulesDue, nextRun, schedule.DeviceID, schedule.ID)
+        }
+        conn.removeDueEntry(schedulesDue, schedule.NextRun, schedule.DeviceID, schedule.ID)
+    }
+    return applied, nil
+}
+
+func (conn *CassConnection) CreateSchedule(schedule datalayer.Schedule) (*datalayer.Schedule, error) {
+    var err error
+    schedule.ID, err = random.Base64URLString(12)
+    if err != nil {
+        return nil, err
+    }
+    schedule.Created = time.Now().UTC()
+    schedule.LastRun = time.Time{}
+    schedule.LastError = ""
+
+    varsJson, err := json.Marshal(schedule.Vars)
+    if err != nil {
+        return nil, err
+    }
+
+    batch := conn.session.NewBatch(gocql.LoggedBatch)
+    batch.Query(`
+            INSERT INTO schedules (
+                device_id,
+                schedule_id,
+                created,
+                created_by,
+                cron,
+                name,
+                next_run,
+                time_zone,
+                vars)
+            VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+    `, schedule.DeviceID, schedule.ID, schedule.Created, schedule.CreatedBy,
+        schedule.Cron, schedule.Name, schedule.NextRun, schedule.TimeZone,
+        string(varsJson))
+    if !schedule.NextRun.IsZero() {
+        batch.Query(schedulesDue.insertStatement(),
+            dueIndexValues(schedule.NextRun, schedule.DeviceID, schedule.ID)...)
+    }
+    err = conn.session.ExecuteBatch(batch)
+    if err != nil {
+        logger.Error("Error creating schedule:", err)
+        return nil, err
+    }
+    return &schedule, nil
+}
+
+func (conn *CassConnection) DeleteSchedule(deviceId gocql.UUID, scheduleId string) error {
+    err := conn.session.Query(`
+            DELETE FROM schedules
+            WHERE device_id = ? AND schedule_id = ?
+    `, deviceId, scheduleId).Exec()
+    if err != nil {
+        logger.Error("Error deleting schedule:", err)
+        return err
+    }
+    return nil
+}
+
+func (conn *CassConnection) DueSchedules(since, until time.Time) ([]datalayer.Schedule, error) {
+    var deviceId gocql.UUID
+    var scheduleId string
+    schedules := []datalayer.Schedule{}
+    seen := map[string]bool{}
+    err := conn.scanDueIndex(schedulesDue, since, until, []interface{}{&deviceId, &scheduleId}, func(indexed time.Time) {
+        schedule, err := conn.LookupSchedule(deviceId, scheduleId)
+        if err == gocql.ErrNotFound {
+            conn.removeDueEntry(schedulesDue, indexed, deviceId, scheduleId)
+            return
+        } else if err != nil {
+            return
+        }
+        key := deviceId.String() + "/" + scheduleId
+        if conn.updateDueEntry(schedulesDue, indexed, schedule.NextRun, until, deviceId, scheduleId) && !seen[key] {
+            seen[key] = true
+            schedules = append(schedules, *schedule)
+        }
+    })
+    return schedules, err
+}
+
+func (conn *CassConnection) LookupSchedule(deviceId gocql.UUID, scheduleId string) (*datalayer.Schedule, error) {
+    iter := conn.session.Query(`
+            SELECT ` + scheduleColumns + `
+            FROM schedules
+            WHERE device_id = ? AND schedule_id = ?
+            LIMIT 1
+    `, deviceId, scheduleId).Consistency(gocql.One).Iter()
+    schedules, err := scanSchedules(iter)
+    if err != nil {
+        return nil, err
+    }
+    if len(schedules) == 0 {
+        return nil, gocql.ErrNotFound
+    }
+    return &schedules[0], nil
+}
+
+func (conn *CassConnection) RecordScheduleResult(deviceId gocql.UUID, scheduleId, errMsg string) error {
+    err := conn.session.Query(`
+            UPDATE schedules
+            SET last_error = ?
+            WHERE device_id = ? AND schedule_id = ?
+    `, errMsg, deviceId, scheduleId).Exec()
+    if err != nil {
+        logger.Error("Error recording schedule result:", err)
+        return err
+    }
+    return nil
+}
+
+func (conn *CassConnection) Schedules(deviceId gocql.UUID) ([]datalayer.Schedule, error) {
+    iter := conn.session.Query(`
+            SELECT ` + scheduleColumns + `
+            FROM schedules
+            WHERE device_id = ?
+    `, deviceId).Consistency(gocql.One).Iter()
+    return scanSchedules(iter)
+}
+
+func (conn *CassConnection) UpdateSchedule(schedule datalayer.Schedule, oldNextRun time.Time) (bool, error) {
+    varsJson, err := json.Marshal(schedule.Vars)
+    if err != nil {
+        return false, err
+    }
+    // If the condition fails, the current value of "next_run" is returned.
+    var currentNextRun time.Time
+    applied, err := conn.session.Query(`
+            UPDATE schedules
+            SET name = ?,
+                vars = ?,
+                cron = ?,
+                time_zone = ?,
+                next_run = ?
+            WHERE device_id = ? AND schedule_id = ?
+            IF next_run = ?
+    `, schedule.Name, string(varsJson), schedule.Cron, schedule.TimeZone,
+        schedule.NextRun, schedule.DeviceID, schedule.ID,
+        oldNextRun).ScanCAS(&currentNextRun)
+    if err != nil {
+        logger.Error("Error updating schedule:", err)
+        return false, err
+    }
+    // An entry for the old NextRun is removed when it comes due.
+    if applied && !schedule.NextRun.IsZero() {
+        conn.addDueEntry(schedulesDue, schedule.NextRun, schedule.DeviceID, schedule.ID)
+    }
+    return applied, nil
+}
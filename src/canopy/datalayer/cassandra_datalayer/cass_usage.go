@@ -0,0 +1,156 @@
+// Copyright 2015 SimpleThings, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cassandra_datalayer
+
+import (
+    "github.com/gocql/gocql"
+    "sync"
+    "time"
+)
+
+// Usage counters are bucketed by UTC day, so each day starts from zero
+// without needing to reset anything.  Counters can't expire, so the
+// principals with counters on each day are listed in daily_usage_principals,
+// and PurgeDailyUsage deletes past days' counters.
+func usageDay(t time.Time) string {
+    return t.UTC().Format("2006-01-02")
+}
+
+// Principals this process has already listed in daily_usage_principals for
+// <day>, so that it is only written once per principal per day.
+var usageListed = struct {
+    sync.Mutex
+    day string
+    principals map[string]bool
+}{}
+
+func (conn *CassConnection) listUsagePrincipal(principal, day string) error {
+    usageListed.Lock()
+    if usageListed.day != day {
+        usageListed.day = day
+        usageListed.principals = map[string]bool{}
+    }
+    listed := usageListed.principals[principal]
+    usageListed.Unlock()
+    if listed {
+        return nil
+    }
+
+    err := conn.session.Query(`
+            INSERT INTO daily_usage_principals (day, principal)
+            VALUES (?, ?)
+    `, day, principal).Exec()
+    if err != nil {
+        return err
+    }
+    usageListed.Lock()
+    if usageListed.day == day {
+        usageListed.principals[principal] = true
+    }
+    usageListed.Unlock()
+    return nil
+}
+
+func (conn *CassConnection) AddDailyUsage(principal, metric string, delta int64) error {
+    day := usageDay(time.Now())
+    err := conn.listUsagePrincipal(principal, day)
+    if err != nil {
+        logger.Error("Error listing usage for ", principal, ": ", err)
+        return err
+    }
+    err = conn.session.Query(`
+            UPDATE daily_usage
+            SET count = count + ?
+            WHERE principal = ? AND day = ? AND metric = ?
+    `, delta, principal, day, metric).Exec()
+    if err != nil {
+        logger.Error("Error updating usage for ", principal, ": ", err)
+    }
+    return err
+}
+
+func (conn *CassConnection) DailyUsage(principal string) (map[string]int64, error) {
+    var metric string
+    var count int64
+    out := map[string]int64{}
+
+    iter := conn.session.Query(`
+            SELECT metric, count FROM daily_usage
+            WHERE principal = ? AND day = ?
+    `, principal, usageDay(time.Now())).Consistency(gocql.One).Iter()
+    for iter.Scan(&metric, &count) {
+        out[metric] = count
+    }
+    if err := iter.Close(); err != nil {
+        return nil, err
+    }
+    return out, nil
+}
+
+func (conn *CassConnection) PurgeDailyUsage(before time.Time) error {
+    // There are only ever a few days in daily_usage_principals, since each
+    // one is removed once it has been purged.
+    var day string
+    days := []string{}
+    iter := conn.session.Query(`
+            SELECT DISTINCT day FROM daily_usage_principals
+    `).Consistency(gocql.One).Iter()
+    for iter.Scan(&day) {
+        days = append(days, day)
+    }
+    if err := iter.Close(); err != nil {
+        logger.Error("Error reading usage days: ", err)
+        return err
+    }
+
+    beforeDay := usageDay(before)
+    for _, day := range days {
+        // Days are formatted YYYY-MM-DD, so they sort as strings.
+        if day >= beforeDay {
+            continue
+        }
+
+        var principal string
+        iter := conn.session.Query(`
+                SELECT principal FROM daily_usage_principals
+                WHERE day = ?
+        `, day).Consistency(gocql.One).Iter()
+        for iter.Scan(&principal) {
+            err := conn.session.Query(`
+                    DELETE FROM daily_usage
+                    WHERE principal = ? AND day = ?
+            `, principal, day).Exec()
+            if err != nil {
+                iter.Close()
+                logger.Error("Error purging usage for ", principal, ": ", err)
+                return err
+            }
+        }
+        if err := iter.Close(); err != nil {
+            logger.Error("Error reading usage principals: ", err)
+            return err
+        }
+
+        err := conn.session.Query(`
+                DELETE FROM daily_usage_principals
+                WHERE day = ?
+        `, day).Exec()
+        if err != nil {
+            logger.Error("Error purging usage day ", day, ": ", err)
+            return err
+        }
+    }
+    return nil
+}
@@ -0,0 +1,208 @@
+// Copyright 2015 SimpleThings, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cassandra_datalayer
+
+import (
+    "canopy/datalayer"
+    "canopy/util/random"
+    "github.com/gocql/gocql"
+    "time"
+)
+
+func (conn *CassConnection) CreateWebhook(hook datalayer.Webhook) (*datalayer.Webhook, error) {
+    var err error
+    hook.ID, err = random.Base64URLString(12)
+    if err != nil {
+        return nil, err
+    }
+    hook.Secret, err = random.Base64URLString(32)
+    if err != nil {
+        return nil, err
+    }
+    hook.Created = time.Now().UTC()
+
+    err = conn.session.Query(`
+            INSERT INTO webhooks (
+                username,
+                webhook_id,
+                created,
+                device_ids,
+                event_types,
+                notify_types,
+                secret,
+                url,
+                var_names)
+            VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+    `, hook.Username, hook.ID, hook.Created, hook.DeviceIDs, hook.EventTypes,
+        hook.NotifyTypes, hook.Secret, hook.URL, hook.VarNames).Exec()
+    if err != nil {
+        logger.Error("Error creating webhook:", err)
+        return nil, err
+    }
+    return &hook, nil
+}
+
+func (conn *CassConnection) DeleteWebhook(username, webhookId string) error {
+    for _, table := range []string{"webhook_deliveries", "webhook_dead_letters"} {
+        err := conn.session.Query(`
+                DELETE FROM ` + table + `
+                WHERE webhook_id = ?
+        `, webhookId).Exec()
+        if err != nil {
+            logger.Error("Error deleting from ", table, ": ", err)
+            return err
+        }
+    }
+
+    err := conn.session.Query(`
+            DELETE FROM webhooks
+            WHERE username = ? AND webhook_id = ?
+    `, username, webhookId).Exec()
+    if err != nil {
+        logger.Error("Error deleting webhook:", err)
+        return err
+    }
+    return nil
+}
+
+func (conn *CassConnection) LookupWebhook(username, webhookId string) (*datalayer.Webhook, error) {
+    hook := datalayer.Webhook{
+        ID: webhookId,
+        Username: username,
+    }
+
+    err := conn.session.Query(`
+            SELECT created, device_ids, event_types, notify_types, secret,
+                url, var_names
+            FROM webhooks
+            WHERE username = ? AND webhook_id = ?
+            LIMIT 1
+    `, username, webhookId).Consistency(gocql.One).Scan(
+            &hook.Created,
+            &hook.DeviceIDs,
+            &hook.EventTypes,
+            &hook.NotifyTypes,
+            &hook.Secret,
+            &hook.URL,
+            &hook.VarNames)
+    if err != nil {
+        return nil, err
+    }
+    return &hook, nil
+}
+
+func (conn *CassConnection) Webhooks(username string) ([]datalayer.Webhook, error) {
+    var hook datalayer.Webhook
+    hooks := []datalayer.Webhook{}
+
+    iter := conn.session.Query(`
+            SELECT webhook_id, created, device_ids, event_types, notify_types,
+                secret, url, var_names
+            FROM webhooks
+            WHERE username = ?
+    `, username).Consistency(gocql.One).Iter()
+    for iter.Scan(
+            &hook.ID,
+            &hook.Created,
+            &hook.DeviceIDs,
+            &hook.EventTypes,
+            &hook.NotifyTypes,
+            &hook.Secret,
+            &hook.URL,
+            &hook.VarNames) {
+        hook.Username = username
+        hooks = append(hooks, hook)
+        hook = datalayer.Webhook{}
+    }
+    if err := iter.Close(); err != nil {
+        return []datalayer.Webhook{}, err
+    }
+    return hooks, nil
+}
+
+func (conn *CassConnection) RecordWebhookDelivery(delivery datalayer.WebhookDelivery) error {
+    tables := []string{"webhook_deliveries"}
+    if delivery.Status == datalayer.WebhookDeliveryDead {
+        tables = append(tables, "webhook_dead_letters")
+    }
+    ttl := int(datalayer.WebhookDeliveryHistoryLifetime.Seconds())
+
+    for _, table := range tables {
+        err := conn.session.Query(`
+                INSERT INTO ` + table + ` (
+                    webhook_id,
+                    time,
+                    attempt,
+                    delivery_id,
+                    device_id,
+                    error,
+                    event_type,
+                    payload,
+                    response_code,
+                    status)
+                VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+                USING TTL ?
+        `, delivery.WebhookID, gocql.UUIDFromTime(delivery.Time),
+            delivery.Attempt, delivery.DeliveryID, delivery.DeviceID,
+            delivery.Error, delivery.EventType, delivery.Payload,
+            delivery.ResponseCode, delivery.Status, ttl).Exec()
+        if err != nil {
+            logger.Error("Error recording webhook delivery in ", table, ": ", err)
+            return err
+        }
+    }
+    return nil
+}
+
+func (conn *CassConnection) webhookDeliveryLog(table, webhookId string, limit int) ([]datalayer.WebhookDelivery, error) {
+    var delivery datalayer.WebhookDelivery
+    var t gocql.UUID
+    deliveries := []datalayer.WebhookDelivery{}
+
+    iter := conn.session.Query(`
+            SELECT time, attempt, delivery_id, device_id, error, event_type,
+                payload, response_code, status
+            FROM ` + table + `
+            WHERE webhook_id = ?
+            LIMIT ?
+    `, webhookId, limit).Consistency(gocql.One).Iter()
+    for iter.Scan(
+            &t,
+            &delivery.Attempt,
+            &delivery.DeliveryID,
+            &delivery.DeviceID,
+            &delivery.Error,
+            &delivery.EventType,
+            &delivery.Payload,
+            &delivery.ResponseCode,
+            &delivery.Status) {
+        delivery.WebhookID = webhookId
+        delivery.Time = t.Time()
+        deliveries = append(deliveries, delivery)
+        delivery = datalayer.WebhookDelivery{}
+    }
+    if err := iter.Close(); err != nil {
+        return []datalayer.WebhookDelivery{}, err
+    }
+    return deliveries, nil
+}
+
+func (conn *CassConnection) WebhookDeadLetters(webhookId string, limit int) ([]datalayer.WebhookDelivery, error) {
+    return conn.webhookDeliveryLog("webhook_dead_letters", webhookId, limit)
+}
+
+func (conn *CassConnection) WebhookDeliveries(webhookId string, limit int) ([]datalayer.WebhookDelivery, error) {
+    return conn.webhookDeliveryLog("webhook_deliveries", webhookId, limit)
+}
@@ -18,6 +18,8 @@ import (
     "github.com/gocql/gocql"
 )
 
+var logger = canolog.Subsystem("datalayer")
+
 var migrationQueries []string = []string{
     // Add var_sample_counts table
     `CREATE TABLE var_sample_counts (
@@ -42,10 +44,10 @@ var migrationQueries []string = []string{
 func Migrate_0_9_0_to_0_9_1(session *gocql.Session) error {
     // Perform all migration queries.
     for _, query := range migrationQueries {
-        canolog.Info(query)
+        logger.Info(query)
         if err := session.Query(query).Exec(); err != nil {
             // Ignore errors (just print them).
-            canolog.Warn(query, ": ", err)
+            logger.Warn(query, ": ", err)
             return err
         }
     }
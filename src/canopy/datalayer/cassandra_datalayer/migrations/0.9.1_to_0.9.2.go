@@ -0,0 +1,368 @@
+// Copyright 2015 SimpleThings, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package migrations
+
+import (
+    "github.com/gocql/gocql"
+)
+
+var migrationQueries_0_9_1_to_0_9_2 []string = []string{
+    // Add OAuth2 authorization server tables
+    `CREATE TABLE oauth_clients (
+        client_id text,
+        client_secret_hash blob,
+        name text,
+        owner_username text,
+        redirect_uris list<text>,
+        PRIMARY KEY(client_id)
+    )`,
+
+    `CREATE TABLE oauth_auth_codes (
+        code_hash text,
+        access_level int,
+        client_id text,
+        code_challenge text,
+        code_challenge_method text,
+        expiry timestamp,
+        redirect_uri text,
+        scope text,
+        username text,
+        PRIMARY KEY(code_hash)
+    )`,
+
+    `CREATE TABLE oauth_tokens (
+        token_hash text,
+        token_type text,
+        access_level int,
+        client_id text,
+        expiry timestamp,
+        scope text,
+        username text,
+        PRIMARY KEY(token_hash)
+    )`,
+
+    // Add TOTP two-factor authentication
+    `ALTER TABLE accounts ADD totp_enabled boolean`,
+    `ALTER TABLE accounts ADD totp_secret text`,
+    `ALTER TABLE accounts ADD totp_pending_secret text`,
+    `ALTER TABLE accounts ADD totp_last_step bigint`,
+
+    `CREATE TABLE account_recovery_codes (
+        username text,
+        code_hash text,
+        PRIMARY KEY(username, code_hash)
+    )`,
+
+    `CREATE TABLE account_app_passwords (
+        username text,
+        name text,
+        password_hash blob,
+        created timestamp,
+        PRIMARY KEY(username, name)
+    )`,
+
+    // Add email address change verification
+    `ALTER TABLE accounts ADD pending_email text`,
+    `ALTER TABLE accounts ADD email_change_code text`,
+    `ALTER TABLE accounts ADD email_change_code_expiry timestamp`,
+
+    // Add account deletion support
+    `ALTER TABLE accounts ADD sessions_valid_after timestamp`,
+
+    `CREATE TABLE device_permissions_by_device (
+        device_id uuid,
+        username text,
+        access_level int,
+        PRIMARY KEY(device_id, username)
+    )`,
+
+    `CREATE INDEX ON oauth_clients (owner_username)`,
+
+    `CREATE TABLE oauth_tokens_by_user (
+        username text,
+        token_hash text,
+        PRIMARY KEY(username, token_hash)
+    )`,
+
+    // Add quota usage counters
+    `CREATE TABLE daily_usage (
+        principal text,
+        day text,
+        metric text,
+        count counter,
+        PRIMARY KEY((principal, day), metric)
+    )`,
+
+    `CREATE TABLE daily_usage_principals (
+        day text,
+        principal text,
+        PRIMARY KEY(day, principal)
+    )`,
+
+    // Add outbound webhooks
+    `CREATE TABLE webhooks (
+        username text,
+        webhook_id text,
+        created timestamp,
+        device_ids list<text>,
+        event_types list<text>,
+        notify_types list<text>,
+        secret text,
+        url text,
+        var_names list<text>,
+        PRIMARY KEY(username, webhook_id)
+    )`,
+
+    `CREATE TABLE webhook_deliveries (
+        webhook_id text,
+        time timeuuid,
+        attempt int,
+        delivery_id text,
+        device_id text,
+        error text,
+        event_type text,
+        payload text,
+        response_code int,
+        status text,
+        PRIMARY KEY(webhook_id, time)
+    ) WITH CLUSTERING ORDER BY (time DESC)`,
+
+    `CREATE TABLE webhook_dead_letters (
+        webhook_id text,
+        time timeuuid,
+        attempt int,
+        delivery_id text,
+        device_id text,
+        error text,
+        event_type text,
+        payload text,
+        response_code int,
+        status text,
+        PRIMARY KEY(webhook_id, time)
+    ) WITH CLUSTERING ORDER BY (time DESC)`,
+
+    // Add alarm rules
+    `CREATE TABLE alarm_rules (
+        device_id uuid,
+        rule_id text,
+        bool_value boolean,
+        created timestamp,
+        created_by text,
+        duration_ms bigint,
+        firing boolean,
+        hysteresis double,
+        last_fired timestamp,
+        last_sample_time timestamp,
+        last_value double,
+        message text,
+        name text,
+        notify_type text,
+        operator text,
+        pending_since timestamp,
+        rule_type text,
+        threshold double,
+        var_name text,
+        PRIMARY KEY(device_id, rule_id)
+    )`,
+
+    // Index alarm rules by when they need checking
+    `CREATE TABLE alarm_rules_due (
+        bucket timestamp,
+        due timestamp,
+        device_id uuid,
+        rule_id text,
+        PRIMARY KEY(bucket, due, device_id, rule_id)
+    )`,
+
+    // Add schedules
+    `CREATE TABLE schedules (
+        device_id uuid,
+        schedule_id text,
+        created timestamp,
+        created_by text,
+        cron text,
+        last_error text,
+        last_run timestamp,
+        name text,
+        next_run timestamp,
+        time_zone text,
+        vars text,
+        PRIMARY KEY(device_id, schedule_id)
+    )`,
+
+    `CREATE TABLE schedules_due (
+        bucket timestamp,
+        due timestamp,
+        device_id uuid,
+        schedule_id text,
+        PRIMARY KEY(bucket, due, device_id, schedule_id)
+    )`,
+
+    // Add notification preferences and delivery queue
+    `CREATE TABLE notification_prefs (
+        username text,
+        channels map<text, text>,
+        email_delivery text,
+        quiet_start int,
+        quiet_end int,
+        sms_number text,
+        time_zone text,
+        PRIMARY KEY(username)
+    )`,
+
+    `CREATE TABLE queued_notifications (
+        username text,
+        queued_id timeuuid,
+        channel text,
+        device_id uuid,
+        device_name text,
+        due timestamp,
+        msg text,
+        notify_type text,
+        time_issued timestamp,
+        PRIMARY KEY(username, queued_id)
+    )`,
+
+    `CREATE TABLE queued_notifications_due (
+        bucket timestamp,
+        due timestamp,
+        username text,
+        queued_id timeuuid,
+        PRIMARY KEY(bucket, due, username, queued_id)
+    )`,
+
+    // Add unread notification counts
+    `CREATE TABLE notification_counts (
+        device_id uuid,
+        unread counter,
+        PRIMARY KEY(device_id)
+    )`,
+
+    // Add push tokens and notification delivery records
+    `CREATE TABLE push_tokens (
+        username text,
+        token text,
+        created timestamp,
+        platform text,
+        PRIMARY KEY(username, token)
+    )`,
+
+    `CREATE TABLE notification_deliveries (
+        device_id uuid,
+        time_issued timestamp,
+        time timeuuid,
+        channel text,
+        error text,
+        provider_id text,
+        recipient text,
+        status text,
+        username text,
+        PRIMARY KEY(device_id, time_issued, time)
+    )`,
+
+    // Add mail outbox
+    `CREATE TABLE mail_outbox (
+        mail_id timeuuid,
+        attempts int,
+        created timestamp,
+        dedup_key text,
+        from_email text,
+        from_name text,
+        html text,
+        last_error text,
+        next_attempt timestamp,
+        reply_to text,
+        sent timestamp,
+        status text,
+        subject text,
+        text text,
+        to_emails list<text>,
+        to_names list<text>,
+        PRIMARY KEY(mail_id)
+    )`,
+
+    `CREATE TABLE mail_outbox_dedup (
+        dedup_key text,
+        mail_id timeuuid,
+        PRIMARY KEY(dedup_key)
+    )`,
+
+    `CREATE TABLE mail_outbox_due (
+        bucket timestamp,
+        due timestamp,
+        mail_id timeuuid,
+        PRIMARY KEY(bucket, due, mail_id)
+    )`,
+
+    // Add account language, for localized email
+    `ALTER TABLE accounts ADD language text`,
+}
+
+func Migrate_0_9_1_to_0_9_2(session *gocql.Session) error {
+    // Perform all migration queries.
+    for _, query := range migrationQueries_0_9_1_to_0_9_2 {
+        logger.Info(query)
+        if err := session.Query(query).Exec(); err != nil {
+            logger.Warn(query, ": ", err)
+            return err
+        }
+    }
+
+    // Populate the new device_permissions_by_device index.
+    var username string
+    var deviceId gocql.UUID
+    var accessLevel int
+    iter := session.Query(`
+            SELECT username, device_id, access_level FROM device_permissions
+    `).Iter()
+    for iter.Scan(&username, &deviceId, &accessLevel) {
+        err := session.Query(`
+                INSERT INTO device_permissions_by_device (device_id, username, access_level)
+                VALUES (?, ?, ?)
+        `, deviceId, username, accessLevel).Exec()
+        if err != nil {
+            logger.Warn("Error indexing device permission: ", err)
+            iter.Close()
+            return err
+        }
+    }
+    if err := iter.Close(); err != nil {
+        return err
+    }
+
+    // Count the undismissed notifications of each device.
+    var dismissed bool
+    iter = session.Query(`
+            SELECT device_id, dismissed FROM notifications
+    `).Iter()
+    for iter.Scan(&deviceId, &dismissed) {
+        if dismissed {
+            continue
+        }
+        err := session.Query(`
+                UPDATE notification_counts
+                SET unread = unread + 1
+                WHERE device_id = ?
+        `, deviceId).Exec()
+        if err != nil {
+            logger.Warn("Error counting notifications: ", err)
+            iter.Close()
+            return err
+        }
+    }
+    if err := iter.Close(); err != nil {
+        return err
+    }
+    return nil
+}
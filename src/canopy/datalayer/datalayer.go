@@ -21,9 +21,32 @@ import (
     "github.com/gocql/gocql"
     "time"
     "errors"
+    "regexp"
 )
 
 var InvalidPasswordError = errors.New("Incorrect password")
+var EmailTakenError = errors.New("Email address already in use")
+var InvalidEmailChangeCodeError = errors.New("Invalid or expired email change code")
+var InvalidOAuthGrantError = errors.New("Invalid or expired OAuth grant")
+var InvalidTOTPCodeError = errors.New("Incorrect two-factor authentication code")
+
+// Valid account languages: BCP 47-style tags such as "en" or "pt-br",
+// normalized to lowercase.  Email templates are stored in directories named
+// after them.
+var LanguagePattern = regexp.MustCompile(`^[a-z]{2,3}(-[a-z0-9]{2,8})*$`)
+
+// Lifetimes of the tokens issued by the OAuth2 authorization server.
+const (
+    OAuthAuthCodeLifetime = 10*time.Minute
+    OAuthAccessTokenLifetime = time.Hour
+    OAuthRefreshTokenLifetime = 30*24*time.Hour
+)
+
+// Background workers find the rows that are due (alarm rules to check,
+// schedules to run and so on) by the time they are due, rather than by
+// reading whole tables.  When a worker starts, it looks this far back for
+// rows that became due while no server was running.
+const DueIndexLookback = 7*24*time.Hour
 
 // AccessLevel is the access permissions an account has for a device.
 type AccessLevel int
@@ -69,6 +92,37 @@ type Datalayer interface {
 
 // Connection is a connection to the database.
 type Connection interface {
+    // Add <delta> to today's (UTC) usage counter <metric> for <principal>.
+    // Principals are strings such as "account:<username>" or
+    // "device:<uuid>".  Used for enforcing daily quotas.
+    AddDailyUsage(principal, metric string, delta int64) error
+
+    // Register a mobile device to receive push notifications for
+    // <token.Username>.  Registering a token again replaces it.
+    AddPushToken(token PushToken) error
+
+    // Get all of a device's alarm rules, including their evaluation state.
+    AlarmRules(deviceId gocql.UUID) ([]AlarmRule, error)
+
+    // Get every message in the mail outbox, including recently sent and
+    // failed ones.  This reads the whole table, so it is only meant for
+    // admin tools.
+    AllOutboxMail() ([]OutboxMail, error)
+
+    // Start another attempt at sending <mail>, incrementing its Attempts
+    // and setting its NextAttempt to <nextAttempt> in case this attempt
+    // fails.  The update only happens if the stored Attempts still equals
+    // mail.Attempts, so that when several servers see the same message only
+    // one of them sends it.  Returns false if the update did not happen.
+    ClaimOutboxMailAttempt(mail OutboxMail, nextAttempt time.Time) (bool, error)
+
+    // Claim the run of <schedule> that is due at schedule.NextRun, setting
+    // its NextRun to <nextRun> (zero if it has no more runs) and its LastRun
+    // to <now>.  The update only happens if the stored NextRun still equals
+    // schedule.NextRun, so that when several servers check the same schedule
+    // only one of them runs it.  Returns false if the update did not happen.
+    ClaimScheduleRun(schedule Schedule, nextRun, now time.Time) (bool, error)
+
     // Truncate all sensor data from the database.  Use with care!
     ClearSensorData()
 
@@ -76,16 +130,117 @@ type Connection interface {
     // interface will return an error.
     Close()
 
+    // Lookup and invalidate an OAuth authorization code.  Each code can only
+    // be consumed once.  Returns InvalidOAuthGrantError if the code is
+    // unknown, expired or has already been used.
+    ConsumeOAuthAuthCode(code string) (*OAuthGrant, error)
+
+    // Lookup and invalidate an OAuth refresh token.  Refresh tokens are
+    // rotated, so each one can only be consumed once.  Returns
+    // InvalidOAuthGrantError if the token is unknown, expired or has already
+    // been used.
+    ConsumeOAuthRefreshToken(token string) (*OAuthGrant, error)
+
     // Create a new user account in the database.
     CreateAccount(username, email, password string) (Account, error)
 
+    // Create a new alarm rule.  <rule>'s ID and Created fields are assigned
+    // by the implementation, and its evaluation state starts out clear.
+    CreateAlarmRule(rule AlarmRule) (*AlarmRule, error)
+
     // Create a new device in the database.  If <uuid> is nil, then the
     // implementation will assign a newly created UUID.  If <secretKey> is nil,
     // then the implementation will assign a newly created Secret Key.
     CreateDevice(name string, uuid *gocql.UUID, secretKey string, publicAccessLevel AccessLevel) (Device, error)
 
-    // Remove a user account from the database.
-    DeleteAccount(username string)
+    // Create a new single-use OAuth authorization code for <grant>.  The
+    // code expires after OAuthAuthCodeLifetime.
+    CreateOAuthAuthCode(grant OAuthGrant) (code string, err error)
+
+    // Register a new third-party OAuth client application owned by <owner>.
+    // If <public> is false, a client secret is generated and returned.  The
+    // secret is only stored hashed, so this is the only chance to read it.
+    CreateOAuthClient(owner Account, name string, redirectURIs []string, public bool) (client OAuthClient, secret string, err error)
+
+    // Issue a new access token and refresh token for <grant>.  The grant's
+    // Expiry is ignored; lifetimes are OAuthAccessTokenLifetime and
+    // OAuthRefreshTokenLifetime.
+    CreateOAuthTokens(grant OAuthGrant) (accessToken, refreshToken string, err error)
+
+    // Create a new schedule.  <schedule>'s ID and Created fields are
+    // assigned by the implementation.
+    CreateSchedule(schedule Schedule) (*Schedule, error)
+
+    // Create a new webhook subscription.  <hook>'s ID, Secret and Created
+    // fields are assigned by the implementation and should be left empty.
+    CreateWebhook(hook Webhook) (*Webhook, error)
+
+    // Get all of today's (UTC) usage counters for <principal>, keyed by
+    // metric name.
+    DailyUsage(principal string) (map[string]int64, error)
+
+    // Remove a user account and everything belonging to it from the
+    // database.  Devices that no other account has access to are deleted.
+    // Devices shared with other accounts are kept, and if none of those
+    // accounts has read-write access, one of them is given it.  Also removes
+    // the account's device permissions, OAuth clients and tokens, app
+    // passwords, recovery codes, webhooks and notification preferences.
+    // Existing login sessions for the username stop working, even if the
+    // username is registered again.
+    //
+    // The account record itself is removed last, so if an error occurs
+    // this can safely be called again.
+    DeleteAccount(username string) error
+
+    // Remove one of a device's alarm rules.
+    DeleteAlarmRule(deviceId gocql.UUID, ruleId string) error
+
+    // Remove a device and all of its data (samples, notifications, alarm
+    // rules, schedules and permissions) from the database.
+    DeleteDevice(deviceId gocql.UUID) error
+
+    // Remove a notification from <username>'s delivery queue.  Returns false
+    // if it had already been removed, so that when several servers deliver
+    // queued notifications each one is only delivered once.
+    DeleteQueuedNotification(username string, queuedId gocql.UUID) (bool, error)
+
+    // Stop sending push notifications to <token>.  Does nothing if it isn't
+    // registered.
+    DeletePushToken(username, token string) error
+
+    // Remove one of a device's schedules.
+    DeleteSchedule(deviceId gocql.UUID, scheduleId string) error
+
+    // Remove one of <username>'s webhooks, along with its delivery history.
+    DeleteWebhook(username, webhookId string) error
+
+    // Get the alarm rules that need checking, without a new sample, by
+    // <until> (see AlarmRule.NextCheck).  Rules that became due long before
+    // <since> may be missed, so <since> should be the time of the previous
+    // call.
+    DueAlarmRules(since, until time.Time) ([]AlarmRule, error)
+
+    // Get the usernames of accounts that have queued notifications due at
+    // or before <until>.  Notifications that became due long before
+    // <since> may be missed, so <since> should be the time of the previous
+    // call.
+    DueNotificationUsernames(since, until time.Time) ([]string, error)
+
+    // Get the pending messages in the mail outbox whose NextAttempt is at
+    // or before <until>.  Messages that became due long before <since> may
+    // be missed, so <since> should be the time of the previous call.
+    DueOutboxMail(since, until time.Time) ([]OutboxMail, error)
+
+    // Get the schedules whose NextRun is at or before <until>.  Schedules
+    // that became due long before <since> may be missed, so <since> should
+    // be the time of the previous call.
+    DueSchedules(since, until time.Time) ([]Schedule, error)
+
+    // Add <mail> to the mail outbox, pending and due immediately.  The ID
+    // and Created time are assigned by the implementation.  If a message
+    // with the same DedupKey was added within OutboxMailDedupWindow, nothing
+    // is added; the earlier message's ID is returned, with <duplicate> set.
+    EnqueueOutboxMail(mail OutboxMail) (id gocql.UUID, duplicate bool, err error)
 
     // Lookup a user account from the database (without password verification).
     LookupAccount(usernameOrEmail string) (Account, error)
@@ -95,6 +250,9 @@ type Connection interface {
     // incorrect.
     LookupAccountVerifyPassword(usernameOrEmail, password string) (Account, error)
 
+    // Lookup one of a device's alarm rules by ID.
+    LookupAlarmRule(deviceId gocql.UUID, ruleId string) (*AlarmRule, error)
+
     // Lookup a device from the database (without secret key verification).
     LookupDevice(deviceId gocql.UUID) (Device, error)
 
@@ -108,6 +266,97 @@ type Connection interface {
     // Lookup a device from the database, using string representation of its
     // UUID, and verify the secret key.
     LookupDeviceByStringIDVerifySecretKey(id, secret string) (Device, error)
+
+    // Lookup the grant associated with an OAuth access token.  Returns
+    // InvalidOAuthGrantError if the token is unknown or expired.
+    LookupOAuthAccessToken(token string) (*OAuthGrant, error)
+
+    // Lookup a registered OAuth client application by its client ID.
+    LookupOAuthClient(clientId string) (OAuthClient, error)
+
+    // Lookup a message in the mail outbox by ID.
+    LookupOutboxMail(id gocql.UUID) (*OutboxMail, error)
+
+    // Lookup one of a device's schedules by ID.
+    LookupSchedule(deviceId gocql.UUID, scheduleId string) (*Schedule, error)
+
+    // Lookup one of <username>'s webhooks by ID.
+    LookupWebhook(username, webhookId string) (*Webhook, error)
+
+    // Get the recorded delivery attempts of a device's notification, given
+    // by the time it was issued.
+    NotificationDeliveries(deviceId gocql.UUID, timeIssued time.Time) ([]NotificationDelivery, error)
+
+    // Get <username>'s notification preferences.  Returns the defaults (see
+    // DefaultNotificationPrefs) if the account hasn't saved any.
+    NotificationPrefs(username string) (*NotificationPrefs, error)
+
+    // Get the mobile devices registered to receive <username>'s push
+    // notifications.
+    PushTokens(username string) ([]PushToken, error)
+
+    // Delete the daily usage counters for every day (UTC) before the day of
+    // <before>.
+    PurgeDailyUsage(before time.Time) error
+
+    // Add a notification to its recipient's delivery queue, to be delivered
+    // at notification.Due.  <notification>'s ID is assigned by the
+    // implementation.
+    QueueNotification(notification QueuedNotification) error
+
+    // Get all of the notifications in <username>'s delivery queue, oldest
+    // first.
+    QueuedNotifications(username string) ([]QueuedNotification, error)
+
+    // Record an attempt to deliver a notification to one recipient.
+    // Records are kept for NotificationDeliveryHistoryLifetime.
+    RecordNotificationDelivery(delivery NotificationDelivery) error
+
+    // Record the outcome of a schedule's latest run.  <errMsg> is empty if
+    // the run succeeded.
+    RecordScheduleResult(deviceId gocql.UUID, scheduleId, errMsg string) error
+
+    // Record an attempt to deliver an event to a webhook.  Attempts are kept
+    // for WebhookDeliveryHistoryLifetime.  Deliveries with status
+    // WebhookDeliveryDead are also added to the webhook's dead-letter log.
+    RecordWebhookDelivery(delivery WebhookDelivery) error
+
+    // Save the last sample <rule> has seen (LastValue and LastSampleTime).
+    SaveAlarmRuleSample(rule AlarmRule) error
+
+    // Save <rule>'s evaluation state (Firing, PendingSince and LastFired).
+    // The update only happens if the stored Firing flag still equals
+    // <wasFiring>, so that when several servers evaluate the same rule at
+    // once only one of them sees it fire.  Returns false if the update did
+    // not happen.
+    SaveAlarmRuleState(rule AlarmRule, wasFiring bool) (bool, error)
+
+    // Save an account's notification preferences.
+    SaveNotificationPrefs(prefs NotificationPrefs) error
+
+    // Save the delivery state of a message in the mail outbox (Status,
+    // Attempts, NextAttempt, LastError and Sent).  Messages that are no
+    // longer pending are kept for OutboxMailHistoryLifetime.
+    SaveOutboxMail(mail OutboxMail) error
+
+    // Get all of a device's schedules.
+    Schedules(deviceId gocql.UUID) ([]Schedule, error)
+
+    // Replace a schedule's Name, Vars, Cron, TimeZone and NextRun.  The
+    // update only happens if the stored NextRun still equals <oldNextRun>,
+    // so that it can't race with a server claiming a run (see
+    // ClaimScheduleRun).  Returns false if the update did not happen.
+    UpdateSchedule(schedule Schedule, oldNextRun time.Time) (bool, error)
+
+    // Get the most recent entries, newest first, in a webhook's dead-letter
+    // log.  These are events that could not be delivered after every retry.
+    WebhookDeadLetters(webhookId string, limit int) ([]WebhookDelivery, error)
+
+    // Get the most recent delivery attempts for a webhook, newest first.
+    WebhookDeliveries(webhookId string, limit int) ([]WebhookDelivery, error)
+
+    // Get all of <username>'s webhooks.
+    Webhooks(username string) ([]Webhook, error)
 }
 
 // Account is a user account
@@ -118,6 +367,48 @@ type Account interface {
     // Mark this account as activated, using an activation code.
     Activate(username, code string) error
 
+    // Get the names of this account's app passwords.
+    AppPasswordNames() ([]string, error)
+
+    // Begin changing this account's email address to <newEmail>.  The change
+    // does not take effect until ConfirmEmailChange is called with the
+    // returned code, which should be sent to <newEmail>.  The code expires
+    // after 24 hours.  Returns EmailTakenError if <newEmail> already belongs
+    // to an account.
+    BeginEmailChange(newEmail string) (code string, err error)
+
+    // Begin enrolling in TOTP two-factor authentication.  Generates and
+    // stores a new pending secret, which does not take effect until
+    // ConfirmTOTPEnrollment is called with a valid code.  Returns the secret
+    // and an otpauth:// provisioning URI to show as a QR code.
+    BeginTOTPEnrollment() (secret string, provisioningURI string, err error)
+
+    // Finish changing this account's email address, using the code from
+    // BeginEmailChange.  Updates both the account and the email-to-account
+    // index, so that the new address works for login and the old one no
+    // longer does.  Returns the old email address.  Returns
+    // InvalidEmailChangeCodeError if the code is wrong or expired, or
+    // EmailTakenError if the address was claimed by another account in the
+    // meantime.
+    ConfirmEmailChange(code string) (oldEmail string, err error)
+
+    // Finish enrolling in TOTP two-factor authentication by verifying a code
+    // generated from the pending secret.  Enables 2FA and returns a fresh
+    // set of single-use recovery codes, replacing any previous ones.
+    ConfirmTOTPEnrollment(code string) (recoveryCodes []string, err error)
+
+    // Create a named app password.  App passwords are used instead of the
+    // account password for HTTP BASIC auth when 2FA is enabled.  The
+    // password is only stored hashed, so this is the only chance to read it.
+    CreateAppPassword(name string) (password string, err error)
+
+    // Delete a named app password.
+    DeleteAppPassword(name string) error
+
+    // Disable TOTP two-factor authentication and discard the secret and
+    // recovery codes.
+    DisableTOTP() error
+
     // Get all devices that user has access to.
     Devices() ([]Device, error)
 
@@ -134,22 +425,57 @@ type Account interface {
     // Has this account been activated?
     IsActivated() bool
 
+    // Is TOTP two-factor authentication enabled for this account?
+    IsTOTPEnabled() bool
+
+    // Get the language that email to this account should be written in, as
+    // a lowercase BCP 47 tag like "en" or "pt-br", or "" if the account has
+    // not chosen one.
+    Language() string
+
+    // Get the email address this account is in the process of changing to,
+    // or "" if there is no pending change.
+    PendingEmail() string
+
     // Reset password.  Like SetPassword but requires a valid Password Reset
     // Code, and invalidates <code> on success.
     ResetPassword(code, newPassword string) error
 
+    // Get the time before which login sessions for this account are not
+    // valid.  This is the account's creation time, so that sessions from a
+    // deleted account with the same username are not accepted.
+    SessionsValidAfter() time.Time
+
+    // Set the language that email to this account should be written in.
+    // Accepts tags like "en", "pt-BR" or "pt_BR", which are stored
+    // normalized to "pt-br".  "" clears the preference.
+    SetLanguage(lang string) error
+
     // Set password
     SetPassword(string) error
 
     // Get user's username.
     Username() string
 
+    // Verify an app password.  Returns true if it matches any of this
+    // account's app passwords.
+    VerifyAppPassword(password string) bool
+
     // Verify user's password.  Returns true if password is correct.
     VerifyPassword(password string) bool
+
+    // Verify the second authentication factor: either a current TOTP code
+    // or an unused recovery code (which is then consumed).  TOTP codes
+    // cannot be replayed.  Returns InvalidTOTPCodeError if it is incorrect.
+    VerifySecondFactor(code string) error
 }
 
 // Device is a Canopy-enabled device
 type Device interface {
+    // Get the usernames of the accounts that have been granted access to
+    // this device, and their access levels.
+    AccountAccess() (map[string]AccessLevel, error)
+
     // Extend the SDDL by adding Cloud Variables
     ExtendSDDL(jsn map[string]interface{}) error
 
@@ -189,6 +515,9 @@ type Device interface {
     // Get the user-assigned note about device's location
     LocationNote() string
 
+    // Lookup one of this device's notifications by ID.
+    LookupNotification(id string) (Notification, error)
+
     // Lookup a Cloud Variable by name.  Essentially, shorthand for:
     //      device.SDDLDocument().LookupVarDef(cloudVarName)
     LookupVarDef(cloudVarName string) (sddl.VarDef, error)
@@ -196,6 +525,11 @@ type Device interface {
     // Get the user-assigned name for this device.
     Name() string
 
+    // Get up to <limit> of this device's notifications issued before
+    // <before>, newest first.  If <before> is zero, starts with the newest
+    // notification.
+    Notifications(before time.Time, limit int) ([]Notification, error)
+
     // Get the public access level
     PublicAccessLevel() AccessLevel
 
@@ -226,6 +560,10 @@ type Device interface {
     // Set the SDDL class associated with this device.
     SetSDDLDocument(doc sddl.Document) error
 
+    // Get the number of this device's notifications that haven't been
+    // dismissed.
+    UnreadNotificationCount() (int64, error)
+
     // Update the last activity timestamp.
     // If <t> is nil, the current server time is used.  Otherwise, the last
     // activity timestamp is set to *t.
@@ -239,9 +577,14 @@ type Notification interface {
     // Get the date & time that this notification was sent.
     Datetime() time.Time
 
-    // Mark this notification as dismissed.
+    // Mark this notification as dismissed.  Dismissing a notification that
+    // has already been dismissed does nothing.
     Dismiss() error
 
+    // Get an ID for this notification, unique among the device's
+    // notifications.
+    ID() string
+
     // Has this notification been dismissed?
     IsDismissed() bool
  
@@ -252,3 +595,390 @@ type Notification interface {
     NotifyType() int
 }
 
+// OAuthClient is a third-party application registered with Canopy's OAuth2
+// authorization server.
+type OAuthClient interface {
+    // Get the client ID.
+    ClientID() string
+
+    // Is this a public client (such as a mobile or javascript app) that
+    // cannot keep a secret?  Public clients have no client secret and must
+    // use PKCE.
+    IsPublic() bool
+
+    // Get the application's display name, shown on the consent screen.
+    Name() string
+
+    // Get the username of the account that registered this client.
+    OwnerUsername() string
+
+    // Get the list of allowed redirect URIs.
+    RedirectURIs() []string
+
+    // Verify the client secret.  Always returns false for public clients.
+    VerifySecret(secret string) bool
+}
+
+// OAuthGrant records what an account has authorized an OAuth client to do.
+// It is attached to every authorization code, access token and refresh
+// token.
+type OAuthGrant struct {
+    // Maximum access level that the token holder has for the account's
+    // devices.
+    AccessLevel AccessLevel
+
+    ClientID string
+
+    // PKCE code challenge and method ("plain" or "S256").  Only set for
+    // authorization codes.
+    CodeChallenge string
+    CodeChallengeMethod string
+
+    Expiry time.Time
+
+    // Redirect URI used in the authorization request.  Only set for
+    // authorization codes.
+    RedirectURI string
+
+    // Space-separated list of scopes that were granted.
+    Scope string
+
+    Username string
+}
+
+// Webhook delivery statuses
+const (
+    WebhookDelivered = "delivered"
+    WebhookDeliveryRetrying = "retrying"
+    WebhookDeliveryDead = "dead"
+)
+
+// How long webhook delivery attempts and dead letters are kept.
+const WebhookDeliveryHistoryLifetime = 30*24*time.Hour
+
+// Webhook is an account's subscription to events from its devices.  Matching
+// events are POSTed to <URL> as JSON, signed with <Secret>.  An event must
+// pass every filter to match, and an empty filter matches everything.
+type Webhook struct {
+    ID string
+    Username string
+    URL string
+    Secret string
+
+    // Event types (see package events) to deliver.
+    EventTypes []string
+
+    // Only deliver events from these devices (string UUIDs).
+    DeviceIDs []string
+
+    // Only deliver sample events for these Cloud Variables.  Does not apply
+    // to other types of event.
+    VarNames []string
+
+    // Only deliver notification events of these types ("email", "sms",
+    // etc).  Does not apply to other types of event.
+    NotifyTypes []string
+
+    Created time.Time
+}
+
+// WebhookDelivery records one attempt to deliver an event to a webhook.
+type WebhookDelivery struct {
+    // Identifies the event delivery.  Shared by all attempts to deliver the
+    // same event to the same webhook.
+    DeliveryID string
+
+    WebhookID string
+    DeviceID string
+    EventType string
+
+    // JSON body that was POSTed.
+    Payload string
+
+    // Attempt number, starting at 1.
+    Attempt int
+
+    // WebhookDelivered, WebhookDeliveryRetrying or WebhookDeliveryDead
+    Status string
+
+    // HTTP status code of the response, or 0 if no response was received.
+    ResponseCode int
+
+    // Reason the attempt failed, if it did.
+    Error string
+
+    Time time.Time
+}
+
+// Alarm rule types
+const (
+    // Fires when a numeric Cloud Variable compares with Threshold.
+    AlarmRuleThreshold = "threshold"
+
+    // Fires when a numeric Cloud Variable's rate of change, per minute,
+    // compares with Threshold.
+    AlarmRuleRateOfChange = "rate"
+
+    // Fires when a Cloud Variable has had no samples for Duration.
+    AlarmRuleStaleData = "stale"
+
+    // Fires when a boolean Cloud Variable equals BoolValue.
+    AlarmRuleBoolean = "boolean"
+)
+
+// AlarmRule is a server-side condition on one of a device's Cloud Variables.
+// When the condition has held for Duration the rule fires, raising a
+// notification from the device.  It does not fire again until it has
+// cleared.
+type AlarmRule struct {
+    ID string
+    DeviceID gocql.UUID
+    Name string
+    Type string
+    VarName string
+
+    // Comparison used by threshold and rate rules: ">", ">=", "<", "<=",
+    // "==" or "!=".
+    Operator string
+    Threshold float64
+
+    // How far back across the threshold the value must go for a firing
+    // threshold or rate rule to clear.  Stops a noisy value that hovers
+    // around the threshold from firing repeatedly.
+    Hysteresis float64
+
+    BoolValue bool
+    Duration time.Duration
+
+    // Notification raised when the rule fires (see notify.ProcessNotification).
+    // If <Message> is empty, one is generated.
+    NotifyType string
+    Message string
+
+    Created time.Time
+    CreatedBy string
+
+    // Evaluation state
+    Firing bool
+    // When the condition started holding, or zero if it doesn't.
+    PendingSince time.Time
+    LastValue float64
+    LastSampleTime time.Time
+    LastFired time.Time
+}
+
+// Get when <rule> could next fire without a new sample, because its
+// condition will have held for long enough or its data will be stale.
+// Returns zero if it can't.
+func (rule AlarmRule) NextCheck() time.Time {
+    if rule.Firing {
+        return time.Time{}
+    }
+    if rule.Type == AlarmRuleStaleData {
+        lastSeen := rule.LastSampleTime
+        if lastSeen.IsZero() {
+            lastSeen = rule.Created
+        }
+        return lastSeen.Add(rule.Duration)
+    }
+    if rule.PendingSince.IsZero() {
+        return time.Time{}
+    }
+    return rule.PendingSince.Add(rule.Duration)
+}
+
+// Schedule is a write to one or more of a device's "in" or "inout" Cloud
+// Variables that the server makes at a later time, either once or
+// repeatedly according to a cron expression.
+type Schedule struct {
+    ID string
+    DeviceID gocql.UUID
+    Name string
+
+    // Cloud Variable values to write, by name, as they would appear in the
+    // "vars" object of a POST /api/device/<id> request.
+    Vars map[string]interface{}
+
+    // Five-field cron expression (see util/cron), interpreted in TimeZone.
+    // Empty for a one-shot schedule.
+    Cron string
+    TimeZone string
+
+    // When the schedule is next due, or zero if it has no more runs.
+    NextRun time.Time
+    LastRun time.Time
+    // Problem with the latest run, or empty if it succeeded.
+    LastError string
+
+    Created time.Time
+    CreatedBy string
+}
+
+// Notification delivery channels
+const (
+    NotifyChannelNone = "none"
+    NotifyChannelInApp = "in-app"
+    NotifyChannelEmail = "email"
+    NotifyChannelSMS = "sms"
+)
+
+// How email notifications are sent.  High-priority notifications are always
+// sent immediately.
+const (
+    NotifyDeliveryImmediate = "immediate"
+    NotifyDeliveryHourlyDigest = "hourly"
+    NotifyDeliveryDailyDigest = "daily"
+)
+
+// NotificationPrefs is how an account wants to hear about notifications from
+// the devices it has access to.
+type NotificationPrefs struct {
+    Username string
+
+    // Channel for each priority, keyed by notify type: "low-priority",
+    // "med-priority" and "high-priority".  Notifications of type "email",
+    // "sms" and "in-app" always use that channel.  Notifications are always
+    // kept in the device's notification log, so "in-app" only adds a push
+    // notification to each of the account's PushTokens.
+    Channels map[string]string
+
+    // One of the NotifyDelivery constants.
+    EmailDelivery string
+
+    // Quiet hours, in minutes after midnight in TimeZone.  Notifications
+    // other than high-priority ones are held until quiet hours end.  Quiet
+    // hours are disabled if QuietStart equals QuietEnd.
+    QuietStart int
+    QuietEnd int
+    TimeZone string
+
+    // Phone number that "sms" notifications are sent to, in E.164 format
+    // (for example "+14155550100").  Empty if none has been given.
+    SMSNumber string
+}
+
+// Get the notification preferences of an account that hasn't saved any.
+func DefaultNotificationPrefs(username string) NotificationPrefs {
+    return NotificationPrefs{
+        Username: username,
+        Channels: map[string]string{
+            "low-priority" : NotifyChannelInApp,
+            "med-priority" : NotifyChannelEmail,
+            "high-priority" : NotifyChannelEmail,
+        },
+        EmailDelivery: NotifyDeliveryImmediate,
+        TimeZone: "UTC",
+    }
+}
+
+// QueuedNotification is a notification waiting to be delivered to one
+// account, because of its quiet hours or digest preferences.
+type QueuedNotification struct {
+    ID gocql.UUID
+    Username string
+    Channel string
+    Due time.Time
+
+    DeviceID gocql.UUID
+    DeviceName string
+    NotifyType string
+    Msg string
+    TimeIssued time.Time
+}
+
+// PushToken identifies one of an account's mobile devices to the push
+// notification service.
+type PushToken struct {
+    Username string
+    Token string
+
+    // "ios" or "android".
+    Platform string
+
+    Created time.Time
+}
+
+// Outcomes of a notification delivery attempt.
+const (
+    DeliveryStatusSent = "sent"
+    DeliveryStatusFailed = "failed"
+    DeliveryStatusQueued = "queued"
+    DeliveryStatusSkipped = "skipped"
+)
+
+// How long notification delivery records are kept.
+const NotificationDeliveryHistoryLifetime = 30*24*time.Hour
+
+// NotificationDelivery records what happened when a notification was sent
+// (or held back) to one recipient.
+type NotificationDelivery struct {
+    // The notification, as given by its device and time issued.
+    DeviceID gocql.UUID
+    TimeIssued time.Time
+
+    Username string
+    Channel string
+
+    // Email address, phone number or push token the notification was sent
+    // to.  Empty if there was nowhere to send it.
+    Recipient string
+
+    // One of the DeliveryStatus constants.
+    Status string
+
+    // Why delivery failed or was skipped.
+    Error string
+
+    // ID the email, SMS or push service gave the message, if any.
+    ProviderID string
+
+    Time time.Time
+}
+
+// Mail outbox message statuses
+const (
+    OutboxMailPending = "pending"
+    OutboxMailSent = "sent"
+    OutboxMailFailed = "failed"
+)
+
+// How long sent and failed messages are kept in the mail outbox.
+const OutboxMailHistoryLifetime = 7*24*time.Hour
+
+// Messages with the same DedupKey added to the mail outbox within this long
+// of each other are only sent once.
+const OutboxMailDedupWindow = 10*time.Minute
+
+// OutboxMail is an email in the mail outbox, waiting to be sent or recently
+// sent.
+type OutboxMail struct {
+    ID gocql.UUID
+
+    // Identifies the message's sender, recipients and content.
+    DedupKey string
+
+    FromEmail string
+    FromName string
+    ToEmails []string
+    ToNames []string
+    ReplyTo string
+    Subject string
+    Text string
+    HTML string
+    Created time.Time
+
+    // One of the OutboxMail status constants.
+    Status string
+
+    // Number of attempts made to send the message so far.
+    Attempts int
+
+    // When to try again, if still pending.
+    NextAttempt time.Time
+
+    // Problem with the latest attempt, or empty.
+    LastError string
+
+    // When the message was sent, or zero.
+    Sent time.Time
+}
@@ -0,0 +1,207 @@
+// Copyright 2015 SimpleThings, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+// Package derived computes derived Cloud Variables: those declared with an
+// "expression" in the device's SDDL, such as:
+//
+//      "out float32 dew_point" : {
+//          "expression" : "temperature - (100 - humidity) / 5"
+//      }
+//
+// Derived Cloud Variables are recomputed whenever a Cloud Variable that they
+// depend on is reported, and are stored as ordinary samples, so they can be
+// read like any other Cloud Variable.  They may depend on other derived
+// Cloud Variables, but not in a cycle.  See package util/expr for the
+// expression language.
+package derived
+
+import (
+    "canopy/canolog"
+    "canopy/cloudvar"
+    "canopy/datalayer"
+    "canopy/events"
+    "canopy/sddl"
+    "canopy/util/expr"
+    "fmt"
+    "math"
+    "strings"
+    "time"
+)
+
+// Supplies values to expressions from a device's stored samples, and from
+// the values reported or computed in this update, which may not be readable
+// from the database yet.
+type deviceEnv struct {
+    device datalayer.Device
+    t time.Time
+    values map[string]float64
+}
+
+func (env *deviceEnv) Value(name string) (float64, error) {
+    if x, ok := env.values[name]; ok {
+        return x, nil
+    }
+    sample, err := env.device.LatestDataByName(name)
+    if err != nil {
+        return 0, fmt.Errorf("No value for %s: %s", name, err)
+    }
+    x, ok := cloudvar.ToFloat64(sample.Value)
+    if !ok {
+        return 0, fmt.Errorf("%s is not numeric", name)
+    }
+    env.values[name] = x
+    return x, nil
+}
+
+func (env *deviceEnv) History(name string, window time.Duration) ([]float64, error) {
+    samples, err := env.device.HistoricDataByName(name, env.t.Add(-window), env.t)
+    if err != nil {
+        return nil, err
+    }
+    out := []float64{}
+    start := env.t.Add(-window)
+    for _, sample := range samples {
+        if sample.Timestamp.After(start) && sample.Timestamp.Before(env.t) {
+            if x, ok := cloudvar.ToFloat64(sample.Value); ok {
+                out = append(out, x)
+            }
+        }
+    }
+    // Samples from this update are stored with time <t>.
+    if x, ok := env.values[name]; ok {
+        out = append(out, x)
+    }
+    return out, nil
+}
+
+// Convert an expression result to a value of <varDef>'s datatype.
+func fromFloat64(varDef sddl.VarDef, x float64) (cloudvar.CloudVarValue, error) {
+    if varDef.Datatype() == sddl.DATATYPE_BOOL {
+        return x != 0, nil
+    }
+    if !varDef.IsNumeric() {
+        return nil, fmt.Errorf("Derived Cloud Variable %s must be numeric or bool", varDef.Name())
+    }
+    return cloudvar.JsonToCloudVarValue(varDef, x)
+}
+
+func dependsOnAny(e expr.Expr, names map[string]bool) bool {
+    for _, name := range e.Vars() {
+        if names[name] {
+            return true
+        }
+    }
+    return false
+}
+
+// Recompute <device>'s derived Cloud Variables that depend, directly or
+// indirectly, on <reported>.  <reported> holds the Cloud Variable values
+// that have just been stored with time <t>, keyed by name.  The results are
+// stored with time <t> too, and published on <hub>, which may be nil.
+//
+// Derived Cloud Variables that can't be computed, for example because a
+// Cloud Variable they depend on has no samples yet, are skipped.  Returns an
+// error if storing a result fails.
+func Recompute(hub *events.Hub, device datalayer.Device, reported map[string]interface{}, t time.Time) error {
+    doc := device.SDDLDocument()
+    if doc == nil {
+        return nil
+    }
+
+    env := &deviceEnv{
+        device: device,
+        t: t,
+        values: map[string]float64{},
+    }
+    changed := map[string]bool{}
+    for name, value := range reported {
+        changed[name] = true
+        if x, ok := cloudvar.ToFloat64(value); ok {
+            env.values[name] = x
+        }
+    }
+
+    exprs := map[string]expr.Expr{}
+    for _, varDef := range doc.VarDefs() {
+        if varDef.Expression() == "" {
+            continue
+        }
+        // Expressions were validated when the SDDL was parsed.
+        e, err := expr.Parse(varDef.Expression())
+        if err != nil {
+            canolog.Warn("Invalid expression for ", varDef.Name(), ": ", err)
+            continue
+        }
+        exprs[varDef.Name()] = e
+    }
+
+    // Find the derived Cloud Variables that need recomputing.
+    affected := map[string]bool{}
+    for grown := true; grown; {
+        grown = false
+        for name, e := range exprs {
+            if !affected[name] && (dependsOnAny(e, changed) || dependsOnAny(e, affected)) {
+                affected[name] = true
+                grown = true
+            }
+        }
+    }
+
+    // Compute them in dependency order.
+    for len(affected) > 0 {
+        progress := false
+        for _, varDef := range doc.VarDefs() {
+            name := varDef.Name()
+            if !affected[name] || dependsOnAny(exprs[name], affected) {
+                continue
+            }
+            delete(affected, name)
+            progress = true
+
+            x, err := exprs[name].Eval(env)
+            if err == nil && (math.IsNaN(x) || math.IsInf(x, 0)) {
+                err = fmt.Errorf("Result is %g", x)
+            }
+            if err != nil {
+                canolog.Info("Not computing ", name, " for device ", device.IDString(), ": ", err)
+                continue
+            }
+            value, err := fromFloat64(varDef, x)
+            if err != nil {
+                canolog.Warn(err)
+                continue
+            }
+
+            err = device.InsertSample(varDef, t, value)
+            if err != nil {
+                return err
+            }
+            env.values[name] = x
+            hub.Publish(device.IDString(), events.TypeSample, map[string]interface{}{
+                "var" : name,
+                "v" : value,
+            })
+        }
+        if !progress {
+            names := []string{}
+            for name := range affected {
+                names = append(names, name)
+            }
+            canolog.Warn("Circular dependency between derived Cloud Variables of device ", device.IDString(), ": ", strings.Join(names, ", "))
+            break
+        }
+    }
+    return nil
+}
@@ -0,0 +1,185 @@
+// Copyright 2015 SimpleThings, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+// Package events broadcasts device activity (new samples, SDDL changes,
+// notifications and websocket connects/disconnects) to interested parties
+// within this server, such as Server-Sent Events streams and webhooks.
+//
+// Like pigeon, it only functions locally.  A recent history of events is kept
+// so that a subscriber that reconnects can resume where it left off.
+package events
+
+import (
+    "sync"
+    "time"
+)
+
+// Event types
+const (
+    TypeSample = "sample"
+    TypeSDDL = "sddl"
+    TypeNotification = "notification"
+    TypeConnected = "connected"
+    TypeDisconnected = "disconnected"
+)
+
+const (
+    // Number of recent events kept for resuming.
+    HistorySize = 1000
+
+    // Number of undelivered events a subscriber may have before it is
+    // dropped.
+    SubscriberBuffer = 64
+)
+
+type Event struct {
+    // Increases with each event.  IDs are seeded from the clock, so they
+    // also increase across server restarts.
+    ID uint64
+    Type string
+    DeviceID string
+    Time time.Time
+
+    // Type-specific details
+    Data map[string]interface{}
+}
+
+// Get the JSON object for <event>, as sent to clients.
+func (event Event) JsonObj() map[string]interface{} {
+    out := map[string]interface{}{}
+    for k, v := range event.Data {
+        out[k] = v
+    }
+    out["type"] = event.Type
+    out["device_id"] = event.DeviceID
+    out["t"] = event.Time.Format(time.RFC3339Nano)
+    return out
+}
+
+type Hub struct {
+    mu sync.Mutex
+    nextID uint64
+    history []Event
+    historyStart int
+    subs map[*Subscription]bool
+    listeners []func(Event)
+}
+
+type Subscription struct {
+    hub *Hub
+    filter func(Event) bool
+    ch chan Event
+}
+
+func NewHub() *Hub {
+    return &Hub{
+        nextID: uint64(time.Now().UnixNano()),
+        subs: map[*Subscription]bool{},
+    }
+}
+
+// Call <fn> for every event, in the publisher's goroutine.  Unlike
+// subscribers, listeners are never dropped, so <fn> must return quickly.  It
+// may publish further events.
+func (hub *Hub) AddListener(fn func(Event)) {
+    hub.mu.Lock()
+    defer hub.mu.Unlock()
+    hub.listeners = append(hub.listeners, fn)
+}
+
+// Broadcast an event.  Safe to call on a nil *Hub, which does nothing, so
+// that callers without a hub need not check.
+func (hub *Hub) Publish(deviceId, eventType string, data map[string]interface{}) {
+    if hub == nil {
+        return
+    }
+    hub.mu.Lock()
+
+    event := Event{
+        ID: hub.nextID,
+        Type: eventType,
+        DeviceID: deviceId,
+        Time: time.Now(),
+        Data: data,
+    }
+    hub.nextID++
+
+    if len(hub.history) < HistorySize {
+        hub.history = append(hub.history, event)
+    } else {
+        hub.history[hub.historyStart] = event
+        hub.historyStart = (hub.historyStart + 1) % HistorySize
+    }
+
+    for sub := range hub.subs {
+        if !sub.filter(event) {
+            continue
+        }
+        select {
+        case sub.ch <- event:
+        default:
+            // Subscriber isn't keeping up.  Drop it; it can resume from
+            // the history.
+            delete(hub.subs, sub)
+            close(sub.ch)
+        }
+    }
+    listeners := hub.listeners
+    hub.mu.Unlock()
+
+    for _, fn := range listeners {
+        fn(event)
+    }
+}
+
+// Subscribe to events for which <filter> returns true.  If <lastEventID> is
+// non-zero, also returns the remembered events after it, oldest first, which
+// the caller should handle before reading from the subscription.
+func (hub *Hub) Subscribe(filter func(Event) bool, lastEventID uint64) (*Subscription, []Event) {
+    hub.mu.Lock()
+    defer hub.mu.Unlock()
+
+    missed := []Event{}
+    if lastEventID != 0 {
+        for i := 0; i < len(hub.history); i++ {
+            event := hub.history[(hub.historyStart + i) % len(hub.history)]
+            if event.ID > lastEventID && filter(event) {
+                missed = append(missed, event)
+            }
+        }
+    }
+
+    sub := &Subscription{
+        hub: hub,
+        filter: filter,
+        ch: make(chan Event, SubscriberBuffer),
+    }
+    hub.subs[sub] = true
+    return sub, missed
+}
+
+// Channel of events.  It is closed if the subscriber falls too far behind.
+func (sub *Subscription) C() <-chan Event {
+    return sub.ch
+}
+
+func (sub *Subscription) Close() {
+    sub.hub.mu.Lock()
+    defer sub.hub.mu.Unlock()
+    if sub.hub.subs[sub] {
+        delete(sub.hub.subs, sub)
+        close(sub.ch)
+    }
+}
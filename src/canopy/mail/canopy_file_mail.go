@@ -0,0 +1,308 @@
+// Copyright 2015 SimpleThings, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mail
+
+import (
+    "bufio"
+    "bytes"
+    "errors"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "mime"
+    "mime/multipart"
+    "mime/quotedprintable"
+    netmail "net/mail"
+    "os"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Capture formats, as given by the "email-file-format" option.
+const (
+    // Write each message to its own .eml file.
+    FileMailFormatEML = "eml"
+
+    // Append every message to a single mbox file, MboxFileName.
+    FileMailFormatMbox = "mbox"
+)
+
+// Name of the mbox file written in the capture directory.
+const MboxFileName = "canopy.mbox"
+
+// CanopyFileMailClient captures mail in a directory instead of sending it,
+// so that email flows can be checked in development, staging and automated
+// tests.  Messages are rendered exactly as CanopySMTPClient would send them.
+type CanopyFileMailClient struct {
+    dir string
+    format string
+
+    lock sync.Mutex
+    count int
+}
+
+// A message read back from a capture directory.
+type CapturedMail struct {
+    // The .eml file name, or the message's position in the mbox (starting
+    // at 1).
+    ID string
+    From string
+    To []string
+    Subject string
+    Date time.Time
+    Text string
+    HTML string
+}
+
+// Create a client that writes mail to <dir> in <format>, creating <dir> if
+// necessary.
+func NewFileMailClient(dir, format string) (MailClient, error) {
+    if dir == "" {
+        return nil, fmt.Errorf("email-file-dir must be set")
+    }
+    if !(format == FileMailFormatEML || format == FileMailFormatMbox) {
+        return nil, fmt.Errorf("Unknown email file format: %s", format)
+    }
+    err := os.MkdirAll(dir, 0700)
+    if err != nil {
+        return nil, err
+    }
+    return &CanopyFileMailClient{
+        dir: dir,
+        format: format,
+    }, nil
+}
+
+func (*CanopyFileMailClient) NewMail() MailMessage {
+    return &CanopySMTPMail{}
+}
+
+func (client *CanopyFileMailClient) Send(m MailMessage) error {
+    mail, ok := m.(*CanopySMTPMail)
+    if !ok {
+        return errors.New("Message was not constructed with CanopyFileMailClient")
+    }
+    data, err := mail.Bytes()
+    if err != nil {
+        return err
+    }
+
+    client.lock.Lock()
+    defer client.lock.Unlock()
+    client.count++
+
+    if client.format == FileMailFormatMbox {
+        return client.appendMbox(mail, data)
+    }
+
+    // Names sort in the order the messages were sent.  Writing to a
+    // temporary file first means readers never see a partial message.
+    name := fmt.Sprintf("%s-%06d.eml", time.Now().UTC().Format("20060102-150405.000000000"), client.count)
+    tmpPath := filepath.Join(client.dir, "." + name + ".tmp")
+    err = ioutil.WriteFile(tmpPath, data, 0600)
+    if err != nil {
+        return err
+    }
+    return os.Rename(tmpPath, filepath.Join(client.dir, name))
+}
+
+// Append a message to the mbox file, in the "mboxrd" format: lines of the
+// message that look like "From " lines, even after quoting, get another
+// ">".
+func (client *CanopyFileMailClient) appendMbox(mail *CanopySMTPMail, data []byte) error {
+    var buf bytes.Buffer
+    sender := "MAILER-DAEMON"
+    if mail.from != nil {
+        sender = mail.from.Address
+    }
+    buf.WriteString("From " + sender + " " + time.Now().UTC().Format(time.ANSIC) + "\n")
+    for _, line := range strings.Split(strings.Replace(string(data), "\r\n", "\n", -1), "\n") {
+        if strings.HasPrefix(strings.TrimLeft(line, ">"), "From ") {
+            buf.WriteString(">")
+        }
+        buf.WriteString(line + "\n")
+    }
+    buf.WriteString("\n")
+
+    f, err := os.OpenFile(filepath.Join(client.dir, MboxFileName), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+    if err != nil {
+        return err
+    }
+    _, err = f.Write(buf.Bytes())
+    if err != nil {
+        f.Close()
+        return err
+    }
+    return f.Close()
+}
+
+// Read the <limit> most recently captured messages from <dir>, newest
+// first.
+func ReadCapturedMail(dir, format string, limit int) ([]CapturedMail, error) {
+    raw := [][]byte{}
+    ids := []string{}
+    if format == FileMailFormatMbox {
+        data, err := ioutil.ReadFile(filepath.Join(dir, MboxFileName))
+        if os.IsNotExist(err) {
+            return []CapturedMail{}, nil
+        } else if err != nil {
+            return nil, err
+        }
+        raw = splitMbox(data)
+        for i := range raw {
+            ids = append(ids, strconv.Itoa(i + 1))
+        }
+    } else {
+        entries, err := ioutil.ReadDir(dir)
+        if err != nil {
+            return nil, err
+        }
+        for _, entry := range entries {
+            name := entry.Name()
+            if entry.IsDir() || !strings.HasSuffix(name, ".eml") || strings.HasPrefix(name, ".") {
+                continue
+            }
+            ids = append(ids, name)
+        }
+        sort.Strings(ids)
+        if len(ids) > limit {
+            ids = ids[len(ids) - limit:]
+        }
+        for _, name := range ids {
+            data, err := ioutil.ReadFile(filepath.Join(dir, name))
+            if err != nil {
+                return nil, err
+            }
+            raw = append(raw, data)
+        }
+    }
+
+    out := []CapturedMail{}
+    for i := len(raw) - 1; i >= 0 && len(out) < limit; i-- {
+        mail, err := parseCapturedMail(raw[i])
+        if err != nil {
+            return nil, fmt.Errorf("Error reading captured mail %s: %s", ids[i], err)
+        }
+        mail.ID = ids[i]
+        out = append(out, mail)
+    }
+    return out, nil
+}
+
+// Split an mboxrd file into messages, undoing the "From " quoting.
+func splitMbox(data []byte) [][]byte {
+    out := [][]byte{}
+    var msg *bytes.Buffer
+    scanner := bufio.NewScanner(bytes.NewReader(data))
+    for scanner.Scan() {
+        line := scanner.Text()
+        if strings.HasPrefix(line, "From ") {
+            if msg != nil {
+                out = append(out, bytes.TrimSuffix(msg.Bytes(), []byte("\r\n")))
+            }
+            msg = &bytes.Buffer{}
+            continue
+        }
+        if msg == nil {
+            continue
+        }
+        if strings.HasPrefix(strings.TrimLeft(line, ">"), "From ") {
+            line = line[1:]
+        }
+        msg.WriteString(line + "\r\n")
+    }
+    if msg != nil {
+        out = append(out, bytes.TrimSuffix(msg.Bytes(), []byte("\r\n")))
+    }
+    return out
+}
+
+func parseCapturedMail(data []byte) (CapturedMail, error) {
+    out := CapturedMail{To: []string{}}
+    msg, err := netmail.ReadMessage(bytes.NewReader(data))
+    if err != nil {
+        return out, err
+    }
+
+    decoder := &mime.WordDecoder{}
+    out.From = msg.Header.Get("From")
+    out.Subject, err = decoder.DecodeHeader(msg.Header.Get("Subject"))
+    if err != nil {
+        out.Subject = msg.Header.Get("Subject")
+    }
+    out.Date, _ = msg.Header.Date()
+    to, err := msg.Header.AddressList("To")
+    if err == nil {
+        for _, addr := range to {
+            out.To = append(out.To, addr.Address)
+        }
+    }
+
+    mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+    if err != nil {
+        return out, err
+    }
+    if !strings.HasPrefix(mediaType, "multipart/") {
+        body, err := decodeBody(msg.Body, msg.Header.Get("Content-Transfer-Encoding"))
+        if err != nil {
+            return out, err
+        }
+        if mediaType == "text/html" {
+            out.HTML = body
+        } else {
+            out.Text = body
+        }
+        return out, nil
+    }
+
+    // Parts are decoded from quoted-printable automatically.
+    reader := multipart.NewReader(msg.Body, params["boundary"])
+    for {
+        part, err := reader.NextPart()
+        if err == io.EOF {
+            break
+        } else if err != nil {
+            return out, err
+        }
+        body, err := ioutil.ReadAll(part)
+        if err != nil {
+            return out, err
+        }
+        partType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+        if partType == "text/html" {
+            out.HTML = toLF(string(body))
+        } else if partType == "text/plain" {
+            out.Text = toLF(string(body))
+        }
+    }
+    return out, nil
+}
+
+func decodeBody(body io.Reader, encoding string) (string, error) {
+    if strings.ToLower(encoding) == "quoted-printable" {
+        body = quotedprintable.NewReader(body)
+    }
+    data, err := ioutil.ReadAll(body)
+    return toLF(string(data)), err
+}
+
+// Bodies are stored with CRLF line endings, as sent over SMTP.
+func toLF(s string) string {
+    return strings.Replace(s, "\r\n", "\n", -1)
+}
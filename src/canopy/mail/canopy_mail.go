@@ -21,6 +21,19 @@ import (
     "time"
 )
 
+// Address that the server's email is sent from.  Replies to it are not
+// read.
+const (
+    NoReplyEmail = "no-reply@canopy.link"
+    NoReplyName = "Canopy Cloud Service"
+)
+
+// Set <msg>'s sender and reply-to address to the no-reply address.
+func SetNoReply(msg MailMessage) {
+    msg.SetFrom(NoReplyEmail, NoReplyName)
+    msg.SetReplyTo(NoReplyEmail)
+}
+
 type MailClient interface {
     NewMail() MailMessage
     Send(m MailMessage) error
@@ -41,10 +54,18 @@ func NewMailClient(cfg config.Config) (MailClient, error) {
     switch cfg.OptEmailService() {
     case "none":
         return NewNoOpMailClient()
+    case "file":
+        return NewFileMailClient(cfg.OptEmailFileDir(), cfg.OptEmailFileFormat())
     case "sendgrid":
         username := cfg.OptSendgridUsername()
         secret := cfg.OptSendgridSecretKey()
         return NewSendGridMailClient(username, secret)
+    case "smtp":
+        return NewSMTPMailClient(cfg.OptSMTPHost(),
+                int(cfg.OptSMTPPort()),
+                cfg.OptSMTPSecurity(),
+                cfg.OptSMTPUsername(),
+                cfg.OptSMTPPassword())
     default:
         return nil, fmt.Errorf("Unsupported mail service: %s", cfg.OptEmailService())
     }
@@ -0,0 +1,432 @@
+// Copyright 2015 SimpleThings, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+package mail
+
+import (
+    "canopy/util/random"
+    "bytes"
+    "crypto/tls"
+    "errors"
+    "fmt"
+    "io"
+    "mime"
+    "mime/multipart"
+    "mime/quotedprintable"
+    "net"
+    "net/smtp"
+    "net/textproto"
+    netmail "net/mail"
+    "os"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// How long to wait for the SMTP server, for the whole conversation.
+const SMTPTimeout = 60*time.Second
+
+// SMTP connection security, as given by the "smtp-security" option.
+const (
+    // Connect in plaintext and upgrade with the STARTTLS command.  Fails if
+    // the server doesn't support it.
+    SMTPSecuritySTARTTLS = "starttls"
+
+    // Connect using TLS from the start ("SMTPS").
+    SMTPSecurityTLS = "tls"
+
+    // Never encrypt.  Authentication is refused unless the server is on
+    // localhost.
+    SMTPSecurityNone = "none"
+)
+
+// Get the usual port for <security>.
+func DefaultSMTPPort(security string) int {
+    switch security {
+    case SMTPSecurityTLS:
+        return 465
+    case SMTPSecurityNone:
+        return 25
+    }
+    return 587
+}
+
+// CanopySMTPClient sends mail through an SMTP server.  If a username is
+// configured it authenticates with AUTH PLAIN or, if the server doesn't
+// offer that, AUTH LOGIN.
+type CanopySMTPClient struct {
+    host string
+    port int
+    security string
+    username string
+    password string
+
+    // Used to verify the server's certificate.  If nil, the system's root
+    // certificates are used.
+    tlsConfig *tls.Config
+}
+
+// CanopySMTPMail is a message for CanopySMTPClient.  Messages with both
+// text and HTML bodies are sent as multipart/alternative.
+type CanopySMTPMail struct {
+    from *netmail.Address
+    to []*netmail.Address
+    replyTo *netmail.Address
+    subject string
+    text string
+    html string
+    date time.Time
+}
+
+// Create a client for the SMTP server at <host>:<port>.  A <port> of 0
+// uses the usual port for <security>.  Authentication is skipped if
+// <username> is empty.
+func NewSMTPMailClient(host string, port int, security, username, password string) (MailClient, error) {
+    if host == "" {
+        return nil, fmt.Errorf("smtp-host must be set")
+    }
+    if !(security == SMTPSecuritySTARTTLS || security == SMTPSecurityTLS || security == SMTPSecurityNone) {
+        return nil, fmt.Errorf("Unknown SMTP security: %s", security)
+    }
+    if port == 0 {
+        port = DefaultSMTPPort(security)
+    }
+    return &CanopySMTPClient{
+        host: host,
+        port: port,
+        security: security,
+        username: username,
+        password: password,
+    }, nil
+}
+
+// Use <tlsConfig> when connecting to the server, instead of the defaults.
+// Intended for servers with private certificates, and for tests.
+func (client *CanopySMTPClient) SetTLSConfig(tlsConfig *tls.Config) {
+    client.tlsConfig = tlsConfig
+}
+
+func (*CanopySMTPClient) NewMail() MailMessage {
+    return &CanopySMTPMail{}
+}
+
+func (client *CanopySMTPClient) Send(m MailMessage) error {
+    mail, ok := m.(*CanopySMTPMail)
+    if !ok {
+        return errors.New("Message was not constructed with CanopySMTPClient")
+    }
+    if mail.from == nil {
+        return errors.New("Message has no sender")
+    }
+    if len(mail.to) == 0 {
+        return errors.New("Message has no recipients")
+    }
+    msg, err := mail.Bytes()
+    if err != nil {
+        return err
+    }
+
+    c, err := client.connect()
+    if err != nil {
+        return err
+    }
+    defer c.Close()
+
+    if client.username != "" {
+        auth, err := client.auth(c)
+        if err != nil {
+            return err
+        }
+        err = c.Auth(auth)
+        if err != nil {
+            return err
+        }
+    }
+
+    err = c.Mail(mail.from.Address)
+    if err != nil {
+        return err
+    }
+    for _, to := range mail.to {
+        err = c.Rcpt(to.Address)
+        if err != nil {
+            return err
+        }
+    }
+    w, err := c.Data()
+    if err != nil {
+        return err
+    }
+    _, err = w.Write(msg)
+    if err != nil {
+        return err
+    }
+    err = w.Close()
+    if err != nil {
+        return err
+    }
+    return c.Quit()
+}
+
+func (client *CanopySMTPClient) getTLSConfig() *tls.Config {
+    if client.tlsConfig != nil {
+        return client.tlsConfig
+    }
+    return &tls.Config{ServerName: client.host}
+}
+
+// Connect to the server and, for STARTTLS, upgrade the connection.
+func (client *CanopySMTPClient) connect() (*smtp.Client, error) {
+    addr := net.JoinHostPort(client.host, strconv.Itoa(client.port))
+    conn, err := net.DialTimeout("tcp", addr, SMTPTimeout)
+    if err != nil {
+        return nil, err
+    }
+    conn.SetDeadline(time.Now().Add(SMTPTimeout))
+    if client.security == SMTPSecurityTLS {
+        conn = tls.Client(conn, client.getTLSConfig())
+    }
+
+    c, err := smtp.NewClient(conn, client.host)
+    if err != nil {
+        conn.Close()
+        return nil, err
+    }
+    hostname, err := os.Hostname()
+    if err == nil {
+        err = c.Hello(hostname)
+        if err != nil {
+            c.Close()
+            return nil, err
+        }
+    }
+
+    if client.security == SMTPSecuritySTARTTLS {
+        if ok, _ := c.Extension("STARTTLS"); !ok {
+            c.Close()
+            return nil, errors.New("SMTP server does not support STARTTLS")
+        }
+        err = c.StartTLS(client.getTLSConfig())
+        if err != nil {
+            c.Close()
+            return nil, err
+        }
+    }
+    return c, nil
+}
+
+// Choose an authentication mechanism offered by the server.
+func (client *CanopySMTPClient) auth(c *smtp.Client) (smtp.Auth, error) {
+    ok, mechanisms := c.Extension("AUTH")
+    if !ok {
+        return nil, errors.New("SMTP server does not support authentication")
+    }
+    for _, mechanism := range strings.Fields(strings.ToUpper(mechanisms)) {
+        if mechanism == "PLAIN" {
+            return smtp.PlainAuth("", client.username, client.password, client.host), nil
+        }
+    }
+    for _, mechanism := range strings.Fields(strings.ToUpper(mechanisms)) {
+        if mechanism == "LOGIN" {
+            return &loginAuth{client.username, client.password, client.host}, nil
+        }
+    }
+    return nil, fmt.Errorf("No supported SMTP authentication mechanism in: %s", mechanisms)
+}
+
+// loginAuth implements the AUTH LOGIN mechanism, which net/smtp doesn't
+// provide.  Like smtp.PlainAuth, it refuses to send credentials over an
+// unencrypted connection unless the server is on localhost.
+type loginAuth struct {
+    username string
+    password string
+    host string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+    if server.Name != a.host {
+        return "", nil, errors.New("wrong host name")
+    }
+    if !server.TLS && !isLocalhost(server.Name) {
+        return "", nil, errors.New("unencrypted connection")
+    }
+    return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+    if !more {
+        return nil, nil
+    }
+    switch strings.ToLower(strings.TrimSpace(string(fromServer))) {
+    case "username:":
+        return []byte(a.username), nil
+    case "password:":
+        return []byte(a.password), nil
+    }
+    return nil, fmt.Errorf("Unexpected SMTP LOGIN challenge: %s", fromServer)
+}
+
+func isLocalhost(name string) bool {
+    return name == "localhost" || name == "127.0.0.1" || name == "::1"
+}
+
+func (mail *CanopySMTPMail) AddTo(email string, name string) error {
+    addr, err := netmail.ParseAddress(email)
+    if err != nil {
+        return err
+    }
+    addr.Name = name
+    mail.to = append(mail.to, addr)
+    return nil
+}
+
+func (mail *CanopySMTPMail) AddTos(emails []string, names []string) error {
+    for i, email := range emails {
+        name := ""
+        if i < len(names) {
+            name = names[i]
+        }
+        err := mail.AddTo(email, name)
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func (mail *CanopySMTPMail) SetSubject(subject string) {
+    mail.subject = subject
+}
+
+func (mail *CanopySMTPMail) SetText(text string) {
+    mail.text = text
+}
+
+func (mail *CanopySMTPMail) SetHTML(html string) {
+    mail.html = html
+}
+
+func (mail *CanopySMTPMail) SetFrom(email string, name string) error {
+    addr, err := netmail.ParseAddress(email)
+    if err != nil {
+        return err
+    }
+    addr.Name = name
+    mail.from = addr
+    return nil
+}
+
+func (mail *CanopySMTPMail) SetReplyTo(email string) error {
+    addr, err := netmail.ParseAddress(email)
+    if err != nil {
+        return err
+    }
+    mail.replyTo = addr
+    return nil
+}
+
+func (mail *CanopySMTPMail) SetDate(date time.Time) error {
+    mail.date = date
+    return nil
+}
+
+// Render the message in RFC 5322 format, with CRLF line endings.  The Date
+// header is the current time unless SetDate was called.
+func (mail *CanopySMTPMail) Bytes() ([]byte, error) {
+    var buf bytes.Buffer
+
+    date := mail.date
+    if date.IsZero() {
+        date = time.Now()
+    }
+    id, err := random.Base64URLString(24)
+    if err != nil {
+        return nil, err
+    }
+    domain := "localhost"
+    if mail.from != nil {
+        domain = mail.from.Address[strings.LastIndex(mail.from.Address, "@") + 1:]
+    }
+
+    to := []string{}
+    for _, addr := range mail.to {
+        to = append(to, addr.String())
+    }
+
+    if mail.from != nil {
+        writeHeader(&buf, "From", mail.from.String())
+    }
+    writeHeader(&buf, "To", strings.Join(to, ", "))
+    if mail.replyTo != nil {
+        writeHeader(&buf, "Reply-To", mail.replyTo.String())
+    }
+    writeHeader(&buf, "Subject", mime.QEncoding.Encode("utf-8", mail.subject))
+    writeHeader(&buf, "Date", date.Format(time.RFC1123Z))
+    writeHeader(&buf, "Message-ID", "<" + id + "@" + domain + ">")
+    writeHeader(&buf, "MIME-Version", "1.0")
+
+    if mail.text != "" && mail.html != "" {
+        w := multipart.NewWriter(&buf)
+        writeHeader(&buf, "Content-Type", "multipart/alternative; boundary=\"" + w.Boundary() + "\"")
+        buf.WriteString("\r\n")
+        for _, part := range []struct{ contentType, body string }{
+                {"text/plain; charset=utf-8", mail.text},
+                {"text/html; charset=utf-8", mail.html}} {
+            pw, err := w.CreatePart(textproto.MIMEHeader{
+                "Content-Type": {part.contentType},
+                "Content-Transfer-Encoding": {"quoted-printable"},
+            })
+            if err != nil {
+                return nil, err
+            }
+            err = writeQuotedPrintable(pw, part.body)
+            if err != nil {
+                return nil, err
+            }
+        }
+        err = w.Close()
+        if err != nil {
+            return nil, err
+        }
+        return buf.Bytes(), nil
+    }
+
+    contentType, body := "text/plain; charset=utf-8", mail.text
+    if mail.html != "" {
+        contentType, body = "text/html; charset=utf-8", mail.html
+    }
+    writeHeader(&buf, "Content-Type", contentType)
+    writeHeader(&buf, "Content-Transfer-Encoding", "quoted-printable")
+    buf.WriteString("\r\n")
+    err = writeQuotedPrintable(&buf, body)
+    if err != nil {
+        return nil, err
+    }
+    return buf.Bytes(), nil
+}
+
+func writeHeader(buf *bytes.Buffer, name, value string) {
+    buf.WriteString(name + ": " + value + "\r\n")
+}
+
+// Write <body> quoted-printable encoded.  Line breaks become CRLF.
+func writeQuotedPrintable(w io.Writer, body string) error {
+    qp := quotedprintable.NewWriter(w)
+    _, err := qp.Write([]byte(body))
+    if err != nil {
+        return err
+    }
+    return qp.Close()
+}
@@ -0,0 +1,231 @@
+// Copyright 2015 SimpleThings, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mail
+
+import (
+    "io/ioutil"
+    "net"
+    "net/textproto"
+    "strconv"
+    "strings"
+    "testing"
+)
+
+// fakeSMTPServer accepts a single connection and answers just enough of
+// the SMTP protocol for CanopySMTPClient.  It never does TLS.
+type fakeSMTPServer struct {
+    listener net.Listener
+
+    // Extension lines advertised in reply to EHLO, e.g. "AUTH PLAIN".
+    extensions []string
+
+    // Every command received, in order, and the body of the last DATA with
+    // line endings converted to "\n".  Only read these after done is closed.
+    commands []string
+    data string
+    done chan struct{}
+}
+
+// Listen on <addr> (with port 0) and serve one connection in the
+// background.
+func newFakeSMTPServer(t *testing.T, addr string, extensions ...string) *fakeSMTPServer {
+    listener, err := net.Listen("tcp", addr)
+    if err != nil {
+        t.Skip("Cannot listen on ", addr, ": ", err)
+    }
+    server := &fakeSMTPServer{
+        listener: listener,
+        extensions: extensions,
+        done: make(chan struct{}),
+    }
+    go server.serve()
+    return server
+}
+
+func (server *fakeSMTPServer) port() int {
+    return server.listener.Addr().(*net.TCPAddr).Port
+}
+
+// Wait for the client to hang up, and stop listening.
+func (server *fakeSMTPServer) wait() {
+    <-server.done
+    server.listener.Close()
+}
+
+func (server *fakeSMTPServer) serve() {
+    defer close(server.done)
+    conn, err := server.listener.Accept()
+    if err != nil {
+        return
+    }
+    tp := textproto.NewConn(conn)
+    defer tp.Close()
+
+    tp.PrintfLine("220 fake ESMTP")
+    for {
+        line, err := tp.ReadLine()
+        if err != nil {
+            return
+        }
+        server.commands = append(server.commands, line)
+        verb := strings.ToUpper(strings.Fields(line + " ")[0])
+        switch verb {
+        case "EHLO":
+            lines := append([]string{"fake"}, server.extensions...)
+            for i, ext := range lines {
+                sep := "-"
+                if i == len(lines) - 1 {
+                    sep = " "
+                }
+                tp.PrintfLine("250%s%s", sep, ext)
+            }
+        case "AUTH":
+            tp.PrintfLine("235 Authenticated")
+        case "MAIL", "RCPT":
+            tp.PrintfLine("250 OK")
+        case "DATA":
+            tp.PrintfLine("354 Go ahead")
+            body, err := ioutil.ReadAll(tp.DotReader())
+            if err != nil {
+                return
+            }
+            server.data = string(body)
+            tp.PrintfLine("250 Queued")
+        case "QUIT":
+            tp.PrintfLine("221 Bye")
+            return
+        default:
+            tp.PrintfLine("502 Not implemented")
+        }
+    }
+}
+
+// Whether the server received a command starting with <verb>.
+func (server *fakeSMTPServer) received(verb string) bool {
+    for _, cmd := range server.commands {
+        if strings.HasPrefix(strings.ToUpper(cmd), verb) {
+            return true
+        }
+    }
+    return false
+}
+
+func newTestMail(client MailClient) MailMessage {
+    msg := client.NewMail()
+    msg.SetFrom("sender@example.com", "Zoë Sender")
+    msg.AddTo("to@example.com", "Recipient")
+    msg.SetSubject("Grüße from Canopy")
+    msg.SetText("Hello")
+    return msg
+}
+
+// With "starttls" security, nothing is sent to a server that doesn't offer
+// STARTTLS.
+func TestSMTPRequiresSTARTTLS(t *testing.T) {
+    server := newFakeSMTPServer(t, "127.0.0.1:0", "AUTH PLAIN")
+    client, err := NewSMTPMailClient("127.0.0.1", server.port(), SMTPSecuritySTARTTLS, "user", "secret")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    err = client.Send(newTestMail(client))
+    server.wait()
+    if err == nil || !strings.Contains(err.Error(), "STARTTLS") {
+        t.Fatalf("Expected STARTTLS error, got %v", err)
+    }
+    if server.received("AUTH") || server.received("MAIL") {
+        t.Errorf("Client continued without STARTTLS: %v", server.commands)
+    }
+}
+
+// Credentials are never sent over plaintext to a server that isn't on
+// localhost, whichever mechanism the server offers.
+func TestSMTPRefusesPlaintextAuth(t *testing.T) {
+    for _, mechanism := range []string{"PLAIN", "LOGIN"} {
+        // Any 127/8 address is loopback, but only the usual names count as
+        // localhost for authentication.
+        server := newFakeSMTPServer(t, "127.0.0.2:0", "AUTH " + mechanism)
+        client, err := NewSMTPMailClient("127.0.0.2", server.port(), SMTPSecurityNone, "user", "secret")
+        if err != nil {
+            t.Fatal(err)
+        }
+
+        err = client.Send(newTestMail(client))
+        server.wait()
+        if err == nil || !strings.Contains(err.Error(), "unencrypted connection") {
+            t.Errorf("AUTH %s: expected unencrypted connection error, got %v", mechanism, err)
+        }
+        for _, cmd := range server.commands {
+            if strings.Contains(cmd, "secret") || strings.HasPrefix(strings.ToUpper(cmd), "AUTH") {
+                t.Errorf("AUTH %s: credentials sent in plaintext: %q", mechanism, cmd)
+            }
+        }
+        if server.received("MAIL") {
+            t.Errorf("AUTH %s: client continued after refusing to authenticate", mechanism)
+        }
+    }
+}
+
+// Non-ASCII display names and subjects are RFC 2047 encoded, and the
+// message reaches the server intact.
+func TestSMTPEncodedHeaders(t *testing.T) {
+    server := newFakeSMTPServer(t, "127.0.0.1:0")
+    client, err := NewSMTPMailClient("127.0.0.1", server.port(), SMTPSecurityNone, "", "")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    err = client.Send(newTestMail(client))
+    server.wait()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if server.received("AUTH") {
+        t.Errorf("Client authenticated without a username")
+    }
+
+    headers := map[string]string{}
+    lines := strings.Split(server.data, "\n")
+    for _, line := range lines {
+        if line == "" {
+            break
+        }
+        for _, c := range line {
+            if c > 127 {
+                t.Errorf("Header is not 7-bit: %q", line)
+                break
+            }
+        }
+        parts := strings.SplitN(line, ": ", 2)
+        if len(parts) == 2 {
+            headers[parts[0]] = parts[1]
+        }
+    }
+
+    expected := map[string]string{
+        "From": "=?utf-8?q?Zo=C3=AB_Sender?= <sender@example.com>",
+        "To": "\"Recipient\" <to@example.com>",
+        "Subject": "=?utf-8?q?Gr=C3=BC=C3=9Fe_from_Canopy?=",
+        "Content-Transfer-Encoding": "quoted-printable",
+    }
+    for name, value := range expected {
+        if headers[name] != value {
+            t.Errorf("%s: expected %s, got %s", name, strconv.Quote(value), strconv.Quote(headers[name]))
+        }
+    }
+    if !strings.HasSuffix(headers["Message-ID"], "@example.com>") {
+        t.Errorf("Unexpected Message-ID: %s", headers["Message-ID"])
+    }
+}
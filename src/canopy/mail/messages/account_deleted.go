@@ -0,0 +1,53 @@
+// Copyright 2015 SimpleThings, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package messages
+
+import (
+    "canopy/mail"
+)
+
+const accountDeletedSubject = `Your Canopy account has been deleted (on {{.Hostname}})`
+
+const accountDeletedHTML = `{{define "greeting"}}Goodbye <b>{{.Username}}</b>,{{end}}
+{{define "heading"}}Account Deleted{{end}}
+{{define "content"}}
+                <p>
+                    Your Canopy account and its data have been deleted, as
+                    you requested.  Devices that you shared with other
+                    people have been left with them.
+                </p>
+                <p>
+                    This is the last email you will receive from us.  Thanks
+                    for using Canopy!
+                </p>
+{{end}}`
+
+const accountDeletedText = `{{define "greeting"}}Goodbye {{.Username}},{{end}}
+{{define "heading"}}Account Deleted{{end}}
+{{define "content"}}
+Your Canopy account and its data have been deleted, as you requested.
+Devices that you shared with other people have been left with them.
+
+This is the last email you will receive from us.  Thanks for using Canopy!
+{{end}}`
+
+// Sent once an account has been deleted.  Templates see Username and
+// Hostname.
+func MailMessageAccountDeleted(msg mail.MailMessage, lang, username, hostname string) error {
+    return render(msg, lang, "account_deleted", map[string]interface{}{
+        "Username": username,
+        "Hostname": hostname,
+    })
+}
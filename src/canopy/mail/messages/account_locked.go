@@ -0,0 +1,65 @@
+// Copyright 2015 SimpleThings, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package messages
+
+import (
+    "canopy/mail"
+)
+
+const accountLockedSubject = `Your Canopy account has been locked (on {{.Hostname}})`
+
+const accountLockedHTML = `{{define "greeting"}}Hi <b>{{.Username}}</b>,{{end}}
+{{define "heading"}}Account Temporarily Locked{{end}}
+{{define "content"}}
+                <p>
+                    There have been too many failed attempts to sign in to
+                    your Canopy account, so we have locked it for
+                    {{.LockoutDuration}}.  You will be able to sign in
+                    again after that.
+                </p>
+                <p>
+                    If this wasn't you, somebody may be trying to guess your
+                    password.  We recommend choosing a new one, using the
+                    "Forgot password" link when signing in here:
+                </p>
+                <p>
+                    <a href="{{.ManageLink}}">{{.ManageLink}}</a>
+                </p>
+{{end}}`
+
+const accountLockedText = `{{define "greeting"}}Hi {{.Username}},{{end}}
+{{define "heading"}}Account Temporarily Locked{{end}}
+{{define "content"}}
+There have been too many failed attempts to sign in to your Canopy account,
+so we have locked it for {{.LockoutDuration}}.  You will be able to sign in
+again after that.
+
+If this wasn't you, somebody may be trying to guess your password.  We
+recommend choosing a new one, using the "Forgot password" link when signing
+in here:
+
+{{.ManageLink}}
+{{end}}`
+
+// Sent when an account is locked after too many failed logins.  Templates
+// see Username, LockoutDuration, ManageLink and Hostname.
+func MailMessageAccountLocked(msg mail.MailMessage, lang, username, lockoutDuration, manageLink, hostname string) error {
+    return render(msg, lang, "account_locked", map[string]interface{}{
+        "Username": username,
+        "LockoutDuration": lockoutDuration,
+        "ManageLink": manageLink,
+        "Hostname": hostname,
+    })
+}
@@ -0,0 +1,105 @@
+// Copyright 2015 SimpleThings, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package messages
+
+import (
+    "canopy/mail"
+)
+
+const confirmEmailChangeSubject = `Confirm your new Canopy email address (on {{.Hostname}})`
+
+const confirmEmailChangeHTML = `{{define "greeting"}}Hi <b>{{.Username}}</b>,{{end}}
+{{define "heading"}}Confirm Your Email Address{{end}}
+{{define "content"}}
+                <p>
+                    <br><i>If you believe you have received this email in error
+                    then simply disregard this message.</i>
+                </p>
+                <p>
+                    To finish changing the email address for your Canopy
+                    account to this one, enter the following confirmation
+                    code.  The code will expire in 24 hours.
+                </p>
+                <p>
+                    <font size=5><b>{{.Code}}</b></font>
+                </p>
+                <h3><br>Manage Your Devices</h3>
+                <p>
+                    <a href="{{.ManageLink}}">{{.ManageLink}}</a>
+                </p>
+{{end}}`
+
+const confirmEmailChangeText = `{{define "greeting"}}Hi {{.Username}},{{end}}
+{{define "heading"}}Confirm Your Email Address{{end}}
+{{define "content"}}
+If you believe you have received this email in error then simply disregard
+this message.
+
+To finish changing the email address for your Canopy account to this one,
+enter the following confirmation code.  The code will expire in 24 hours.
+
+    {{.Code}}
+
+Manage your devices here:
+
+{{.ManageLink}}
+{{end}}`
+
+const emailChangedSubject = `Your Canopy email address has changed (on {{.Hostname}})`
+
+const emailChangedHTML = `{{define "greeting"}}Hi <b>{{.Username}}</b>,{{end}}
+{{define "heading"}}Email Address Changed{{end}}
+{{define "content"}}
+                <p>
+                    The email address for your Canopy account has been
+                    changed to <b>{{.NewEmail}}</b>.  We will no longer
+                    send email to this address.
+                </p>
+                <p>
+                    If you did not make this change, please contact the
+                    administrator of {{.Hostname}} right away.
+                </p>
+{{end}}`
+
+const emailChangedText = `{{define "greeting"}}Hi {{.Username}},{{end}}
+{{define "heading"}}Email Address Changed{{end}}
+{{define "content"}}
+The email address for your Canopy account has been changed to
+{{.NewEmail}}.  We will no longer send email to this address.
+
+If you did not make this change, please contact the administrator of
+{{.Hostname}} right away.
+{{end}}`
+
+// Sent to the new address to confirm an email address change.  Templates
+// see Username, Code, ManageLink and Hostname.
+func MailMessageConfirmEmailChange(msg mail.MailMessage, lang, username, code, manageLink, hostname string) error {
+    return render(msg, lang, "confirm_email_change", map[string]interface{}{
+        "Username": username,
+        "Code": code,
+        "ManageLink": manageLink,
+        "Hostname": hostname,
+    })
+}
+
+// Sent to the old address once an email address change has been confirmed.
+// Templates see Username, NewEmail and Hostname.
+func MailMessageEmailChanged(msg mail.MailMessage, lang, username, newEmail, hostname string) error {
+    return render(msg, lang, "email_changed", map[string]interface{}{
+        "Username": username,
+        "NewEmail": newEmail,
+        "Hostname": hostname,
+    })
+}
@@ -0,0 +1,67 @@
+// Copyright 2015 SimpleThings, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package messages
+
+// The layouts shared by every message.  Every message's data includes
+// Hostname.
+const layoutHTML = `<html>
+    <body style='font-family: sans-serif'>
+    <table align="center" width="600" border=0 cellspacing=0 cellpadding=0 style="border-collapse: collapse;">
+        <tr>
+            <td bgcolor=#204080 style='border:4px solid #204080; color:#ffffff; padding: 16px 16px 0px 16px;'>
+                <p>
+                    {{template "greeting" .}}
+                </p>
+                <p>
+                    <font size=6><b>{{template "heading" .}}</b></font>
+                </p>
+                <br>
+            </td>
+        </tr>
+        <tr>
+            <td bgcolor=#f0f0f0 style='border:4px solid #204080; color:#303030; padding: 16px 16px 16px 16px;'>
+                {{template "content" .}}
+                <br>
+            </td>
+        </tr>
+        <tr>
+            <td bgcolor=#ffff80 style='border:4px solid #204080; color:#303030; padding: 16px 16px 16px 16px;'>
+                <b>Note</b>: This is only for
+                <b>{{.Hostname}}</b>.  Other deployments of the Canopy
+                Server have separate accounts.
+            </td>
+        </tr>
+        <tr>
+            <td style='font-size:12px'>
+                <br>
+                <b>Web: </b><a href=http://canopy.link>canopy.link</a>
+                <br><b>Twitter:</b><a href='http://twitter.com/CanopyIOT'>@CanopyIoT</a>
+                <br><b>Github:</b><a href='http://github.com/canopy-project'>github.com/canopy-project</a>
+                <br><b>Forum:</b><a href='http://canopy.lefora.com'>canopy.lefora.com</a>
+            </td>
+        </tr>
+    </table>
+    </body>
+</html>
+`
+
+const layoutText = `{{template "greeting" .}}
+
+{{template "heading" .}}
+{{template "content" .}}
+--
+This is only for {{.Hostname}}.  Other deployments of the Canopy Server
+have separate accounts.
+`
@@ -18,59 +18,48 @@ import (
     "canopy/mail"
 )
 
-func MailMessageCreatedAccount(msg mail.MailMessage, username, activationLink, manageLink, hostname string) {
-    msg.SetSubject("Your New Canopy Account (on " + hostname + ")")
+const newAccountSubject = `Your New Canopy Account (on {{.Hostname}})`
 
-    msg.SetHTML(`<html>
-    <body style='font-family: sans-serif'>
-    <table align="center" width="600" border=0 cellspacing=0 cellpadding=0 style="border-collapse: collapse;">
-        <tr>
-            <td bgcolor=#204080 style='border:4px solid #204080; color:#ffffff; padding: 16px 16px 0px 16px;'>
-                <p>
-                    Hi <b>` + username + `</b>,
-                </p>
-                <p>
-                    <font size=6><b>Welcome to Canopy</b></font>
-                </p>
+const newAccountHTML = `{{define "greeting"}}Hi <b>{{.Username}}</b>,{{end}}
+{{define "heading"}}Welcome to Canopy{{end}}
+{{define "content"}}
                 <p>The open cloud for IoT.</p>
-                <br>
-            </td>
-        </tr>
-        <tr>
-            <td bgcolor=#f0f0f0 style='border:4px solid #204080; color:#303030; padding: 16px 16px 16px 16px;'>
                 <h3><br>Activate Your Account</h3>
                 <p>
                     You must activate your account by clicking the link below.
                 </p>
 
                 <p>
-                    <a href=` + activationLink + `>Activate your account.</a>
+                    <a href="{{.ActivationLink}}">Activate your account.</a>
                 </p>
                 <h3><br>Manage Your Devices</h3>
                 Manage your Canopy-enabled devices by going here:
                 <p>
-                    <a href=` + manageLink + `>` + manageLink + `</a>
+                    <a href="{{.ManageLink}}">{{.ManageLink}}</a>
                 </p>
-                <br>
-            </td>
-        </tr>
-        <tr>
-            <td bgcolor=#ffff80 style='border:4px solid #204080; color:#303030; padding: 16px 16px 16px 16px;'>
-                <b>Note</b>: This account is only for
-                <b>` + hostname + `</b>.  Other deployments of the Canopy
-                Server require separate accounts.
-            </td>
-        </tr>
-        <tr>
-            <td style='font-size:12px'>
-                <br>
-                <b>Web: </b><a href=http://canopy.link>canopy.link</a>
-                <br><b>Twitter:</b><a href='http://twitter.com/CanopyIOT'>@CanopyIoT</a>
-                <br><b>Github:</b><a href='http://github.com/canopy-project'>github.com/canopy-project</a>
-                <br><b>Forum:</b><a href='http://canopy.lefora.com'>canopy.lefora.com</a>
-            </td>
-        </tr>
-    </table>
-    </body>
-</html>`)
+{{end}}`
+
+const newAccountText = `{{define "greeting"}}Hi {{.Username}},{{end}}
+{{define "heading"}}Welcome to Canopy{{end}}
+{{define "content"}}
+The open cloud for IoT.
+
+You must activate your account by going to the link below:
+
+{{.ActivationLink}}
+
+Manage your Canopy-enabled devices by going here:
+
+{{.ManageLink}}
+{{end}}`
+
+// Sent when an account is created.  Templates see Username, ActivationLink,
+// ManageLink and Hostname.
+func MailMessageCreatedAccount(msg mail.MailMessage, lang, username, activationLink, manageLink, hostname string) error {
+    return render(msg, lang, "new_account", map[string]interface{}{
+        "Username": username,
+        "ActivationLink": activationLink,
+        "ManageLink": manageLink,
+        "Hostname": hostname,
+    })
 }
@@ -0,0 +1,73 @@
+// Copyright 2015 SimpleThings, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+package messages
+
+import (
+    "canopy/mail"
+    "time"
+)
+
+// A notification from a device, as shown in notification emails.
+type NotificationItem struct {
+    DeviceName string
+    NotifyType string
+    Msg string
+    Time time.Time
+}
+
+const notificationSubject = `{{if eq (len .Items) 1}}Message from {{(index .Items 0).DeviceName}}{{else}}Messages from your devices{{end}} (on {{.Hostname}})`
+
+const notificationHTML = `{{define "greeting"}}Hi <b>{{.Username}}</b>,{{end}}
+{{define "heading"}}{{if eq (len .Items) 1}}Message from {{(index .Items 0).DeviceName}}{{else}}{{len .Items}} messages from your devices{{end}}{{end}}
+{{define "content"}}
+                {{range .Items}}
+                <p>
+                    <b>{{.DeviceName}}</b>
+                    <font color=#808080>({{.NotifyType}}, {{.Time.Format "Jan 2 15:04 MST"}})</font>
+                    <br>{{.Msg}}
+                </p>
+                {{end}}
+                <p>
+                    To view your devices or change how you are notified,
+                    go here:
+                </p>
+                <p>
+                    <a href="{{.ManageLink}}">{{.ManageLink}}</a>
+                </p>
+{{end}}`
+
+const notificationText = `{{define "greeting"}}Hi {{.Username}},{{end}}
+{{define "heading"}}{{if eq (len .Items) 1}}Message from {{(index .Items 0).DeviceName}}{{else}}{{len .Items}} messages from your devices{{end}}{{end}}
+{{define "content"}}{{range .Items}}
+{{.DeviceName}} ({{.NotifyType}}, {{.Time.Format "Jan 2 15:04 MST"}}):
+{{.Msg}}
+{{end}}
+To view your devices or change how you are notified, go here:
+
+{{.ManageLink}}
+{{end}}`
+
+// Fill in an email with one or more notifications for <username>.  Several
+// notifications are sent together as a digest.  Templates see Username,
+// Items (a list of NotificationItem), ManageLink and Hostname.
+func MailMessageNotification(msg mail.MailMessage, lang, username string, items []NotificationItem, manageLink, hostname string) error {
+    return render(msg, lang, "notification", map[string]interface{}{
+        "Username": username,
+        "Items": items,
+        "ManageLink": manageLink,
+        "Hostname": hostname,
+    })
+}
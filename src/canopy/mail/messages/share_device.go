@@ -0,0 +1,61 @@
+// Copyright 2015 SimpleThings, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+package messages
+
+import (
+    "canopy/mail"
+)
+
+const shareDeviceSubject = `{{.Username}} shared {{.DeviceName}} with you (on {{.Hostname}})`
+
+const shareDeviceHTML = `{{define "greeting"}}Hi,{{end}}
+{{define "heading"}}{{.DeviceName}}{{end}}
+{{define "content"}}
+                <p>
+                    <b>{{.Username}}</b> has shared a device with you:
+                </p>
+                <p>
+                    <a href="{{.ShareLink}}">{{.DeviceName}}</a>
+                </p>
+                <h3><br>What is Canopy?</h3>
+                <p>
+                    <b>Canopy</b> is a secure platform for monitoring and
+                    controlling physical devices.  Learn more at
+                    <a href=http://canopy.link>canopy.link</a>.
+                </p>
+{{end}}`
+
+const shareDeviceText = `{{define "greeting"}}Hi,{{end}}
+{{define "heading"}}{{.DeviceName}}{{end}}
+{{define "content"}}
+{{.Username}} has shared a device with you:
+
+{{.ShareLink}}
+
+Canopy is a secure platform for monitoring and controlling physical
+devices.  Learn more at http://canopy.link.
+{{end}}`
+
+// Sent by a user to somebody they want to share a device with.  Templates
+// see Username (the sender), DeviceName, ShareLink and Hostname.
+func MailMessageShareDevice(msg mail.MailMessage, lang, username, deviceName, shareLink, hostname string) error {
+    return render(msg, lang, "share_device", map[string]interface{}{
+        "Username": username,
+        "DeviceName": deviceName,
+        "ShareLink": shareLink,
+        "Hostname": hostname,
+    })
+}
@@ -0,0 +1,272 @@
+// Copyright 2015 SimpleThings, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package messages renders the emails that Canopy sends from templates.
+//
+// Each message <name> has three templates: <name>.subject and <name>.txt,
+// which use text/template, and <name>.html, which uses html/template so that
+// anything that came from users or devices is escaped.  The .txt and .html
+// templates define "greeting", "heading" and "content", which are placed
+// into the shared layout.txt and layout.html templates.  Overriding the
+// layouts is enough to rebrand every message.
+//
+// Templates are looked up by language.  If the "email-template-dir" option
+// is set, <dir>/<lang>/<file> is used in preference to the built-in
+// template for <lang>.  Languages fall back from "pt-br" to "pt" and then to
+// "en", one file at a time, so a directory only needs the files it changes.
+package messages
+
+import (
+    "bytes"
+    "canopy/datalayer"
+    "canopy/mail"
+    "fmt"
+    htmltemplate "html/template"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "strings"
+    "sync"
+    "text/template"
+)
+
+// Language used when there is no template for the account's language.
+const defaultLanguage = "en"
+
+// Names of all messages, used to check templates when they are loaded.
+var messageNames = []string{
+    "account_deleted",
+    "account_locked",
+    "confirm_email_change",
+    "email_changed",
+    "new_account",
+    "notification",
+    "reset_password",
+    "share_device",
+}
+
+// Built-in templates, by language and then by file name.
+var builtinTemplates = map[string]map[string]string{
+    "en": {
+        "layout.html": layoutHTML,
+        "layout.txt": layoutText,
+        "account_deleted.subject": accountDeletedSubject,
+        "account_deleted.txt": accountDeletedText,
+        "account_deleted.html": accountDeletedHTML,
+        "account_locked.subject": accountLockedSubject,
+        "account_locked.txt": accountLockedText,
+        "account_locked.html": accountLockedHTML,
+        "confirm_email_change.subject": confirmEmailChangeSubject,
+        "confirm_email_change.txt": confirmEmailChangeText,
+        "confirm_email_change.html": confirmEmailChangeHTML,
+        "email_changed.subject": emailChangedSubject,
+        "email_changed.txt": emailChangedText,
+        "email_changed.html": emailChangedHTML,
+        "new_account.subject": newAccountSubject,
+        "new_account.txt": newAccountText,
+        "new_account.html": newAccountHTML,
+        "notification.subject": notificationSubject,
+        "notification.txt": notificationText,
+        "notification.html": notificationHTML,
+        "reset_password.subject": resetPasswordSubject,
+        "reset_password.txt": resetPasswordText,
+        "reset_password.html": resetPasswordHTML,
+        "share_device.subject": shareDeviceSubject,
+        "share_device.txt": shareDeviceText,
+        "share_device.html": shareDeviceHTML,
+    },
+}
+
+type messageTemplates struct {
+    subject *template.Template
+    text *template.Template
+    html *htmltemplate.Template
+}
+
+// TemplateSet is a set of email templates loaded by LoadTemplates.
+type TemplateSet struct {
+    dir string
+    lock sync.Mutex
+    cache map[string]*messageTemplates
+}
+
+var currentTemplatesLock sync.RWMutex
+var currentTemplates = &TemplateSet{cache: map[string]*messageTemplates{}}
+
+// Load templates from <dir>, or only the built-in templates if <dir> is "".
+// Every template, including those for each language directory in <dir>, is
+// parsed up front so that mistakes are reported here rather than when mail
+// is sent.  The templates are not used until passed to UseTemplates.
+func LoadTemplates(dir string) (*TemplateSet, error) {
+    set := &TemplateSet{dir: dir, cache: map[string]*messageTemplates{}}
+
+    langs := []string{defaultLanguage}
+    if dir != "" {
+        entries, err := ioutil.ReadDir(dir)
+        if err != nil {
+            return nil, err
+        }
+        for _, entry := range entries {
+            if entry.IsDir() && datalayer.LanguagePattern.MatchString(entry.Name()) {
+                langs = append(langs, entry.Name())
+            }
+        }
+    }
+    for _, lang := range langs {
+        for _, name := range messageNames {
+            _, err := set.lookup(lang, name)
+            if err != nil {
+                return nil, err
+            }
+        }
+    }
+    return set, nil
+}
+
+// Use <set> for all messages sent from now on.
+func UseTemplates(set *TemplateSet) {
+    currentTemplatesLock.Lock()
+    currentTemplates = set
+    currentTemplatesLock.Unlock()
+}
+
+// Is <lang> a language tag that an account can choose, like "en", "pt-BR"
+// or "pt_BR"?
+func IsLanguage(lang string) bool {
+    return datalayer.LanguagePattern.MatchString(normalizeLanguage(lang))
+}
+
+func normalizeLanguage(lang string) string {
+    return strings.Replace(strings.ToLower(lang), "_", "-", -1)
+}
+
+// Languages to try for <lang>, most specific first.
+func languageFallbacks(lang string) []string {
+    lang = normalizeLanguage(lang)
+    if !datalayer.LanguagePattern.MatchString(lang) {
+        return []string{defaultLanguage}
+    }
+    out := []string{}
+    for {
+        out = append(out, lang)
+        i := strings.LastIndex(lang, "-")
+        if i < 0 {
+            break
+        }
+        lang = lang[:i]
+    }
+    if lang != defaultLanguage {
+        out = append(out, defaultLanguage)
+    }
+    return out
+}
+
+// Read the source of template file <file>, trying each language in turn.
+func (set *TemplateSet) source(langs []string, file string) (string, error) {
+    for _, lang := range langs {
+        if set.dir != "" {
+            src, err := ioutil.ReadFile(filepath.Join(set.dir, lang, file))
+            if err == nil {
+                return string(src), nil
+            } else if !os.IsNotExist(err) {
+                return "", err
+            }
+        }
+        src, ok := builtinTemplates[lang][file]
+        if ok {
+            return src, nil
+        }
+    }
+    return "", fmt.Errorf("No email template %s", file)
+}
+
+// Get the parsed templates for message <name> in language <lang>, parsing
+// and caching them on first use.
+func (set *TemplateSet) lookup(lang, name string) (*messageTemplates, error) {
+    langs := languageFallbacks(lang)
+    key := langs[0] + "/" + name
+
+    set.lock.Lock()
+    defer set.lock.Unlock()
+    tmpls, ok := set.cache[key]
+    if ok {
+        return tmpls, nil
+    }
+
+    files := map[string]string{}
+    for _, file := range []string{"layout.txt", "layout.html", name + ".subject", name + ".txt", name + ".html"} {
+        src, err := set.source(langs, file)
+        if err != nil {
+            return nil, err
+        }
+        files[file] = src
+    }
+
+    tmpls = &messageTemplates{}
+    var err error
+    tmpls.subject, err = template.New(name + ".subject").Parse(files[name + ".subject"])
+    if err != nil {
+        return nil, fmt.Errorf("Error parsing %s email template: %s", langs[0], err)
+    }
+    tmpls.text, err = template.New("layout.txt").Parse(files["layout.txt"])
+    if err == nil {
+        _, err = tmpls.text.New(name + ".txt").Parse(files[name + ".txt"])
+    }
+    if err != nil {
+        return nil, fmt.Errorf("Error parsing %s email template: %s", langs[0], err)
+    }
+    tmpls.html, err = htmltemplate.New("layout.html").Parse(files["layout.html"])
+    if err == nil {
+        _, err = tmpls.html.New(name + ".html").Parse(files[name + ".html"])
+    }
+    if err != nil {
+        return nil, fmt.Errorf("Error parsing %s email template: %s", langs[0], err)
+    }
+
+    set.cache[key] = tmpls
+    return tmpls, nil
+}
+
+// Fill in the subject and both bodies of <msg> from the templates for
+// message <name> in language <lang>.
+func render(msg mail.MailMessage, lang, name string, data map[string]interface{}) error {
+    currentTemplatesLock.RLock()
+    set := currentTemplates
+    currentTemplatesLock.RUnlock()
+
+    tmpls, err := set.lookup(lang, name)
+    if err != nil {
+        return err
+    }
+
+    var subject, text, html bytes.Buffer
+    err = tmpls.subject.Execute(&subject, data)
+    if err != nil {
+        return fmt.Errorf("Error rendering %s email: %s", name, err)
+    }
+    err = tmpls.text.ExecuteTemplate(&text, "layout.txt", data)
+    if err != nil {
+        return fmt.Errorf("Error rendering %s email: %s", name, err)
+    }
+    err = tmpls.html.ExecuteTemplate(&html, "layout.html", data)
+    if err != nil {
+        return fmt.Errorf("Error rendering %s email: %s", name, err)
+    }
+
+    // Subjects are a single line, however the template file ends.
+    msg.SetSubject(strings.Join(strings.Fields(subject.String()), " "))
+    msg.SetText(text.String())
+    msg.SetHTML(html.String())
+    return nil
+}
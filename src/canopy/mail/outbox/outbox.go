@@ -0,0 +1,335 @@
+// Copyright 2015 SimpleThings, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+// Package outbox sends email in the background.  An Outbox is a
+// mail.MailClient whose Send only stores the message in the database.
+// Workers then send stored messages through the configured mail service,
+// retrying with exponential backoff until they are sent or MaxAttempts is
+// reached.
+//
+// Identical messages (same sender, recipients, subject and body) sent within
+// datalayer.OutboxMailDedupWindow of each other are only sent once.
+//
+// Messages can be inspected and resent with canodevtool's "list-mail",
+// "show-mail" and "resend-mail" commands.
+package outbox
+
+import (
+    "canopy/canolog"
+    "canopy/config"
+    "canopy/datalayer"
+    "canopy/datalayer/cassandra_datalayer"
+    "canopy/mail"
+    "canopy/util/limiter"
+    "crypto/sha256"
+    "encoding/hex"
+    "errors"
+    "github.com/gocql/gocql"
+    netmail "net/mail"
+    "strings"
+    "sync"
+    "time"
+)
+
+const (
+    // Number of messages sent at once.
+    NumWorkers = 4
+
+    // Messages that fail this many times are marked failed.
+    MaxAttempts = 10
+
+    // How often stored messages are checked.
+    pollInterval = 10*time.Second
+)
+
+// Get how long to wait after attempt number <attempt> fails: 1 minute,
+// doubling each time, up to an hour.
+func RetryDelay(attempt int) time.Duration {
+    return limiter.Backoff(attempt, 0, time.Minute, time.Hour)
+}
+
+// Outbox stores outgoing email and sends it in the background.  There
+// should be one per server process.  Several servers may run Outboxes;
+// each attempt at sending a message is claimed in the database first, and
+// only the server that claims it sends it.
+type Outbox struct {
+    cfg config.Config
+    conn datalayer.Connection
+    clientLock sync.RWMutex
+    client mail.MailClient
+    wake chan bool
+    jobs chan datalayer.OutboxMail
+
+    // Time of the last successful check for due messages.
+    lastTick time.Time
+}
+
+// outboxMessage is a message built with Outbox.NewMail.
+type outboxMessage struct {
+    mail datalayer.OutboxMail
+}
+
+// Create an Outbox that sends messages through <client>.
+func NewOutbox(cfg config.Config, client mail.MailClient) *Outbox {
+    return &Outbox{
+        cfg: cfg,
+        client: client,
+        wake: make(chan bool, 1),
+        jobs: make(chan datalayer.OutboxMail),
+    }
+}
+
+// Connect to the database and start sending stored messages.
+func (outbox *Outbox) Start() error {
+    dl := cassandra_datalayer.NewDatalayer(outbox.cfg)
+    conn, err := dl.Connect("canopy")
+    if err != nil {
+        return err
+    }
+    outbox.conn = conn
+    outbox.lastTick = time.Now().Add(-datalayer.DueIndexLookback)
+
+    for i := 0; i < NumWorkers; i++ {
+        go outbox.work()
+    }
+    go outbox.run()
+    return nil
+}
+
+// Send stored messages through <client> from now on.  Used when the mail
+// settings are reloaded.  Attempts already in progress finish with the old
+// client.
+func (outbox *Outbox) SetClient(client mail.MailClient) {
+    outbox.clientLock.Lock()
+    outbox.client = client
+    outbox.clientLock.Unlock()
+}
+
+func (outbox *Outbox) NewMail() mail.MailMessage {
+    return &outboxMessage{}
+}
+
+// Store <m> to be sent.  Returns an error only if it couldn't be stored.
+func (outbox *Outbox) Send(m mail.MailMessage) error {
+    msg, ok := m.(*outboxMessage)
+    if !ok {
+        return errors.New("Message was not constructed with Outbox")
+    }
+    if outbox.conn == nil {
+        return errors.New("Outbox not started")
+    }
+    if len(msg.mail.ToEmails) == 0 {
+        return errors.New("Message has no recipients")
+    }
+
+    msg.mail.DedupKey = dedupKey(msg.mail)
+    id, duplicate, err := outbox.conn.EnqueueOutboxMail(msg.mail)
+    if err != nil {
+        return err
+    }
+    if duplicate {
+        canolog.Info("Not sending duplicate of outbox mail ", id)
+        return nil
+    }
+
+    select {
+    case outbox.wake <- true:
+    default:
+    }
+    return nil
+}
+
+// Mark <id> to be sent again, even if it has already been sent or has
+// failed.  A running Outbox sends it within a few seconds.
+func Resend(conn datalayer.Connection, id gocql.UUID) error {
+    msg, err := conn.LookupOutboxMail(id)
+    if err != nil {
+        return err
+    }
+    msg.Status = datalayer.OutboxMailPending
+    msg.Attempts = 0
+    msg.NextAttempt = time.Now()
+    msg.LastError = ""
+    msg.Sent = time.Time{}
+    return conn.SaveOutboxMail(*msg)
+}
+
+// Identify <msg> by its sender, recipients and content.
+func dedupKey(msg datalayer.OutboxMail) string {
+    h := sha256.New()
+    for _, s := range []string{
+            msg.FromEmail,
+            strings.Join(msg.ToEmails, ","),
+            msg.ReplyTo,
+            msg.Subject,
+            msg.Text,
+            msg.HTML} {
+        h.Write([]byte(s))
+        h.Write([]byte{0})
+    }
+    return hex.EncodeToString(h.Sum(nil))
+}
+
+func (outbox *Outbox) run() {
+    ticker := time.NewTicker(pollInterval)
+    for {
+        select {
+        case <-ticker.C:
+        case <-outbox.wake:
+        }
+        outbox.dispatchDue(time.Now())
+    }
+}
+
+// Hand every message that is due to the workers.
+func (outbox *Outbox) dispatchDue(now time.Time) {
+    msgs, err := outbox.conn.DueOutboxMail(outbox.lastTick, now)
+    if err != nil {
+        canolog.Error("Error reading mail outbox: ", err)
+        return
+    }
+    outbox.lastTick = now
+    for _, msg := range msgs {
+        outbox.jobs <- msg
+    }
+}
+
+func (outbox *Outbox) work() {
+    for msg := range outbox.jobs {
+        outbox.attempt(msg)
+    }
+}
+
+// Make one attempt at sending <msg>, if no other server has.
+func (outbox *Outbox) attempt(msg datalayer.OutboxMail) {
+    now := time.Now()
+    claimed, err := outbox.conn.ClaimOutboxMailAttempt(msg, now.Add(RetryDelay(msg.Attempts + 1)))
+    if err != nil || !claimed {
+        return
+    }
+    msg.Attempts++
+    msg.NextAttempt = now.Add(RetryDelay(msg.Attempts))
+
+    err = outbox.deliver(msg)
+    if err == nil {
+        msg.Status = datalayer.OutboxMailSent
+        msg.Sent = time.Now()
+        msg.LastError = ""
+    } else {
+        canolog.Warn("Attempt ", msg.Attempts, " at sending outbox mail ", msg.ID, " failed: ", err)
+        msg.LastError = err.Error()
+        if msg.Attempts >= MaxAttempts {
+            canolog.Error("Giving up on outbox mail ", msg.ID, ": ", err)
+            msg.Status = datalayer.OutboxMailFailed
+        }
+    }
+    err = outbox.conn.SaveOutboxMail(msg)
+    if err != nil {
+        canolog.Error("Error saving outbox mail ", msg.ID, ": ", err)
+    }
+}
+
+// Send <msg> through the mail service.
+func (outbox *Outbox) deliver(msg datalayer.OutboxMail) error {
+    outbox.clientLock.RLock()
+    client := outbox.client
+    outbox.clientLock.RUnlock()
+
+    m := client.NewMail()
+    err := m.AddTos(msg.ToEmails, msg.ToNames)
+    if err != nil {
+        return err
+    }
+    err = m.SetFrom(msg.FromEmail, msg.FromName)
+    if err != nil {
+        return err
+    }
+    if msg.ReplyTo != "" {
+        err = m.SetReplyTo(msg.ReplyTo)
+        if err != nil {
+            return err
+        }
+    }
+    m.SetSubject(msg.Subject)
+    if msg.Text != "" {
+        m.SetText(msg.Text)
+    }
+    if msg.HTML != "" {
+        m.SetHTML(msg.HTML)
+    }
+    // Not every mail service supports setting the date.
+    m.SetDate(msg.Created)
+    return client.Send(m)
+}
+
+func (msg *outboxMessage) AddTo(email string, name string) error {
+    addr, err := netmail.ParseAddress(email)
+    if err != nil {
+        return err
+    }
+    msg.mail.ToEmails = append(msg.mail.ToEmails, addr.Address)
+    msg.mail.ToNames = append(msg.mail.ToNames, name)
+    return nil
+}
+
+func (msg *outboxMessage) AddTos(emails []string, names []string) error {
+    for i, email := range emails {
+        name := ""
+        if i < len(names) {
+            name = names[i]
+        }
+        err := msg.AddTo(email, name)
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func (msg *outboxMessage) SetSubject(subject string) {
+    msg.mail.Subject = subject
+}
+
+func (msg *outboxMessage) SetText(text string) {
+    msg.mail.Text = text
+}
+
+func (msg *outboxMessage) SetHTML(html string) {
+    msg.mail.HTML = html
+}
+
+func (msg *outboxMessage) SetFrom(email string, name string) error {
+    addr, err := netmail.ParseAddress(email)
+    if err != nil {
+        return err
+    }
+    msg.mail.FromEmail = addr.Address
+    msg.mail.FromName = name
+    return nil
+}
+
+func (msg *outboxMessage) SetReplyTo(email string) error {
+    addr, err := netmail.ParseAddress(email)
+    if err != nil {
+        return err
+    }
+    msg.mail.ReplyTo = addr.Address
+    return nil
+}
+
+// The date is always the time the message is stored.
+func (msg *outboxMessage) SetDate(date time.Time) error {
+    return nil
+}
@@ -0,0 +1,109 @@
+// Copyright 2015 SimpleThings, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+package notify
+
+import (
+    "canopy/canolog"
+    "canopy/config"
+    "canopy/datalayer"
+    "canopy/datalayer/cassandra_datalayer"
+    "time"
+)
+
+// How often queued notifications are checked.
+const deliveryInterval = time.Minute
+
+// Deliverer sends queued notifications once they are due.  There should be
+// one per server process.  Several servers may run Deliverers; each queued
+// notification is removed from the queue before it is sent, and only the
+// server that removes it sends it.
+type Deliverer struct {
+    cfg config.Config
+    conn datalayer.Connection
+    senders *Senders
+
+    // Time of the last successful check for due notifications.
+    lastTick time.Time
+}
+
+func NewDeliverer(cfg config.Config, senders *Senders) *Deliverer {
+    return &Deliverer{
+        cfg: cfg,
+        senders: senders,
+    }
+}
+
+// Connect to the database and start sending queued notifications.
+func (d *Deliverer) Start() error {
+    dl := cassandra_datalayer.NewDatalayer(d.cfg)
+    conn, err := dl.Connect("canopy")
+    if err != nil {
+        return err
+    }
+    d.conn = conn
+    d.lastTick = time.Now().Add(-datalayer.DueIndexLookback)
+
+    go d.run()
+    return nil
+}
+
+func (d *Deliverer) run() {
+    ticker := time.NewTicker(deliveryInterval)
+    for now := range ticker.C {
+        d.tick(now)
+    }
+}
+
+func (d *Deliverer) tick(now time.Time) {
+    usernames, err := d.conn.DueNotificationUsernames(d.lastTick, now)
+    if err != nil {
+        canolog.Error("Error reading notification queue: ", err)
+        return
+    }
+    d.lastTick = now
+    for _, username := range usernames {
+        d.deliverDue(username, now)
+    }
+}
+
+// Send <username>'s due notifications.  Due email notifications are sent
+// together, as one message.
+func (d *Deliverer) deliverDue(username string, now time.Time) {
+    queued, err := d.conn.QueuedNotifications(username)
+    if err != nil {
+        canolog.Error("Error reading notification queue for ", username, ": ", err)
+        return
+    }
+
+    byChannel := map[string][]datalayer.QueuedNotification{}
+    for _, notification := range queued {
+        if notification.Due.After(now) {
+            continue
+        }
+        claimed, err := d.conn.DeleteQueuedNotification(username, notification.ID)
+        if err != nil || !claimed {
+            continue
+        }
+        byChannel[notification.Channel] = append(byChannel[notification.Channel], notification)
+    }
+
+    for channel, notifications := range byChannel {
+        err = send(d.cfg, d.conn, d.senders, username, channel, notifications)
+        if err != nil {
+            canolog.Error("Problem sending queued notifications to ", username, ": ", err)
+        }
+    }
+}
@@ -13,54 +13,398 @@
  * See the License for the specific language governing permissions and
  * limitations under the License.
  */
+
+// Package notify records notifications raised by devices (or on their
+// behalf, by alarm rules) and delivers them to every account with access to
+// the device, according to each account's NotificationPrefs.
+//
+// Notifications that an account's quiet hours or digest preferences hold
+// back are queued in the database and sent later by a Deliverer.  SMS and
+// push notifications are handed to the Senders' workers, so a slow service
+// doesn't hold up the device or alarm rule that raised them.  Every attempt
+// to send a notification is recorded as a datalayer.NotificationDelivery.
 package notify
 
 import (
+    "canopy/canolog"
+    "canopy/config"
     "canopy/datalayer"
+    "canopy/events"
     "canopy/mail"
+    "canopy/mail/messages"
+    "canopy/notify/transport"
     "fmt"
     "time"
 )
 
-func ProcessNotification(device datalayer.Device, notifyType string, mailer mail.MailClient, msg string) error {
+// Notification types accepted by ProcessNotification.
+var NotifyTypes = []string{
+    "low-priority",
+    "med-priority",
+    "high-priority",
+    "sms",
+    "email",
+    "in-app",
+}
+
+var notifyTypeInts = map[string]int{
+    "low-priority" : datalayer.NotificationType_LowPriority,
+    "med-priority" : datalayer.NotificationType_MedPriority,
+    "high-priority" : datalayer.NotificationType_HighPriority,
+    "sms" : datalayer.NotificationType_SMS,
+    "email" : datalayer.NotificationType_Email,
+    "in-app" : datalayer.NotificationType_InApp,
+}
+
+// Get the name of a stored notification type, as accepted by
+// ProcessNotification.
+func TypeName(notifyTypeInt int) string {
+    for name, value := range notifyTypeInts {
+        if value == notifyTypeInt {
+            return name
+        }
+    }
+    return "unknown"
+}
+
+// Notification types whose channel is chosen by the recipient.
+var Priorities = []string{
+    "low-priority",
+    "med-priority",
+    "high-priority",
+}
+
+// Valid values for NotificationPrefs fields.
+var (
+    Channels = []string{
+        datalayer.NotifyChannelNone,
+        datalayer.NotifyChannelInApp,
+        datalayer.NotifyChannelEmail,
+        datalayer.NotifyChannelSMS,
+    }
+    EmailDeliveries = []string{
+        datalayer.NotifyDeliveryImmediate,
+        datalayer.NotifyDeliveryHourlyDigest,
+        datalayer.NotifyDeliveryDailyDigest,
+    }
+)
+
+// Local hour of day at which daily digests are sent.
+const DigestHour = 8
+
+// Senders are the services that notifications are delivered through.
+// "in-app" notifications are sent as push notifications to the account's
+// registered mobile devices.
+type Senders struct {
+    Mail mail.MailClient
+    SMS transport.Transport
+    Push transport.Transport
+
+    cfg config.Config
+    conn datalayer.Connection
+    jobs chan sendJob
+}
+
+// Create Senders that send email through <mailer>, and SMS and push
+// notifications through the services selected by the "sms-service" and
+// "push-service" options.  SMS and push notifications are sent once Start
+// is called.
+func NewSenders(cfg config.Config, mailer mail.MailClient) (*Senders, error) {
+    sms, err := transport.NewSMSTransport(cfg)
+    if err != nil {
+        return nil, err
+    }
+    push, err := transport.NewPushTransport(cfg)
+    if err != nil {
+        return nil, err
+    }
+    return &Senders{
+        Mail: mailer,
+        SMS: sms,
+        Push: push,
+        cfg: cfg,
+        jobs: make(chan sendJob, sendQueueSize),
+    }, nil
+}
+
+// Record a notification from <device> and deliver it to every account with
+// access to the device.  <hub> and <senders> may be nil.  Problems
+// delivering to individual accounts are logged rather than returned, since
+// the notification is already recorded.
+func ProcessNotification(
+        cfg config.Config,
+        conn datalayer.Connection,
+        hub *events.Hub,
+        senders *Senders,
+        device datalayer.Device,
+        notifyType string,
+        msg string) error {
     // Add to notification log
-    var notifyTypeInt int
-    switch notifyType {
-    case "low-priority":
-        notifyTypeInt = datalayer.NotificationType_LowPriority
-    case "med-priority":
-        notifyTypeInt = datalayer.NotificationType_MedPriority
-    case "high-priority":
-        notifyTypeInt = datalayer.NotificationType_HighPriority
-    case "sms":
-        notifyTypeInt = datalayer.NotificationType_SMS
-    case "email":
-        notifyTypeInt = datalayer.NotificationType_Email
-    case "in-app":
-        notifyTypeInt = datalayer.NotificationType_InApp
-    default:
+    notifyTypeInt, ok := notifyTypeInts[notifyType]
+    if !ok {
         return fmt.Errorf("Unexpected notifyType: %s", notifyType)
     }
 
-    err := device.InsertNotification(notifyTypeInt, time.Now(), msg)
+    now := time.Now()
+    err := device.InsertNotification(notifyTypeInt, now, msg)
     if (err != nil) {
         return err
     }
+    hub.Publish(device.IDString(), events.TypeNotification, map[string]interface{}{
+        "notify_type" : notifyType,
+        "msg" : msg,
+    })
 
-    // Send email
-    if notifyType == "email" && mailer != nil{
-        mailMsg := mailer.NewMail()
-        mailMsg.SetSubject("Message from your device")
-        mailMsg.SetText(msg)
+    access, err := device.AccountAccess()
+    if err != nil {
+        return err
+    }
+    notification := datalayer.QueuedNotification{
+        DeviceID: device.ID(),
+        DeviceName: device.Name(),
+        NotifyType: notifyType,
+        Msg: msg,
+        TimeIssued: now,
+    }
+    for username, accessLevel := range access {
+        if accessLevel == datalayer.NoAccess {
+            continue
+        }
+        notification.Username = username
+        err = deliverToAccount(cfg, conn, senders, notification, now)
+        if err != nil {
+            canolog.Error("Problem delivering notification to ", username, ": ", err)
+        }
+    }
 
-        // TODO: hack!
-        mailMsg.AddTo("greg@canopy.link", "Greg")
-        err = mailer.Send(mailMsg)
+    return nil
+}
+
+// Send <notification> to its recipient now, or queue it if their
+// preferences say to send it later.
+func deliverToAccount(cfg config.Config, conn datalayer.Connection, senders *Senders, notification datalayer.QueuedNotification, now time.Time) error {
+    prefs, err := conn.NotificationPrefs(notification.Username)
+    if err != nil {
+        return err
+    }
+    notification.Channel = Channel(*prefs, notification.NotifyType)
+    if notification.Channel == datalayer.NotifyChannelNone {
+        // Already in the device's notification log.
+        return nil
+    }
+
+    notification.Due = DueTime(*prefs, notification.NotifyType, notification.Channel, now)
+    if notification.Due.After(now) {
+        err = conn.QueueNotification(notification)
         if err != nil {
             return err
         }
+        return conn.RecordNotificationDelivery(datalayer.NotificationDelivery{
+            DeviceID: notification.DeviceID,
+            TimeIssued: notification.TimeIssued,
+            Username: notification.Username,
+            Channel: notification.Channel,
+            Status: datalayer.DeliveryStatusQueued,
+            Time: now,
+        })
     }
+    return send(cfg, conn, senders, notification.Username, notification.Channel, []datalayer.QueuedNotification{notification})
+}
 
-    return nil
+// Get the channel on which an account with <prefs> receives notifications
+// of type <notifyType>.
+func Channel(prefs datalayer.NotificationPrefs, notifyType string) string {
+    switch notifyType {
+    case "sms", "email", "in-app":
+        return notifyType
+    }
+    channel, ok := prefs.Channels[notifyType]
+    if !ok {
+        channel = datalayer.DefaultNotificationPrefs(prefs.Username).Channels[notifyType]
+    }
+    return channel
 }
 
+// Get when a notification of type <notifyType>, raised at <now>, should be
+// sent on <channel> to an account with <prefs>.  High-priority notifications
+// are sent immediately.  Others wait until quiet hours are over and, for
+// email digests, until the next digest.
+func DueTime(prefs datalayer.NotificationPrefs, notifyType, channel string, now time.Time) time.Time {
+    if notifyType == "high-priority" {
+        return now
+    }
+    loc, err := time.LoadLocation(prefs.TimeZone)
+    if err != nil {
+        loc = time.UTC
+    }
+    due := quietHoursEnd(prefs, now.In(loc))
+
+    if channel == datalayer.NotifyChannelEmail {
+        switch prefs.EmailDelivery {
+        case datalayer.NotifyDeliveryHourlyDigest:
+            hour := time.Date(due.Year(), due.Month(), due.Day(), due.Hour(), 0, 0, 0, loc)
+            if hour.Before(due) {
+                hour = hour.Add(time.Hour)
+            }
+            due = hour
+        case datalayer.NotifyDeliveryDailyDigest:
+            digest := time.Date(due.Year(), due.Month(), due.Day(), DigestHour, 0, 0, 0, loc)
+            if !digest.After(due) {
+                digest = digest.AddDate(0, 0, 1)
+            }
+            due = quietHoursEnd(prefs, digest)
+        }
+    }
+    return due
+}
+
+// If <t> is during quiet hours, get the time they end.  Otherwise returns
+// <t>.
+func quietHoursEnd(prefs datalayer.NotificationPrefs, t time.Time) time.Time {
+    if prefs.QuietStart == prefs.QuietEnd {
+        return t
+    }
+    minutes := t.Hour()*60 + t.Minute()
+    var quiet bool
+    if prefs.QuietStart < prefs.QuietEnd {
+        quiet = minutes >= prefs.QuietStart && minutes < prefs.QuietEnd
+    } else {
+        // Quiet hours span midnight.
+        quiet = minutes >= prefs.QuietStart || minutes < prefs.QuietEnd
+    }
+    if !quiet {
+        return t
+    }
+    end := time.Date(t.Year(), t.Month(), t.Day(), 0, prefs.QuietEnd, 0, 0, t.Location())
+    if !end.After(t) {
+        end = end.AddDate(0, 0, 1)
+    }
+    return end
+}
+
+// Send <notifications> to <username> on <channel>, and record the outcome
+// for each of them.  Email notifications are sent together, as one message.
+// SMS and push notifications are left to the workers, which record the
+// outcome once they have sent them.
+// Returns an error only if the recipient could not be determined.
+func send(cfg config.Config, conn datalayer.Connection, senders *Senders, username, channel string, notifications []datalayer.QueuedNotification) error {
+    if senders == nil {
+        return nil
+    }
+
+    switch channel {
+    case datalayer.NotifyChannelEmail:
+        account, err := conn.LookupAccount(username)
+        if err != nil {
+            return err
+        }
+
+        items := []messages.NotificationItem{}
+        for _, notification := range notifications {
+            items = append(items, messages.NotificationItem{
+                DeviceName: notification.DeviceName,
+                NotifyType: notification.NotifyType,
+                Msg: notification.Msg,
+                Time: notification.TimeIssued,
+            })
+        }
+
+        mailMsg := senders.Mail.NewMail()
+        mailMsg.AddTo(account.Email(), account.Username())
+        mail.SetNoReply(mailMsg)
+        err = messages.MailMessageNotification(mailMsg,
+            account.Language(),
+            account.Username(),
+            items,
+            config.BaseURL(cfg),
+            cfg.OptHostname(),
+        )
+        if err == nil {
+            err = senders.Mail.Send(mailMsg)
+        }
+        for _, notification := range notifications {
+            recordDelivery(conn, notification, account.Email(), "", err)
+        }
+        return nil
+    case datalayer.NotifyChannelSMS:
+        prefs, err := conn.NotificationPrefs(username)
+        if err != nil {
+            return err
+        }
+        for _, notification := range notifications {
+            if prefs.SMSNumber == "" {
+                recordSkipped(conn, notification, "No SMS number set")
+                continue
+            }
+            senders.enqueue(conn, notification, []string{prefs.SMSNumber})
+        }
+        return nil
+    case datalayer.NotifyChannelInApp:
+        tokens, err := conn.PushTokens(username)
+        if err != nil {
+            return err
+        }
+        for _, notification := range notifications {
+            if len(tokens) == 0 {
+                recordSkipped(conn, notification, "No push tokens registered")
+                continue
+            }
+            recipients := []string{}
+            for _, token := range tokens {
+                recipients = append(recipients, token.Token)
+            }
+            senders.enqueue(conn, notification, recipients)
+        }
+        return nil
+    }
+    return fmt.Errorf("Unexpected channel: %s", channel)
+}
+
+// Get the SMS or push message for <notification>.
+func transportMessage(notification datalayer.QueuedNotification) transport.Message {
+    return transport.Message{
+        Title: notification.DeviceName,
+        Body: notification.Msg,
+        Data: map[string]string{
+            "device_id" : notification.DeviceID.String(),
+            "notify_type" : notification.NotifyType,
+        },
+    }
+}
+
+// Record the outcome of sending <notification> to <recipient>.  <err> is
+// the error from sending it, if any.
+func recordDelivery(conn datalayer.Connection, notification datalayer.QueuedNotification, recipient, providerId string, err error) {
+    delivery := datalayer.NotificationDelivery{
+        DeviceID: notification.DeviceID,
+        TimeIssued: notification.TimeIssued,
+        Username: notification.Username,
+        Channel: notification.Channel,
+        Recipient: recipient,
+        Status: datalayer.DeliveryStatusSent,
+        ProviderID: providerId,
+        Time: time.Now(),
+    }
+    if err == transport.NotConfiguredError {
+        delivery.Status = datalayer.DeliveryStatusSkipped
+        delivery.Error = err.Error()
+    } else if err != nil {
+        canolog.Error("Problem sending ", notification.Channel, " notification to ", notification.Username, ": ", err)
+        delivery.Status = datalayer.DeliveryStatusFailed
+        delivery.Error = err.Error()
+    }
+    conn.RecordNotificationDelivery(delivery)
+}
+
+// Record that <notification> was not sent, because of <reason>.
+func recordSkipped(conn datalayer.Connection, notification datalayer.QueuedNotification, reason string) {
+    conn.RecordNotificationDelivery(datalayer.NotificationDelivery{
+        DeviceID: notification.DeviceID,
+        TimeIssued: notification.TimeIssued,
+        Username: notification.Username,
+        Channel: notification.Channel,
+        Status: datalayer.DeliveryStatusSkipped,
+        Error: reason,
+        Time: time.Now(),
+    })
+}
@@ -0,0 +1,69 @@
+// Copyright 2015 SimpleThings, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+package transport
+
+import (
+    "encoding/json"
+    "fmt"
+    "os"
+    "sync"
+    "time"
+)
+
+// FileTransport appends each message to a file, one JSON object per line,
+// instead of sending it.  It is meant for development and testing.
+type FileTransport struct {
+    filename string
+    mutex sync.Mutex
+    count int
+}
+
+func NewFileTransport(filename string) (Transport, error) {
+    if filename == "" {
+        return nil, fmt.Errorf("A file must be set for the file transport")
+    }
+    return &FileTransport{filename: filename}, nil
+}
+
+func (transport *FileTransport) Send(to string, msg Message) (string, error) {
+    transport.mutex.Lock()
+    defer transport.mutex.Unlock()
+
+    transport.count++
+    providerId := fmt.Sprintf("file-%d-%d", os.Getpid(), transport.count)
+    line, err := json.Marshal(map[string]interface{}{
+        "id" : providerId,
+        "time" : time.Now().UTC().Format(time.RFC3339Nano),
+        "to" : to,
+        "title" : msg.Title,
+        "body" : msg.Body,
+        "data" : msg.Data,
+    })
+    if err != nil {
+        return "", err
+    }
+
+    f, err := os.OpenFile(transport.filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+    if err != nil {
+        return "", err
+    }
+    defer f.Close()
+    _, err = f.Write(append(line, '\n'))
+    if err != nil {
+        return "", err
+    }
+    return providerId, nil
+}
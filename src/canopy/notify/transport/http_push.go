@@ -0,0 +1,125 @@
+// Copyright 2015 SimpleThings, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+package transport
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "net/http"
+)
+
+// Used if no push-http-url is configured.
+const DefaultPushURL = "https://fcm.googleapis.com/fcm/send"
+
+// Errors a push service reports for tokens that will never work again.
+var invalidTokenErrors = []string{
+    "InvalidRegistration",
+    "MismatchSenderId",
+    "NotRegistered",
+}
+
+// HTTPPushTransport sends push notifications using the Firebase Cloud
+// Messaging HTTP protocol.  Apple devices are reached through the same
+// protocol, since FCM (and compatible gateways) forward to APNs.
+//
+// Each message is POSTed as:
+//
+//      {
+//          "to" : "<device token>",
+//          "priority" : "high",
+//          "notification" : {"title" : "...", "body" : "..."},
+//          "data" : {...}
+//      }
+//
+// with an "Authorization: key=<auth key>" header.
+type HTTPPushTransport struct {
+    url string
+    authKey string
+    client *http.Client
+}
+
+func NewHTTPPushTransport(url, authKey string) (Transport, error) {
+    if url == "" {
+        url = DefaultPushURL
+    }
+    if authKey == "" {
+        return nil, fmt.Errorf("push-http-auth-key must be set")
+    }
+    return &HTTPPushTransport{
+        url: url,
+        authKey: authKey,
+        client: &http.Client{Timeout: RequestTimeout},
+    }, nil
+}
+
+func (transport *HTTPPushTransport) Send(to string, msg Message) (string, error) {
+    payload, err := json.Marshal(map[string]interface{}{
+        "to" : to,
+        "priority" : "high",
+        "notification" : map[string]interface{}{
+            "title" : msg.Title,
+            "body" : msg.Body,
+        },
+        "data" : msg.Data,
+    })
+    if err != nil {
+        return "", err
+    }
+
+    req, err := http.NewRequest("POST", transport.url, bytes.NewReader(payload))
+    if err != nil {
+        return "", err
+    }
+    req.Header.Set("Content-Type", "application/json")
+    req.Header.Set("Authorization", "key=" + transport.authKey)
+
+    resp, err := transport.client.Do(req)
+    if err != nil {
+        return "", err
+    }
+    defer resp.Body.Close()
+    body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+
+    if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+        return "", fmt.Errorf("Unexpected response from push service: %s", resp.Status)
+    }
+
+    var result struct {
+        Results []struct {
+            MessageID string `json:"message_id"`
+            Error string `json:"error"`
+        } `json:"results"`
+    }
+    err = json.Unmarshal(body, &result)
+    if err != nil {
+        return "", fmt.Errorf("Unexpected response from push service: %s", err)
+    }
+    if len(result.Results) == 0 {
+        return "", fmt.Errorf("Push service returned no result")
+    }
+    if result.Results[0].Error != "" {
+        for _, invalid := range invalidTokenErrors {
+            if result.Results[0].Error == invalid {
+                return "", InvalidRecipientError
+            }
+        }
+        return "", fmt.Errorf("Push service error: %s", result.Results[0].Error)
+    }
+    return result.Results[0].MessageID, nil
+}
@@ -0,0 +1,97 @@
+// Copyright 2015 SimpleThings, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+package transport
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "net/http"
+    "time"
+)
+
+// How long to wait for an SMS or push service to respond.
+const RequestTimeout = 10*time.Second
+
+// HTTPSMSTransport sends SMS through a generic HTTP gateway.  Each message
+// is POSTed to the gateway's URL as a JSON object:
+//
+//      {"to" : "+14155550100", "from" : "Canopy", "body" : "..."}
+//
+// with an "Authorization: Bearer <token>" header if a token is configured.
+// Any 2xx response means the message was accepted.  If the response is a
+// JSON object with an "id" string, that is returned as the provider ID.
+type HTTPSMSTransport struct {
+    url string
+    authToken string
+    from string
+    client *http.Client
+}
+
+func NewHTTPSMSTransport(url, authToken, from string) (Transport, error) {
+    if url == "" {
+        return nil, fmt.Errorf("sms-http-url must be set")
+    }
+    return &HTTPSMSTransport{
+        url: url,
+        authToken: authToken,
+        from: from,
+        client: &http.Client{Timeout: RequestTimeout},
+    }, nil
+}
+
+func (transport *HTTPSMSTransport) Send(to string, msg Message) (string, error) {
+    text := msg.Body
+    if msg.Title != "" {
+        text = msg.Title + ": " + msg.Body
+    }
+    payload, err := json.Marshal(map[string]interface{}{
+        "to" : to,
+        "from" : transport.from,
+        "body" : text,
+    })
+    if err != nil {
+        return "", err
+    }
+
+    req, err := http.NewRequest("POST", transport.url, bytes.NewReader(payload))
+    if err != nil {
+        return "", err
+    }
+    req.Header.Set("Content-Type", "application/json")
+    if transport.authToken != "" {
+        req.Header.Set("Authorization", "Bearer " + transport.authToken)
+    }
+
+    resp, err := transport.client.Do(req)
+    if err != nil {
+        return "", err
+    }
+    defer resp.Body.Close()
+    body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+
+    if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+        return "", fmt.Errorf("Unexpected response from SMS gateway: %s", resp.Status)
+    }
+
+    var result struct {
+        ID string `json:"id"`
+    }
+    json.Unmarshal(body, &result)
+    return result.ID, nil
+}
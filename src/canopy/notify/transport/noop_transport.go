@@ -0,0 +1,29 @@
+// Copyright 2015 SimpleThings, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+package transport
+
+// NoOpTransport sends nothing.  Every Send returns NotConfiguredError, so
+// that deliveries are recorded as skipped.
+type NoOpTransport struct {
+}
+
+func NewNoOpTransport() (Transport, error) {
+    return &NoOpTransport{}, nil
+}
+
+func (*NoOpTransport) Send(to string, msg Message) (string, error) {
+    return "", NotConfiguredError
+}
@@ -0,0 +1,79 @@
+// Copyright 2015 SimpleThings, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+// Package transport sends notifications over channels other than email: SMS
+// and mobile push.  As with mail.MailClient, the implementation used for
+// each channel is selected by configuration.
+package transport
+
+import (
+    "canopy/config"
+    "errors"
+    "fmt"
+)
+
+// Returned by Send when the service reports that the recipient will never
+// be reachable (for example, a push token for an uninstalled app).
+var InvalidRecipientError = errors.New("Recipient is not valid")
+
+// Returned by Send when no service is configured for the channel.
+var NotConfiguredError = errors.New("No service configured")
+
+// Message is a notification to send to one recipient.
+type Message struct {
+    Title string
+    Body string
+
+    // Extra values passed to the app that receives a push notification.
+    // Not sent by SMS.
+    Data map[string]string
+}
+
+// Transport is a channel on which notifications are sent.
+type Transport interface {
+    // Send <msg> to <to>, which is a phone number for SMS or a device token
+    // for push.  Returns the ID the service gave the message, if any.
+    Send(to string, msg Message) (providerId string, err error)
+}
+
+// Get the Transport for SMS notifications selected by the "sms-service"
+// option.
+func NewSMSTransport(cfg config.Config) (Transport, error) {
+    switch cfg.OptSMSService() {
+    case "none":
+        return NewNoOpTransport()
+    case "file":
+        return NewFileTransport(cfg.OptSMSFile())
+    case "http":
+        return NewHTTPSMSTransport(cfg.OptSMSHTTPURL(), cfg.OptSMSHTTPAuthToken(), cfg.OptSMSFrom())
+    default:
+        return nil, fmt.Errorf("Unsupported SMS service: %s", cfg.OptSMSService())
+    }
+}
+
+// Get the Transport for push notifications selected by the "push-service"
+// option.
+func NewPushTransport(cfg config.Config) (Transport, error) {
+    switch cfg.OptPushService() {
+    case "none":
+        return NewNoOpTransport()
+    case "file":
+        return NewFileTransport(cfg.OptPushFile())
+    case "http":
+        return NewHTTPPushTransport(cfg.OptPushHTTPURL(), cfg.OptPushHTTPAuthKey())
+    default:
+        return nil, fmt.Errorf("Unsupported push service: %s", cfg.OptPushService())
+    }
+}
@@ -0,0 +1,107 @@
+// Copyright 2015 SimpleThings, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notify
+
+import (
+    "canopy/canolog"
+    "canopy/datalayer"
+    "canopy/datalayer/cassandra_datalayer"
+    "canopy/notify/transport"
+    "time"
+)
+
+const (
+    // Number of SMS and push notifications sent at once.
+    NumWorkers = 4
+
+    // Number of SMS and push notifications that may wait for a worker.
+    // Beyond this, notifications are queued in the database and sent by
+    // the Deliverer.
+    sendQueueSize = 1000
+)
+
+// sendJob is an SMS or push notification waiting for a worker.
+type sendJob struct {
+    notification datalayer.QueuedNotification
+
+    // Phone number or push tokens to send it to.
+    recipients []string
+}
+
+// Connect to the database and start sending SMS and push notifications.
+func (senders *Senders) Start() error {
+    dl := cassandra_datalayer.NewDatalayer(senders.cfg)
+    conn, err := dl.Connect("canopy")
+    if err != nil {
+        return err
+    }
+    senders.conn = conn
+
+    for i := 0; i < NumWorkers; i++ {
+        go senders.work()
+    }
+    return nil
+}
+
+// Hand <notification> to the workers, to send to each of <recipients>.  If
+// they are too far behind, queue it in the database instead, so that the
+// Deliverer tries again shortly.
+func (senders *Senders) enqueue(conn datalayer.Connection, notification datalayer.QueuedNotification, recipients []string) {
+    select {
+    case senders.jobs <- sendJob{notification, recipients}:
+        return
+    default:
+    }
+
+    canolog.Warn("Notification workers are busy; queueing ", notification.Channel, " notification to ", notification.Username)
+    now := time.Now()
+    notification.Due = now
+    err := conn.QueueNotification(notification)
+    if err != nil {
+        canolog.Error("Problem queueing notification to ", notification.Username, ": ", err)
+        recordDelivery(conn, notification, "", "", err)
+        return
+    }
+    conn.RecordNotificationDelivery(datalayer.NotificationDelivery{
+        DeviceID: notification.DeviceID,
+        TimeIssued: notification.TimeIssued,
+        Username: notification.Username,
+        Channel: notification.Channel,
+        Status: datalayer.DeliveryStatusQueued,
+        Time: now,
+    })
+}
+
+func (senders *Senders) work() {
+    for job := range senders.jobs {
+        senders.sendJob(job)
+    }
+}
+
+// Send <job> through the SMS or push service, and record the outcome for
+// each recipient.
+func (senders *Senders) sendJob(job sendJob) {
+    service := senders.SMS
+    if job.notification.Channel == datalayer.NotifyChannelInApp {
+        service = senders.Push
+    }
+    for _, recipient := range job.recipients {
+        providerId, err := service.Send(recipient, transportMessage(job.notification))
+        recordDelivery(senders.conn, job.notification, recipient, providerId, err)
+        if err == transport.InvalidRecipientError && job.notification.Channel == datalayer.NotifyChannelInApp {
+            senders.conn.DeletePushToken(job.notification.Username, recipient)
+        }
+    }
+}
@@ -21,6 +21,8 @@ import (
     "time"
 )
 
+var logger = canolog.Subsystem("pigeon")
+
 /*
  * The "pigeon" package is a message-passing system for canopy.
  *
@@ -69,15 +71,15 @@ func (pigeon *PigeonSystem)SendMessage(mailboxId string, msg *PigeonMessage, tim
     if mailbox != nil {
         select {
             case mailbox.ch <- msg:
-                canolog.Info("Message sent to mailbox");
+                logger.Info("Message sent to mailbox");
                 // message transferred
                 return nil
             case <- time.After(timeout):
-                canolog.Warn("SendMessage timed out");
+                logger.Warn("SendMessage timed out");
                 return errors.New("SendMessage timed out")
         }
     }
-    canolog.Warn("Mailbox not found");
+    logger.Warn("Mailbox not found");
     return errors.New("Mailbox not found")
 }
 
@@ -0,0 +1,68 @@
+// Copyright 2015 SimpleThings, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+package quota
+
+import (
+    "canopy/canolog"
+    "canopy/config"
+    "canopy/datalayer"
+    "canopy/datalayer/cassandra_datalayer"
+    "time"
+)
+
+// How often past days' usage counters are purged.
+const purgeInterval = time.Hour
+
+// UsagePurger deletes daily usage counters once their day is over.  Only
+// today's counters are read, but the previous day's are kept in case
+// servers' clocks disagree around midnight.  There should be one per
+// server process; purging the same day twice is harmless.
+type UsagePurger struct {
+    cfg config.Config
+    conn datalayer.Connection
+}
+
+func NewUsagePurger(cfg config.Config) *UsagePurger {
+    return &UsagePurger{cfg: cfg}
+}
+
+// Connect to the database and start purging.
+func (p *UsagePurger) Start() error {
+    dl := cassandra_datalayer.NewDatalayer(p.cfg)
+    conn, err := dl.Connect("canopy")
+    if err != nil {
+        return err
+    }
+    p.conn = conn
+
+    go p.run()
+    return nil
+}
+
+func (p *UsagePurger) run() {
+    p.purge(time.Now())
+    ticker := time.NewTicker(purgeInterval)
+    for now := range ticker.C {
+        p.purge(now)
+    }
+}
+
+func (p *UsagePurger) purge(now time.Time) {
+    err := p.conn.PurgeDailyUsage(now.AddDate(0, 0, -1))
+    if err != nil {
+        canolog.Error("Error purging daily usage: ", err)
+    }
+}
@@ -0,0 +1,257 @@
+// Copyright 2015 SimpleThings, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+// Package quota enforces per-account and per-device API rate limits and daily
+// quotas.  Limits are set by the configuration options:
+//
+//      rate-limit-requests-per-minute
+//      quota-daily-notifications
+//      quota-daily-requests
+//      quota-daily-samples
+//      quota-max-devices
+//
+// A value of 0 means unlimited.  The per-minute rate limit is tracked in
+// memory on each server, while daily usage is stored in the database, so
+// that it is shared between servers and survives restarts.  A UsagePurger
+// deletes it once the day is over.
+package quota
+
+import (
+    "canopy/config"
+    "canopy/datalayer"
+    "canopy/util/limiter"
+    "fmt"
+    "time"
+)
+
+// Daily usage metric names.
+const (
+    MetricNotifications = "notifications"
+    MetricRequests = "requests"
+    MetricSamples = "samples"
+)
+
+// Names of the limits reported in LimitExceededError.
+const (
+    LimitRequestsPerMinute = "requests_per_minute"
+    LimitDailyNotifications = "daily_notifications"
+    LimitDailyRequests = "daily_requests"
+    LimitDailySamples = "daily_samples"
+    LimitDevices = "devices"
+)
+
+// LimitExceededError is returned when a rate limit or quota has been used
+// up.  <RetryAfter> is 0 for limits that do not reset with time.
+type LimitExceededError struct {
+    Limit string
+    RetryAfter time.Duration
+}
+
+func (err *LimitExceededError) Error() string {
+    return fmt.Sprintf("Limit exceeded: %s", err.Limit)
+}
+
+// Status describes the per-minute rate limit after a request, for reporting
+// in response headers.  <Limit> is 0 if there is no per-minute limit.
+type Status struct {
+    Limit int
+    Remaining int
+}
+
+// Enforcer holds the in-memory state for per-minute rate limiting.  There
+// should be one per server process, shared by the REST API and websocket
+// handlers.
+type Enforcer struct {
+    cfg config.Config
+    requests limiter.Limiter
+}
+
+func NewEnforcer(cfg config.Config) *Enforcer {
+    return &Enforcer{
+        cfg: cfg,
+        requests: limiter.NewSlidingWindowLimiter(int(cfg.OptRateLimitRequestsPerMinute()), time.Minute),
+    }
+}
+
+// Pick up a change to the per-minute rate limit after the config has been
+// reloaded.  The daily quotas are read from the config on each check, so
+// they need nothing.
+func (e *Enforcer) Reconfigure() {
+    e.requests.SetLimit(int(e.cfg.OptRateLimitRequestsPerMinute()))
+}
+
+func AccountPrincipal(account datalayer.Account) string {
+    return "account:" + account.Username()
+}
+
+func DevicePrincipal(device datalayer.Device) string {
+    return "device:" + device.IDString()
+}
+
+// Time until daily quotas reset.
+func untilMidnightUTC(now time.Time) time.Duration {
+    now = now.UTC()
+    midnight := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+    return midnight.Sub(now)
+}
+
+// Count a request by <principal> against the per-minute rate limit only.
+// Used for unauthenticated requests, which are limited per IP address.
+// Returns a *LimitExceededError if the limit is used up.
+func (e *Enforcer) CheckRate(principal string) (Status, error) {
+    var status Status
+
+    perMinute := int(e.cfg.OptRateLimitRequestsPerMinute())
+    if perMinute > 0 {
+        allowed, retryAfter := e.requests.Allow(principal)
+        status.Limit = perMinute
+        status.Remaining = e.requests.Remaining(principal)
+        if !allowed {
+            return status, &LimitExceededError{LimitRequestsPerMinute, retryAfter}
+        }
+    }
+    return status, nil
+}
+
+// Count a request by <principal> against the per-minute rate limit and the
+// daily request quota.  Returns a *LimitExceededError if either is used up.
+func (e *Enforcer) CheckRequest(conn datalayer.Connection, principal string) (Status, error) {
+    status, err := e.CheckRate(principal)
+    if err != nil {
+        return status, err
+    }
+
+    daily := int64(e.cfg.OptQuotaDailyRequests())
+    if daily > 0 {
+        usage, err := conn.DailyUsage(principal)
+        if err != nil {
+            return status, err
+        }
+        if usage[MetricRequests] >= daily {
+            return status, &LimitExceededError{LimitDailyRequests, untilMidnightUTC(time.Now())}
+        }
+    }
+
+    return status, conn.AddDailyUsage(principal, MetricRequests, 1)
+}
+
+// Check whether <principal> may store <numSamples> more samples today.
+func CheckSamples(cfg config.Config, conn datalayer.Connection, principal string, numSamples int) error {
+    daily := int64(cfg.OptQuotaDailySamples())
+    if daily <= 0 {
+        return nil
+    }
+    usage, err := conn.DailyUsage(principal)
+    if err != nil {
+        return err
+    }
+    if usage[MetricSamples] + int64(numSamples) > daily {
+        return &LimitExceededError{LimitDailySamples, untilMidnightUTC(time.Now())}
+    }
+    return nil
+}
+
+// Record that <principal> stored <numSamples> samples.
+func RecordSamples(conn datalayer.Connection, principal string, numSamples int) error {
+    if numSamples == 0 {
+        return nil
+    }
+    return conn.AddDailyUsage(principal, MetricSamples, int64(numSamples))
+}
+
+// Check whether <principal> may raise <numNotifications> more notifications
+// today.
+func CheckNotifications(cfg config.Config, conn datalayer.Connection, principal string, numNotifications int) error {
+    daily := int64(cfg.OptQuotaDailyNotifications())
+    if daily <= 0 {
+        return nil
+    }
+    usage, err := conn.DailyUsage(principal)
+    if err != nil {
+        return err
+    }
+    if usage[MetricNotifications] + int64(numNotifications) > daily {
+        return &LimitExceededError{LimitDailyNotifications, untilMidnightUTC(time.Now())}
+    }
+    return nil
+}
+
+// Record that <principal> raised <numNotifications> notifications.
+func RecordNotifications(conn datalayer.Connection, principal string, numNotifications int) error {
+    if numNotifications == 0 {
+        return nil
+    }
+    return conn.AddDailyUsage(principal, MetricNotifications, int64(numNotifications))
+}
+
+// Check whether <account> may create <numDevices> more devices.  Every device
+// the account has access to counts towards the limit.
+func CheckDevices(cfg config.Config, account datalayer.Account, numDevices int) error {
+    max := int(cfg.OptQuotaMaxDevices())
+    if max <= 0 {
+        return nil
+    }
+    devices, err := account.Devices()
+    if err != nil {
+        return err
+    }
+    if len(devices) + numDevices > max {
+        return &LimitExceededError{LimitDevices, 0}
+    }
+    return nil
+}
+
+// Get <account>'s current usage and limits, for reporting in /api/me.
+func AccountUsage(cfg config.Config, conn datalayer.Connection, account datalayer.Account) (map[string]interface{}, error) {
+    usage, err := conn.DailyUsage(AccountPrincipal(account))
+    if err != nil {
+        return nil, err
+    }
+    devices, err := account.Devices()
+    if err != nil {
+        return nil, err
+    }
+
+    // The sample and notification quotas apply to each device separately.
+    deviceSamples := map[string]interface{}{}
+    deviceNotifications := map[string]interface{}{}
+    for _, device := range devices {
+        deviceUsage, err := conn.DailyUsage(DevicePrincipal(device))
+        if err != nil {
+            return nil, err
+        }
+        if deviceUsage[MetricSamples] > 0 {
+            deviceSamples[device.IDString()] = deviceUsage[MetricSamples]
+        }
+        if deviceUsage[MetricNotifications] > 0 {
+            deviceNotifications[device.IDString()] = deviceUsage[MetricNotifications]
+        }
+    }
+
+    return map[string]interface{} {
+        "requests_today" : usage[MetricRequests],
+        "device_samples_today" : deviceSamples,
+        "device_notifications_today" : deviceNotifications,
+        "devices" : len(devices),
+        "limits" : map[string]interface{} {
+            LimitRequestsPerMinute : cfg.OptRateLimitRequestsPerMinute(),
+            LimitDailyNotifications : cfg.OptQuotaDailyNotifications(),
+            LimitDailyRequests : cfg.OptQuotaDailyRequests(),
+            LimitDailySamples : cfg.OptQuotaDailySamples(),
+            LimitDevices : cfg.OptQuotaMaxDevices(),
+        },
+        "resets_in" : int(untilMidnightUTC(time.Now()).Seconds()),
+    }, nil
+}
@@ -18,9 +18,16 @@ import(
     "canopy/config"
     "canopy/datalayer"
     "canopy/datalayer/cassandra_datalayer"
+    "canopy/events"
     "canopy/mail"
+    "canopy/mail/messages"
+    "canopy/notify"
     "canopy/pigeon"
+    "canopy/quota"
     "canopy/rest/rest_errors"
+    "canopy/rest/throttle"
+    "canopy/util/random"
+    "crypto/subtle"
     "encoding/base64"
     "errors"
     "encoding/json"
@@ -29,14 +36,25 @@ import(
     "github.com/gorilla/sessions"
     "io/ioutil"
     "net/http"
+    "net/url"
+    "strconv"
     "strings"
 )
 
+var logger = canolog.Subsystem("rest")
+
 type RestHandlerIn struct {
+    // Which version of the REST API the handler is mounted under (1 for
+    // /api, 2 for /api/v2).  Determines the error format.
+    APIVersion int
     Config config.Config
     CookieStore *sessions.CookieStore
+    EventHub *events.Hub
+    LoginThrottle *throttle.LoginThrottle
     Mailer mail.MailClient
     PigeonSys *pigeon.PigeonSystem
+    Quotas *quota.Enforcer
+    Senders *notify.Senders
 }
 
 // CanopyRestAuthTypeEnum is the type of authentication used in a request
@@ -53,18 +71,28 @@ const (
 
     // Request included a session cookie
     CANOPY_REST_AUTH_SESSION
+
+    // Request included an OAuth2 access token issued to a third-party app
+    CANOPY_REST_AUTH_BEARER
 )
 
 type CanopyRestInfo struct {
+    APIVersion int
     AuthType CanopyRestAuthTypeEnum
     Account datalayer.Account
     BodyObj map[string]interface{}
     Conn datalayer.Connection
     Config config.Config
     Device datalayer.Device
+    EventHub *events.Hub
+    LoginThrottle *throttle.LoginThrottle
+    OAuthGrant *datalayer.OAuthGrant
     Session *sessions.Session
     Mailer mail.MailClient
     PigeonSys *pigeon.PigeonSystem
+    Quotas *quota.Enforcer
+    RequestID string
+    Senders *notify.Senders
     URLVars map[string]string
 }
 
@@ -95,25 +123,121 @@ func basicAuthFromRequest(r *http.Request) (username string, password string, er
     return parts[0], parts[1], nil
 }
 
-func CanopyRestAdapter(fn CanopyRestHandler, in RestHandlerIn) http.HandlerFunc {
+func isFormEncoded(r *http.Request) bool {
+    return strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded")
+}
+
+func formToJsonObj(body string) (map[string]interface{}, error) {
+    values, err := url.ParseQuery(body)
+    if err != nil {
+        return nil, err
+    }
+    out := map[string]interface{}{}
+    for k, v := range values {
+        out[k] = v[0]
+    }
+    return out, nil
+}
+
+func bearerTokenFromRequest(r *http.Request) (string, error) {
+    h, ok := r.Header["Authorization"]
+    if !ok || len(h) == 0 {
+        return "", errors.New("Authorization header not set")
+    }
+    parts := strings.SplitN(h[0], " ", 2)
+    if len(parts) != 2 || parts[1] == "" {
+        return "", errors.New("Authentication header malformed")
+    }
+    if parts[0] != "Bearer" {
+        return "", errors.New("Expected bearer authentication")
+    }
+    return parts[1], nil
+}
+
+const requestIDChars = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_."
+
+// Use the client's X-Request-Id if it looks sane, so that requests can be
+// traced through proxies.  Otherwise generate one.
+func requestIDFromRequest(r *http.Request) string {
+    id := r.Header.Get("X-Request-Id")
+    if id != "" && len(id) <= 64 && strings.Trim(id, requestIDChars) == "" {
+        return id
+    }
+    id, err := random.Base64URLString(12)
+    if err != nil {
+        return "unknown"
+    }
+    return id
+}
+
+// Email the account holder to let them know their account has been locked
+// after too many failed login attempts.
+func SendLockoutNotice(info CanopyRestInfo, account datalayer.Account) {
+
+    msg := info.Mailer.NewMail();
+    msg.AddTo(account.Email(), account.Username())
+    mail.SetNoReply(msg)
+    err := messages.MailMessageAccountLocked(msg,
+        account.Language(),
+        account.Username(),
+        throttle.LockoutDuration.String(),
+        config.BaseURL(info.Config),
+        info.Config.OptHostname(),
+    )
+    if err == nil {
+        err = info.Mailer.Send(msg)
+    }
+    if err != nil {
+        logger.Error("Problem sending lockout notice to ", account.Username(), ": ", err)
+    }
+}
+
+// Errors that the adapter has always reported in the legacy format.
+var badCredentialsError = rest_errors.NewLegacyError(http.StatusUnauthorized,
+        "incorrect_username_or_password", "Incorrect username or password",
+        "incorrect_username_or_password")
+var accountLookupFailedError = rest_errors.NewLegacyError(http.StatusInternalServerError,
+        "account_lookup_failed", "Account lookup failed", "account_lookup_failed")
+
+func CanopyRestAdapter(ep Endpoint, in RestHandlerIn) http.HandlerFunc {
     return func(w http.ResponseWriter, r *http.Request) {
+        // Handle the whole request with the same settings, even if the
+        // config is reloaded meanwhile.
         info := CanopyRestInfo{
-            Config: in.Config,
+            APIVersion: in.APIVersion,
+            Config: config.Snapshot(in.Config),
+            EventHub: in.EventHub,
+            LoginThrottle: in.LoginThrottle,
             Mailer: in.Mailer,
             PigeonSys: in.PigeonSys,
+            Quotas: in.Quotas,
+            RequestID: requestIDFromRequest(r),
+            Senders: in.Senders,
+        }
+        reqLogger := logger.With("request", info.RequestID)
+
+        // /api/v2 reports every error in the same envelope.  /api keeps
+        // each error's original format.
+        writeError := func(restErr rest_errors.CanopyRestError) {
+            if info.APIVersion >= 2 {
+                rest_errors.WriteV2(w, restErr, info.RequestID)
+            } else {
+                restErr.WriteTo(w)
+            }
         }
 
         // Log request
-        canolog.Info("Request: ", r.Method, r.URL, " BY ", r.RemoteAddr)
+        reqLogger.Info("Request ", r.Method, r.URL, " BY ", r.RemoteAddr)
+        w.Header().Set("X-Request-Id", info.RequestID)
 
         // Get vars from URL if any
         info.URLVars = mux.Vars(r)
 
         // Connect to the database
-        dl := cassandra_datalayer.NewDatalayer(in.Config)
+        dl := cassandra_datalayer.NewDatalayer(info.Config)
         conn, err := dl.Connect("canopy")
         if err != nil {
-            rest_errors.NewDatabaseConnectionError().WriteTo(w)
+            writeError(rest_errors.NewDatabaseConnectionError())
             return
         }
         defer conn.Close()
@@ -121,8 +245,8 @@ func CanopyRestAdapter(fn CanopyRestHandler, in RestHandlerIn) http.HandlerFunc
 
         // Set standard headers
         w.Header().Set("Content-Type", "application/json")
-        if (in.Config.OptAllowOrigin() != "") {
-            w.Header().Set("Access-Control-Allow-Origin", in.Config.OptAllowOrigin())
+        if (info.Config.OptAllowOrigin() != "") {
+            w.Header().Set("Access-Control-Allow-Origin", info.Config.OptAllowOrigin())
             // Allow cross-origin cookies.
             // Client must also set "withCredentials" to ture on the
             // XMLHttpRequest.
@@ -132,18 +256,30 @@ func CanopyRestAdapter(fn CanopyRestHandler, in RestHandlerIn) http.HandlerFunc
         // Check for BASIC AUTH
         username_string, password, err := basicAuthFromRequest(r)
         if err == nil {
+            clientIP := throttle.ClientIP(r.RemoteAddr)
+
             // was a UUID provided?
             if len(username_string) == 36 {
+                // Device failures are only counted against the client's
+                // IP address.  Device IDs are not secret, so locking out the
+                // device itself would let anyone who knows its ID shut it
+                // out of the API.
+                wait, _ := info.LoginThrottle.Check(clientIP, "")
+                if wait > 0 {
+                    writeError(rest_errors.NewTooManyAttemptsError(wait, false))
+                    return
+                }
+
                 device, err := conn.LookupDeviceByStringID(username_string)
                 if err != nil {
-                    w.WriteHeader(http.StatusUnauthorized)
-                    fmt.Fprintf(w, "{\"error\" : \"incorrect_username_or_password\"}")
+                    info.LoginThrottle.RecordFailure(clientIP, "")
+                    writeError(badCredentialsError)
                     return
                 }
                 
-                if device.SecretKey() != password {
-                    w.WriteHeader(http.StatusUnauthorized)
-                    fmt.Fprintf(w, "{\"error\" : \"incorrect_username_or_password\"}")
+                if subtle.ConstantTimeCompare([]byte(device.SecretKey()), []byte(password)) != 1 {
+                    info.LoginThrottle.RecordFailure(clientIP, "")
+                    writeError(badCredentialsError)
                     return
                 }
 
@@ -151,34 +287,83 @@ func CanopyRestAdapter(fn CanopyRestHandler, in RestHandlerIn) http.HandlerFunc
                 info.Device = device
 
                 // update last_seen for this device
-                canolog.Info("Updating last seen")
+                reqLogger.Info("Updating last seen")
                 err = device.UpdateLastActivityTime(nil)
                 if err != nil {
-                    rest_errors.NewInternalServerError("Updating last seen time").WriteTo(w)
+                    writeError(rest_errors.NewInternalServerError("Updating last seen time"))
                     return
                 }
-                canolog.Info("Device BASIC auth provided")
+                reqLogger.Info("Device BASIC auth provided")
             } else {
+                wait, _ := info.LoginThrottle.Check(clientIP, "")
+                if wait > 0 {
+                    writeError(rest_errors.NewTooManyAttemptsError(wait, false))
+                    return
+                }
+
                 // otherwise, assume user account username/password provided
-                acct, err := conn.LookupAccountVerifyPassword(username_string, password)
+                acct, err := conn.LookupAccount(username_string)
                 if err != nil {
-                    if err == datalayer.InvalidPasswordError {
-                        w.WriteHeader(http.StatusUnauthorized)
-                        fmt.Fprintf(w, "{\"error\" : \"incorrect_username_or_password\"}")
-                        return
-                    } else {
-                        w.WriteHeader(http.StatusInternalServerError);
-                        fmt.Fprintf(w, "{\"error\" : \"account_lookup_failed\"}");
-                        return
+                    info.LoginThrottle.RecordFailure(clientIP, "")
+                    writeError(accountLookupFailedError)
+                    return
+                }
+
+                wait, locked := info.LoginThrottle.Check(clientIP, acct.Username())
+                if wait > 0 {
+                    writeError(rest_errors.NewTooManyAttemptsError(wait, locked))
+                    return
+                }
+
+                // Accounts with two-factor authentication enabled cannot
+                // use their main password for BASIC auth, because there is
+                // nowhere to put the second factor.  They must use an app
+                // password instead.
+                verified := false
+                if !acct.IsTOTPEnabled() {
+                    verified = acct.VerifyPassword(password)
+                }
+                if !verified {
+                    verified = acct.VerifyAppPassword(password)
+                }
+                if !verified {
+                    reqLogger.Info("Incorrect password for ", username_string)
+                    if info.LoginThrottle.RecordFailure(clientIP, acct.Username()) {
+                        SendLockoutNotice(info, acct)
                     }
+                    writeError(badCredentialsError)
+                    return
                 }
+                info.LoginThrottle.RecordSuccess(clientIP, acct.Username())
                 
-                canolog.Info("Basic auth provided")
+                reqLogger.Info("Basic auth provided")
                 info.AuthType = CANOPY_REST_AUTH_BASIC
                 info.Account = acct
             }
         }
 
+        // Check for OAuth2 BEARER token
+        token, err := bearerTokenFromRequest(r)
+        if err == nil {
+            grant, err := conn.LookupOAuthAccessToken(token)
+            if err != nil {
+                w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+                writeError(rest_errors.NewLegacyError(http.StatusUnauthorized,
+                        "invalid_token", "Invalid or expired access token", "invalid_token"))
+                return
+            }
+            acct, err := conn.LookupAccount(grant.Username)
+            if err != nil {
+                writeError(accountLookupFailedError)
+                return
+            }
+
+            reqLogger.Info("Bearer auth provided for client ", grant.ClientID)
+            info.AuthType = CANOPY_REST_AUTH_BEARER
+            info.Account = acct
+            info.OAuthGrant = grant
+        }
+
         // Check for session-based AUTH
         session, _ := in.CookieStore.Get(r, "canopy-login-session")
         info.Session = session
@@ -187,54 +372,114 @@ func CanopyRestAdapter(fn CanopyRestHandler, in RestHandlerIn) http.HandlerFunc
         if ok {
             username_string, ok = username.(string)
             if ok && username_string != "" {
-                canolog.Info("Looking up account: ", username_string)
+                reqLogger.Info("Looking up account: ", username_string)
                 acct, err := conn.LookupAccount(username_string)
                 if err != nil {
                     info.Session.Values["logged_in_username"] = ""
                     info.Session.Save(r, w)
-                    w.WriteHeader(http.StatusInternalServerError);
-                    fmt.Fprintf(w, "{\"error\" : \"account_lookup_failed\"}");
+                    writeError(accountLookupFailedError)
                     return
                 }
 
-                canolog.Info("Session auth provided")
-                info.AuthType = CANOPY_REST_AUTH_SESSION
-                info.Account = acct
+                // Reject sessions from before the account was created,
+                // which belong to a deleted account with the same username.
+                loggedInAt, _ := session.Values["logged_in_at"].(int64)
+                if acct.SessionsValidAfter().Unix() > loggedInAt {
+                    reqLogger.Info("Stale session for ", username_string)
+                    delete(info.Session.Values, "logged_in_username")
+                    delete(info.Session.Values, "logged_in_at")
+                    info.Session.Save(r, w)
+                } else {
+                    reqLogger.Info("Session auth provided")
+                    info.AuthType = CANOPY_REST_AUTH_SESSION
+                    info.Account = acct
+                }
             }
         }
 
         if info.Account == nil && info.Device == nil {
-            canolog.Info("No auth provided")
+            reqLogger.Info("No auth provided")
+        }
+
+        // Enforce rate limits and daily quotas.  Anonymous requests are only
+        // rate limited, per IP address.
+        var status quota.Status
+        if info.Device != nil {
+            status, err = info.Quotas.CheckRequest(conn, quota.DevicePrincipal(info.Device))
+        } else if info.Account != nil {
+            status, err = info.Quotas.CheckRequest(conn, quota.AccountPrincipal(info.Account))
+        } else {
+            status, err = info.Quotas.CheckRate("ip:" + throttle.ClientIP(r.RemoteAddr))
+        }
+        if status.Limit > 0 {
+            w.Header().Set("X-RateLimit-Limit", strconv.Itoa(status.Limit))
+            w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(status.Remaining))
+        }
+        if limitErr, ok := err.(*quota.LimitExceededError); ok {
+            writeError(rest_errors.NewRateLimitExceededError(limitErr.Limit, limitErr.RetryAfter))
+            return
+        } else if err != nil {
+            // Don't lock everybody out if usage can't be tracked.
+            reqLogger.Error("Problem checking quotas: ", err)
         }
         // Parse the JSON payload
         // TODO: better way to figure out if there is a message body?
         var data map[string]interface{}
         bodyBytes, err := ioutil.ReadAll(r.Body)
         if err != nil {
-            fmt.Fprintf(w, "{\"error\" : \"reading_body\"}")
+            writeError(rest_errors.NewLegacyError(http.StatusBadRequest,
+                    "reading_body", "Problem reading request body", "reading_body"))
             return
         }
         bodyString := string(bodyBytes)
         if bodyString != "" {
             decoder := json.NewDecoder(strings.NewReader(bodyString))
             err := decoder.Decode(&data)
+            if err != nil && ep.FormEncoded && isFormEncoded(r) {
+                // Some clients (such as OAuth2 clients talking to the token
+                // endpoint) send form-encoded bodies.  Only the first value
+                // of each field is kept.  Other endpoints don't accept them,
+                // so that cross-site HTML forms can't use a session cookie.
+                data, err = formToJsonObj(bodyString)
+            }
             if err != nil {
-                fmt.Fprintf(w, "{\"error\" : \"json_decode_failed\"}")
+                writeError(rest_errors.NewLegacyError(http.StatusBadRequest,
+                        "json_decode_failed", "Request body is not valid JSON", "json_decode_failed"))
                 return
             }
             info.BodyObj = data
         }
 
+        // OAuth2 access tokens are limited to the access level the account
+        // holder granted.  Read-only tokens may only be used for GET
+        // requests.
+        if info.AuthType == CANOPY_REST_AUTH_BEARER {
+            var required datalayer.AccessLevel = datalayer.ReadOnlyAccess
+            if r.Method != "GET" && r.Method != "HEAD" {
+                required = datalayer.ReadWriteAccess
+            }
+            if info.OAuthGrant.AccessLevel < required {
+                writeError(rest_errors.NewInsufficientScopeError("Token does not grant write access"))
+                return
+            }
+        }
+
+        restErr := ep.validateBody(info.BodyObj)
+        if restErr != nil {
+            writeError(restErr)
+            return
+        }
+
         // Call the wrapped function.
         // The wrapped function may either write the response itself to <w>
         // (and return (nil, nil)), or it can return a JSON object that will be
         // marshalled by this wrapper, or it can return a CanopyRestError
         // object.
-        jsonObj, restErr := fn(w, r, info)
+        jsonObj, restErr := ep.Handler(w, r, info)
 
         // Return the appropriate error, if an error occurred
         if restErr != nil {
-            restErr.WriteTo(w)
+            writeError(restErr)
             return
         }
 
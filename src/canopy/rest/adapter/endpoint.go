@@ -0,0 +1,102 @@
+// Copyright 2015 SimpleThings, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package adapter
+
+import (
+    "canopy/rest/rest_errors"
+    "canopy/util/jsonschema"
+)
+
+// Endpoint declares a REST endpoint: where it is mounted, what it accepts
+// and what it returns.  The route table and the OpenAPI document are both
+// generated from these, and request bodies are validated against <Body>
+// before <Handler> runs.
+type Endpoint struct {
+    // HTTP method, or "" if the handler accepts GET and POST alike.
+    Method string
+
+    // Path relative to the API root (/api or /api/v2), in gorilla/mux
+    // syntax, such as "/device/{id}".
+    Path string
+
+    Summary string
+    Description string
+
+    // Kinds of credentials the endpoint accepts.  Empty if it can be used
+    // without logging in.
+    Auth []CanopyRestAuthTypeEnum
+
+    // Schema for the request body, or nil if the endpoint takes no body.
+    Body *jsonschema.Schema
+
+    // The endpoint also accepts application/x-www-form-urlencoded bodies.
+    FormEncoded bool
+
+    // Schema for successful responses.
+    Response *jsonschema.Schema
+
+    // Content type of successful responses, if not "application/json".
+    ResponseContentType string
+
+    Handler CanopyRestHandler
+
+    // Reports body validation failures.  Defaults to a bad_input error.
+    InvalidBody func([]jsonschema.FieldError) rest_errors.CanopyRestError
+
+    // Only served under /api, because the endpoint's error format is fixed
+    // by some other standard and so is not versioned.
+    Unversioned bool
+}
+
+// Credentials that identify an account.
+var AccountAuth = []CanopyRestAuthTypeEnum{
+    CANOPY_REST_AUTH_BASIC,
+    CANOPY_REST_AUTH_SESSION,
+    CANOPY_REST_AUTH_BEARER,
+}
+
+// Credentials that identify an account or a device.
+var AccountOrDeviceAuth = []CanopyRestAuthTypeEnum{
+    CANOPY_REST_AUTH_BASIC,
+    CANOPY_REST_AUTH_DEVICE_BASIC,
+    CANOPY_REST_AUTH_SESSION,
+    CANOPY_REST_AUTH_BEARER,
+}
+
+func defaultInvalidBody(errs []jsonschema.FieldError) rest_errors.CanopyRestError {
+    fields := make([]rest_errors.FieldError, len(errs))
+    for i, e := range errs {
+        fields[i] = rest_errors.FieldError{Field: e.Field, Message: e.Message}
+    }
+    return rest_errors.NewBadInputFieldsError(fields)
+}
+
+// Check the request body against the endpoint's schema.
+func (ep Endpoint) validateBody(body map[string]interface{}) rest_errors.CanopyRestError {
+    if ep.Body == nil {
+        return nil
+    }
+    if body == nil {
+        body = map[string]interface{}{}
+    }
+    errs := ep.Body.Validate(body)
+    if len(errs) == 0 {
+        return nil
+    }
+    if ep.InvalidBody != nil {
+        return ep.InvalidBody(errs)
+    }
+    return defaultInvalidBody(errs)
+}
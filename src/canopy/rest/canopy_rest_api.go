@@ -17,10 +17,14 @@ package rest
 
 import (
     "canopy/config"
-    "canopy/mail"
+    "canopy/events"
+    "canopy/notify"
     "canopy/pigeon"
+    "canopy/quota"
     "canopy/rest/adapter"
     "canopy/rest/endpoints"
+    "canopy/rest/throttle"
+    "encoding/json"
     "github.com/gorilla/mux"
     "github.com/gorilla/sessions"
     "net/http"
@@ -30,40 +34,111 @@ func rootRedirectHandler(w http.ResponseWriter, r *http.Request) {
     http.Redirect(w, r, "/mgr/index.html", 301);
 }
 
-func AddRoutes(r *mux.Router, cfg config.Config, pigeonSys *pigeon.PigeonSystem) error {
-    store := sessions.NewCookieStore([]byte(cfg.OptProductionSecret()))
-    
-    mailer, err := mail.NewMailClient(cfg)
-    if err != nil {
-        return err
+// All REST endpoints.  Each is declared next to its handler.
+var routes = []adapter.Endpoint{
+    endpoints.POST_activate_endpoint,
+    endpoints.GET_info_endpoint,
+    endpoints.GET_admin_config_endpoint,
+    endpoints.POST_create_account_endpoint,
+    endpoints.POST_create_devices_endpoint,
+    endpoints.GET_device__id_endpoint,
+    endpoints.POST_device__id_endpoint,
+    endpoints.GET_device__id__events_endpoint,
+    endpoints.GET_device__id__rules_endpoint,
+    endpoints.POST_device__id__rules_endpoint,
+    endpoints.DELETE_device__id__rule__rule_id_endpoint,
+    endpoints.GET_device__id__notifications_endpoint,
+    endpoints.POST_device__id__notifications_dismiss_endpoint,
+    endpoints.GET_device__id__notification__notification_id_endpoint,
+    endpoints.GET_device__id__schedules_endpoint,
+    endpoints.POST_device__id__schedules_endpoint,
+    endpoints.GET_device__id__schedule__schedule_id_endpoint,
+    endpoints.POST_device__id__schedule__schedule_id_endpoint,
+    endpoints.DELETE_device__id__schedule__schedule_id_endpoint,
+    endpoints.GET_device__id__sensor_endpoint,
+    endpoints.GET_devices_endpoint,
+    endpoints.GET_me_devices_endpoint,
+    endpoints.GET_me_events_endpoint,
+    endpoints.GET_me_notifications_endpoint,
+    endpoints.GET_me_notifications_unread_endpoint,
+    endpoints.POST_me_notifications_dismiss_endpoint,
+    endpoints.GET_me_notification_prefs_endpoint,
+    endpoints.POST_me_notification_prefs_endpoint,
+    endpoints.GET_me_push_tokens_endpoint,
+    endpoints.POST_me_push_tokens_endpoint,
+    endpoints.DELETE_me_push_token__token_endpoint,
+    endpoints.GET_me_webhooks_endpoint,
+    endpoints.POST_me_webhooks_endpoint,
+    endpoints.DELETE_me_webhook__id_endpoint,
+    endpoints.GET_me_webhook__id__deliveries_endpoint,
+    endpoints.POST_share_endpoint,
+    endpoints.POST_finish_share_transaction_endpoint,
+    endpoints.POST_login_endpoint,
+    endpoints.GET_POST_logout_endpoint,
+    endpoints.GET_me_endpoint,
+    endpoints.POST_me_endpoint,
+    endpoints.DELETE_me_endpoint,
+    endpoints.POST_oauth_authorize_endpoint,
+    endpoints.GET_oauth_client__id_endpoint,
+    endpoints.POST_oauth_clients_endpoint,
+    endpoints.POST_oauth_token_endpoint,
+    endpoints.POST_reset_password_endpoint,
+}
+
+// Endpoints only served when the "dev-mode" option is set.  They expose
+// things, like captured email, that must never be reachable in production.
+var devRoutes = []adapter.Endpoint{
+    endpoints.GET_dev_mail_endpoint,
+}
+
+func addRoute(r *mux.Router, prefix string, ep adapter.Endpoint, in adapter.RestHandlerIn) {
+    handler := r.HandleFunc(prefix + ep.Path, adapter.CanopyRestAdapter(ep, in))
+    if ep.Method != "" {
+        handler.Methods(ep.Method)
     }
+}
 
+func AddRoutes(r *mux.Router, cfg config.Config, hub *events.Hub, pigeonSys *pigeon.PigeonSystem, quotas *quota.Enforcer, senders *notify.Senders) error {
+    store := sessions.NewCookieStore([]byte(cfg.OptProductionSecret()))
+    
     extra := adapter.RestHandlerIn{
+        APIVersion: 1,
         Config: cfg,
         CookieStore: store,
-        Mailer: mailer,
+        EventHub: hub,
+        LoginThrottle: throttle.NewLoginThrottle(),
+        Mailer: senders.Mail,
         PigeonSys: pigeonSys,
-   }
+        Quotas: quotas,
+        Senders: senders,
+    }
+
+    // /api/v2 serves the same endpoints, but reports all errors using the
+    // rest_errors envelope.  /api is kept for existing clients.
+    extraV2 := extra
+    extraV2.APIVersion = 2
 
     // TODO: Need to handle allow-origin correctly!
     r.HandleFunc("/", rootRedirectHandler).Methods("GET")
-    r.HandleFunc("/api/activate", adapter.CanopyRestAdapter(endpoints.POST_activate, extra)).Methods("POST")
-    r.HandleFunc("/api/info", adapter.CanopyRestAdapter(endpoints.GET_info, extra)).Methods("GET")
-    r.HandleFunc("/api/create_account", adapter.CanopyRestAdapter(endpoints.POST_create_account, extra)).Methods("POST")
-    r.HandleFunc("/api/create_devices", adapter.CanopyRestAdapter(endpoints.POST_create_devices, extra)).Methods("POST")
-    r.HandleFunc("/api/device/{id}", adapter.CanopyRestAdapter(endpoints.GET_device__id, extra)).Methods("GET")
-    r.HandleFunc("/api/device/{id}", adapter.CanopyRestAdapter(endpoints.POST_device__id, extra)).Methods("POST")
-    r.HandleFunc("/api/device/{id}/{sensor}", adapter.CanopyRestAdapter(endpoints.GET_device__id__sensor, extra)).Methods("GET")
-    r.HandleFunc("/api/devices", adapter.CanopyRestAdapter(endpoints.GET_devices, extra)).Methods("GET")
-    r.HandleFunc("/api/me/devices", adapter.CanopyRestAdapter(endpoints.GET_devices, extra)).Methods("GET")
-    r.HandleFunc("/api/share", adapter.CanopyRestAdapter(endpoints.POST_share, extra)).Methods("POST")
-    r.HandleFunc("/api/finish_share_transaction", adapter.CanopyRestAdapter(endpoints.POST_finish_share_transaction, extra)).Methods("POST")
-    r.HandleFunc("/api/login", adapter.CanopyRestAdapter(endpoints.POST_login, extra)).Methods("POST")
-    r.HandleFunc("/api/logout", adapter.CanopyRestAdapter(endpoints.GET_POST_logout, extra))
-    r.HandleFunc("/api/me", adapter.CanopyRestAdapter(endpoints.GET_me, extra)).Methods("GET")
-    r.HandleFunc("/api/me", adapter.CanopyRestAdapter(endpoints.POST_me, extra)).Methods("POST")
-    r.HandleFunc("/api/reset_password", adapter.CanopyRestAdapter(endpoints.POST_reset_password, extra)).Methods("POST")
+
+    served := routes
+    if cfg.OptDevMode() {
+        served = append(append([]adapter.Endpoint{}, routes...), devRoutes...)
+    }
+
+    spec, err := json.MarshalIndent(openAPIDocument(served), "", "    ")
+    if err != nil {
+        return err
+    }
+    r.HandleFunc("/api/openapi.json", openAPIHandler(spec)).Methods("GET")
+    r.HandleFunc("/api/v2/openapi.json", openAPIHandler(spec)).Methods("GET")
+
+    for _, ep := range served {
+        addRoute(r, "/api", ep, extra)
+        if !ep.Unversioned {
+            addRoute(r, "/api/v2", ep, extraV2)
+        }
+    }
 
     return nil
 }
-
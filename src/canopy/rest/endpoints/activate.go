@@ -16,9 +16,23 @@ package endpoints
 import (
     "canopy/rest/adapter"
     "canopy/rest/rest_errors"
+    "canopy/util/jsonschema"
     "net/http"
 )
 
+var POST_activate_endpoint = adapter.Endpoint{
+    Method: "POST",
+    Path: "/activate",
+    Summary: "Activate an account using the code from the activation email",
+    Auth: adapter.AccountAuth,
+    Body: jsonschema.Object(map[string]*jsonschema.Schema{
+        "username" : jsonschema.String("Account username"),
+        "code" : jsonschema.String("Activation code"),
+    }, "username", "code"),
+    Response: okResponse(nil),
+    Handler: POST_activate,
+}
+
 // Request:
 // {
 //     "username" : 
@@ -31,12 +45,12 @@ func POST_activate(w http.ResponseWriter, r *http.Request, info adapter.CanopyRe
 
     username, ok := info.BodyObj["username"].(string)
     if !ok {
-        return nil, rest_errors.NewBadInputError("String \"username\" expected")
+        return nil, rest_errors.NewBadInputFieldError("username", "String \"username\" expected")
     }
 
     code, ok := info.BodyObj["code"].(string)
     if !ok {
-        return nil, rest_errors.NewBadInputError("String \"code\" expected")
+        return nil, rest_errors.NewBadInputFieldError("code", "String \"code\" expected")
     }
 
     err := info.Account.Activate(username, code)
@@ -0,0 +1,60 @@
+// Copyright 2015 SimpleThings, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+package endpoints
+
+import (
+    "canopy/config"
+    "canopy/rest/adapter"
+    "canopy/rest/rest_errors"
+    "canopy/util/jsonschema"
+    "net/http"
+)
+
+// Apps with OAuth2 access tokens never get administrator access, so only
+// the account holder's own credentials are accepted.
+var adminAuth = []adapter.CanopyRestAuthTypeEnum{
+    adapter.CANOPY_REST_AUTH_BASIC,
+    adapter.CANOPY_REST_AUTH_SESSION,
+}
+
+var GET_admin_config_endpoint = adapter.Endpoint{
+    Method: "GET",
+    Path: "/admin/config",
+    Summary: "Get the server configuration, including secrets",
+    Description: "Only for accounts listed in the \"admin-accounts\" option.  " +
+            "GET /info shows only the options that are safe to show anyone.",
+    Auth: adminAuth,
+    Response: okResponse(map[string]*jsonschema.Schema{
+        "config" : jsonschema.Map(jsonschema.Any(""), "Server configuration"),
+    }),
+    Handler: GET_admin_config,
+}
+
+func GET_admin_config(w http.ResponseWriter, r *http.Request, info adapter.CanopyRestInfo) (map[string]interface{}, rest_errors.CanopyRestError) {
+    if info.Account == nil {
+        return nil, rest_errors.NewNotLoggedInError()
+    }
+    if info.AuthType == adapter.CANOPY_REST_AUTH_BEARER || !config.IsAdminAccount(info.Config, info.Account.Username()) {
+        return nil, rest_errors.NewPermissionDeniedError("Administrator access required")
+    }
+
+    logger.Warn("Full config shown to ", info.Account.Username(), " (request ", info.RequestID, ")")
+    w.Header().Set("Cache-Control", "no-store")
+    return map[string]interface{}{
+        "result" : "ok",
+        "config" : info.Config.ToFullJsonObject(),
+    }, nil
+}
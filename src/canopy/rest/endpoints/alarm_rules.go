@@ -0,0 +1,273 @@
+// Copyright 2015 SimpleThings, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package endpoints
+
+import (
+    "canopy/datalayer"
+    "canopy/notify"
+    "canopy/rest/adapter"
+    "canopy/rest/rest_errors"
+    "canopy/rules"
+    "canopy/util/jsonschema"
+    "github.com/gocql/gocql"
+    "net/http"
+    "time"
+)
+
+var alarmRuleSchema = jsonschema.Object(map[string]*jsonschema.Schema{
+    "rule_id" : jsonschema.String("Rule ID"),
+    "name" : jsonschema.String("Rule name"),
+    "type" : jsonschema.StringEnum("Rule type", rules.Types...),
+    "var_name" : jsonschema.String("Cloud variable the rule watches"),
+    "operator" : jsonschema.StringEnum("Comparison (threshold and rate rules)", rules.Operators...),
+    "threshold" : jsonschema.Number("Threshold value, or change per minute for rate rules"),
+    "hysteresis" : jsonschema.Number("How far back across the threshold the value must go to clear"),
+    "bool_value" : jsonschema.Boolean("Value that triggers a boolean rule"),
+    "duration" : jsonschema.Number("Seconds the condition must hold before firing, or without data for stale rules"),
+    "notify_type" : jsonschema.StringEnum("Notification raised when the rule fires", notify.NotifyTypes...),
+    "message" : jsonschema.String("Notification message"),
+    "created" : jsonschema.String("Time, RFC 3339"),
+    "created_by" : jsonschema.String("Username of the account that created the rule"),
+    "firing" : jsonschema.Boolean("Whether the rule has fired and not yet cleared"),
+    "last_fired" : jsonschema.String("Time the rule last fired, RFC 3339").OrNull(),
+})
+
+func alarmRuleJsonObj(rule datalayer.AlarmRule) map[string]interface{} {
+    var lastFired interface{} = nil
+    if !rule.LastFired.IsZero() {
+        lastFired = rule.LastFired.Format(time.RFC3339)
+    }
+    return map[string]interface{} {
+        "rule_id" : rule.ID,
+        "name" : rule.Name,
+        "type" : rule.Type,
+        "var_name" : rule.VarName,
+        "operator" : rule.Operator,
+        "threshold" : rule.Threshold,
+        "hysteresis" : rule.Hysteresis,
+        "bool_value" : rule.BoolValue,
+        "duration" : rule.Duration.Seconds(),
+        "notify_type" : rule.NotifyType,
+        "message" : rule.Message,
+        "created" : rule.Created.Format(time.RFC3339),
+        "created_by" : rule.CreatedBy,
+        "firing" : rule.Firing,
+        "last_fired" : lastFired,
+    }
+}
+
+// Lookup the device in the request URL, checking that the logged-in account
+// has at least <access> to it.
+func deviceForAccount(info adapter.CanopyRestInfo, access datalayer.AccessLevel) (datalayer.Device, rest_errors.CanopyRestError) {
+    if info.Account == nil {
+        return nil, rest_errors.NewNotLoggedInError()
+    }
+    uuid, err := gocql.ParseUUID(info.URLVars["id"])
+    if err != nil {
+        return nil, rest_errors.NewURLNotFoundError()
+    }
+    device, err := info.Account.Device(uuid)
+    if err != nil {
+        return nil, rest_errors.NewURLNotFoundError()
+    }
+    accountAccess, err := device.AccountAccess()
+    if err != nil {
+        return nil, rest_errors.NewInternalServerError("Device lookup failed")
+    }
+    if accountAccess[info.Account.Username()] < access {
+        return nil, rest_errors.NewPermissionDeniedError("Insufficient access to device")
+    }
+    return device, nil
+}
+
+func isOneOf(s string, values []string) bool {
+    for _, value := range values {
+        if s == value {
+            return true
+        }
+    }
+    return false
+}
+
+var GET_device__id__rules_endpoint = adapter.Endpoint{
+    Method: "GET",
+    Path: "/device/{id}/rules",
+    Summary: "List a device's alarm rules",
+    Auth: adapter.AccountAuth,
+    Response: okResponse(map[string]*jsonschema.Schema{
+        "rules" : jsonschema.Array(alarmRuleSchema, "Alarm rules"),
+    }),
+    Handler: GET_device__id__rules,
+}
+
+func GET_device__id__rules(w http.ResponseWriter, r *http.Request, info adapter.CanopyRestInfo) (map[string]interface{}, rest_errors.CanopyRestError) {
+    device, restErr := deviceForAccount(info, datalayer.ReadOnlyAccess)
+    if restErr != nil {
+        return nil, restErr
+    }
+
+    alarmRules, err := info.Conn.AlarmRules(device.ID())
+    if err != nil {
+        return nil, rest_errors.NewInternalServerError("Problem listing alarm rules")
+    }
+    out := []map[string]interface{}{}
+    for _, rule := range alarmRules {
+        out = append(out, alarmRuleJsonObj(rule))
+    }
+    return map[string]interface{} {
+        "result" : "ok",
+        "rules" : out,
+    }, nil
+}
+
+var POST_device__id__rules_endpoint = adapter.Endpoint{
+    Method: "POST",
+    Path: "/device/{id}/rules",
+    Summary: "Create an alarm rule",
+    Auth: adapter.AccountAuth,
+    Body: jsonschema.Object(map[string]*jsonschema.Schema{
+        "name" : jsonschema.String("Rule name"),
+        "type" : jsonschema.StringEnum("Rule type", rules.Types...),
+        "var_name" : jsonschema.String("Cloud variable to watch"),
+        "operator" : jsonschema.StringEnum("Comparison (threshold and rate rules)", rules.Operators...),
+        "threshold" : jsonschema.Number("Threshold value, or change per minute for rate rules"),
+        "hysteresis" : jsonschema.Number("How far back across the threshold the value must go to clear"),
+        "bool_value" : jsonschema.Boolean("Value that triggers a boolean rule"),
+        "duration" : jsonschema.Number("Seconds the condition must hold before firing, or without data for stale rules"),
+        "notify_type" : jsonschema.StringEnum("Notification raised when the rule fires", notify.NotifyTypes...),
+        "message" : jsonschema.String("Notification message.  Generated if omitted."),
+    }, "type", "var_name", "notify_type"),
+    Response: okResponse(map[string]*jsonschema.Schema{
+        "rule" : alarmRuleSchema,
+    }),
+    Handler: POST_device__id__rules,
+}
+
+// Create an alarm rule on one of the logged-in account's devices.  Requires
+// read-write access to the device.  Request:
+// {
+//      "name" : <NAME>,
+//      "type" : "threshold" | "rate" | "stale" | "boolean",
+//      "var_name" : <CLOUD_VAR_NAME>,
+//      "operator" : ">" | ">=" | "<" | "<=" | "==" | "!=",
+//      "threshold" : <NUMBER>,
+//      "hysteresis" : <NUMBER>,
+//      "bool_value" : <BOOL>,
+//      "duration" : <SECONDS>,
+//      "notify_type" : <NOTIFY_TYPE>,
+//      "message" : <MESSAGE>
+// }
+//
+// Threshold and rate rules require "operator" and "threshold".  Boolean
+// rules require "bool_value".  Stale rules require "duration".
+func POST_device__id__rules(w http.ResponseWriter, r *http.Request, info adapter.CanopyRestInfo) (map[string]interface{}, rest_errors.CanopyRestError) {
+    device, restErr := deviceForAccount(info, datalayer.ReadWriteAccess)
+    if restErr != nil {
+        return nil, restErr
+    }
+
+    rule := datalayer.AlarmRule{
+        DeviceID: device.ID(),
+        CreatedBy: info.Account.Username(),
+    }
+    rule.Name, _ = info.BodyObj["name"].(string)
+    rule.Message, _ = info.BodyObj["message"].(string)
+
+    rule.Type, _ = info.BodyObj["type"].(string)
+    if !isOneOf(rule.Type, rules.Types) {
+        return nil, rest_errors.NewBadInputFieldError("type", "Unknown rule type")
+    }
+    rule.VarName, _ = info.BodyObj["var_name"].(string)
+    if rule.VarName == "" {
+        return nil, rest_errors.NewBadInputFieldError("var_name", "String \"var_name\" expected")
+    }
+    rule.NotifyType, _ = info.BodyObj["notify_type"].(string)
+    if !isOneOf(rule.NotifyType, notify.NotifyTypes) {
+        return nil, rest_errors.NewBadInputFieldError("notify_type", "Unknown notify_type")
+    }
+
+    duration, _ := info.BodyObj["duration"].(float64)
+    if duration < 0 {
+        return nil, rest_errors.NewBadInputFieldError("duration", "\"duration\" must not be negative")
+    }
+    rule.Duration = time.Duration(duration*float64(time.Second))
+
+    hysteresis, _ := info.BodyObj["hysteresis"].(float64)
+    if hysteresis < 0 {
+        return nil, rest_errors.NewBadInputFieldError("hysteresis", "\"hysteresis\" must not be negative")
+    }
+    rule.Hysteresis = hysteresis
+
+    var ok bool
+    switch rule.Type {
+    case datalayer.AlarmRuleThreshold, datalayer.AlarmRuleRateOfChange:
+        rule.Operator, _ = info.BodyObj["operator"].(string)
+        if !isOneOf(rule.Operator, rules.Operators) {
+            return nil, rest_errors.NewBadInputFieldError("operator", "\"operator\" must be one of > >= < <= == !=")
+        }
+        rule.Threshold, ok = info.BodyObj["threshold"].(float64)
+        if !ok {
+            return nil, rest_errors.NewBadInputFieldError("threshold", "Numeric \"threshold\" expected")
+        }
+    case datalayer.AlarmRuleBoolean:
+        rule.BoolValue, ok = info.BodyObj["bool_value"].(bool)
+        if !ok {
+            return nil, rest_errors.NewBadInputFieldError("bool_value", "Boolean \"bool_value\" expected")
+        }
+    case datalayer.AlarmRuleStaleData:
+        if rule.Duration <= 0 {
+            return nil, rest_errors.NewBadInputFieldError("duration", "Stale data rules require a positive \"duration\"")
+        }
+    }
+
+    created, err := info.Conn.CreateAlarmRule(rule)
+    if err != nil {
+        return nil, rest_errors.NewInternalServerError("Problem creating alarm rule")
+    }
+    return map[string]interface{} {
+        "result" : "ok",
+        "rule" : alarmRuleJsonObj(*created),
+    }, nil
+}
+
+var DELETE_device__id__rule__rule_id_endpoint = adapter.Endpoint{
+    Method: "DELETE",
+    Path: "/device/{id}/rule/{rule_id}",
+    Summary: "Delete an alarm rule",
+    Auth: adapter.AccountAuth,
+    Response: okResponse(nil),
+    Handler: DELETE_device__id__rule__rule_id,
+}
+
+// Delete one of a device's alarm rules.  Requires read-write access to the
+// device.
+func DELETE_device__id__rule__rule_id(w http.ResponseWriter, r *http.Request, info adapter.CanopyRestInfo) (map[string]interface{}, rest_errors.CanopyRestError) {
+    device, restErr := deviceForAccount(info, datalayer.ReadWriteAccess)
+    if restErr != nil {
+        return nil, restErr
+    }
+
+    rule, err := info.Conn.LookupAlarmRule(device.ID(), info.URLVars["rule_id"])
+    if err != nil {
+        return nil, rest_errors.NewURLNotFoundError()
+    }
+    err = info.Conn.DeleteAlarmRule(device.ID(), rule.ID)
+    if err != nil {
+        return nil, rest_errors.NewInternalServerError("Problem deleting alarm rule")
+    }
+    return map[string]interface{} {
+        "result" : "ok",
+    }, nil
+}
@@ -14,27 +14,57 @@
 package endpoints
 
 import (
-    "canopy/canolog"
+    "canopy/config"
+    "canopy/mail"
     "canopy/mail/messages"
     "canopy/rest/adapter"
     "canopy/rest/rest_errors"
+    "canopy/util/jsonschema"
     "net/http"
+    "time"
 )
 
+var POST_create_account_endpoint = adapter.Endpoint{
+    Method: "POST",
+    Path: "/create_account",
+    Summary: "Create an account and log in",
+    Description: "Sends an activation email to the new account's address.",
+    Body: jsonschema.Object(map[string]*jsonschema.Schema{
+        "username" : jsonschema.String("Username"),
+        "email" : jsonschema.String("Email address"),
+        "password" : jsonschema.String("Password"),
+        "language" : jsonschema.String("Language for email, like \"en\" or \"pt-BR\""),
+    }, "username", "email", "password"),
+    Response: okResponse(map[string]*jsonschema.Schema{
+        "activated" : jsonschema.Boolean("Always false for a new account"),
+        "username" : jsonschema.String("Username"),
+        "email" : jsonschema.String("Email address"),
+    }),
+    Handler: POST_create_account,
+}
+
 func POST_create_account(w http.ResponseWriter, r *http.Request, info adapter.CanopyRestInfo) (map[string]interface{}, rest_errors.CanopyRestError) {
     username, ok := info.BodyObj["username"].(string)
     if !ok {
-        return nil, rest_errors.NewBadInputError("String \"username\" expected")
+        return nil, rest_errors.NewBadInputFieldError("username", "String \"username\" expected")
     }
 
     email, ok := info.BodyObj["email"].(string)
     if !ok {
-        return nil, rest_errors.NewBadInputError("String \"email\" expected")
+        return nil, rest_errors.NewBadInputFieldError("email", "String \"email\" expected")
     }
 
     password, ok := info.BodyObj["password"].(string)
     if !ok {
-        return nil, rest_errors.NewBadInputError("String \"password\" expected")
+        return nil, rest_errors.NewBadInputFieldError("password", "String \"password\" expected")
+    }
+
+    lang := ""
+    if value, ok := info.BodyObj["language"]; ok {
+        lang, ok = value.(string)
+        if !ok || (lang != "" && !messages.IsLanguage(lang)) {
+            return nil, rest_errors.NewBadInputFieldError("language", "Expected language like \"en\" or \"pt-BR\"")
+        }
     }
 
     account, err := info.Conn.LookupAccount(username)
@@ -56,35 +86,41 @@ func POST_create_account(w http.ResponseWriter, r *http.Request, info adapter.Ca
         return nil, rest_errors.NewInternalServerError("Problem Creating Account")
     }
 
+    if lang != "" {
+        err = account.SetLanguage(lang)
+        if err != nil {
+            return nil, rest_errors.NewInternalServerError("Problem setting language")
+        }
+    }
+
     info.Session.Values["logged_in_username"] = username
+    info.Session.Values["logged_in_at"] = time.Now().Unix()
     err = info.Session.Save(r, w)
     if err != nil {
         return nil, rest_errors.NewInternalServerError("Problem saving session")
     }
 
-    canolog.Trace("Sending email")
-
-    protocol := "http://"
-    if info.Config.OptEnableHTTPS() {
-        protocol = "https://"
-    }
+    logger.Trace("Sending email")
 
-    activationLink := protocol + info.Config.OptHostname() + 
+    activationLink := config.BaseURL(info.Config) + 
             "/mgr/activate.html?username=" + account.Username() + 
             "&code=" + account.ActivationCode()
 
     msg := info.Mailer.NewMail();
     msg.AddTo(account.Email(), account.Username())
-    msg.SetFrom("no-reply@canopy.link", "Canopy Cloud Service")
-    msg.SetReplyTo("no-reply@canopy.link")
-    messages.MailMessageCreatedAccount(msg,
+    mail.SetNoReply(msg)
+    err = messages.MailMessageCreatedAccount(msg,
+        account.Language(),
         account.Username(), 
         activationLink,
-        protocol + info.Config.OptHostname(),
+        config.BaseURL(info.Config),
         info.Config.OptHostname(),
     )
-    err = info.Mailer.Send(msg)
+    if (err == nil) {
+        err = info.Mailer.Send(msg)
+    }
     if (err != nil) {
+        logger.Error("Problem sending account creation email: ", err)
         return nil, rest_errors.NewInternalServerError("Problem sending mail")
     }
 
@@ -15,11 +15,32 @@ package endpoints
 
 import (
     "canopy/datalayer"
+    "canopy/quota"
     "canopy/rest/adapter"
     "canopy/rest/rest_errors"
+    "canopy/util/jsonschema"
     "net/http"
 )
 
+var POST_create_devices_endpoint = adapter.Endpoint{
+    Method: "POST",
+    Path: "/create_devices",
+    Summary: "Create devices owned by the account",
+    Auth: adapter.AccountAuth,
+    Body: jsonschema.Object(map[string]*jsonschema.Schema{
+        "quantity" : jsonschema.Integer("Number of devices to create"),
+        "friendly_names" : jsonschema.Array(jsonschema.String(""), "Name of each device"),
+    }, "quantity", "friendly_names"),
+    Response: okResponse(map[string]*jsonschema.Schema{
+        "devices" : jsonschema.Array(jsonschema.Object(map[string]*jsonschema.Schema{
+            "friendly_name" : jsonschema.String("Device name"),
+            "device_id" : jsonschema.String("Device UUID"),
+            "device_secret_key" : jsonschema.String("Secret key the device authenticates with"),
+        }), "Created devices"),
+    }),
+    Handler: POST_create_devices,
+}
+
 func POST_create_devices(w http.ResponseWriter, r *http.Request, info adapter.CanopyRestInfo) (map[string]interface{}, rest_errors.CanopyRestError) {
     if info.Account == nil {
         return nil, rest_errors.NewNotLoggedInError()
@@ -27,17 +48,24 @@ func POST_create_devices(w http.ResponseWriter, r *http.Request, info adapter.Ca
 
     quantityFloat, ok := info.BodyObj["quantity"].(float64)
     if !ok {
-        return nil, rest_errors.NewBadInputError("Numeric \"quantity\" expected")
+        return nil, rest_errors.NewBadInputFieldError("quantity", "Numeric \"quantity\" expected")
     }
     quantity := int(quantityFloat)
 
     friendlyNames, ok := info.BodyObj["friendly_names"].([]interface{})
     if !ok {
-        return nil, rest_errors.NewBadInputError("List \"friendly_names\" expected")
+        return nil, rest_errors.NewBadInputFieldError("friendly_names", "List \"friendly_names\" expected")
     }
 
     if len(friendlyNames) != quantity {
-        return nil, rest_errors.NewBadInputError("Incorrect number of friendly_names provided")
+        return nil, rest_errors.NewBadInputFieldError("friendly_names", "Incorrect number of friendly_names provided")
+    }
+
+    err := quota.CheckDevices(info.Config, info.Account, quantity)
+    if limitErr, ok := err.(*quota.LimitExceededError); ok {
+        return nil, rest_errors.NewRateLimitExceededError(limitErr.Limit, limitErr.RetryAfter)
+    } else if err != nil {
+        return nil, rest_errors.NewInternalServerError("Problem checking device quota")
     }
 
     out := map[string]interface{} {
@@ -48,7 +76,7 @@ func POST_create_devices(w http.ResponseWriter, r *http.Request, info adapter.Ca
     for _, nameItf := range friendlyNames {
         friendlyName, ok := nameItf.(string)
         if !ok {
-            return nil, rest_errors.NewBadInputError("String friendly name expected")
+            return nil, rest_errors.NewBadInputFieldError("friendly_names", "String friendly name expected")
         }
         device, err := info.Conn.CreateDevice(friendlyName, nil, "", datalayer.NoAccess);
         if err != nil {
@@ -0,0 +1,94 @@
+// Copyright 2015 SimpleThings, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package endpoints
+
+import (
+    "canopy/mail"
+    "canopy/rest/adapter"
+    "canopy/rest/rest_errors"
+    "canopy/util/jsonschema"
+    "net/http"
+    "strconv"
+    "time"
+)
+
+const devMailDefaultLimit = 10
+const devMailMaxLimit = 100
+
+var capturedMailSchema = jsonschema.Object(map[string]*jsonschema.Schema{
+    "id" : jsonschema.String("File name, or position in the mbox"),
+    "from" : jsonschema.String("From header"),
+    "to" : jsonschema.Array(jsonschema.String(""), "Recipient addresses"),
+    "subject" : jsonschema.String("Subject"),
+    "date" : jsonschema.String("Date header, RFC 3339"),
+    "text" : jsonschema.String("Plain text body"),
+    "html" : jsonschema.String("HTML body"),
+})
+
+var GET_dev_mail_endpoint = adapter.Endpoint{
+    Method: "GET",
+    Path: "/dev/mail",
+    Summary: "List the most recent email captured by the \"file\" email service",
+    Description: "Only served when the \"dev-mode\" option is set.  Requires " +
+            "no credentials, so that tests can read activation links and " +
+            "reset codes.  The optional \"limit\" query parameter sets how " +
+            "many messages are returned.",
+    Response: okResponse(map[string]*jsonschema.Schema{
+        "messages" : jsonschema.Array(capturedMailSchema, "Captured messages, newest first"),
+    }),
+    Handler: GET_dev_mail,
+}
+
+func GET_dev_mail(w http.ResponseWriter, r *http.Request, info adapter.CanopyRestInfo) (map[string]interface{}, rest_errors.CanopyRestError) {
+    if !info.Config.OptDevMode() {
+        return nil, rest_errors.NewURLNotFoundError()
+    }
+    if info.Config.OptEmailService() != "file" {
+        return nil, rest_errors.NewBadInputError("Email is only captured when \"email-service\" is \"file\"")
+    }
+
+    var err error
+    limit := devMailDefaultLimit
+    if limitString := r.URL.Query().Get("limit"); limitString != "" {
+        limit, err = strconv.Atoi(limitString)
+        if err != nil || limit < 1 || limit > devMailMaxLimit {
+            return nil, rest_errors.NewBadInputFieldError("limit", "\"limit\" must be between 1 and " + strconv.Itoa(devMailMaxLimit))
+        }
+    }
+
+    captured, err := mail.ReadCapturedMail(info.Config.OptEmailFileDir(), info.Config.OptEmailFileFormat(), limit)
+    if err != nil {
+        logger.Error("Problem reading captured mail: ", err)
+        return nil, rest_errors.NewInternalServerError("Problem reading captured mail")
+    }
+
+    messages := []map[string]interface{}{}
+    for _, msg := range captured {
+        messages = append(messages, map[string]interface{} {
+            "id" : msg.ID,
+            "from" : msg.From,
+            "to" : msg.To,
+            "subject" : msg.Subject,
+            "date" : msg.Date.Format(time.RFC3339),
+            "text" : msg.Text,
+            "html" : msg.HTML,
+        })
+    }
+
+    return map[string]interface{} {
+        "result" : "ok",
+        "messages" : messages,
+    }, nil
+}
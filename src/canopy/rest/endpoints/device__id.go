@@ -14,18 +14,29 @@
 package endpoints
 
 import (
-    "canopy/canolog"
-    "canopy/cloudvar"
     "canopy/pigeon"
+    "canopy/quota"
     "canopy/rest/adapter"
     "canopy/datalayer"
+    "canopy/events"
     "canopy/rest/rest_errors"
+    "canopy/service"
+    "canopy/util/jsonschema"
     "canopy/sddl"
     "github.com/gocql/gocql"
     "net/http"
     "time"
 )
 
+var GET_device__id_endpoint = adapter.Endpoint{
+    Method: "GET",
+    Path: "/device/{id}",
+    Summary: "Get a device's details and latest cloud variable values",
+    Auth: adapter.AccountOrDeviceAuth,
+    Response: deviceSchema,
+    Handler: GET_device__id,
+}
+
 func GET_device__id(w http.ResponseWriter, r *http.Request, info adapter.CanopyRestInfo) (map[string]interface{}, rest_errors.CanopyRestError) {
     // TODO: Check permissions
     //
@@ -44,13 +55,28 @@ func GET_device__id(w http.ResponseWriter, r *http.Request, info adapter.CanopyR
     }
     out, err := deviceToJsonObj(info.PigeonSys, device)
     if err != nil {
-        w.WriteHeader(http.StatusInternalServerError);
         return nil, rest_errors.NewInternalServerError("Generating JSON")
     }
 
     return out, nil
 }
 
+var POST_device__id_endpoint = adapter.Endpoint{
+    Method: "POST",
+    Path: "/device/{id}",
+    Summary: "Update a device and report cloud variable values",
+    Auth: adapter.AccountOrDeviceAuth,
+    Body: jsonschema.Object(map[string]*jsonschema.Schema{
+        "__friendly_name" : jsonschema.String("New device name"),
+        "__location_note" : jsonschema.String("New location note"),
+        "sddl" : jsonschema.Map(jsonschema.Any(""), "SDDL to add to the device's class"),
+        "vars" : jsonschema.Map(jsonschema.Any(""), "Cloud variable values, by name"),
+        "notify" : jsonschema.Any("Notification to raise, {\"type\", \"msg\"}, or a list of up to 10 of them.  Only devices may raise notifications."),
+    }),
+    Response: okResponse(nil),
+    Handler: POST_device__id,
+}
+
 func POST_device__id(w http.ResponseWriter, r *http.Request, info adapter.CanopyRestInfo) (map[string]interface{}, rest_errors.CanopyRestError) {
     deviceIdString := info.URLVars["id"]
 
@@ -111,38 +137,49 @@ func POST_device__id(w http.ResponseWriter, r *http.Request, info adapter.Canopy
         case "sddl":
             sddlJsonObj, ok := value.(map[string]interface{})
             if !ok {
-                return nil, rest_errors.NewBadInputError("Expected object \"sddl\"")
+                return nil, rest_errors.NewBadInputFieldError("sddl", "Expected object \"sddl\"")
             }
             err = device.ExtendSDDL(sddlJsonObj)
             if err != nil {
-                return nil, rest_errors.NewBadInputError(err.Error())
+                return nil, rest_errors.NewBadInputFieldError("sddl", err.Error())
             }
+            info.EventHub.Publish(device.IDString(), events.TypeSDDL, map[string]interface{}{
+                "sddl" : device.SDDLDocument().Json(),
+            })
         }
     }
 
-    // Handle vars last
+    // Handle vars and notifications last
     for fieldName, value := range info.BodyObj {
         switch fieldName {
         case "vars":
             varsJsonObj, ok := value.(map[string]interface{})
             if !ok {
-                return nil, rest_errors.NewBadInputError("Expected object \"vars\"")
+                return nil, rest_errors.NewBadInputFieldError("vars", "Expected object \"vars\"")
+            }
+            principal := quota.DevicePrincipal(device)
+            err = quota.CheckSamples(info.Config, info.Conn, principal, len(varsJsonObj))
+            if limitErr, ok := err.(*quota.LimitExceededError); ok {
+                return nil, rest_errors.NewRateLimitExceededError(limitErr.Limit, limitErr.RetryAfter)
+            } else if err != nil {
+                logger.Error("Problem checking sample quota: ", err)
+            }
+            numStored, err := service.StoreCloudVars(info.EventHub, device, varsJsonObj, time.Now())
+            quota.RecordSamples(info.Conn, principal, numStored)
+            if err != nil {
+                return nil, rest_errors.NewInternalServerError("Storing derived cloud variables")
+            }
+        case "notify":
+            // Notifications can be sent to the owner and everyone the device
+            // is shared with, so only the device itself may raise them.
+            if info.Device == nil {
+                return nil, rest_errors.NewPermissionDeniedError("Only devices can raise notifications")
             }
-            for varName, valueJsonObj := range varsJsonObj {
-                varDef, err := device.LookupVarDef(varName)
-                if err != nil {
-                    canolog.Warn("Cloud variable not found: ", varName)
-                    /* TODO: Report warning in response*/
-                    continue;
-                }
-
-                varVal, err := cloudvar.JsonToCloudVarValue(varDef, valueJsonObj)
-                if err != nil {
-                    canolog.Warn("Cloud variable value parsing problem: ", varName, err)
-                    /* TODO: Report warning in response*/
-                    continue;
-                }
-                device.InsertSample(varDef, time.Now(), varVal);
+            err = service.RaiseNotifications(info.Config, info.Conn, info.EventHub, info.Senders, device, value)
+            if limitErr, ok := err.(*quota.LimitExceededError); ok {
+                return nil, rest_errors.NewRateLimitExceededError(limitErr.Limit, limitErr.RetryAfter)
+            } else if err != nil {
+                return nil, rest_errors.NewBadInputFieldError("notify", err.Error())
             }
         }
     }
@@ -150,10 +187,10 @@ func POST_device__id(w http.ResponseWriter, r *http.Request, info adapter.Canopy
     msg := &pigeon.PigeonMessage {
         Data : info.BodyObj,
     }
-    canolog.Info("Sending pigeon message", msg);
+    logger.Info("Sending pigeon message", msg);
     err = info.PigeonSys.SendMessage(deviceIdString, msg, time.Duration(100*time.Millisecond))
     if err != nil {
-        canolog.Warn("Problem sending WS message! ", err);
+        logger.Warn("Problem sending WS message! ", err);
         // TODO: Are there certain errors here that shouldn't be ignored?
         //return nil, rest_errors.NewInternalServerError("SendMessage failed")
     }
@@ -16,16 +16,27 @@
 package endpoints
 
 import (
-    "canopy/canolog"
     "canopy/datalayer"
     "canopy/rest/adapter"
     "canopy/rest/rest_errors"
+    "canopy/util/jsonschema"
     "fmt"
     "github.com/gocql/gocql"
     "net/http"
     "time"
 )
 
+var GET_device__id__sensor_endpoint = adapter.Endpoint{
+    Method: "GET",
+    Path: "/device/{id}/{sensor}",
+    Summary: "Get historic samples of a cloud variable",
+    Auth: adapter.AccountAuth,
+    Response: jsonschema.Object(map[string]*jsonschema.Schema{
+        "samples" : jsonschema.Array(sampleSchema, "Samples, oldest first"),
+    }),
+    Handler: GET_device__id__sensor,
+}
+
 func GET_device__id__sensor(w http.ResponseWriter, r *http.Request, info adapter.CanopyRestInfo) (map[string]interface{}, rest_errors.CanopyRestError) {
     deviceIdString := info.URLVars["id"]
     sensorName := info.URLVars["sensor"]
@@ -38,7 +49,7 @@ func GET_device__id__sensor(w http.ResponseWriter, r *http.Request, info adapter
     }
 
     //if info.Config.OptAllowAnonDevices() && device.PublicAccessLevel() > datalayer.NoAccess {
-        canolog.Info("C");
+        logger.Info("C");
         device, err = info.Conn.LookupDevice(uuid)
         if err != nil {
             // TODO: What errors to return here?
@@ -47,7 +58,7 @@ func GET_device__id__sensor(w http.ResponseWriter, r *http.Request, info adapter
         authorized = true
     //} else {
     // TODO: fix anon devices
-    canolog.Info("D");
+    logger.Info("D");
     if info.Account == nil {
         return nil, rest_errors.NewNotLoggedInError()
     }
@@ -61,46 +72,46 @@ func GET_device__id__sensor(w http.ResponseWriter, r *http.Request, info adapter
     authorized = true
     //}
 
-    canolog.Info("E");
+    logger.Info("E");
     if !authorized {
         // TODO: What is the correct error for this?
         return nil, rest_errors.NewURLNotFoundError()
     }
 
-    canolog.Info("F");
+    logger.Info("F");
     doc := device.SDDLDocument()
     if doc == nil {
-        w.WriteHeader(http.StatusBadRequest);
-        fmt.Fprintf(w, "{\"error\" : \"Device doesn't have any cloud variables\"}");
-        return nil, nil
+        return nil, rest_errors.NewLegacyError(http.StatusBadRequest,
+                "no_cloud_variables",
+                "Device doesn't have any cloud variables",
+                "Device doesn't have any cloud variables")
     }
 
-    canolog.Info("G");
+    logger.Info("G");
     varDef, err := doc.LookupVarDef(sensorName)
     if err != nil{
-        w.WriteHeader(http.StatusBadRequest);
-        fmt.Fprintf(w, "{\"error\" : \"Device does not have cloud variable %s\"}", sensorName);
-        return nil, nil
+        msg := "Device does not have cloud variable " + sensorName
+        return nil, rest_errors.NewLegacyError(http.StatusBadRequest,
+                "unknown_cloud_variable", msg, msg)
     }
 
-    canolog.Info("H");
+    logger.Info("H");
     samples, err := device.HistoricData(varDef, time.Now(), time.Now())
     if err != nil {
-        fmt.Println(err)
-        w.WriteHeader(http.StatusInternalServerError);
-        fmt.Fprintf(w, "{\"error\" : \"Could not obtain sample data\"}");
-        return nil, nil
+        logger.Error("Could not obtain sample data: ", err)
+        return nil, rest_errors.NewLegacyError(http.StatusInternalServerError,
+                "internal_error",
+                "Could not obtain sample data",
+                "Could not obtain sample data")
     }
 
-    canolog.Info("I");
+    logger.Info("I");
     out, err := samplesToJson(samples)
     if err != nil {
-        w.WriteHeader(http.StatusInternalServerError);
-        fmt.Fprintf(w, "{\"error\" : \"generating_json\"} : ", err);
-        return nil, nil
+        return nil, rest_errors.NewInternalServerError("Generating JSON")
     }
 
-    canolog.Info("J");
-    fmt.Fprintf(w, out);
+    logger.Info("J");
+    fmt.Fprint(w, out);
     return nil, nil
 }
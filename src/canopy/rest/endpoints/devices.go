@@ -21,6 +21,25 @@ import (
     "net/http"
 )
 
+var GET_devices_endpoint = adapter.Endpoint{
+    Method: "GET",
+    Path: "/devices",
+    Summary: "List the devices the account has access to",
+    Auth: adapter.AccountAuth,
+    Response: devicesSchema,
+    Handler: GET_devices,
+}
+
+// Same as GET /devices.
+var GET_me_devices_endpoint = adapter.Endpoint{
+    Method: "GET",
+    Path: "/me/devices",
+    Summary: "List the devices the account has access to",
+    Auth: adapter.AccountAuth,
+    Response: devicesSchema,
+    Handler: GET_devices,
+}
+
 func GET_devices(w http.ResponseWriter, r *http.Request, info adapter.CanopyRestInfo) (map[string]interface{}, rest_errors.CanopyRestError) {
     if info.Account == nil {
         return nil, rest_errors.NewNotLoggedInError()
@@ -0,0 +1,257 @@
+// Copyright 2015 SimpleThings, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package endpoints
+
+import (
+    "canopy/datalayer"
+    "canopy/datalayer/cassandra_datalayer"
+    "canopy/events"
+    "canopy/rest/adapter"
+    "canopy/rest/rest_errors"
+    "canopy/util/jsonschema"
+    "encoding/json"
+    "fmt"
+    "github.com/gocql/gocql"
+    "io"
+    "net/http"
+    "strconv"
+    "sync"
+    "time"
+)
+
+// Server-Sent Events streams of device activity.  Each event is sent as:
+//
+//  id: <EVENT_ID>
+//  event: sample | sddl | notification | connected | disconnected
+//  data: {"type" : ..., "device_id" : ..., "t" : ..., ...}
+//
+// Browsers' EventSource reconnects automatically, sending the last event ID
+// it saw in the Last-Event-ID header, and any events since then that the
+// server still remembers are replayed.  Clients that can't set headers may
+// use the "last_event_id" query parameter instead.
+
+// How often to send a comment line, so that proxies don't close idle streams.
+const sseKeepaliveInterval = 15*time.Second
+
+// How often to check that an account still has access to the devices it is
+// streaming, so that unsharing a device takes effect on open streams.
+const sseAccessCheckInterval = time.Minute
+
+var eventSchema = jsonschema.Object(map[string]*jsonschema.Schema{
+    "type" : jsonschema.StringEnum("Event type",
+            events.TypeSample,
+            events.TypeSDDL,
+            events.TypeNotification,
+            events.TypeConnected,
+            events.TypeDisconnected),
+    "device_id" : jsonschema.String("Device UUID"),
+    "t" : jsonschema.String("Time, RFC 3339"),
+    "var" : jsonschema.String("Cloud variable name (sample events)"),
+    "v" : jsonschema.Any("Value (sample events)"),
+    "sddl" : jsonschema.Map(jsonschema.Any(""), "The device's new SDDL class (sddl events)"),
+    "notify_type" : jsonschema.String("Notification type (notification events)"),
+    "msg" : jsonschema.String("Notification message (notification events)"),
+})
+
+var GET_device__id__events_endpoint = adapter.Endpoint{
+    Method: "GET",
+    Path: "/device/{id}/events",
+    Summary: "Stream a device's activity as Server-Sent Events",
+    Auth: adapter.AccountOrDeviceAuth,
+    Response: eventSchema,
+    ResponseContentType: "text/event-stream",
+    Handler: GET_device__id__events,
+}
+
+var GET_me_events_endpoint = adapter.Endpoint{
+    Method: "GET",
+    Path: "/me/events",
+    Summary: "Stream the activity of all the account's devices as Server-Sent Events",
+    Description: "Covers the devices the account has access to.  Changes " +
+            "in access are picked up within a minute.",
+    Auth: adapter.AccountAuth,
+    Response: eventSchema,
+    ResponseContentType: "text/event-stream",
+    Handler: GET_me_events,
+}
+
+func lastEventID(r *http.Request) uint64 {
+    idString := r.Header.Get("Last-Event-ID")
+    if idString == "" {
+        idString = r.URL.Query().Get("last_event_id")
+    }
+    id, _ := strconv.ParseUint(idString, 10, 64)
+    return id
+}
+
+func writeSSEEvent(w io.Writer, event events.Event) error {
+    data, err := json.Marshal(event.JsonObj())
+    if err != nil {
+        return err
+    }
+    _, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+    return err
+}
+
+// Run <checkAccess> with a short-lived database connection.
+func checkStreamAccess(info adapter.CanopyRestInfo, checkAccess func(datalayer.Connection) bool) bool {
+    conn, err := cassandra_datalayer.NewDatalayer(info.Config).Connect("canopy")
+    if err != nil {
+        logger.Error("Problem connecting to check event stream access: ", err)
+        return false
+    }
+    defer conn.Close()
+    return checkAccess(conn)
+}
+
+// Stream events for which <filter> returns true, until the client goes away.
+// If <checkAccess> is not nil, it is called every sseAccessCheckInterval
+// and the stream ends when it returns false.
+//
+// Streams are long-lived, so the request's database connection is closed
+// first, and <info>'s Account and Device must not be used afterwards.
+func streamEvents(w http.ResponseWriter, r *http.Request, info adapter.CanopyRestInfo, filter func(events.Event) bool, checkAccess func(datalayer.Connection) bool) (map[string]interface{}, rest_errors.CanopyRestError) {
+    flusher, ok := w.(http.Flusher)
+    if !ok || info.EventHub == nil {
+        return nil, rest_errors.NewInternalServerError("Event streaming not available")
+    }
+
+    // Closing twice (again when the handler returns) is harmless.
+    info.Conn.Close()
+
+    sub, missed := info.EventHub.Subscribe(filter, lastEventID(r))
+    defer sub.Close()
+
+    w.Header().Set("Content-Type", "text/event-stream")
+    w.Header().Set("Cache-Control", "no-cache")
+    w.Header().Set("X-Accel-Buffering", "no")
+    w.WriteHeader(http.StatusOK)
+    fmt.Fprint(w, "retry: 3000\n\n")
+    for _, event := range missed {
+        err := writeSSEEvent(w, event)
+        if err != nil {
+            return nil, nil
+        }
+    }
+    flusher.Flush()
+
+    keepalive := time.NewTicker(sseKeepaliveInterval)
+    defer keepalive.Stop()
+    accessCheck := time.NewTicker(sseAccessCheckInterval)
+    defer accessCheck.Stop()
+    for {
+        select {
+        case event, ok := <-sub.C():
+            if !ok {
+                // Fell behind.  The client will reconnect and resume.
+                return nil, nil
+            }
+            err := writeSSEEvent(w, event)
+            if err != nil {
+                return nil, nil
+            }
+        case <-keepalive.C:
+            _, err := fmt.Fprint(w, ": keepalive\n\n")
+            if err != nil {
+                return nil, nil
+            }
+        case <-accessCheck.C:
+            if checkAccess != nil && !checkStreamAccess(info, checkAccess) {
+                return nil, nil
+            }
+        case <-r.Context().Done():
+            return nil, nil
+        }
+        flusher.Flush()
+    }
+}
+
+func GET_device__id__events(w http.ResponseWriter, r *http.Request, info adapter.CanopyRestInfo) (map[string]interface{}, rest_errors.CanopyRestError) {
+    deviceIdString := info.URLVars["id"]
+    uuid, err := gocql.ParseUUID(deviceIdString)
+    if err != nil {
+        return nil, rest_errors.NewURLNotFoundError()
+    }
+
+    var checkAccess func(datalayer.Connection) bool
+    if info.Account != nil {
+        _, err = info.Account.Device(uuid)
+        if err != nil {
+            return nil, rest_errors.NewURLNotFoundError()
+        }
+        username := info.Account.Username()
+        checkAccess = func(conn datalayer.Connection) bool {
+            acct, err := conn.LookupAccount(username)
+            if err != nil {
+                return false
+            }
+            _, err = acct.Device(uuid)
+            return err == nil
+        }
+    } else if info.Device != nil {
+        if info.Device.IDString() != uuid.String() {
+            return nil, rest_errors.NewURLNotFoundError()
+        }
+    } else {
+        return nil, rest_errors.NewNotLoggedInError()
+    }
+
+    deviceId := uuid.String()
+    return streamEvents(w, r, info, func(event events.Event) bool {
+        return event.DeviceID == deviceId
+    }, checkAccess)
+}
+
+func GET_me_events(w http.ResponseWriter, r *http.Request, info adapter.CanopyRestInfo) (map[string]interface{}, rest_errors.CanopyRestError) {
+    if info.Account == nil {
+        return nil, rest_errors.NewNotLoggedInError()
+    }
+
+    devices, err := info.Account.Devices()
+    if err != nil {
+        return nil, rest_errors.NewInternalServerError("Device lookup failed")
+    }
+    // The filter runs on the hub's goroutine while access checks replace
+    // the set.
+    var lock sync.RWMutex
+    deviceIds := map[string]bool{}
+    for _, device := range devices {
+        deviceIds[device.IDString()] = true
+    }
+
+    username := info.Account.Username()
+    return streamEvents(w, r, info, func(event events.Event) bool {
+        lock.RLock()
+        defer lock.RUnlock()
+        return deviceIds[event.DeviceID]
+    }, func(conn datalayer.Connection) bool {
+        acct, err := conn.LookupAccount(username)
+        if err != nil {
+            return false
+        }
+        devices, err := acct.Devices()
+        if err != nil {
+            return false
+        }
+        ids := map[string]bool{}
+        for _, device := range devices {
+            ids[device.IDString()] = true
+        }
+        lock.Lock()
+        deviceIds = ids
+        lock.Unlock()
+        return true
+    })
+}
@@ -18,8 +18,23 @@ import (
     "canopy/datalayer"
     "canopy/rest/adapter"
     "canopy/rest/rest_errors"
+    "canopy/util/jsonschema"
 )
 
+var POST_finish_share_transaction_endpoint = adapter.Endpoint{
+    Method: "POST",
+    Path: "/finish_share_transaction",
+    Summary: "Accept a device that was shared with the account",
+    Auth: adapter.AccountAuth,
+    Body: jsonschema.Object(map[string]*jsonschema.Schema{
+        "device_id" : jsonschema.String("Device UUID"),
+    }, "device_id"),
+    Response: okResponse(map[string]*jsonschema.Schema{
+        "device_friendly_name" : jsonschema.String("Device name"),
+    }),
+    Handler: POST_finish_share_transaction,
+}
+
 func POST_finish_share_transaction(w http.ResponseWriter, r *http.Request, info adapter.CanopyRestInfo) (map[string]interface{}, rest_errors.CanopyRestError) {
     /*
      *  POST
@@ -32,7 +47,7 @@ func POST_finish_share_transaction(w http.ResponseWriter, r *http.Request, info
      */
     deviceId, ok := info.BodyObj["device_id"].(string)
     if !ok {
-        return nil, rest_errors.NewBadInputError("String \"device_id\" expected")
+        return nil, rest_errors.NewBadInputFieldError("device_id", "String \"device_id\" expected")
     }
 
     if info.Account == nil {
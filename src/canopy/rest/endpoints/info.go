@@ -19,8 +19,25 @@ import (
     "net/http"
     "canopy/rest/adapter"
     "canopy/rest/rest_errors"
+    "canopy/util/jsonschema"
 )
 
+var GET_info_endpoint = adapter.Endpoint{
+    Method: "GET",
+    Path: "/info",
+    Summary: "Get the service version and configuration",
+    Description: "Only options that are safe to show anyone, such as the " +
+            "hostname, ports, quotas and which notification services are " +
+            "enabled, are included.  Administrators can see every option " +
+            "with GET /admin/config.",
+    Response: okResponse(map[string]*jsonschema.Schema{
+        "service-name" : jsonschema.String("Service name"),
+        "version" : jsonschema.String("Service version"),
+        "config" : jsonschema.Map(jsonschema.Any(""), "Public server configuration options"),
+    }),
+    Handler: GET_info,
+}
+
 func GET_info(w http.ResponseWriter, r *http.Request, info adapter.CanopyRestInfo) (map[string]interface{}, rest_errors.CanopyRestError) {
     return map[string]interface{}{
         "result" : "ok",
@@ -15,27 +15,129 @@ package endpoints
 
 import (
     "net/http"
+    "canopy/datalayer"
     "canopy/rest/adapter"
     "canopy/rest/rest_errors"
+    "canopy/util/jsonschema"
+    "canopy/rest/throttle"
+    "time"
 )
 
+// How long the user has to enter their two-factor code after entering a
+// correct password.
+const totpLoginWindow = 5*time.Minute
+
+var POST_login_endpoint = adapter.Endpoint{
+    Method: "POST",
+    Path: "/login",
+    Summary: "Log in, starting a session",
+    Description: "If the account has two-factor authentication enabled and " +
+            "\"totp_code\" is omitted, responds with a totp_required error. " +
+            "The code can then be sent on its own.",
+    Body: jsonschema.Object(map[string]*jsonschema.Schema{
+        "username" : jsonschema.String("Username or email address"),
+        "password" : jsonschema.String("Password"),
+        "totp_code" : jsonschema.String("Authenticator or recovery code"),
+    }),
+    Response: okResponse(map[string]*jsonschema.Schema{
+        "username" : jsonschema.String("Username"),
+        "email" : jsonschema.String("Email address"),
+    }),
+    Handler: POST_login,
+}
+
+// Login is a one- or two-step process.  The first request contains
+// "username" and "password".  If the account has two-factor authentication
+// enabled, this responds with a "totp_required" error and remembers (in the
+// session) that the password was correct.  The second request then contains
+// just "totp_code", which may be an authenticator code or a recovery code.
+// Clients may instead send all three fields in a single request.
 func POST_login(w http.ResponseWriter, r *http.Request, info adapter.CanopyRestInfo) (map[string]interface{}, rest_errors.CanopyRestError) {
-    username, ok := info.BodyObj["username"].(string)
-    if !ok {
-        return nil, rest_errors.NewBadInputError("String \"username\" expected")
+    var account datalayer.Account
+    var err error
+
+    clientIP := throttle.ClientIP(r.RemoteAddr)
+    wait, _ := info.LoginThrottle.Check(clientIP, "")
+    if wait > 0 {
+        return nil, rest_errors.NewTooManyAttemptsError(wait, false)
     }
 
-    password, ok := info.BodyObj["password"].(string)
-    if !ok {
-        return nil, rest_errors.NewBadInputError("String \"password\" expected")
+    totpCode, hasTOTPCode := info.BodyObj["totp_code"].(string)
+    _, hasUsername := info.BodyObj["username"]
+
+    if hasTOTPCode && !hasUsername {
+        // Second step of login.
+        pendingUsername, _ := info.Session.Values["totp_pending_username"].(string)
+        pendingExpiry, _ := info.Session.Values["totp_pending_expiry"].(int64)
+        if pendingUsername == "" || time.Now().Unix() > pendingExpiry {
+            return nil, rest_errors.NewBadInputFieldError("username", "String \"username\" expected")
+        }
+        account, err = info.Conn.LookupAccount(pendingUsername)
+        if err != nil {
+            return nil, rest_errors.NewIncorrectUsernameOrPasswordError()
+        }
+        wait, locked := info.LoginThrottle.Check(clientIP, account.Username())
+        if wait > 0 {
+            return nil, rest_errors.NewTooManyAttemptsError(wait, locked)
+        }
+    } else {
+        username, ok := info.BodyObj["username"].(string)
+        if !ok {
+            return nil, rest_errors.NewBadInputFieldError("username", "String \"username\" expected")
+        }
+
+        password, ok := info.BodyObj["password"].(string)
+        if !ok {
+            return nil, rest_errors.NewBadInputFieldError("password", "String \"password\" expected")
+        }
+
+        account, err = info.Conn.LookupAccount(username)
+        if err != nil {
+            info.LoginThrottle.RecordFailure(clientIP, "")
+            return nil, rest_errors.NewIncorrectUsernameOrPasswordError()
+        }
+
+        // Failures are counted against the canonical username, so that
+        // alternating between username and email does not help an attacker.
+        wait, locked := info.LoginThrottle.Check(clientIP, account.Username())
+        if wait > 0 {
+            return nil, rest_errors.NewTooManyAttemptsError(wait, locked)
+        }
+
+        if !account.VerifyPassword(password) {
+            if info.LoginThrottle.RecordFailure(clientIP, account.Username()) {
+                adapter.SendLockoutNotice(info, account)
+            }
+            return nil, rest_errors.NewIncorrectUsernameOrPasswordError()
+        }
     }
 
-    account, err := info.Conn.LookupAccountVerifyPassword(username, password)
-    if err != nil {
-        return nil, rest_errors.NewIncorrectUsernameOrPasswordError()
+    if account.IsTOTPEnabled() {
+        if !hasTOTPCode {
+            info.Session.Values["totp_pending_username"] = account.Username()
+            info.Session.Values["totp_pending_expiry"] = time.Now().Add(totpLoginWindow).Unix()
+            err = info.Session.Save(r, w)
+            if err != nil {
+                return nil, rest_errors.NewInternalServerError("Problem saving session")
+            }
+            return nil, rest_errors.NewTOTPRequiredError()
+        }
+        err = account.VerifySecondFactor(totpCode)
+        if err == datalayer.InvalidTOTPCodeError {
+            if info.LoginThrottle.RecordFailure(clientIP, account.Username()) {
+                adapter.SendLockoutNotice(info, account)
+            }
+            return nil, rest_errors.NewIncorrectTOTPCodeError()
+        } else if err != nil {
+            return nil, rest_errors.NewInternalServerError("Problem verifying two-factor code")
+        }
     }
+    info.LoginThrottle.RecordSuccess(clientIP, account.Username())
 
-    info.Session.Values["logged_in_username"] = username
+    delete(info.Session.Values, "totp_pending_username")
+    delete(info.Session.Values, "totp_pending_expiry")
+    info.Session.Values["logged_in_username"] = account.Username()
+    info.Session.Values["logged_in_at"] = time.Now().Unix()
     err = info.Session.Save(r, w)
     if err != nil {
         return nil, rest_errors.NewInternalServerError("Problem saving session")
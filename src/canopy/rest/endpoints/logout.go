@@ -21,6 +21,13 @@ import (
     "canopy/rest/rest_errors"
 )
 
+var GET_POST_logout_endpoint = adapter.Endpoint{
+    Path: "/logout",
+    Summary: "End the session",
+    Response: okResponse(nil),
+    Handler: GET_POST_logout,
+}
+
 func GET_POST_logout(w http.ResponseWriter, r *http.Request, info adapter.CanopyRestInfo) (map[string]interface{}, rest_errors.CanopyRestError) {
     info.Session.Values["logged_in_username"] = ""
     err := info.Session.Save(r, w)
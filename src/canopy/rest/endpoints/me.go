@@ -16,48 +16,254 @@
 package endpoints
 
 import (
+    "canopy/config"
+    "canopy/datalayer"
+    "canopy/mail"
+    "canopy/mail/messages"
+    "canopy/quota"
     "canopy/rest/adapter"
     "canopy/rest/rest_errors"
+    "canopy/util/jsonschema"
     "net/http"
 )
 
+var GET_me_endpoint = adapter.Endpoint{
+    Method: "GET",
+    Path: "/me",
+    Summary: "Get the account's details and usage",
+    Auth: adapter.AccountAuth,
+    Response: okResponse(map[string]*jsonschema.Schema{
+        "activated" : jsonschema.Boolean("Whether the account has been activated"),
+        "app_passwords" : jsonschema.Array(jsonschema.String(""), "Names of app passwords"),
+        "totp_enabled" : jsonschema.Boolean("Whether two-factor authentication is enabled"),
+        "usage" : jsonschema.Map(jsonschema.Any(""), "Usage today, and the limits that apply"),
+        "username" : jsonschema.String("Username"),
+        "email" : jsonschema.String("Email address"),
+        "pending_email" : jsonschema.String("New email address awaiting confirmation"),
+        "language" : jsonschema.String("Language for email, like \"en\" or \"pt-br\".  \"\" for the default."),
+    }),
+    Handler: GET_me,
+}
+
 func GET_me(w http.ResponseWriter, r *http.Request, info adapter.CanopyRestInfo) (map[string]interface{}, rest_errors.CanopyRestError) {
     if info.Account == nil {
         return nil, rest_errors.NewNotLoggedInError()
     }
+    appPasswords, err := info.Account.AppPasswordNames()
+    if err != nil {
+        return nil, rest_errors.NewInternalServerError("Problem listing app passwords")
+    }
+    usage, err := quota.AccountUsage(info.Config, info.Conn, info.Account)
+    if err != nil {
+        return nil, rest_errors.NewInternalServerError("Problem getting usage")
+    }
     return map[string]interface{}{
         "activated" : info.Account.IsActivated(),
+        "app_passwords" : appPasswords,
         "result" : "ok",
+        "totp_enabled" : info.Account.IsTOTPEnabled(),
+        "usage" : usage,
         "username" : info.Account.Username(),
         "email" : info.Account.Email(),
+        "pending_email" : info.Account.PendingEmail(),
+        "language" : info.Account.Language(),
     }, nil
 }
 
+// Check the "old_password" field, which is required for sensitive account
+// changes.
+func verifyOldPassword(info adapter.CanopyRestInfo, action string) rest_errors.CanopyRestError {
+    oldPasswordObj, ok := info.BodyObj["old_password"]
+    if !ok {
+        return rest_errors.NewBadInputFieldError("old_password", "Must provide \"old_password\" to " + action)
+    }
+    oldPassword, ok := oldPasswordObj.(string)
+    if !ok {
+        return rest_errors.NewBadInputFieldError("old_password", "Expected string \"old_password\"")
+    }
+    if !info.Account.VerifyPassword(oldPassword) {
+        return rest_errors.NewBadInputFieldError("old_password", "Incorrect old password")
+    }
+    return nil
+}
+
+// Like verifyOldPassword, but also requires "totp_code" if two-factor
+// authentication is enabled, for changes that could let someone else keep
+// access to the account.  Codes can't be used twice, so <*verified> records
+// that this has been done for the request.
+func verifyOldPasswordAndTOTP(info adapter.CanopyRestInfo, action string, verified *bool) rest_errors.CanopyRestError {
+    if *verified {
+        return nil
+    }
+    restErr := verifyOldPassword(info, action)
+    if restErr != nil {
+        return restErr
+    }
+    if info.Account.IsTOTPEnabled() {
+        totpCode, ok := info.BodyObj["totp_code"].(string)
+        if !ok {
+            return rest_errors.NewTOTPRequiredError()
+        }
+        err := info.Account.VerifySecondFactor(totpCode)
+        if err == datalayer.InvalidTOTPCodeError {
+            return rest_errors.NewIncorrectTOTPCodeError()
+        } else if err != nil {
+            return rest_errors.NewInternalServerError("Problem verifying two-factor code")
+        }
+    }
+    *verified = true
+    return nil
+}
+
+var POST_me_endpoint = adapter.Endpoint{
+    Method: "POST",
+    Path: "/me",
+    Summary: "Change account settings",
+    Description: "Changing the email address or password, or disabling " +
+            "two-factor authentication, requires \"old_password\".  " +
+            "Enrolling in two-factor authentication and creating app " +
+            "passwords require \"old_password\", and also \"totp_code\" " +
+            "if two-factor authentication is enabled.",
+    Auth: adapter.AccountAuth,
+    Body: jsonschema.Object(map[string]*jsonschema.Schema{
+        "old_password" : jsonschema.String("Current password"),
+        "totp_code" : jsonschema.String("Current two-factor authentication code"),
+        "email" : jsonschema.String("New email address.  A confirmation code is sent to it."),
+        "email_change_code" : jsonschema.String("Code confirming the new email address"),
+        "new_password" : jsonschema.String("New password"),
+        "totp_enroll" : jsonschema.Boolean("Begin enrolling in two-factor authentication"),
+        "totp_confirm" : jsonschema.String("Authenticator code completing enrollment"),
+        "totp_disable" : jsonschema.Boolean("Disable two-factor authentication"),
+        "app_password_create" : jsonschema.String("Name of app password to create"),
+        "app_password_delete" : jsonschema.String("Name of app password to delete"),
+        "language" : jsonschema.String("Language for email, like \"en\" or \"pt-BR\".  \"\" for the default."),
+    }),
+    Response: okResponse(map[string]*jsonschema.Schema{
+        "username" : jsonschema.String("Username"),
+        "email" : jsonschema.String("Email address"),
+        "pending_email" : jsonschema.String("New email address awaiting confirmation"),
+        "language" : jsonschema.String("Language for email"),
+        "totp_enabled" : jsonschema.Boolean("Whether two-factor authentication is enabled"),
+        "totp_secret" : jsonschema.String("Returned by \"totp_enroll\""),
+        "totp_provisioning_uri" : jsonschema.String("Returned by \"totp_enroll\""),
+        "recovery_codes" : jsonschema.Array(jsonschema.String(""), "Returned by \"totp_confirm\".  Only shown once."),
+        "app_password" : jsonschema.String("Returned by \"app_password_create\".  Only shown once."),
+    }),
+    Handler: POST_me,
+}
+
 func POST_me(w http.ResponseWriter, r *http.Request, info adapter.CanopyRestInfo) (map[string]interface{}, rest_errors.CanopyRestError) {
     if info.Account == nil {
         return nil, rest_errors.NewNotLoggedInError()
     }
 
+    // Third-party apps must not be able to change how the account holder
+    // logs in, or where password reset emails go.
+    if info.AuthType == adapter.CANOPY_REST_AUTH_BEARER {
+        for _, fieldName := range []string{"email", "email_change_code", "totp_enroll", "totp_confirm", "totp_disable", "app_password_create", "app_password_delete"} {
+            if _, ok := info.BodyObj[fieldName]; ok {
+                return nil, rest_errors.NewInsufficientScopeError("Apps cannot change account security settings")
+            }
+        }
+    }
+
+    out := map[string]interface{}{
+        "result" : "ok",
+    }
+
+    // Change the language first, so that any email sent below uses it.
+    if value, ok := info.BodyObj["language"]; ok {
+        lang, ok := value.(string)
+        if !ok || (lang != "" && !messages.IsLanguage(lang)) {
+            return nil, rest_errors.NewBadInputFieldError("language", "Expected language like \"en\" or \"pt-BR\"")
+        }
+        err := info.Account.SetLanguage(lang)
+        if err != nil {
+            return nil, rest_errors.NewInternalServerError("Problem changing language")
+        }
+    }
+
+    reauthenticated := false
     for fieldName, value := range info.BodyObj {
         switch fieldName {
         case "email":
-            return nil, rest_errors.NewInternalServerError("Changing email not implemented")
-        case "new_password":
-            newPassword, ok := value.(string)
-            if !ok {
-                return nil, rest_errors.NewBadInputError("Expected string \"new_password\"")
+            // Begin changing email address.  A confirmation code is sent to
+            // the new address, which must then be sent back as
+            // "email_change_code".
+            newEmail, ok := value.(string)
+            if !ok || newEmail == "" {
+                return nil, rest_errors.NewBadInputFieldError("email", "Expected string \"email\"")
+            }
+            if newEmail == info.Account.Email() {
+                continue
+            }
+            restErr := verifyOldPassword(info, "change email")
+            if restErr != nil {
+                return nil, restErr
+            }
+            code, err := info.Account.BeginEmailChange(newEmail)
+            if err == datalayer.EmailTakenError {
+                return nil, rest_errors.NewEmailTakenError()
+            } else if err != nil {
+                return nil, rest_errors.NewBadInputFieldError("email", err.Error())
+            }
+
+            msg := info.Mailer.NewMail();
+            msg.AddTo(newEmail, info.Account.Username())
+            mail.SetNoReply(msg)
+            err = messages.MailMessageConfirmEmailChange(msg,
+                info.Account.Language(),
+                info.Account.Username(),
+                code,
+                config.BaseURL(info.Config),
+                info.Config.OptHostname(),
+            )
+            if err == nil {
+                err = info.Mailer.Send(msg)
             }
-            oldPasswordObj, ok := info.BodyObj["old_password"]
+            if err != nil {
+                logger.Error("Problem sending email change confirmation: ", err)
+                return nil, rest_errors.NewInternalServerError("Problem sending mail")
+            }
+        case "email_change_code":
+            code, ok := value.(string)
             if !ok {
-                return nil, rest_errors.NewBadInputError("Must provide \"old_password\" to change password")
+                return nil, rest_errors.NewBadInputFieldError("email_change_code", "Expected string \"email_change_code\"")
+            }
+            oldEmail, err := info.Account.ConfirmEmailChange(code)
+            if err == datalayer.EmailTakenError {
+                return nil, rest_errors.NewEmailTakenError()
+            } else if err == datalayer.InvalidEmailChangeCodeError {
+                return nil, rest_errors.NewBadInputFieldError("email_change_code", err.Error())
+            } else if err != nil {
+                return nil, rest_errors.NewInternalServerError("Problem changing email")
+            }
+
+            // Let the old address know, in case the change wasn't made by
+            // the account holder.
+            msg := info.Mailer.NewMail();
+            msg.AddTo(oldEmail, info.Account.Username())
+            mail.SetNoReply(msg)
+            err = messages.MailMessageEmailChanged(msg,
+                info.Account.Language(),
+                info.Account.Username(),
+                info.Account.Email(),
+                info.Config.OptHostname(),
+            )
+            if err == nil {
+                err = info.Mailer.Send(msg)
+            }
+            if err != nil {
+                logger.Error("Problem sending email change notice: ", err)
             }
-            oldPassword, ok := oldPasswordObj.(string)
+        case "new_password":
+            newPassword, ok := value.(string)
             if !ok {
-                return nil, rest_errors.NewBadInputError("Expected string \"old_password\"")
+                return nil, rest_errors.NewBadInputFieldError("new_password", "Expected string \"new_password\"")
             }
-            ok = info.Account.VerifyPassword(oldPassword);
-            if (!ok) {
-                return nil, rest_errors.NewBadInputError("Incorrect old password")
+            restErr := verifyOldPassword(info, "change password")
+            if restErr != nil {
+                return nil, restErr
             }
 
             err := info.Account.SetPassword(newPassword)
@@ -65,13 +271,176 @@ func POST_me(w http.ResponseWriter, r *http.Request, info adapter.CanopyRestInfo
                 // TODO: finer-grained error reporting
                 return nil, rest_errors.NewInternalServerError("Problem changing password")
             }
+        case "totp_enroll":
+            // Begin enrollment.  The client should render
+            // "totp_provisioning_uri" as a QR code for the user to scan, and
+            // then send "totp_confirm" with a code from their app.
+            enroll, ok := value.(bool)
+            if !ok {
+                return nil, rest_errors.NewBadInputFieldError("totp_enroll", "Expected bool \"totp_enroll\"")
+            }
+            if !enroll {
+                continue
+            }
+            if info.Account.IsTOTPEnabled() {
+                return nil, rest_errors.NewBadInputError("Two-factor authentication already enabled")
+            }
+            restErr := verifyOldPasswordAndTOTP(info, "enable two-factor authentication", &reauthenticated)
+            if restErr != nil {
+                return nil, restErr
+            }
+            secret, uri, err := info.Account.BeginTOTPEnrollment()
+            if err != nil {
+                return nil, rest_errors.NewInternalServerError("Problem starting two-factor enrollment")
+            }
+            out["totp_secret"] = secret
+            out["totp_provisioning_uri"] = uri
+        case "totp_confirm":
+            code, ok := value.(string)
+            if !ok {
+                return nil, rest_errors.NewBadInputFieldError("totp_confirm", "Expected string \"totp_confirm\"")
+            }
+            restErr := verifyOldPasswordAndTOTP(info, "enable two-factor authentication", &reauthenticated)
+            if restErr != nil {
+                return nil, restErr
+            }
+            recoveryCodes, err := info.Account.ConfirmTOTPEnrollment(code)
+            if err == datalayer.InvalidTOTPCodeError {
+                return nil, rest_errors.NewIncorrectTOTPCodeError()
+            } else if err != nil {
+                return nil, rest_errors.NewBadInputError(err.Error())
+            }
+            // Recovery codes are only ever shown once.
+            out["recovery_codes"] = recoveryCodes
+        case "totp_disable":
+            disable, ok := value.(bool)
+            if !ok {
+                return nil, rest_errors.NewBadInputFieldError("totp_disable", "Expected bool \"totp_disable\"")
+            }
+            if !disable {
+                continue
+            }
+            restErr := verifyOldPassword(info, "disable two-factor authentication")
+            if restErr != nil {
+                return nil, restErr
+            }
+            err := info.Account.DisableTOTP()
+            if err != nil {
+                return nil, rest_errors.NewInternalServerError("Problem disabling two-factor authentication")
+            }
+        case "app_password_create":
+            // App passwords are used in place of the account password for
+            // HTTP BASIC auth once two-factor authentication is enabled.
+            name, ok := value.(string)
+            if !ok || name == "" {
+                return nil, rest_errors.NewBadInputFieldError("app_password_create", "Expected string \"app_password_create\"")
+            }
+            restErr := verifyOldPasswordAndTOTP(info, "create an app password", &reauthenticated)
+            if restErr != nil {
+                return nil, restErr
+            }
+            password, err := info.Account.CreateAppPassword(name)
+            if err != nil {
+                return nil, rest_errors.NewInternalServerError("Problem creating app password")
+            }
+            out["app_password"] = password
+        case "app_password_delete":
+            name, ok := value.(string)
+            if !ok {
+                return nil, rest_errors.NewBadInputFieldError("app_password_delete", "Expected string \"app_password_delete\"")
+            }
+            err := info.Account.DeleteAppPassword(name)
+            if err != nil {
+                return nil, rest_errors.NewInternalServerError("Problem deleting app password")
+            }
+        }
+    }
+
+    out["username"] = info.Account.Username()
+    out["email"] = info.Account.Email()
+    if info.Account.PendingEmail() != "" {
+        out["pending_email"] = info.Account.PendingEmail()
+    }
+    out["language"] = info.Account.Language()
+    out["totp_enabled"] = info.Account.IsTOTPEnabled()
+    return out, nil
+}
+
+var DELETE_me_endpoint = adapter.Endpoint{
+    Method: "DELETE",
+    Path: "/me",
+    Summary: "Permanently delete the account",
+    Auth: adapter.AccountAuth,
+    Body: jsonschema.Object(map[string]*jsonschema.Schema{
+        "password" : jsonschema.String("Current password"),
+        "totp_code" : jsonschema.String("Required if two-factor authentication is enabled"),
+    }, "password"),
+    Response: okResponse(nil),
+    Handler: DELETE_me,
+}
+
+// Permanently delete the logged-in account.  Request:
+// {
+//      "password" : <PASSWORD>,
+//      "totp_code" : <CODE>
+// }
+//
+// "totp_code" is only required if two-factor authentication is enabled.
+func DELETE_me(w http.ResponseWriter, r *http.Request, info adapter.CanopyRestInfo) (map[string]interface{}, rest_errors.CanopyRestError) {
+    if info.Account == nil {
+        return nil, rest_errors.NewNotLoggedInError()
+    }
+    if info.AuthType == adapter.CANOPY_REST_AUTH_BEARER {
+        return nil, rest_errors.NewInsufficientScopeError("Apps cannot delete accounts")
+    }
+
+    password, ok := info.BodyObj["password"].(string)
+    if !ok {
+        return nil, rest_errors.NewBadInputFieldError("password", "Must provide \"password\" to delete account")
+    }
+    if !info.Account.VerifyPassword(password) {
+        return nil, rest_errors.NewIncorrectUsernameOrPasswordError()
+    }
+    if info.Account.IsTOTPEnabled() {
+        totpCode, ok := info.BodyObj["totp_code"].(string)
+        if !ok {
+            return nil, rest_errors.NewTOTPRequiredError()
+        }
+        err := info.Account.VerifySecondFactor(totpCode)
+        if err == datalayer.InvalidTOTPCodeError {
+            return nil, rest_errors.NewIncorrectTOTPCodeError()
+        } else if err != nil {
+            return nil, rest_errors.NewInternalServerError("Problem verifying two-factor code")
         }
     }
 
+    username := info.Account.Username()
+    email := info.Account.Email()
+    lang := info.Account.Language()
+    err := info.Conn.DeleteAccount(username)
+    if err != nil {
+        logger.Error("Problem deleting account ", username, ": ", err)
+        return nil, rest_errors.NewInternalServerError("Problem deleting account")
+    }
+
+    if info.Session != nil {
+        delete(info.Session.Values, "logged_in_username")
+        delete(info.Session.Values, "logged_in_at")
+        info.Session.Save(r, w)
+    }
+
+    msg := info.Mailer.NewMail();
+    msg.AddTo(email, username)
+    mail.SetNoReply(msg)
+    err = messages.MailMessageAccountDeleted(msg, lang, username, info.Config.OptHostname())
+    if err == nil {
+        err = info.Mailer.Send(msg)
+    }
+    if err != nil {
+        logger.Error("Problem sending account deletion notice: ", err)
+    }
+
     return map[string]interface{}{
         "result" : "ok",
-        "username" : info.Account.Username(),
-        "email" : info.Account.Email(),
     }, nil
 }
-
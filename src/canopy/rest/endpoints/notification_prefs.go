@@ -0,0 +1,190 @@
+// Copyright 2015 SimpleThings, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+package endpoints
+
+import (
+    "canopy/datalayer"
+    "canopy/notify"
+    "canopy/rest/adapter"
+    "canopy/rest/rest_errors"
+    "canopy/util/jsonschema"
+    "fmt"
+    "net/http"
+    "time"
+)
+
+var notificationPrefsSchema = jsonschema.Object(map[string]*jsonschema.Schema{
+    "channels" : jsonschema.Map(jsonschema.StringEnum("Channel", notify.Channels...), "Delivery channel for each priority: \"low-priority\", \"med-priority\" and \"high-priority\""),
+    "email_delivery" : jsonschema.StringEnum("Send email notifications immediately, or as a digest", notify.EmailDeliveries...),
+    "quiet_start" : jsonschema.String("Start of quiet hours, \"HH:MM\""),
+    "quiet_end" : jsonschema.String("End of quiet hours, \"HH:MM\".  Quiet hours are disabled if this equals quiet_start."),
+    "sms_number" : jsonschema.String("Phone number for \"sms\" notifications, in international format, ex: \"+14155550100\".  Empty for none."),
+    "time_zone" : jsonschema.String("Time zone for quiet hours and daily digests, ex: \"America/Los_Angeles\""),
+})
+
+func formatMinutes(minutes int) string {
+    return fmt.Sprintf("%02d:%02d", minutes/60, minutes%60)
+}
+
+func parseMinutes(s string) (int, bool) {
+    t, err := time.Parse("15:04", s)
+    if err != nil {
+        return 0, false
+    }
+    return t.Hour()*60 + t.Minute(), true
+}
+
+// Check that <s> is a phone number in E.164 format: "+" followed by up to
+// 15 digits.
+func isPhoneNumber(s string) bool {
+    if len(s) < 2 || len(s) > 16 || s[0] != '+' {
+        return false
+    }
+    for _, c := range s[1:] {
+        if c < '0' || c > '9' {
+            return false
+        }
+    }
+    return true
+}
+
+func notificationPrefsJsonObj(prefs datalayer.NotificationPrefs) map[string]interface{} {
+    return map[string]interface{} {
+        "channels" : prefs.Channels,
+        "email_delivery" : prefs.EmailDelivery,
+        "quiet_start" : formatMinutes(prefs.QuietStart),
+        "quiet_end" : formatMinutes(prefs.QuietEnd),
+        "sms_number" : prefs.SMSNumber,
+        "time_zone" : prefs.TimeZone,
+    }
+}
+
+var GET_me_notification_prefs_endpoint = adapter.Endpoint{
+    Method: "GET",
+    Path: "/me/notification_prefs",
+    Summary: "Get how the logged-in account is notified",
+    Auth: adapter.AccountAuth,
+    Response: okResponse(map[string]*jsonschema.Schema{
+        "notification_prefs" : notificationPrefsSchema,
+    }),
+    Handler: GET_me_notification_prefs,
+}
+
+func GET_me_notification_prefs(w http.ResponseWriter, r *http.Request, info adapter.CanopyRestInfo) (map[string]interface{}, rest_errors.CanopyRestError) {
+    if info.Account == nil {
+        return nil, rest_errors.NewNotLoggedInError()
+    }
+    prefs, err := info.Conn.NotificationPrefs(info.Account.Username())
+    if err != nil {
+        return nil, rest_errors.NewInternalServerError("Problem reading notification preferences")
+    }
+    return map[string]interface{} {
+        "result" : "ok",
+        "notification_prefs" : notificationPrefsJsonObj(*prefs),
+    }, nil
+}
+
+var POST_me_notification_prefs_endpoint = adapter.Endpoint{
+    Method: "POST",
+    Path: "/me/notification_prefs",
+    Summary: "Change how the logged-in account is notified",
+    Auth: adapter.AccountAuth,
+    Body: notificationPrefsSchema,
+    Response: okResponse(map[string]*jsonschema.Schema{
+        "notification_prefs" : notificationPrefsSchema,
+    }),
+    Handler: POST_me_notification_prefs,
+}
+
+// Change the logged-in account's notification preferences.  All fields are
+// optional; omitted ones are unchanged.  Request:
+// {
+//      "channels" : {
+//          "low-priority" : "none" | "in-app" | "email" | "sms",
+//          "med-priority" : ...,
+//          "high-priority" : ...
+//      },
+//      "email_delivery" : "immediate" | "hourly" | "daily",
+//      "quiet_start" : "22:00",
+//      "quiet_end" : "07:00",
+//      "sms_number" : "+14155550100",
+//      "time_zone" : "America/Los_Angeles"
+// }
+func POST_me_notification_prefs(w http.ResponseWriter, r *http.Request, info adapter.CanopyRestInfo) (map[string]interface{}, rest_errors.CanopyRestError) {
+    if info.Account == nil {
+        return nil, rest_errors.NewNotLoggedInError()
+    }
+    prefs, err := info.Conn.NotificationPrefs(info.Account.Username())
+    if err != nil {
+        return nil, rest_errors.NewInternalServerError("Problem reading notification preferences")
+    }
+
+    if channels, ok := info.BodyObj["channels"].(map[string]interface{}); ok {
+        for priority, value := range channels {
+            if !isOneOf(priority, notify.Priorities) {
+                return nil, rest_errors.NewBadInputFieldError("channels", "Unknown priority: " + priority)
+            }
+            channel, _ := value.(string)
+            if !isOneOf(channel, notify.Channels) {
+                return nil, rest_errors.NewBadInputFieldError("channels", "Unknown channel for " + priority)
+            }
+            prefs.Channels[priority] = channel
+        }
+    }
+    if emailDelivery, ok := info.BodyObj["email_delivery"].(string); ok {
+        if !isOneOf(emailDelivery, notify.EmailDeliveries) {
+            return nil, rest_errors.NewBadInputFieldError("email_delivery", "Unknown email_delivery")
+        }
+        prefs.EmailDelivery = emailDelivery
+    }
+    for _, field := range []string{"quiet_start", "quiet_end"} {
+        s, ok := info.BodyObj[field].(string)
+        if !ok {
+            continue
+        }
+        minutes, ok := parseMinutes(s)
+        if !ok {
+            return nil, rest_errors.NewBadInputFieldError(field, "Expected time of day \"HH:MM\"")
+        }
+        if field == "quiet_start" {
+            prefs.QuietStart = minutes
+        } else {
+            prefs.QuietEnd = minutes
+        }
+    }
+    if smsNumber, ok := info.BodyObj["sms_number"].(string); ok {
+        if smsNumber != "" && !isPhoneNumber(smsNumber) {
+            return nil, rest_errors.NewBadInputFieldError("sms_number", "Expected phone number in international format, ex: \"+14155550100\"")
+        }
+        prefs.SMSNumber = smsNumber
+    }
+    if timeZone, ok := info.BodyObj["time_zone"].(string); ok {
+        _, err = time.LoadLocation(timeZone)
+        if err != nil || timeZone == "" {
+            return nil, rest_errors.NewBadInputFieldError("time_zone", "Unknown time zone")
+        }
+        prefs.TimeZone = timeZone
+    }
+
+    err = info.Conn.SaveNotificationPrefs(*prefs)
+    if err != nil {
+        return nil, rest_errors.NewInternalServerError("Problem saving notification preferences")
+    }
+    return map[string]interface{} {
+        "result" : "ok",
+        "notification_prefs" : notificationPrefsJsonObj(*prefs),
+    }, nil
+}
@@ -0,0 +1,492 @@
+// Copyright 2015 SimpleThings, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+package endpoints
+
+import (
+    "canopy/datalayer"
+    "canopy/notify"
+    "canopy/rest/adapter"
+    "canopy/rest/rest_errors"
+    "canopy/util/jsonschema"
+    "github.com/gocql/gocql"
+    "net/http"
+    "sort"
+    "strconv"
+    "time"
+)
+
+const (
+    notificationsDefaultLimit = 50
+    notificationsMaxLimit = 500
+)
+
+var notificationSchema = jsonschema.Object(map[string]*jsonschema.Schema{
+    "notification_id" : jsonschema.String("Notification ID, unique among the device's notifications"),
+    "device_id" : jsonschema.String("Device that raised the notification"),
+    "notify_type" : jsonschema.StringEnum("Notification type", notify.NotifyTypes...),
+    "msg" : jsonschema.String("Message"),
+    "t" : jsonschema.String("Time issued, RFC 3339"),
+    "dismissed" : jsonschema.Boolean("Whether the notification has been dismissed"),
+})
+
+var notificationPageSchema = map[string]*jsonschema.Schema{
+    "notifications" : jsonschema.Array(notificationSchema, "Notifications, newest first"),
+    "next_before" : jsonschema.String("Pass as \"before\" to get the next page, or null if there are no more").OrNull(),
+    "unread_count" : jsonschema.Integer("Number of notifications that haven't been dismissed"),
+}
+
+func notificationJsonObj(device datalayer.Device, notification datalayer.Notification) map[string]interface{} {
+    return map[string]interface{} {
+        "notification_id" : notification.ID(),
+        "device_id" : device.IDString(),
+        "notify_type" : notify.TypeName(notification.NotifyType()),
+        "msg" : notification.Msg(),
+        "t" : notification.Datetime().Format(time.RFC3339Nano),
+        "dismissed" : notification.IsDismissed(),
+    }
+}
+
+// Parse the "limit" and "before" query parameters of a notifications
+// request.
+func notificationPageParams(r *http.Request) (int, time.Time, rest_errors.CanopyRestError) {
+    var err error
+    limit := notificationsDefaultLimit
+    if limitString := r.URL.Query().Get("limit"); limitString != "" {
+        limit, err = strconv.Atoi(limitString)
+        if err != nil || limit < 1 || limit > notificationsMaxLimit {
+            return 0, time.Time{}, rest_errors.NewBadInputFieldError("limit", "\"limit\" must be between 1 and " + strconv.Itoa(notificationsMaxLimit))
+        }
+    }
+    var before time.Time
+    if beforeString := r.URL.Query().Get("before"); beforeString != "" {
+        before, err = time.Parse(time.RFC3339Nano, beforeString)
+        if err != nil {
+            return 0, time.Time{}, rest_errors.NewBadInputFieldError("before", "\"before\" must be an RFC 3339 time")
+        }
+    }
+    return limit, before, nil
+}
+
+// A notification and the device that raised it.
+type deviceNotification struct {
+    device datalayer.Device
+    notification datalayer.Notification
+}
+
+// Generate a page of notifications.  <notes> are newest first, and have
+// at most <limit> entries.  If there are exactly <limit>, there may be more.
+func notificationPage(notes []deviceNotification, limit int, unread int64) map[string]interface{} {
+    out := []map[string]interface{}{}
+    for _, note := range notes {
+        out = append(out, notificationJsonObj(note.device, note.notification))
+    }
+    var nextBefore interface{} = nil
+    if len(notes) == limit {
+        nextBefore = notes[len(notes) - 1].notification.Datetime().Format(time.RFC3339Nano)
+    }
+    return map[string]interface{} {
+        "result" : "ok",
+        "notifications" : out,
+        "next_before" : nextBefore,
+        "unread_count" : unread,
+    }
+}
+
+type newestFirst []deviceNotification
+
+func (notes newestFirst) Len() int {
+    return len(notes)
+}
+
+func (notes newestFirst) Less(i, j int) bool {
+    return notes[i].notification.Datetime().After(notes[j].notification.Datetime())
+}
+
+func (notes newestFirst) Swap(i, j int) {
+    notes[i], notes[j] = notes[j], notes[i]
+}
+
+var GET_device__id__notifications_endpoint = adapter.Endpoint{
+    Method: "GET",
+    Path: "/device/{id}/notifications",
+    Summary: "List a device's notifications",
+    Auth: adapter.AccountAuth,
+    Response: okResponse(notificationPageSchema),
+    Handler: GET_device__id__notifications,
+}
+
+// List a device's notifications, newest first.  The optional "limit" query
+// parameter sets the page size, and "before" (from a previous page's
+// "next_before") starts after the previous page.
+func GET_device__id__notifications(w http.ResponseWriter, r *http.Request, info adapter.CanopyRestInfo) (map[string]interface{}, rest_errors.CanopyRestError) {
+    device, restErr := deviceForAccount(info, datalayer.ReadOnlyAccess)
+    if restErr != nil {
+        return nil, restErr
+    }
+    limit, before, restErr := notificationPageParams(r)
+    if restErr != nil {
+        return nil, restErr
+    }
+
+    notifications, err := device.Notifications(before, limit)
+    if err != nil {
+        return nil, rest_errors.NewInternalServerError("Problem reading notifications")
+    }
+    unread, err := device.UnreadNotificationCount()
+    if err != nil {
+        return nil, rest_errors.NewInternalServerError("Problem reading unread notification count")
+    }
+    notes := []deviceNotification{}
+    for _, notification := range notifications {
+        notes = append(notes, deviceNotification{device, notification})
+    }
+    return notificationPage(notes, limit, unread), nil
+}
+
+var notificationDeliverySchema = jsonschema.Object(map[string]*jsonschema.Schema{
+    "channel" : jsonschema.StringEnum("Channel the notification was sent on", notify.Channels...),
+    "recipient" : jsonschema.String("Email address, phone number or push token it was sent to"),
+    "status" : jsonschema.StringEnum("Outcome",
+            datalayer.DeliveryStatusSent,
+            datalayer.DeliveryStatusFailed,
+            datalayer.DeliveryStatusQueued,
+            datalayer.DeliveryStatusSkipped),
+    "error" : jsonschema.String("Why delivery failed or was skipped"),
+    "provider_id" : jsonschema.String("ID the sending service gave the message"),
+    "t" : jsonschema.String("Time of the attempt, RFC 3339"),
+})
+
+func notificationDeliveriesJsonObj(deliveries []datalayer.NotificationDelivery) []map[string]interface{} {
+    out := []map[string]interface{}{}
+    for _, delivery := range deliveries {
+        out = append(out, map[string]interface{} {
+            "channel" : delivery.Channel,
+            "recipient" : delivery.Recipient,
+            "status" : delivery.Status,
+            "error" : delivery.Error,
+            "provider_id" : delivery.ProviderID,
+            "t" : delivery.Time.Format(time.RFC3339Nano),
+        })
+    }
+    return out
+}
+
+var GET_device__id__notification__notification_id_endpoint = adapter.Endpoint{
+    Method: "GET",
+    Path: "/device/{id}/notification/{notification_id}",
+    Summary: "Get one of a device's notifications and its delivery status",
+    Auth: adapter.AccountAuth,
+    Response: okResponse(map[string]*jsonschema.Schema{
+        "notification" : notificationSchema,
+        "deliveries" : jsonschema.Array(notificationDeliverySchema, "Attempts to deliver the notification to the logged-in account, oldest first"),
+    }),
+    Handler: GET_device__id__notification__notification_id,
+}
+
+// Get one of a device's notifications, and the attempts made to deliver it
+// to the logged-in account.  Deliveries to other accounts are not shown.
+func GET_device__id__notification__notification_id(w http.ResponseWriter, r *http.Request, info adapter.CanopyRestInfo) (map[string]interface{}, rest_errors.CanopyRestError) {
+    device, restErr := deviceForAccount(info, datalayer.ReadOnlyAccess)
+    if restErr != nil {
+        return nil, restErr
+    }
+
+    notification, err := device.LookupNotification(info.URLVars["notification_id"])
+    if err != nil {
+        return nil, rest_errors.NewURLNotFoundError()
+    }
+    allDeliveries, err := info.Conn.NotificationDeliveries(device.ID(), notification.Datetime())
+    if err != nil {
+        return nil, rest_errors.NewInternalServerError("Problem reading notification deliveries")
+    }
+    deliveries := []datalayer.NotificationDelivery{}
+    for _, delivery := range allDeliveries {
+        if delivery.Username == info.Account.Username() {
+            deliveries = append(deliveries, delivery)
+        }
+    }
+    return map[string]interface{} {
+        "result" : "ok",
+        "notification" : notificationJsonObj(device, notification),
+        "deliveries" : notificationDeliveriesJsonObj(deliveries),
+    }, nil
+}
+
+var GET_me_notifications_endpoint = adapter.Endpoint{
+    Method: "GET",
+    Path: "/me/notifications",
+    Summary: "List notifications from all of the logged-in account's devices",
+    Auth: adapter.AccountAuth,
+    Response: okResponse(notificationPageSchema),
+    Handler: GET_me_notifications,
+}
+
+// List notifications from all of the logged-in account's devices, newest
+// first.  Takes the same query parameters as GET /device/<id>/notifications.
+func GET_me_notifications(w http.ResponseWriter, r *http.Request, info adapter.CanopyRestInfo) (map[string]interface{}, rest_errors.CanopyRestError) {
+    if info.Account == nil {
+        return nil, rest_errors.NewNotLoggedInError()
+    }
+    limit, before, restErr := notificationPageParams(r)
+    if restErr != nil {
+        return nil, restErr
+    }
+
+    devices, err := info.Account.Devices()
+    if err != nil {
+        return nil, rest_errors.NewInternalServerError("Device lookup failed")
+    }
+
+    // The newest <limit> of all devices' notifications are among the newest
+    // <limit> of each device's.
+    notes := []deviceNotification{}
+    var unread int64
+    for _, device := range devices {
+        notifications, err := device.Notifications(before, limit)
+        if err != nil {
+            return nil, rest_errors.NewInternalServerError("Problem reading notifications")
+        }
+        for _, notification := range notifications {
+            notes = append(notes, deviceNotification{device, notification})
+        }
+        count, err := device.UnreadNotificationCount()
+        if err != nil {
+            return nil, rest_errors.NewInternalServerError("Problem reading unread notification count")
+        }
+        unread += count
+    }
+    sort.Stable(newestFirst(notes))
+    if len(notes) > limit {
+        notes = notes[:limit]
+    }
+    return notificationPage(notes, limit, unread), nil
+}
+
+var GET_me_notifications_unread_endpoint = adapter.Endpoint{
+    Method: "GET",
+    Path: "/me/notifications/unread",
+    Summary: "Count the notifications that haven't been dismissed",
+    Auth: adapter.AccountAuth,
+    Response: okResponse(map[string]*jsonschema.Schema{
+        "unread_count" : jsonschema.Integer("Total for all devices"),
+        "devices" : jsonschema.Map(jsonschema.Integer(""), "Count for each device, by device ID"),
+    }),
+    Handler: GET_me_notifications_unread,
+}
+
+func GET_me_notifications_unread(w http.ResponseWriter, r *http.Request, info adapter.CanopyRestInfo) (map[string]interface{}, rest_errors.CanopyRestError) {
+    if info.Account == nil {
+        return nil, rest_errors.NewNotLoggedInError()
+    }
+    devices, err := info.Account.Devices()
+    if err != nil {
+        return nil, rest_errors.NewInternalServerError("Device lookup failed")
+    }
+
+    var total int64
+    perDevice := map[string]interface{}{}
+    for _, device := range devices {
+        count, err := device.UnreadNotificationCount()
+        if err != nil {
+            return nil, rest_errors.NewInternalServerError("Problem reading unread notification count")
+        }
+        perDevice[device.IDString()] = count
+        total += count
+    }
+    return map[string]interface{} {
+        "result" : "ok",
+        "unread_count" : total,
+        "devices" : perDevice,
+    }, nil
+}
+
+// Dismiss all of <device>'s notifications that haven't been dismissed.
+func dismissAllNotifications(device datalayer.Device) error {
+    notifications, err := device.HistoricNotifications()
+    if err != nil {
+        return err
+    }
+    for _, notification := range notifications {
+        if notification.IsDismissed() {
+            continue
+        }
+        err = notification.Dismiss()
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+var POST_device__id__notifications_dismiss_endpoint = adapter.Endpoint{
+    Method: "POST",
+    Path: "/device/{id}/notifications/dismiss",
+    Summary: "Dismiss some or all of a device's notifications",
+    Auth: adapter.AccountAuth,
+    Body: jsonschema.Object(map[string]*jsonschema.Schema{
+        "notification_ids" : jsonschema.Array(jsonschema.String(""), "Notifications to dismiss"),
+        "all" : jsonschema.Boolean("Dismiss all of the device's notifications"),
+    }),
+    Response: okResponse(map[string]*jsonschema.Schema{
+        "unread_count" : jsonschema.Integer("Number of notifications that haven't been dismissed"),
+    }),
+    Handler: POST_device__id__notifications_dismiss,
+}
+
+// Dismiss notifications from one of the logged-in account's devices.
+// Requires read-write access to the device.  Request:
+// {
+//      "notification_ids" : [<NOTIFICATION_ID>, ...],
+//      "all" : <BOOL>
+// }
+func POST_device__id__notifications_dismiss(w http.ResponseWriter, r *http.Request, info adapter.CanopyRestInfo) (map[string]interface{}, rest_errors.CanopyRestError) {
+    device, restErr := deviceForAccount(info, datalayer.ReadWriteAccess)
+    if restErr != nil {
+        return nil, restErr
+    }
+
+    if all, _ := info.BodyObj["all"].(bool); all {
+        err := dismissAllNotifications(device)
+        if err != nil {
+            return nil, rest_errors.NewInternalServerError("Problem dismissing notifications")
+        }
+    } else {
+        ids, restErr := stringListField(info.BodyObj, "notification_ids")
+        if restErr != nil {
+            return nil, restErr
+        }
+        // Check them all before dismissing any.
+        notifications := []datalayer.Notification{}
+        for _, id := range ids {
+            notification, err := device.LookupNotification(id)
+            if err != nil {
+                return nil, rest_errors.NewBadInputFieldError("notification_ids", "Unknown notification: " + id)
+            }
+            notifications = append(notifications, notification)
+        }
+        for _, notification := range notifications {
+            err := notification.Dismiss()
+            if err != nil {
+                return nil, rest_errors.NewInternalServerError("Problem dismissing notification")
+            }
+        }
+    }
+
+    unread, err := device.UnreadNotificationCount()
+    if err != nil {
+        return nil, rest_errors.NewInternalServerError("Problem reading unread notification count")
+    }
+    return map[string]interface{} {
+        "result" : "ok",
+        "unread_count" : unread,
+    }, nil
+}
+
+var POST_me_notifications_dismiss_endpoint = adapter.Endpoint{
+    Method: "POST",
+    Path: "/me/notifications/dismiss",
+    Summary: "Dismiss notifications from any of the logged-in account's devices",
+    Auth: adapter.AccountAuth,
+    Body: jsonschema.Object(map[string]*jsonschema.Schema{
+        "notifications" : jsonschema.Array(jsonschema.Object(map[string]*jsonschema.Schema{
+            "device_id" : jsonschema.String("Device ID"),
+            "notification_id" : jsonschema.String("Notification ID"),
+        }, "device_id", "notification_id"), "Notifications to dismiss"),
+        "all" : jsonschema.Boolean("Dismiss every notification from devices the account has read-write access to"),
+    }),
+    Response: okResponse(nil),
+    Handler: POST_me_notifications_dismiss,
+}
+
+// Dismiss notifications from several of the logged-in account's devices at
+// once.  Requires read-write access to each device.  Request:
+// {
+//      "notifications" : [
+//          {"device_id" : <DEVICE_ID>, "notification_id" : <NOTIFICATION_ID>},
+//          ...
+//      ],
+//      "all" : <BOOL>
+// }
+func POST_me_notifications_dismiss(w http.ResponseWriter, r *http.Request, info adapter.CanopyRestInfo) (map[string]interface{}, rest_errors.CanopyRestError) {
+    if info.Account == nil {
+        return nil, rest_errors.NewNotLoggedInError()
+    }
+    username := info.Account.Username()
+
+    if all, _ := info.BodyObj["all"].(bool); all {
+        devices, err := info.Account.Devices()
+        if err != nil {
+            return nil, rest_errors.NewInternalServerError("Device lookup failed")
+        }
+        for _, device := range devices {
+            access, err := device.AccountAccess()
+            if err != nil {
+                return nil, rest_errors.NewInternalServerError("Device lookup failed")
+            }
+            if access[username] < datalayer.ReadWriteAccess {
+                continue
+            }
+            err = dismissAllNotifications(device)
+            if err != nil {
+                return nil, rest_errors.NewInternalServerError("Problem dismissing notifications")
+            }
+        }
+        return map[string]interface{} {
+            "result" : "ok",
+        }, nil
+    }
+
+    items, ok := info.BodyObj["notifications"].([]interface{})
+    if !ok {
+        return nil, rest_errors.NewBadInputFieldError("notifications", "List \"notifications\" expected")
+    }
+    // Check them all before dismissing any.
+    notifications := []datalayer.Notification{}
+    for _, item := range items {
+        obj, _ := item.(map[string]interface{})
+        deviceIdString, _ := obj["device_id"].(string)
+        notificationId, _ := obj["notification_id"].(string)
+        uuid, err := gocql.ParseUUID(deviceIdString)
+        if err != nil {
+            return nil, rest_errors.NewBadInputFieldError("notifications", "Invalid device_id: " + deviceIdString)
+        }
+        device, err := info.Account.Device(uuid)
+        if err != nil {
+            return nil, rest_errors.NewBadInputFieldError("notifications", "Unknown device: " + deviceIdString)
+        }
+        access, err := device.AccountAccess()
+        if err != nil {
+            return nil, rest_errors.NewInternalServerError("Device lookup failed")
+        }
+        if access[username] < datalayer.ReadWriteAccess {
+            return nil, rest_errors.NewPermissionDeniedError("Insufficient access to device " + deviceIdString)
+        }
+        notification, err := device.LookupNotification(notificationId)
+        if err != nil {
+            return nil, rest_errors.NewBadInputFieldError("notifications", "Unknown notification: " + notificationId)
+        }
+        notifications = append(notifications, notification)
+    }
+    for _, notification := range notifications {
+        err := notification.Dismiss()
+        if err != nil {
+            return nil, rest_errors.NewInternalServerError("Problem dismissing notification")
+        }
+    }
+    return map[string]interface{} {
+        "result" : "ok",
+    }, nil
+}
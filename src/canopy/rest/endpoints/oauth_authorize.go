@@ -0,0 +1,214 @@
+// Copyright 2015 SimpleThings, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package endpoints
+
+import (
+    "canopy/datalayer"
+    "canopy/rest/adapter"
+    "canopy/rest/rest_errors"
+    "canopy/util/jsonschema"
+    "fmt"
+    "net/http"
+    "net/url"
+    "strings"
+    "time"
+)
+
+// OAuth2 scopes, and the device AccessLevel that each one grants.  A token's
+// access level is the highest level of any of its scopes.
+var oauthScopes = map[string]datalayer.AccessLevel {
+    "read" : datalayer.ReadOnlyAccess,
+    "write" : datalayer.ReadWriteAccess,
+}
+
+// Validate a space-separated list of scopes.  Defaults to "read" if empty.
+// Returns the normalized scope string and the access level it grants.
+func parseOAuthScope(scope string) (string, datalayer.AccessLevel, error) {
+    var level datalayer.AccessLevel = datalayer.NoAccess
+    scopes := strings.Fields(scope)
+    if len(scopes) == 0 {
+        scopes = []string{"read"}
+    }
+    for _, s := range scopes {
+        scopeLevel, ok := oauthScopes[s]
+        if !ok {
+            return "", datalayer.NoAccess, fmt.Errorf("Unknown scope: %s", s)
+        }
+        if scopeLevel > level {
+            level = scopeLevel
+        }
+    }
+    return strings.Join(scopes, " "), level, nil
+}
+
+func isRegisteredRedirectURI(client datalayer.OAuthClient, uri string) bool {
+    for _, registered := range client.RedirectURIs() {
+        if registered == uri {
+            return true
+        }
+    }
+    return false
+}
+
+// Append OAuth2 response parameters to the client's redirect URI.
+func oauthRedirect(redirectURI string, params map[string]string) (map[string]interface{}, rest_errors.CanopyRestError) {
+    u, err := url.Parse(redirectURI)
+    if err != nil {
+        return nil, rest_errors.NewBadInputError("Invalid redirect URI")
+    }
+    q := u.Query()
+    for k, v := range params {
+        if v != "" {
+            q.Set(k, v)
+        }
+    }
+    u.RawQuery = q.Encode()
+    return map[string]interface{} {
+        "result" : "ok",
+        "redirect_uri" : u.String(),
+    }, nil
+}
+
+var POST_oauth_authorize_endpoint = adapter.Endpoint{
+    Method: "POST",
+    Path: "/oauth/authorize",
+    Summary: "Approve or deny an app's authorization request",
+    Auth: []adapter.CanopyRestAuthTypeEnum{adapter.CANOPY_REST_AUTH_SESSION},
+    Body: jsonschema.Object(map[string]*jsonschema.Schema{
+        "response_type" : jsonschema.String("Must be \"code\""),
+        "client_id" : jsonschema.String("Client ID"),
+        "redirect_uri" : jsonschema.String("Registered redirect URI"),
+        "scope" : jsonschema.String("Space-separated scopes"),
+        "state" : jsonschema.String("Opaque value returned to the client"),
+        "code_challenge" : jsonschema.String("PKCE code challenge"),
+        "code_challenge_method" : jsonschema.StringEnum("PKCE method", "plain", "S256"),
+        "approve" : jsonschema.Boolean("Whether the user approved"),
+    }, "client_id"),
+    Response: okResponse(map[string]*jsonschema.Schema{
+        "redirect_uri" : jsonschema.String("Where to send the browser next"),
+    }),
+    Handler: POST_oauth_authorize,
+}
+
+// Called by the consent screen (webapp /oauth/authorize) once the logged-in
+// user approves or denies an app's authorization request.  Request:
+// {
+//      "response_type" : "code",
+//      "client_id" : <CLIENT_ID>,
+//      "redirect_uri" : <REDIRECT_URI>,
+//      "scope" : <SCOPES>,
+//      "state" : <STATE>,
+//      "code_challenge" : <PKCE_CHALLENGE>,
+//      "code_challenge_method" : "S256" or "plain",
+//      "approve" : <BOOL>
+// }
+//
+// "redirect_uri" may be omitted if the client registered exactly one.  On
+// success, responds with the "redirect_uri" (including the authorization
+// code or error) that the browser should navigate to.
+func POST_oauth_authorize(w http.ResponseWriter, r *http.Request, info adapter.CanopyRestInfo) (map[string]interface{}, rest_errors.CanopyRestError) {
+    // Only the account holder, using the web app, may grant access.
+    if info.Account == nil || info.AuthType != adapter.CANOPY_REST_AUTH_SESSION {
+        return nil, rest_errors.NewNotLoggedInError()
+    }
+
+    clientId, ok := info.BodyObj["client_id"].(string)
+    if !ok {
+        return nil, rest_errors.NewBadInputFieldError("client_id", "String \"client_id\" expected")
+    }
+    client, err := info.Conn.LookupOAuthClient(clientId)
+    if err != nil {
+        return nil, rest_errors.NewBadInputFieldError("client_id", "Unknown client_id")
+    }
+
+    // Errors up to this point are reported to the user rather than to the
+    // client, because the redirect URI has not been verified.
+    redirectURI, _ := info.BodyObj["redirect_uri"].(string)
+    if redirectURI == "" && len(client.RedirectURIs()) == 1 {
+        redirectURI = client.RedirectURIs()[0]
+    }
+    if !isRegisteredRedirectURI(client, redirectURI) {
+        return nil, rest_errors.NewBadInputFieldError("redirect_uri", "redirect_uri does not match a registered redirect URI")
+    }
+
+    state, _ := info.BodyObj["state"].(string)
+
+    approve, _ := info.BodyObj["approve"].(bool)
+    if !approve {
+        return oauthRedirect(redirectURI, map[string]string{
+            "error" : "access_denied",
+            "state" : state,
+        })
+    }
+
+    responseType, _ := info.BodyObj["response_type"].(string)
+    if responseType != "code" {
+        return oauthRedirect(redirectURI, map[string]string{
+            "error" : "unsupported_response_type",
+            "state" : state,
+        })
+    }
+
+    scopeIn, _ := info.BodyObj["scope"].(string)
+    scope, accessLevel, err := parseOAuthScope(scopeIn)
+    if err != nil {
+        return oauthRedirect(redirectURI, map[string]string{
+            "error" : "invalid_scope",
+            "error_description" : err.Error(),
+            "state" : state,
+        })
+    }
+
+    codeChallenge, _ := info.BodyObj["code_challenge"].(string)
+    codeChallengeMethod, _ := info.BodyObj["code_challenge_method"].(string)
+    if codeChallenge != "" && codeChallengeMethod == "" {
+        codeChallengeMethod = "plain"
+    }
+    if codeChallengeMethod != "" && codeChallengeMethod != "plain" && codeChallengeMethod != "S256" {
+        return oauthRedirect(redirectURI, map[string]string{
+            "error" : "invalid_request",
+            "error_description" : "Unsupported code_challenge_method",
+            "state" : state,
+        })
+    }
+    if codeChallenge == "" && client.IsPublic() {
+        return oauthRedirect(redirectURI, map[string]string{
+            "error" : "invalid_request",
+            "error_description" : "Public clients must use PKCE",
+            "state" : state,
+        })
+    }
+
+    code, err := info.Conn.CreateOAuthAuthCode(datalayer.OAuthGrant{
+        AccessLevel: accessLevel,
+        ClientID: client.ClientID(),
+        CodeChallenge: codeChallenge,
+        CodeChallengeMethod: codeChallengeMethod,
+        Expiry: time.Now().Add(datalayer.OAuthAuthCodeLifetime),
+        RedirectURI: redirectURI,
+        Scope: scope,
+        Username: info.Account.Username(),
+    })
+    if err != nil {
+        return oauthRedirect(redirectURI, map[string]string{
+            "error" : "server_error",
+            "state" : state,
+        })
+    }
+
+    return oauthRedirect(redirectURI, map[string]string{
+        "code" : code,
+        "state" : state,
+    })
+}
@@ -0,0 +1,139 @@
+// Copyright 2015 SimpleThings, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package endpoints
+
+import (
+    "canopy/rest/adapter"
+    "canopy/rest/rest_errors"
+    "canopy/util/jsonschema"
+    "net/http"
+    "net/url"
+)
+
+var POST_oauth_clients_endpoint = adapter.Endpoint{
+    Method: "POST",
+    Path: "/oauth/clients",
+    Summary: "Register an OAuth2 client app",
+    Auth: []adapter.CanopyRestAuthTypeEnum{
+        adapter.CANOPY_REST_AUTH_BASIC,
+        adapter.CANOPY_REST_AUTH_SESSION,
+    },
+    Body: jsonschema.Object(map[string]*jsonschema.Schema{
+        "name" : jsonschema.String("App name, shown on the consent screen"),
+        "redirect_uris" : jsonschema.Array(jsonschema.String(""), "Absolute redirect URIs"),
+        "public" : jsonschema.Boolean("Whether the client cannot keep a secret"),
+    }, "name", "redirect_uris"),
+    Response: okResponse(map[string]*jsonschema.Schema{
+        "client_id" : jsonschema.String("Client ID"),
+        "client_secret" : jsonschema.String("Only for confidential clients.  Only shown once."),
+        "name" : jsonschema.String("App name"),
+        "public" : jsonschema.Boolean("Whether the client is public"),
+        "redirect_uris" : jsonschema.Array(jsonschema.String(""), "Redirect URIs"),
+    }),
+    Handler: POST_oauth_clients,
+}
+
+// Register a third-party application with the OAuth2 authorization server.
+// Request:
+// {
+//      "name" : <APP_NAME>,
+//      "redirect_uris" : [<URI>, ...],
+//      "public" : <BOOL>
+// }
+//
+// Public clients (such as mobile or in-browser apps) do not get a client
+// secret and must use PKCE.  The client secret is only returned once.
+func POST_oauth_clients(w http.ResponseWriter, r *http.Request, info adapter.CanopyRestInfo) (map[string]interface{}, rest_errors.CanopyRestError) {
+    if info.Account == nil {
+        return nil, rest_errors.NewNotLoggedInError()
+    }
+    if info.AuthType == adapter.CANOPY_REST_AUTH_BEARER {
+        return nil, rest_errors.NewInsufficientScopeError("Apps cannot register other apps")
+    }
+
+    name, ok := info.BodyObj["name"].(string)
+    if !ok || name == "" {
+        return nil, rest_errors.NewBadInputFieldError("name", "String \"name\" expected")
+    }
+
+    redirectURIsObj, ok := info.BodyObj["redirect_uris"].([]interface{})
+    if !ok || len(redirectURIsObj) == 0 {
+        return nil, rest_errors.NewBadInputFieldError("redirect_uris", "List \"redirect_uris\" expected")
+    }
+    redirectURIs := []string{}
+    for _, uriObj := range redirectURIsObj {
+        uri, ok := uriObj.(string)
+        if !ok {
+            return nil, rest_errors.NewBadInputFieldError("redirect_uris", "String redirect URI expected")
+        }
+        parsed, err := url.Parse(uri)
+        if err != nil || !parsed.IsAbs() || parsed.Fragment != "" {
+            return nil, rest_errors.NewBadInputFieldError("redirect_uris", "Redirect URIs must be absolute and must not have a fragment")
+        }
+        redirectURIs = append(redirectURIs, uri)
+    }
+
+    public := false
+    if publicObj, ok := info.BodyObj["public"]; ok {
+        public, ok = publicObj.(bool)
+        if !ok {
+            return nil, rest_errors.NewBadInputFieldError("public", "Boolean \"public\" expected")
+        }
+    }
+
+    client, secret, err := info.Conn.CreateOAuthClient(info.Account, name, redirectURIs, public)
+    if err != nil {
+        return nil, rest_errors.NewInternalServerError("Problem registering client")
+    }
+
+    out := map[string]interface{} {
+        "result" : "ok",
+        "client_id" : client.ClientID(),
+        "name" : client.Name(),
+        "public" : client.IsPublic(),
+        "redirect_uris" : client.RedirectURIs(),
+    }
+    if !client.IsPublic() {
+        out["client_secret"] = secret
+    }
+    return out, nil
+}
+
+var GET_oauth_client__id_endpoint = adapter.Endpoint{
+    Method: "GET",
+    Path: "/oauth/client/{id}",
+    Summary: "Get an OAuth2 client's public details",
+    Response: okResponse(map[string]*jsonschema.Schema{
+        "client_id" : jsonschema.String("Client ID"),
+        "name" : jsonschema.String("App name"),
+        "owner" : jsonschema.String("Username of the account that registered it"),
+    }),
+    Handler: GET_oauth_client__id,
+}
+
+// Get the public details of a registered OAuth client.  Used by the consent
+// screen.
+func GET_oauth_client__id(w http.ResponseWriter, r *http.Request, info adapter.CanopyRestInfo) (map[string]interface{}, rest_errors.CanopyRestError) {
+    client, err := info.Conn.LookupOAuthClient(info.URLVars["id"])
+    if err != nil {
+        return nil, rest_errors.NewURLNotFoundError()
+    }
+
+    return map[string]interface{} {
+        "result" : "ok",
+        "client_id" : client.ClientID(),
+        "name" : client.Name(),
+        "owner" : client.OwnerUsername(),
+    }, nil
+}
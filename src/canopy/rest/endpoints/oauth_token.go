@@ -0,0 +1,144 @@
+// Copyright 2015 SimpleThings, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package endpoints
+
+import (
+    "canopy/datalayer"
+    "canopy/rest/adapter"
+    "canopy/rest/rest_errors"
+    "canopy/util/jsonschema"
+    "crypto/sha256"
+    "crypto/subtle"
+    "encoding/base64"
+    "net/http"
+)
+
+// Check a PKCE code verifier against the challenge sent in the authorization
+// request (RFC 7636).
+func verifyPKCE(challenge, method, verifier string) bool {
+    if len(verifier) < 43 || len(verifier) > 128 {
+        return false
+    }
+    expected := verifier
+    if method == "S256" {
+        sum := sha256.Sum256([]byte(verifier))
+        expected = base64.RawURLEncoding.EncodeToString(sum[:])
+    }
+    return subtle.ConstantTimeCompare([]byte(expected), []byte(challenge)) == 1
+}
+
+var POST_oauth_token_endpoint = adapter.Endpoint{
+    Method: "POST",
+    Path: "/oauth/token",
+    Summary: "OAuth2 token endpoint",
+    Body: jsonschema.Object(map[string]*jsonschema.Schema{
+        "grant_type" : jsonschema.String("\"authorization_code\" or \"refresh_token\""),
+        "code" : jsonschema.String("Authorization code"),
+        "redirect_uri" : jsonschema.String("Redirect URI used in the authorization request"),
+        "code_verifier" : jsonschema.String("PKCE code verifier"),
+        "refresh_token" : jsonschema.String("Refresh token"),
+        "client_id" : jsonschema.String("Client ID"),
+        "client_secret" : jsonschema.String("Client secret, for confidential clients"),
+    }, "grant_type"),
+    FormEncoded: true,
+    Response: jsonschema.Object(map[string]*jsonschema.Schema{
+        "access_token" : jsonschema.String("Access token"),
+        "token_type" : jsonschema.StringEnum("Token type", "Bearer"),
+        "expires_in" : jsonschema.Integer("Access token lifetime in seconds"),
+        "refresh_token" : jsonschema.String("Refresh token"),
+        "scope" : jsonschema.String("Granted scopes"),
+    }),
+    Handler: POST_oauth_token,
+    InvalidBody: func(errs []jsonschema.FieldError) rest_errors.CanopyRestError {
+        return rest_errors.NewOAuthError("invalid_request", errs[0].Message)
+    },
+    Unversioned: true,
+}
+
+// OAuth2 token endpoint.  Accepts form-encoded (or JSON) requests:
+//
+//  grant_type=authorization_code&code=...&redirect_uri=...&client_id=...
+//      [&client_secret=...][&code_verifier=...]
+//
+//  grant_type=refresh_token&refresh_token=...&client_id=...
+//      [&client_secret=...]
+//
+// Client credentials must be sent in the request body.  HTTP BASIC client
+// authentication is not supported, because BASIC auth on /api is reserved
+// for account and device credentials.
+func POST_oauth_token(w http.ResponseWriter, r *http.Request, info adapter.CanopyRestInfo) (map[string]interface{}, rest_errors.CanopyRestError) {
+    clientId, _ := info.BodyObj["client_id"].(string)
+    client, err := info.Conn.LookupOAuthClient(clientId)
+    if err != nil {
+        return nil, rest_errors.NewOAuthError("invalid_client", "Unknown client")
+    }
+    if !client.IsPublic() {
+        clientSecret, _ := info.BodyObj["client_secret"].(string)
+        if !client.VerifySecret(clientSecret) {
+            return nil, rest_errors.NewOAuthError("invalid_client", "Client authentication failed")
+        }
+    }
+
+    var grant *datalayer.OAuthGrant
+    grantType, _ := info.BodyObj["grant_type"].(string)
+    switch grantType {
+    case "authorization_code":
+        code, _ := info.BodyObj["code"].(string)
+        grant, err = info.Conn.ConsumeOAuthAuthCode(code)
+        if err != nil {
+            return nil, rest_errors.NewOAuthError("invalid_grant", "Invalid or expired authorization code")
+        }
+        if grant.ClientID != client.ClientID() {
+            return nil, rest_errors.NewOAuthError("invalid_grant", "Code was issued to another client")
+        }
+        // Required whenever the authorization request had one (RFC 6749
+        // section 4.1.3).
+        redirectURI, _ := info.BodyObj["redirect_uri"].(string)
+        if grant.RedirectURI != "" && redirectURI != grant.RedirectURI {
+            return nil, rest_errors.NewOAuthError("invalid_grant", "redirect_uri mismatch")
+        }
+        if grant.CodeChallenge != "" {
+            verifier, _ := info.BodyObj["code_verifier"].(string)
+            if !verifyPKCE(grant.CodeChallenge, grant.CodeChallengeMethod, verifier) {
+                return nil, rest_errors.NewOAuthError("invalid_grant", "PKCE verification failed")
+            }
+        }
+    case "refresh_token":
+        refreshToken, _ := info.BodyObj["refresh_token"].(string)
+        grant, err = info.Conn.ConsumeOAuthRefreshToken(refreshToken)
+        if err != nil {
+            return nil, rest_errors.NewOAuthError("invalid_grant", "Invalid or expired refresh token")
+        }
+        if grant.ClientID != client.ClientID() {
+            return nil, rest_errors.NewOAuthError("invalid_grant", "Token was issued to another client")
+        }
+    default:
+        return nil, rest_errors.NewOAuthError("unsupported_grant_type", "Expected authorization_code or refresh_token")
+    }
+
+    accessToken, refreshToken, err := info.Conn.CreateOAuthTokens(*grant)
+    if err != nil {
+        return nil, rest_errors.NewOAuthError("server_error", "Problem issuing tokens")
+    }
+
+    w.Header().Set("Cache-Control", "no-store")
+    w.Header().Set("Pragma", "no-cache")
+    return map[string]interface{} {
+        "access_token" : accessToken,
+        "token_type" : "Bearer",
+        "expires_in" : int(datalayer.OAuthAccessTokenLifetime.Seconds()),
+        "refresh_token" : refreshToken,
+        "scope" : grant.Scope,
+    }, nil
+}
@@ -0,0 +1,149 @@
+// Copyright 2015 SimpleThings, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+package endpoints
+
+import (
+    "canopy/datalayer"
+    "canopy/rest/adapter"
+    "canopy/rest/rest_errors"
+    "canopy/util/jsonschema"
+    "net/http"
+    "time"
+)
+
+// Platforms a push token may be registered for.
+var pushPlatforms = []string{"ios", "android"}
+
+var pushTokenSchema = jsonschema.Object(map[string]*jsonschema.Schema{
+    "token" : jsonschema.String("Device token issued by the push notification service"),
+    "platform" : jsonschema.StringEnum("Mobile platform", pushPlatforms...),
+    "created" : jsonschema.String("When the token was registered, RFC 3339"),
+})
+
+func pushTokenJsonObj(token datalayer.PushToken) map[string]interface{} {
+    return map[string]interface{} {
+        "token" : token.Token,
+        "platform" : token.Platform,
+        "created" : token.Created.Format(time.RFC3339),
+    }
+}
+
+var GET_me_push_tokens_endpoint = adapter.Endpoint{
+    Method: "GET",
+    Path: "/me/push_tokens",
+    Summary: "List the mobile devices that receive the logged-in account's push notifications",
+    Auth: adapter.AccountAuth,
+    Response: okResponse(map[string]*jsonschema.Schema{
+        "push_tokens" : jsonschema.Array(pushTokenSchema, "Registered push tokens"),
+    }),
+    Handler: GET_me_push_tokens,
+}
+
+func GET_me_push_tokens(w http.ResponseWriter, r *http.Request, info adapter.CanopyRestInfo) (map[string]interface{}, rest_errors.CanopyRestError) {
+    if info.Account == nil {
+        return nil, rest_errors.NewNotLoggedInError()
+    }
+
+    tokens, err := info.Conn.PushTokens(info.Account.Username())
+    if err != nil {
+        return nil, rest_errors.NewInternalServerError("Problem reading push tokens")
+    }
+    out := []map[string]interface{}{}
+    for _, token := range tokens {
+        out = append(out, pushTokenJsonObj(token))
+    }
+    return map[string]interface{} {
+        "result" : "ok",
+        "push_tokens" : out,
+    }, nil
+}
+
+var POST_me_push_tokens_endpoint = adapter.Endpoint{
+    Method: "POST",
+    Path: "/me/push_tokens",
+    Summary: "Register a mobile device for push notifications",
+    Auth: adapter.AccountAuth,
+    Body: jsonschema.Object(map[string]*jsonschema.Schema{
+        "token" : jsonschema.String("Device token issued by the push notification service"),
+        "platform" : jsonschema.StringEnum("Mobile platform", pushPlatforms...),
+    }, "token", "platform"),
+    Response: okResponse(map[string]*jsonschema.Schema{
+        "push_token" : pushTokenSchema,
+    }),
+    Handler: POST_me_push_tokens,
+}
+
+// Register a mobile device to receive the logged-in account's "in-app"
+// notifications.  Request:
+// {
+//      "token" : <DEVICE_TOKEN>,
+//      "platform" : "ios" | "android"
+// }
+//
+// Registering a token again replaces it.  Tokens that the push service
+// rejects as invalid are removed automatically.
+func POST_me_push_tokens(w http.ResponseWriter, r *http.Request, info adapter.CanopyRestInfo) (map[string]interface{}, rest_errors.CanopyRestError) {
+    if info.Account == nil {
+        return nil, rest_errors.NewNotLoggedInError()
+    }
+
+    tokenString, ok := info.BodyObj["token"].(string)
+    if !ok || tokenString == "" {
+        return nil, rest_errors.NewBadInputFieldError("token", "String \"token\" expected")
+    }
+    platform, _ := info.BodyObj["platform"].(string)
+    if !isOneOf(platform, pushPlatforms) {
+        return nil, rest_errors.NewBadInputFieldError("platform", "Unknown platform")
+    }
+
+    token := datalayer.PushToken{
+        Username: info.Account.Username(),
+        Token: tokenString,
+        Platform: platform,
+        Created: time.Now(),
+    }
+    err := info.Conn.AddPushToken(token)
+    if err != nil {
+        return nil, rest_errors.NewInternalServerError("Problem registering push token")
+    }
+    return map[string]interface{} {
+        "result" : "ok",
+        "push_token" : pushTokenJsonObj(token),
+    }, nil
+}
+
+var DELETE_me_push_token__token_endpoint = adapter.Endpoint{
+    Method: "DELETE",
+    Path: "/me/push_token/{token}",
+    Summary: "Stop sending push notifications to a mobile device",
+    Auth: adapter.AccountAuth,
+    Response: okResponse(nil),
+    Handler: DELETE_me_push_token__token,
+}
+
+func DELETE_me_push_token__token(w http.ResponseWriter, r *http.Request, info adapter.CanopyRestInfo) (map[string]interface{}, rest_errors.CanopyRestError) {
+    if info.Account == nil {
+        return nil, rest_errors.NewNotLoggedInError()
+    }
+
+    err := info.Conn.DeletePushToken(info.Account.Username(), info.URLVars["token"])
+    if err != nil {
+        return nil, rest_errors.NewInternalServerError("Problem deleting push token")
+    }
+    return map[string]interface{} {
+        "result" : "ok",
+    }, nil
+}
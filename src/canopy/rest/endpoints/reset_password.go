@@ -14,13 +14,28 @@
 package endpoints
 
 import (
-    "canopy/canolog"
+    "canopy/config"
+    "canopy/mail"
     "canopy/mail/messages"
     "canopy/rest/adapter"
     "canopy/rest/rest_errors"
+    "canopy/util/jsonschema"
     "net/http"
 )
 
+var POST_reset_password_endpoint = adapter.Endpoint{
+    Method: "POST",
+    Path: "/reset_password",
+    Summary: "Request a password reset email, or reset the password",
+    Body: jsonschema.Object(map[string]*jsonschema.Schema{
+        "username" : jsonschema.String("Username or email address"),
+        "password" : jsonschema.String("New password"),
+        "code" : jsonschema.String("Code from the password reset email.  Required with \"password\"."),
+    }, "username"),
+    Response: okResponse(nil),
+    Handler: POST_reset_password,
+}
+
 // This endpoint is used for two purposes:
 //
 // Purpose 1) Send Reset Password Request.  If only "username" field is
@@ -40,7 +55,7 @@ import (
 func POST_reset_password(w http.ResponseWriter, r *http.Request, info adapter.CanopyRestInfo) (map[string]interface{}, rest_errors.CanopyRestError) {
     usernameOrEmail, ok := info.BodyObj["username"].(string)
     if !ok {
-        return nil, rest_errors.NewBadInputError("String \"username\" expected")
+        return nil, rest_errors.NewBadInputFieldError("username", "String \"username\" expected")
     }
 
     account, err := info.Conn.LookupAccount(usernameOrEmail)
@@ -61,7 +76,7 @@ func POST_reset_password(w http.ResponseWriter, r *http.Request, info adapter.Ca
         // Set new password using code (Purpose 2 above).
         code, ok := info.BodyObj["code"].(string)
         if !ok {
-            return nil, rest_errors.NewBadInputError("String \"code\" expected")
+            return nil, rest_errors.NewBadInputFieldError("code", "String \"code\" expected")
         }
 
         err = account.ResetPassword(code, password)
@@ -71,32 +86,31 @@ func POST_reset_password(w http.ResponseWriter, r *http.Request, info adapter.Ca
         }
     } else {
         // Send Reset Password Request (Purpose 1 above)
-        canolog.Trace("Sending password reset email")
-
-        protocol := "http://"
-        if info.Config.OptEnableHTTPS() {
-            protocol = "https://"
-        }
+        logger.Trace("Sending password reset email")
 
         code, err := account.GenResetPasswordCode()
         if (err != nil) {
             return nil, rest_errors.NewInternalServerError("Problem resetting password: " + err.Error())
         }
 
-        activationLink := protocol + info.Config.OptHostname() + 
+        activationLink := config.BaseURL(info.Config) + 
                 "/mgr/reset_password.html?username=" + account.Username() + 
                 "&code=" + code
 
         msg := info.Mailer.NewMail();
         msg.AddTo(account.Email(), account.Username())
-        msg.SetFrom("no-reply@canopy.link", "Canopy Cloud Service")
-        msg.SetReplyTo("no-reply@canopy.link")
-        messages.MailMessageResetPassword(msg,
+        mail.SetNoReply(msg)
+        err = messages.MailMessageResetPassword(msg,
+            account.Language(),
             account.Username(), 
             activationLink,
-            protocol + info.Config.OptHostname(),
+            config.BaseURL(info.Config),
             info.Config.OptHostname(),
         )
+        if (err != nil) {
+            logger.Error("Problem rendering password reset email: ", err)
+            return nil, rest_errors.NewInternalServerError("Problem sending mail")
+        }
         err = info.Mailer.Send(msg)
         if (err != nil) {
             return nil, rest_errors.NewInternalServerError("Problem sending mail")
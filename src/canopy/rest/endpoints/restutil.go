@@ -14,40 +14,27 @@
 package endpoints
 
 import (
+    "canopy/canolog"
     "canopy/cloudvar"
     "canopy/datalayer"
     "canopy/pigeon"
+    "canopy/util/jsonschema"
     "canopy/ws"
     "encoding/base64"
     "encoding/json"
     "errors"
-    "fmt"
     "net/http"
     "strings"
     "time"
 )
 
-// TODO: Need to handle allow-origin correctly!
-//var gConfAllowOrigin = "http://74.93.13.249:8080"
-
-func writeDatabaseConnectionError(w http.ResponseWriter) {
-    w.WriteHeader(http.StatusInternalServerError);
-    fmt.Fprintf(w, `{"result" : "error", "error_type" : "could_not_connect_to_database"}`);
-}
-func writeNotLoggedInError(w http.ResponseWriter) {
-    w.WriteHeader(http.StatusUnauthorized);
-    fmt.Fprintf(w, `{"result" : "error", "error_type" : "not_logged_in"}`);
-}
+var logger = canolog.Subsystem("rest")
 
-func writeAccountLookupFailedError(w http.ResponseWriter) {
-    w.WriteHeader(http.StatusInternalServerError);
-    fmt.Fprintf(w, `{"result" : "error", "error_type" : "account_lookup_failed"}`);
-}
+// Number of notifications included in a device's JSON.
+const deviceJsonNotificationLimit = 10
 
-func writeIncorrectUsernameOrPasswordError(w http.ResponseWriter) {
-    w.WriteHeader(http.StatusUnauthorized);
-    fmt.Fprintf(w, `{"result" : "error", "error_type" : "incorrect_username_or_password"}`);
-}
+// TODO: Need to handle allow-origin correctly!
+//var gConfAllowOrigin = "http://74.93.13.249:8080"
 
 /*func writeStandardHeaders(w http.ResponseWriter) {
     w.Header().Set("Connection", "close")
@@ -97,6 +84,42 @@ func basicAuthFromRequest(r *http.Request) (username string, password string, er
 // datetime              string  -->    time.Time
 //
 
+// Schemas for the JSON produced below, used in endpoint declarations.
+
+var sampleSchema = jsonschema.Object(map[string]*jsonschema.Schema{
+    "t" : jsonschema.String("Time, RFC 3339"),
+    "v" : jsonschema.Any("Value"),
+})
+
+var deviceSchema = jsonschema.Object(map[string]*jsonschema.Schema{
+    "device_id" : jsonschema.String("Device UUID"),
+    "friendly_name" : jsonschema.String("Device name"),
+    "location_note" : jsonschema.String("Where the device is"),
+    "status" : jsonschema.Object(map[string]*jsonschema.Schema{
+        "ws_connected" : jsonschema.Boolean("Whether the device has a websocket open"),
+        "last_activity_time" : jsonschema.String("Time the device was last heard from").OrNull(),
+    }),
+    "sddl" : jsonschema.Map(jsonschema.Any(""), "The device's SDDL class").OrNull(),
+    "secret_key" : jsonschema.String("Secret key the device authenticates with"),
+    "vars" : jsonschema.Map(sampleSchema, "Latest value of each cloud variable"),
+    "notifs" : jsonschema.Array(notificationSchema, "Most recent notifications, newest first"),
+})
+
+var devicesSchema = jsonschema.Object(map[string]*jsonschema.Schema{
+    "devices" : jsonschema.Array(deviceSchema, "Devices"),
+})
+
+// Schema for a {"result" : "ok", ...} response with <properties>.
+func okResponse(properties map[string]*jsonschema.Schema) *jsonschema.Schema {
+    all := map[string]*jsonschema.Schema{
+        "result" : jsonschema.StringEnum("", "ok"),
+    }
+    for k, v := range properties {
+        all[k] = v
+    }
+    return jsonschema.Object(all, "result")
+}
+
 type jsonDevices struct {
     Devices []jsonDevicesItem `json:"devices"`
 }
@@ -165,29 +188,21 @@ func deviceToJsonObj(pigeonSys *pigeon.PigeonSystem, device datalayer.Device) (m
                 "v" : sample.Value,
             }
         }
+    }
 
+    // Most recent notifications.  Use GET /device/<id>/notifications for
+    // the rest.
+    notifications, err := device.Notifications(time.Time{}, deviceJsonNotificationLimit)
+    if err != nil {
+        logger.Error("Error reading notifications: ", err)
+        return nil, err
+    }
+    outNotifications := []interface{}{}
+    for _, notification := range notifications {
+        outNotifications = append(outNotifications, notificationJsonObj(device, notification))
+    }
+    out["notifs"] = outNotifications
 
-        // Generate JSON for notifications
-        //
-        /*notifications, err := device.HistoricNotifications()
-        canolog.Info("Reading notifications")
-        if err != nil {
-            canolog.Info("Error reading notifications %s", err)
-            return nil, err
-        }
-
-        outNotifications := []jsonNotification{};
-        for _, notification := range notifications {
-            outNotifications = append(
-                    outNotifications, 
-                    jsonNotification{
-                        notification.Datetime().Format(time.RFC3339),
-                        notification.IsDismissed(),
-                        notification.Msg(),
-                    })
-        }*/
-    }
-    
     return out, nil
 
 }
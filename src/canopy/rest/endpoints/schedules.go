@@ -0,0 +1,346 @@
+// Copyright 2015 SimpleThings, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+package endpoints
+
+import (
+    "canopy/datalayer"
+    "canopy/rest/adapter"
+    "canopy/rest/rest_errors"
+    "canopy/scheduler"
+    "canopy/util/jsonschema"
+    "net/http"
+    "time"
+)
+
+var scheduleSchema = jsonschema.Object(map[string]*jsonschema.Schema{
+    "schedule_id" : jsonschema.String("Schedule ID"),
+    "name" : jsonschema.String("Schedule name"),
+    "vars" : jsonschema.Map(jsonschema.Any(""), "Cloud variable values to set, by name"),
+    "cron" : jsonschema.String("Cron expression for repeating schedules, or empty for one-shot schedules"),
+    "time_zone" : jsonschema.String("Time zone the cron expression is interpreted in"),
+    "next_run" : jsonschema.String("Time of the next run, RFC 3339").OrNull(),
+    "last_run" : jsonschema.String("Time of the latest run, RFC 3339").OrNull(),
+    "last_error" : jsonschema.String("Problem with the latest run, or empty"),
+    "created" : jsonschema.String("Time, RFC 3339"),
+    "created_by" : jsonschema.String("Username of the account that created the schedule"),
+})
+
+// Properties accepted when creating or updating a schedule.
+var scheduleBodyProperties = map[string]*jsonschema.Schema{
+    "name" : jsonschema.String("Schedule name"),
+    "vars" : jsonschema.Map(jsonschema.Any(""), "Cloud variable values to set, by name"),
+    "cron" : jsonschema.String("Cron expression, ex: \"0 22 * * mon-fri\""),
+    "time_zone" : jsonschema.String("Time zone for \"cron\", ex: \"America/Los_Angeles\".  Defaults to UTC."),
+    "at" : jsonschema.String("Time of a one-shot run, RFC 3339"),
+    "delay" : jsonschema.Number("Seconds from now of a one-shot run"),
+}
+
+func optionalTimeString(t time.Time) interface{} {
+    if t.IsZero() {
+        return nil
+    }
+    return t.Format(time.RFC3339)
+}
+
+func scheduleJsonObj(schedule datalayer.Schedule) map[string]interface{} {
+    return map[string]interface{} {
+        "schedule_id" : schedule.ID,
+        "name" : schedule.Name,
+        "vars" : schedule.Vars,
+        "cron" : schedule.Cron,
+        "time_zone" : schedule.TimeZone,
+        "next_run" : optionalTimeString(schedule.NextRun),
+        "last_run" : optionalTimeString(schedule.LastRun),
+        "last_error" : schedule.LastError,
+        "created" : schedule.Created.Format(time.RFC3339),
+        "created_by" : schedule.CreatedBy,
+    }
+}
+
+// Apply the fields of a create or update request to <schedule>.  If
+// <requireAll> is set, "vars" and one of "cron", "at" or "delay" must be
+// given.
+func applyScheduleBody(info adapter.CanopyRestInfo, device datalayer.Device, schedule *datalayer.Schedule, requireAll bool) rest_errors.CanopyRestError {
+    if name, ok := info.BodyObj["name"].(string); ok {
+        schedule.Name = name
+    }
+
+    if value, ok := info.BodyObj["vars"]; ok || requireAll {
+        vars, ok := value.(map[string]interface{})
+        if !ok {
+            return rest_errors.NewBadInputFieldError("vars", "Object \"vars\" expected")
+        }
+        err := scheduler.ValidateVars(device, vars)
+        if err != nil {
+            return rest_errors.NewBadInputFieldError("vars", err.Error())
+        }
+        schedule.Vars = vars
+    }
+
+    cronSpec, hasCron := info.BodyObj["cron"].(string)
+    timeZone, hasTimeZone := info.BodyObj["time_zone"].(string)
+    at, hasAt := info.BodyObj["at"].(string)
+    delay, hasDelay := info.BodyObj["delay"].(float64)
+    numTimings := 0
+    for _, has := range []bool{hasCron, hasAt, hasDelay} {
+        if has {
+            numTimings++
+        }
+    }
+    if numTimings > 1 {
+        return rest_errors.NewBadInputError("Only one of \"cron\", \"at\" and \"delay\" may be given")
+    }
+    if numTimings == 0 && requireAll {
+        return rest_errors.NewBadInputError("One of \"cron\", \"at\" or \"delay\" is required")
+    }
+    if hasTimeZone && (hasAt || hasDelay || (!hasCron && schedule.Cron == "")) {
+        return rest_errors.NewBadInputFieldError("time_zone", "\"time_zone\" only applies to \"cron\" schedules")
+    }
+    if timeZone == "" {
+        timeZone = "UTC"
+    }
+
+    now := time.Now()
+    switch {
+    case hasCron:
+        schedule.Cron = cronSpec
+        schedule.TimeZone = timeZone
+        nextRun, err := scheduler.NextRun(*schedule, now)
+        if err != nil {
+            return rest_errors.NewBadInputFieldError("cron", err.Error())
+        }
+        schedule.NextRun = nextRun
+    case hasTimeZone:
+        // Keep the stored cron expression, in the new time zone.
+        schedule.TimeZone = timeZone
+        nextRun, err := scheduler.NextRun(*schedule, now)
+        if err != nil {
+            return rest_errors.NewBadInputFieldError("time_zone", err.Error())
+        }
+        schedule.NextRun = nextRun
+    case hasAt:
+        t, err := time.Parse(time.RFC3339, at)
+        if err != nil {
+            return rest_errors.NewBadInputFieldError("at", "\"at\" must be an RFC 3339 time")
+        }
+        if !t.After(now) {
+            return rest_errors.NewBadInputFieldError("at", "\"at\" must be in the future")
+        }
+        schedule.Cron = ""
+        schedule.TimeZone = ""
+        schedule.NextRun = t.UTC()
+    case hasDelay:
+        if delay <= 0 {
+            return rest_errors.NewBadInputFieldError("delay", "\"delay\" must be positive")
+        }
+        schedule.Cron = ""
+        schedule.TimeZone = ""
+        schedule.NextRun = now.Add(time.Duration(delay*float64(time.Second))).UTC()
+    }
+    return nil
+}
+
+var GET_device__id__schedules_endpoint = adapter.Endpoint{
+    Method: "GET",
+    Path: "/device/{id}/schedules",
+    Summary: "List a device's scheduled cloud variable writes",
+    Auth: adapter.AccountAuth,
+    Response: okResponse(map[string]*jsonschema.Schema{
+        "schedules" : jsonschema.Array(scheduleSchema, "Schedules"),
+    }),
+    Handler: GET_device__id__schedules,
+}
+
+func GET_device__id__schedules(w http.ResponseWriter, r *http.Request, info adapter.CanopyRestInfo) (map[string]interface{}, rest_errors.CanopyRestError) {
+    device, restErr := deviceForAccount(info, datalayer.ReadOnlyAccess)
+    if restErr != nil {
+        return nil, restErr
+    }
+
+    schedules, err := info.Conn.Schedules(device.ID())
+    if err != nil {
+        return nil, rest_errors.NewInternalServerError("Problem listing schedules")
+    }
+    out := []map[string]interface{}{}
+    for _, schedule := range schedules {
+        out = append(out, scheduleJsonObj(schedule))
+    }
+    return map[string]interface{} {
+        "result" : "ok",
+        "schedules" : out,
+    }, nil
+}
+
+var POST_device__id__schedules_endpoint = adapter.Endpoint{
+    Method: "POST",
+    Path: "/device/{id}/schedules",
+    Summary: "Schedule cloud variable writes",
+    Auth: adapter.AccountAuth,
+    Body: jsonschema.Object(scheduleBodyProperties, "vars"),
+    Response: okResponse(map[string]*jsonschema.Schema{
+        "schedule" : scheduleSchema,
+    }),
+    Handler: POST_device__id__schedules,
+}
+
+// Schedule writes to "in" or "inout" Cloud Variables of one of the
+// logged-in account's devices.  Requires read-write access to the device.
+// Request:
+// {
+//      "name" : <NAME>,
+//      "vars" : {
+//          <CLOUD_VAR_NAME> : <VALUE>,
+//          ...
+//      },
+//      "cron" : <CRON_EXPRESSION>,
+//      "time_zone" : <TIME_ZONE>,
+//      "at" : <RFC3339_TIME>,
+//      "delay" : <SECONDS>
+// }
+//
+// Exactly one of "cron" (repeating, see util/cron), "at" or "delay"
+// (one-shot) is required.
+func POST_device__id__schedules(w http.ResponseWriter, r *http.Request, info adapter.CanopyRestInfo) (map[string]interface{}, rest_errors.CanopyRestError) {
+    device, restErr := deviceForAccount(info, datalayer.ReadWriteAccess)
+    if restErr != nil {
+        return nil, restErr
+    }
+
+    schedule := datalayer.Schedule{
+        DeviceID: device.ID(),
+        CreatedBy: info.Account.Username(),
+    }
+    restErr = applyScheduleBody(info, device, &schedule, true)
+    if restErr != nil {
+        return nil, restErr
+    }
+
+    created, err := info.Conn.CreateSchedule(schedule)
+    if err != nil {
+        return nil, rest_errors.NewInternalServerError("Problem creating schedule")
+    }
+    return map[string]interface{} {
+        "result" : "ok",
+        "schedule" : scheduleJsonObj(*created),
+    }, nil
+}
+
+var GET_device__id__schedule__schedule_id_endpoint = adapter.Endpoint{
+    Method: "GET",
+    Path: "/device/{id}/schedule/{schedule_id}",
+    Summary: "Get a scheduled cloud variable write",
+    Auth: adapter.AccountAuth,
+    Response: okResponse(map[string]*jsonschema.Schema{
+        "schedule" : scheduleSchema,
+    }),
+    Handler: GET_device__id__schedule__schedule_id,
+}
+
+func GET_device__id__schedule__schedule_id(w http.ResponseWriter, r *http.Request, info adapter.CanopyRestInfo) (map[string]interface{}, rest_errors.CanopyRestError) {
+    device, restErr := deviceForAccount(info, datalayer.ReadOnlyAccess)
+    if restErr != nil {
+        return nil, restErr
+    }
+
+    schedule, err := info.Conn.LookupSchedule(device.ID(), info.URLVars["schedule_id"])
+    if err != nil {
+        return nil, rest_errors.NewURLNotFoundError()
+    }
+    return map[string]interface{} {
+        "result" : "ok",
+        "schedule" : scheduleJsonObj(*schedule),
+    }, nil
+}
+
+var POST_device__id__schedule__schedule_id_endpoint = adapter.Endpoint{
+    Method: "POST",
+    Path: "/device/{id}/schedule/{schedule_id}",
+    Summary: "Update a scheduled cloud variable write",
+    Auth: adapter.AccountAuth,
+    Body: jsonschema.Object(scheduleBodyProperties),
+    Response: okResponse(map[string]*jsonschema.Schema{
+        "schedule" : scheduleSchema,
+    }),
+    Handler: POST_device__id__schedule__schedule_id,
+}
+
+// Update one of a device's schedules.  Requires read-write access to the
+// device.  Accepts the same fields as POST /device/<id>/schedules, all
+// optional.  Giving "cron", "at" or "delay" reschedules it, which also
+// restarts a one-shot schedule that has already run.  Giving "time_zone"
+// alone reschedules a cron schedule in the new time zone.
+func POST_device__id__schedule__schedule_id(w http.ResponseWriter, r *http.Request, info adapter.CanopyRestInfo) (map[string]interface{}, rest_errors.CanopyRestError) {
+    device, restErr := deviceForAccount(info, datalayer.ReadWriteAccess)
+    if restErr != nil {
+        return nil, restErr
+    }
+
+    // If a run is claimed between reading the schedule and updating it, the
+    // update doesn't happen; start again from the new state.
+    for attempt := 0; attempt < 3; attempt++ {
+        schedule, err := info.Conn.LookupSchedule(device.ID(), info.URLVars["schedule_id"])
+        if err != nil {
+            return nil, rest_errors.NewURLNotFoundError()
+        }
+        oldNextRun := schedule.NextRun
+        restErr = applyScheduleBody(info, device, schedule, false)
+        if restErr != nil {
+            return nil, restErr
+        }
+
+        applied, err := info.Conn.UpdateSchedule(*schedule, oldNextRun)
+        if err != nil {
+            return nil, rest_errors.NewInternalServerError("Problem updating schedule")
+        }
+        if applied {
+            return map[string]interface{} {
+                "result" : "ok",
+                "schedule" : scheduleJsonObj(*schedule),
+            }, nil
+        }
+    }
+    return nil, rest_errors.NewInternalServerError("Schedule kept changing during update")
+}
+
+var DELETE_device__id__schedule__schedule_id_endpoint = adapter.Endpoint{
+    Method: "DELETE",
+    Path: "/device/{id}/schedule/{schedule_id}",
+    Summary: "Delete a scheduled cloud variable write",
+    Auth: adapter.AccountAuth,
+    Response: okResponse(nil),
+    Handler: DELETE_device__id__schedule__schedule_id,
+}
+
+// Delete one of a device's schedules.  Requires read-write access to the
+// device.
+func DELETE_device__id__schedule__schedule_id(w http.ResponseWriter, r *http.Request, info adapter.CanopyRestInfo) (map[string]interface{}, rest_errors.CanopyRestError) {
+    device, restErr := deviceForAccount(info, datalayer.ReadWriteAccess)
+    if restErr != nil {
+        return nil, restErr
+    }
+
+    schedule, err := info.Conn.LookupSchedule(device.ID(), info.URLVars["schedule_id"])
+    if err != nil {
+        return nil, rest_errors.NewURLNotFoundError()
+    }
+    err = info.Conn.DeleteSchedule(device.ID(), schedule.ID)
+    if err != nil {
+        return nil, rest_errors.NewInternalServerError("Problem deleting schedule")
+    }
+    return map[string]interface{} {
+        "result" : "ok",
+    }, nil
+}
@@ -14,12 +14,28 @@
 package endpoints
 
 import (
+    "canopy/config"
     "canopy/mail"
+    "canopy/mail/messages"
     "canopy/rest/adapter"
     "canopy/rest/rest_errors"
+    "canopy/util/jsonschema"
     "net/http"
 )
 
+var POST_share_endpoint = adapter.Endpoint{
+    Method: "POST",
+    Path: "/share",
+    Summary: "Email someone a link for accessing a device",
+    Auth: adapter.AccountAuth,
+    Body: jsonschema.Object(map[string]*jsonschema.Schema{
+        "device_id" : jsonschema.String("Device UUID"),
+        "email" : jsonschema.String("Recipient's email address"),
+    }, "device_id", "email"),
+    Response: okResponse(nil),
+    Handler: POST_share,
+}
+
 func POST_share(w http.ResponseWriter, r *http.Request, info adapter.CanopyRestInfo) (map[string]interface{}, rest_errors.CanopyRestError) {
     /*
      *  POST
@@ -34,12 +50,12 @@ func POST_share(w http.ResponseWriter, r *http.Request, info adapter.CanopyRestI
      */
     deviceId, ok := info.BodyObj["device_id"].(string)
     if !ok {
-        return nil, rest_errors.NewBadInputError("String \"device_id\" expected")
+        return nil, rest_errors.NewBadInputFieldError("device_id", "String \"device_id\" expected")
     }
 
     device, err := info.Conn.LookupDeviceByStringID(deviceId)
     if err != nil {
-        return nil, rest_errors.NewBadInputError("Device not found")
+        return nil, rest_errors.NewBadInputFieldError("device_id", "Device not found")
     }
 
     //accessLevel, ok := data["access_level"].(int)
@@ -58,34 +74,37 @@ func POST_share(w http.ResponseWriter, r *http.Request, info adapter.CanopyRestI
 
     email, ok := info.BodyObj["email"].(string)
     if !ok {
-        return nil, rest_errors.NewBadInputError("String \"email\" expected")
+        return nil, rest_errors.NewBadInputFieldError("email", "String \"email\" expected")
     }
 
     if info.Account == nil {
         return nil, rest_errors.NewNotLoggedInError()
     }
 
-    mailer, err := mail.NewMailClient(info.Config)
+    shareLink := config.BaseURL(info.Config) +
+            "/mgr/index.html?share_device=" + deviceId
+
+    // The recipient may not have an account, so this is written in the
+    // sender's language.
+    msg := info.Mailer.NewMail();
+    err = msg.AddTo(email, "")
     if err != nil {
-        return nil, rest_errors.NewInternalServerError("Error initializing mail client")
+        return nil, rest_errors.NewBadInputFieldError("email", "Invalid email recipient")
     }
-    mail := mailer.NewMail();
-    err = mail.AddTo(email, "")
-    if err != nil {
-        return nil, rest_errors.NewBadInputError("Invalid email recipient")
+    msg.SetFrom(mail.NoReplyEmail, mail.NoReplyName)
+    msg.SetReplyTo(info.Account.Email())
+    err = messages.MailMessageShareDevice(msg,
+        info.Account.Language(),
+        info.Account.Username(),
+        device.Name(),
+        shareLink,
+        info.Config.OptHostname(),
+    )
+    if err == nil {
+        err = info.Mailer.Send(msg)
     }
-    mail.SetSubject(device.Name())
-    mail.SetHTML(`
-<img src="http://devel.canopy.link/canopy_logo.jpg"></img>
-<h2>I've shared a device with you.</h2>
-<a href="http://devel.canopy.link/go.php?share_device=` + deviceId + `">` + device.Name() + `</a>
-<h2>What is Canopy?</h2>
-<b>Canopy</b> is a secure platform for monitoring and controlling physical
-devices.  Learn more at <a href=http://devel.canopy.link>http://canopy.link</a>
-`)
-    mail.SetFrom("greg@canopy.link", "greg (via Canopy)")
-    err = mailer.Send(mail)
     if err != nil {
+        logger.Error("Problem sending share email: ", err)
         return nil, rest_errors.NewInternalServerError("Error sending mail")
     }
 
@@ -0,0 +1,305 @@
+// Copyright 2015 SimpleThings, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package endpoints
+
+import (
+    "canopy/datalayer"
+    "canopy/rest/adapter"
+    "canopy/rest/rest_errors"
+    "canopy/util/jsonschema"
+    "canopy/webhooks"
+    "github.com/gocql/gocql"
+    "net/http"
+    "strconv"
+    "time"
+)
+
+// Default and maximum number of entries returned from a webhook's delivery
+// history.
+const (
+    webhookDeliveriesDefaultLimit = 50
+    webhookDeliveriesMaxLimit = 500
+)
+
+var webhookSchema = jsonschema.Object(map[string]*jsonschema.Schema{
+    "webhook_id" : jsonschema.String("Webhook ID"),
+    "url" : jsonschema.String("Where events are POSTed"),
+    "event_types" : jsonschema.Array(jsonschema.StringEnum("", webhooks.EventTypes...), "Only deliver these types of event"),
+    "device_ids" : jsonschema.Array(jsonschema.String(""), "Only deliver events from these devices"),
+    "var_names" : jsonschema.Array(jsonschema.String(""), "Only deliver samples of these cloud variables"),
+    "notify_types" : jsonschema.Array(jsonschema.String(""), "Only deliver notifications of these types"),
+    "created" : jsonschema.String("Time, RFC 3339"),
+})
+
+var webhookDeliverySchema = jsonschema.Object(map[string]*jsonschema.Schema{
+    "delivery_id" : jsonschema.String("Shared by all attempts to deliver the same event"),
+    "device_id" : jsonschema.String("Device UUID"),
+    "event_type" : jsonschema.String("Event type"),
+    "payload" : jsonschema.String("JSON body that was POSTed"),
+    "attempt" : jsonschema.Integer("Attempt number, starting at 1"),
+    "status" : jsonschema.StringEnum("Outcome",
+            datalayer.WebhookDelivered,
+            datalayer.WebhookDeliveryRetrying,
+            datalayer.WebhookDeliveryDead),
+    "response_code" : jsonschema.Integer("HTTP status code, or 0 if there was no response"),
+    "error" : jsonschema.String("Why the attempt failed"),
+    "t" : jsonschema.String("Time, RFC 3339"),
+})
+
+func webhookJsonObj(hook datalayer.Webhook) map[string]interface{} {
+    return map[string]interface{} {
+        "webhook_id" : hook.ID,
+        "url" : hook.URL,
+        "event_types" : hook.EventTypes,
+        "device_ids" : hook.DeviceIDs,
+        "var_names" : hook.VarNames,
+        "notify_types" : hook.NotifyTypes,
+        "created" : hook.Created.Format(time.RFC3339),
+    }
+}
+
+func webhookDeliveriesJsonObj(deliveries []datalayer.WebhookDelivery) []map[string]interface{} {
+    out := []map[string]interface{}{}
+    for _, delivery := range deliveries {
+        out = append(out, map[string]interface{} {
+            "delivery_id" : delivery.DeliveryID,
+            "device_id" : delivery.DeviceID,
+            "event_type" : delivery.EventType,
+            "payload" : delivery.Payload,
+            "attempt" : delivery.Attempt,
+            "status" : delivery.Status,
+            "response_code" : delivery.ResponseCode,
+            "error" : delivery.Error,
+            "t" : delivery.Time.Format(time.RFC3339Nano),
+        })
+    }
+    return out
+}
+
+// Read an optional list of strings from the request body.
+func stringListField(body map[string]interface{}, field string) ([]string, rest_errors.CanopyRestError) {
+    out := []string{}
+    listObj, ok := body[field]
+    if !ok {
+        return out, nil
+    }
+    list, ok := listObj.([]interface{})
+    if !ok {
+        return nil, rest_errors.NewBadInputFieldError(field, "List \"" + field + "\" expected")
+    }
+    for _, itemObj := range list {
+        item, ok := itemObj.(string)
+        if !ok {
+            return nil, rest_errors.NewBadInputFieldError(field, "List of strings expected")
+        }
+        out = append(out, item)
+    }
+    return out, nil
+}
+
+var GET_me_webhooks_endpoint = adapter.Endpoint{
+    Method: "GET",
+    Path: "/me/webhooks",
+    Summary: "List the account's webhooks",
+    Auth: adapter.AccountAuth,
+    Response: okResponse(map[string]*jsonschema.Schema{
+        "webhooks" : jsonschema.Array(webhookSchema, "Webhooks"),
+    }),
+    Handler: GET_me_webhooks,
+}
+
+// List the logged-in account's webhooks.  Secrets are not included.
+func GET_me_webhooks(w http.ResponseWriter, r *http.Request, info adapter.CanopyRestInfo) (map[string]interface{}, rest_errors.CanopyRestError) {
+    if info.Account == nil {
+        return nil, rest_errors.NewNotLoggedInError()
+    }
+
+    hooks, err := info.Conn.Webhooks(info.Account.Username())
+    if err != nil {
+        return nil, rest_errors.NewInternalServerError("Problem listing webhooks")
+    }
+
+    out := []map[string]interface{}{}
+    for _, hook := range hooks {
+        out = append(out, webhookJsonObj(hook))
+    }
+    return map[string]interface{} {
+        "result" : "ok",
+        "webhooks" : out,
+    }, nil
+}
+
+var POST_me_webhooks_endpoint = adapter.Endpoint{
+    Method: "POST",
+    Path: "/me/webhooks",
+    Summary: "Create a webhook",
+    Auth: adapter.AccountAuth,
+    Body: jsonschema.Object(map[string]*jsonschema.Schema{
+        "url" : jsonschema.String("Absolute http or https URL, on a public address, to POST events to"),
+        "event_types" : jsonschema.Array(jsonschema.StringEnum("", webhooks.EventTypes...), "Only deliver these types of event"),
+        "device_ids" : jsonschema.Array(jsonschema.String(""), "Only deliver events from these devices"),
+        "var_names" : jsonschema.Array(jsonschema.String(""), "Only deliver samples of these cloud variables"),
+        "notify_types" : jsonschema.Array(jsonschema.String(""), "Only deliver notifications of these types"),
+    }, "url"),
+    Response: okResponse(map[string]*jsonschema.Schema{
+        "webhook" : webhookSchema,
+        "secret" : jsonschema.String("Key that deliveries are signed with.  Only shown once."),
+    }),
+    Handler: POST_me_webhooks,
+}
+
+// Subscribe a URL to events from the logged-in account's devices.  Request:
+// {
+//      "url" : <URL>,
+//      "event_types" : ["sample", "notification", "connected", "disconnected"],
+//      "device_ids" : [<DEVICE_ID>, ...],
+//      "var_names" : [<CLOUD_VAR_NAME>, ...],
+//      "notify_types" : [<NOTIFY_TYPE>, ...]
+// }
+//
+// All fields except "url" are optional filters, and an omitted or empty
+// filter matches everything.  See package webhooks for the delivery format.
+// The signing secret is only returned once.
+func POST_me_webhooks(w http.ResponseWriter, r *http.Request, info adapter.CanopyRestInfo) (map[string]interface{}, rest_errors.CanopyRestError) {
+    if info.Account == nil {
+        return nil, rest_errors.NewNotLoggedInError()
+    }
+
+    urlString, ok := info.BodyObj["url"].(string)
+    if !ok {
+        return nil, rest_errors.NewBadInputFieldError("url", "String \"url\" expected")
+    }
+    err := webhooks.CheckURL(urlString)
+    if err != nil {
+        return nil, rest_errors.NewBadInputFieldError("url", err.Error())
+    }
+
+    hook := datalayer.Webhook{
+        Username: info.Account.Username(),
+        URL: urlString,
+    }
+    var restErr rest_errors.CanopyRestError
+    if hook.EventTypes, restErr = stringListField(info.BodyObj, "event_types"); restErr != nil {
+        return nil, restErr
+    }
+    for _, eventType := range hook.EventTypes {
+        if !webhooks.IsEventType(eventType) {
+            return nil, rest_errors.NewBadInputFieldError("event_types", "Unknown event type: " + eventType)
+        }
+    }
+    if hook.DeviceIDs, restErr = stringListField(info.BodyObj, "device_ids"); restErr != nil {
+        return nil, restErr
+    }
+    for _, deviceId := range hook.DeviceIDs {
+        if _, err := gocql.ParseUUID(deviceId); err != nil {
+            return nil, rest_errors.NewBadInputFieldError("device_ids", "Invalid device UUID: " + deviceId)
+        }
+    }
+    if hook.VarNames, restErr = stringListField(info.BodyObj, "var_names"); restErr != nil {
+        return nil, restErr
+    }
+    if hook.NotifyTypes, restErr = stringListField(info.BodyObj, "notify_types"); restErr != nil {
+        return nil, restErr
+    }
+
+    created, err := info.Conn.CreateWebhook(hook)
+    if err != nil {
+        return nil, rest_errors.NewInternalServerError("Problem creating webhook")
+    }
+
+    return map[string]interface{} {
+        "result" : "ok",
+        "webhook" : webhookJsonObj(*created),
+        "secret" : created.Secret,
+    }, nil
+}
+
+var DELETE_me_webhook__id_endpoint = adapter.Endpoint{
+    Method: "DELETE",
+    Path: "/me/webhook/{id}",
+    Summary: "Delete a webhook",
+    Auth: adapter.AccountAuth,
+    Response: okResponse(nil),
+    Handler: DELETE_me_webhook__id,
+}
+
+// Delete one of the logged-in account's webhooks, and its delivery history.
+func DELETE_me_webhook__id(w http.ResponseWriter, r *http.Request, info adapter.CanopyRestInfo) (map[string]interface{}, rest_errors.CanopyRestError) {
+    if info.Account == nil {
+        return nil, rest_errors.NewNotLoggedInError()
+    }
+
+    hook, err := info.Conn.LookupWebhook(info.Account.Username(), info.URLVars["id"])
+    if err != nil {
+        return nil, rest_errors.NewURLNotFoundError()
+    }
+
+    err = info.Conn.DeleteWebhook(hook.Username, hook.ID)
+    if err != nil {
+        return nil, rest_errors.NewInternalServerError("Problem deleting webhook")
+    }
+    return map[string]interface{} {
+        "result" : "ok",
+    }, nil
+}
+
+var GET_me_webhook__id__deliveries_endpoint = adapter.Endpoint{
+    Method: "GET",
+    Path: "/me/webhook/{id}/deliveries",
+    Summary: "Get a webhook's delivery history and dead-letter log",
+    Auth: adapter.AccountAuth,
+    Response: okResponse(map[string]*jsonschema.Schema{
+        "deliveries" : jsonschema.Array(webhookDeliverySchema, "Recent delivery attempts, newest first"),
+        "dead_letters" : jsonschema.Array(webhookDeliverySchema, "Recent events that could not be delivered, newest first"),
+    }),
+    Handler: GET_me_webhook__id__deliveries,
+}
+
+// Get the most recent delivery attempts and dead letters for one of the
+// logged-in account's webhooks.  The optional "limit" query parameter sets
+// how many of each are returned.
+func GET_me_webhook__id__deliveries(w http.ResponseWriter, r *http.Request, info adapter.CanopyRestInfo) (map[string]interface{}, rest_errors.CanopyRestError) {
+    if info.Account == nil {
+        return nil, rest_errors.NewNotLoggedInError()
+    }
+
+    hook, err := info.Conn.LookupWebhook(info.Account.Username(), info.URLVars["id"])
+    if err != nil {
+        return nil, rest_errors.NewURLNotFoundError()
+    }
+
+    limit := webhookDeliveriesDefaultLimit
+    if limitString := r.URL.Query().Get("limit"); limitString != "" {
+        limit, err = strconv.Atoi(limitString)
+        if err != nil || limit < 1 || limit > webhookDeliveriesMaxLimit {
+            return nil, rest_errors.NewBadInputFieldError("limit", "\"limit\" must be between 1 and " + strconv.Itoa(webhookDeliveriesMaxLimit))
+        }
+    }
+
+    deliveries, err := info.Conn.WebhookDeliveries(hook.ID, limit)
+    if err != nil {
+        return nil, rest_errors.NewInternalServerError("Problem reading webhook deliveries")
+    }
+    deadLetters, err := info.Conn.WebhookDeadLetters(hook.ID, limit)
+    if err != nil {
+        return nil, rest_errors.NewInternalServerError("Problem reading webhook dead letters")
+    }
+
+    return map[string]interface{} {
+        "result" : "ok",
+        "deliveries" : webhookDeliveriesJsonObj(deliveries),
+        "dead_letters" : webhookDeliveriesJsonObj(deadLetters),
+    }, nil
+}
@@ -0,0 +1,238 @@
+// Copyright 2015 SimpleThings, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rest
+
+import (
+    "canopy/rest/adapter"
+    "canopy/util/jsonschema"
+    "net/http"
+    "strings"
+)
+
+// OpenAPI 3 description of the REST API, generated from the endpoint
+// declarations.  It describes /api/v2; /api serves the same endpoints with
+// the older error format.
+
+// Security scheme names for each kind of credentials.
+var securitySchemeNames = map[adapter.CanopyRestAuthTypeEnum]string{
+    adapter.CANOPY_REST_AUTH_BASIC : "accountBasic",
+    adapter.CANOPY_REST_AUTH_DEVICE_BASIC : "deviceBasic",
+    adapter.CANOPY_REST_AUTH_SESSION : "session",
+    adapter.CANOPY_REST_AUTH_BEARER : "oauth2",
+}
+
+var securitySchemes = map[string]interface{}{
+    "accountBasic" : map[string]interface{}{
+        "type" : "http",
+        "scheme" : "basic",
+        "description" : "Username and password, or an app password if two-factor authentication is enabled",
+    },
+    "deviceBasic" : map[string]interface{}{
+        "type" : "http",
+        "scheme" : "basic",
+        "description" : "Device UUID and secret key",
+    },
+    "session" : map[string]interface{}{
+        "type" : "apiKey",
+        "in" : "cookie",
+        "name" : "canopy-login-session",
+    },
+    "oauth2" : map[string]interface{}{
+        "type" : "oauth2",
+        "flows" : map[string]interface{}{
+            "authorizationCode" : map[string]interface{}{
+                "authorizationUrl" : "/oauth/authorize",
+                "tokenUrl" : "/api/oauth/token",
+                "scopes" : map[string]interface{}{
+                    "read" : "Read devices and account details",
+                    "write" : "Control devices and change account details",
+                },
+            },
+        },
+    },
+}
+
+var errorSchema = jsonschema.Object(map[string]*jsonschema.Schema{
+    "result" : jsonschema.StringEnum("", "error"),
+    "error" : jsonschema.Object(map[string]*jsonschema.Schema{
+        "code" : jsonschema.String("Stable error code, such as \"bad_input\""),
+        "message" : jsonschema.String("Human-readable description"),
+        "status" : jsonschema.Integer("HTTP status"),
+        "request_id" : jsonschema.String("Also sent in the X-Request-Id header"),
+        "fields" : jsonschema.Array(jsonschema.Object(map[string]*jsonschema.Schema{
+            "field" : jsonschema.String("Path to the invalid field"),
+            "message" : jsonschema.String("What is wrong with it"),
+        }), "Validation problems with the request body"),
+    }, "code", "message", "status", "request_id"),
+}, "result", "error")
+
+// RFC 6749 section 5.2
+var oauthErrorSchema = jsonschema.Object(map[string]*jsonschema.Schema{
+    "error" : jsonschema.String("OAuth2 error code"),
+    "error_description" : jsonschema.String("Human-readable description"),
+}, "error")
+
+// Get the operationId for <ep>, which follows the handler naming
+// convention: "/device/{id}/{sensor}" becomes "device__id__sensor".
+func operationId(method string, ep adapter.Endpoint) string {
+    segments := []string{}
+    for _, segment := range strings.Split(strings.Trim(ep.Path, "/"), "/") {
+        if strings.HasPrefix(segment, "{") {
+            segment = "_" + strings.Trim(segment, "{}")
+        }
+        segments = append(segments, segment)
+    }
+    return method + "_" + strings.Join(segments, "_")
+}
+
+func pathParameters(path string) []interface{} {
+    params := []interface{}{}
+    for _, segment := range strings.Split(path, "/") {
+        if strings.HasPrefix(segment, "{") {
+            params = append(params, map[string]interface{}{
+                "name" : strings.Trim(segment, "{}"),
+                "in" : "path",
+                "required" : true,
+                "schema" : jsonschema.String(""),
+            })
+        }
+    }
+    return params
+}
+
+func operation(method string, ep adapter.Endpoint) map[string]interface{} {
+    errorRef := "#/components/schemas/Error"
+    if ep.Unversioned {
+        errorRef = "#/components/schemas/OAuthError"
+    }
+
+    contentType := "application/json"
+    if ep.ResponseContentType != "" {
+        contentType = ep.ResponseContentType
+    }
+
+    op := map[string]interface{}{
+        "operationId" : operationId(method, ep),
+        "summary" : ep.Summary,
+        "responses" : map[string]interface{}{
+            "200" : map[string]interface{}{
+                "description" : "Success",
+                "content" : map[string]interface{}{
+                    contentType : map[string]interface{}{"schema" : ep.Response},
+                },
+            },
+            "default" : map[string]interface{}{
+                "description" : "Error",
+                "content" : map[string]interface{}{
+                    "application/json" : map[string]interface{}{
+                        "schema" : map[string]interface{}{"$ref" : errorRef},
+                    },
+                },
+            },
+        },
+    }
+    if ep.Description != "" {
+        op["description"] = ep.Description
+    }
+    if params := pathParameters(ep.Path); len(params) > 0 {
+        op["parameters"] = params
+    }
+
+    if ep.Body != nil {
+        content := map[string]interface{}{
+            "application/json" : map[string]interface{}{"schema" : ep.Body},
+        }
+        if ep.FormEncoded {
+            content["application/x-www-form-urlencoded"] = map[string]interface{}{"schema" : ep.Body}
+        }
+        op["requestBody"] = map[string]interface{}{
+            "required" : len(ep.Body.Required) > 0,
+            "content" : content,
+        }
+    }
+
+    // Read-only OAuth2 tokens may only be used for GET requests.
+    scope := "write"
+    if method == "GET" {
+        scope = "read"
+    }
+    security := []interface{}{}
+    for _, authType := range ep.Auth {
+        scopes := []string{}
+        if authType == adapter.CANOPY_REST_AUTH_BEARER {
+            scopes = append(scopes, scope)
+        }
+        security = append(security, map[string]interface{}{
+            securitySchemeNames[authType] : scopes,
+        })
+    }
+    op["security"] = security
+
+    return op
+}
+
+func openAPIDocument(eps []adapter.Endpoint) map[string]interface{} {
+    paths := map[string]interface{}{}
+    for _, ep := range eps {
+        pathItem, ok := paths[ep.Path].(map[string]interface{})
+        if !ok {
+            pathItem = map[string]interface{}{}
+            paths[ep.Path] = pathItem
+        }
+        if ep.Unversioned {
+            pathItem["servers"] = []interface{}{
+                map[string]interface{}{"url" : "/api"},
+            }
+        }
+
+        methods := []string{ep.Method}
+        if ep.Method == "" {
+            methods = []string{"GET", "POST"}
+        }
+        for _, method := range methods {
+            pathItem[strings.ToLower(method)] = operation(method, ep)
+        }
+    }
+
+    return map[string]interface{}{
+        "openapi" : "3.0.3",
+        "info" : map[string]interface{}{
+            "title" : "Canopy Cloud Service REST API",
+            "version" : "2",
+        },
+        "servers" : []interface{}{
+            map[string]interface{}{"url" : "/api/v2"},
+            map[string]interface{}{
+                "url" : "/api",
+                "description" : "Legacy error format",
+            },
+        },
+        "paths" : paths,
+        "components" : map[string]interface{}{
+            "schemas" : map[string]interface{}{
+                "Error" : errorSchema,
+                "OAuthError" : oauthErrorSchema,
+            },
+            "securitySchemes" : securitySchemes,
+        },
+    }
+}
+
+func openAPIHandler(spec []byte) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "application/json")
+        w.Write(spec)
+    }
+}
@@ -14,31 +14,86 @@
 package rest_errors
 
 import(
+    "encoding/json"
     "net/http"
-    "fmt"
+    "strconv"
+    "time"
 )
 
 type CanopyRestError interface {
-    // Set error headers and payload depending on the error that occured
+    // Get the status, stable error code and other details used to report
+    // this error in the /api/v2 error envelope.
+    Details() ErrorDetails
+
+    // Set error headers and payload depending on the error that occured.
+    // This is the /api (v1) format.
     WriteTo(http.ResponseWriter)
 }
+
+// Write an /api (v1) error response.  <body> is marshalled rather than
+// formatted, since messages may contain quotes or echo request input.
+func writeV1(w http.ResponseWriter, status int, body map[string]interface{}) {
+    out, err := json.MarshalIndent(body, "", "    ")
+    if err != nil {
+        out = []byte(`{"result" : "error", "error_type" : "internal_error"}`)
+    }
+    w.WriteHeader(status)
+    w.Write(out)
+}
+
 // BadInputError
+// <fields> optionally identifies which request fields were invalid.
 type BadInputError struct {
     msg string
+    fields []FieldError
+}
+func (err BadInputError) Details() ErrorDetails {
+    return ErrorDetails{
+        Status: http.StatusBadRequest,
+        Code: "bad_input",
+        Message: err.msg,
+        Fields: err.fields,
+    }
 }
 func (err BadInputError) WriteTo(w http.ResponseWriter) {
-    w.WriteHeader(http.StatusBadRequest);
-    fmt.Fprintf(w, `{"result" : "error", "error_type" : "bad_input", "error_msg" : "%s"}`, err.msg)
+    writeV1(w, http.StatusBadRequest, map[string]interface{}{
+        "result" : "error",
+        "error_type" : "bad_input",
+        "error_msg" : err.msg,
+    })
 }
 func NewBadInputError(msg string) CanopyRestError {
-    return &BadInputError{msg}
+    return &BadInputError{msg: msg}
+}
+// Report a problem with request field <field>.  <msg> is reported as the
+// overall error message too, so it should name the field.
+func NewBadInputFieldError(field, msg string) CanopyRestError {
+    return &BadInputError{msg: msg, fields: []FieldError{{field, msg}}}
+}
+// Report problems with several request fields.  The first one's message is
+// used as the overall error message.
+func NewBadInputFieldsError(fields []FieldError) CanopyRestError {
+    msg := "Invalid request body"
+    if len(fields) > 0 {
+        msg = fields[0].Message
+    }
+    return &BadInputError{msg: msg, fields: fields}
 }
 
 // DatabaseConnectionError
 type DatabaseConnectionError struct {}
+func (DatabaseConnectionError) Details() ErrorDetails {
+    return ErrorDetails{
+        Status: http.StatusServiceUnavailable,
+        Code: "could_not_connect_to_database",
+        Message: "Could not connect to database",
+    }
+}
 func (DatabaseConnectionError) WriteTo(w http.ResponseWriter) {
-    w.WriteHeader(http.StatusInternalServerError);
-    fmt.Fprintf(w, `{"result" : "error", "error_type" : "could_not_connect_to_database"}`)
+    writeV1(w, http.StatusInternalServerError, map[string]interface{}{
+        "result" : "error",
+        "error_type" : "could_not_connect_to_database",
+    })
 }
 func NewDatabaseConnectionError() CanopyRestError {
     return &DatabaseConnectionError{}
@@ -46,9 +101,18 @@ func NewDatabaseConnectionError() CanopyRestError {
 
 // EmailTakenError
 type EmailTakenError struct {}
+func (EmailTakenError) Details() ErrorDetails {
+    return ErrorDetails{
+        Status: http.StatusConflict,
+        Code: "email_taken",
+        Message: "Email address is already in use",
+    }
+}
 func (EmailTakenError) WriteTo(w http.ResponseWriter) {
-    w.WriteHeader(http.StatusBadRequest);
-    fmt.Fprintf(w, `{"result" : "error", "error_type" : "email_taken"}`)
+    writeV1(w, http.StatusBadRequest, map[string]interface{}{
+        "result" : "error",
+        "error_type" : "email_taken",
+    })
 }
 func NewEmailTakenError() CanopyRestError {
     return &EmailTakenError{}
@@ -58,41 +122,309 @@ func NewEmailTakenError() CanopyRestError {
 type IncorrectUsernameOrPasswordError struct {
     msg string
 }
+func (IncorrectUsernameOrPasswordError) Details() ErrorDetails {
+    return ErrorDetails{
+        Status: http.StatusUnauthorized,
+        Code: "incorrect_username_or_password",
+        Message: "Incorrect username or password",
+    }
+}
 func (err IncorrectUsernameOrPasswordError) WriteTo(w http.ResponseWriter) {
-    w.WriteHeader(http.StatusUnauthorized);
-    fmt.Fprintf(w, `{"result" : "error", "error_type" : "incorrect_username_or_password"}`)
+    writeV1(w, http.StatusUnauthorized, map[string]interface{}{
+        "result" : "error",
+        "error_type" : "incorrect_username_or_password",
+    })
 }
 func NewIncorrectUsernameOrPasswordError() CanopyRestError {
     return &IncorrectUsernameOrPasswordError{}
 }
 
+// IncorrectTOTPCodeError
+type IncorrectTOTPCodeError struct {}
+func (IncorrectTOTPCodeError) Details() ErrorDetails {
+    return ErrorDetails{
+        Status: http.StatusUnauthorized,
+        Code: "incorrect_totp_code",
+        Message: "Incorrect two-factor authentication code",
+    }
+}
+func (IncorrectTOTPCodeError) WriteTo(w http.ResponseWriter) {
+    writeV1(w, http.StatusUnauthorized, map[string]interface{}{
+        "result" : "error",
+        "error_type" : "incorrect_totp_code",
+    })
+}
+func NewIncorrectTOTPCodeError() CanopyRestError {
+    return &IncorrectTOTPCodeError{}
+}
+
+// InsufficientScopeError
+type InsufficientScopeError struct {
+    msg string
+}
+func (err InsufficientScopeError) Details() ErrorDetails {
+    return ErrorDetails{
+        Status: http.StatusForbidden,
+        Code: "insufficient_scope",
+        Message: err.msg,
+        Headers: map[string]string{
+            "WWW-Authenticate" : `Bearer error="insufficient_scope"`,
+        },
+    }
+}
+func (err InsufficientScopeError) WriteTo(w http.ResponseWriter) {
+    w.Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope"`)
+    writeV1(w, http.StatusForbidden, map[string]interface{}{
+        "result" : "error",
+        "error_type" : "insufficient_scope",
+        "error_msg" : err.msg,
+    })
+}
+func NewInsufficientScopeError(msg string) CanopyRestError {
+    return &InsufficientScopeError{msg}
+}
+
 // InternalServerError
 type InternalServerError struct {
     msg string
 }
+func (err InternalServerError) Details() ErrorDetails {
+    return ErrorDetails{
+        Status: http.StatusInternalServerError,
+        Code: "internal_error",
+        Message: err.msg,
+    }
+}
 func (err InternalServerError) WriteTo(w http.ResponseWriter) {
-    w.WriteHeader(http.StatusInternalServerError);
-    fmt.Fprintf(w, `{"result" : "error", "error_type" : "internal_error", "error_msg" : "%s"}`, err.msg)
+    writeV1(w, http.StatusInternalServerError, map[string]interface{}{
+        "result" : "error",
+        "error_type" : "internal_error",
+        "error_msg" : err.msg,
+    })
 }
 func NewInternalServerError(msg string) CanopyRestError {
-    return &BadInputError{msg}
+    return &InternalServerError{msg}
+}
+
+// LegacyError
+// An error that /api has historically reported as {"error" : <legacyMsg>}
+// rather than in the usual format.  Kept so that existing /api clients see
+// the same responses, while /api/v2 reports it with a proper <code>.
+type LegacyError struct {
+    status int
+    code string
+    msg string
+    legacyMsg string
+}
+func (err LegacyError) Details() ErrorDetails {
+    return ErrorDetails{
+        Status: err.status,
+        Code: err.code,
+        Message: err.msg,
+    }
+}
+func (err LegacyError) WriteTo(w http.ResponseWriter) {
+    writeV1(w, err.status, map[string]interface{}{
+        "error" : err.legacyMsg,
+    })
+}
+func NewLegacyError(status int, code, msg, legacyMsg string) CanopyRestError {
+    return &LegacyError{status, code, msg, legacyMsg}
 }
 
 // NotLoggedInError
 type NotLoggedInError struct {}
+func (NotLoggedInError) Details() ErrorDetails {
+    return ErrorDetails{
+        Status: http.StatusUnauthorized,
+        Code: "not_logged_in",
+        Message: "Authentication required",
+    }
+}
 func (NotLoggedInError) WriteTo(w http.ResponseWriter) {
-    w.WriteHeader(http.StatusUnauthorized);
-    fmt.Fprintf(w, `{"result" : "error", "error_type" : "not_logged_in"}`)
+    writeV1(w, http.StatusUnauthorized, map[string]interface{}{
+        "result" : "error",
+        "error_type" : "not_logged_in",
+    })
 }
 func NewNotLoggedInError() CanopyRestError {
     return &NotLoggedInError{}
 }
 
+// OAuthError
+// Reported by the OAuth2 token endpoint, using the error format required by
+// RFC 6749 section 5.2.  <code> is one of the RFC's error codes, such as
+// "invalid_grant".
+type OAuthError struct {
+    code string
+    description string
+}
+func (err OAuthError) Details() ErrorDetails {
+    status := http.StatusBadRequest
+    if err.code == "invalid_client" {
+        status = http.StatusUnauthorized
+    }
+    return ErrorDetails{
+        Status: status,
+        Code: err.code,
+        Message: err.description,
+        Headers: map[string]string{
+            "Cache-Control" : "no-store",
+        },
+    }
+}
+func (err OAuthError) WriteTo(w http.ResponseWriter) {
+    w.Header().Set("Cache-Control", "no-store")
+    status := http.StatusBadRequest
+    if err.code == "invalid_client" {
+        status = http.StatusUnauthorized
+    }
+    writeV1(w, status, map[string]interface{}{
+        "error" : err.code,
+        "error_description" : err.description,
+    })
+}
+func NewOAuthError(code, description string) CanopyRestError {
+    return &OAuthError{code, description}
+}
+
+// PermissionDeniedError
+// The caller is authenticated, but lacks the access level needed for the
+// request, such as read-write access to a device.
+type PermissionDeniedError struct {
+    msg string
+}
+func (err PermissionDeniedError) Details() ErrorDetails {
+    return ErrorDetails{
+        Status: http.StatusForbidden,
+        Code: "permission_denied",
+        Message: err.msg,
+    }
+}
+func (err PermissionDeniedError) WriteTo(w http.ResponseWriter) {
+    writeV1(w, http.StatusForbidden, map[string]interface{}{
+        "result" : "error",
+        "error_type" : "permission_denied",
+        "error_msg" : err.msg,
+    })
+}
+func NewPermissionDeniedError(msg string) CanopyRestError {
+    return &PermissionDeniedError{msg}
+}
+
+// RateLimitExceededError
+// A rate limit or quota has been used up.  <limit> names which one.
+// <retryAfter> is 0 for limits that do not reset with time (such as the
+// maximum number of devices).
+type RateLimitExceededError struct {
+    limit string
+    retryAfter time.Duration
+}
+func (err RateLimitExceededError) Details() ErrorDetails {
+    details := ErrorDetails{
+        Status: http.StatusTooManyRequests,
+        Code: "rate_limit_exceeded",
+        Message: "Limit exceeded: " + err.limit,
+        Extra: map[string]interface{}{
+            "limit" : err.limit,
+            "retry_after" : retryAfterSeconds(err.retryAfter),
+        },
+    }
+    if err.retryAfter > 0 {
+        details.Headers = map[string]string{
+            "Retry-After" : strconv.Itoa(retryAfterSeconds(err.retryAfter)),
+        }
+    }
+    return details
+}
+func (err RateLimitExceededError) WriteTo(w http.ResponseWriter) {
+    seconds := retryAfterSeconds(err.retryAfter)
+    if seconds > 0 {
+        w.Header().Set("Retry-After", strconv.Itoa(seconds))
+    }
+    writeV1(w, http.StatusTooManyRequests, map[string]interface{}{
+        "result" : "error",
+        "error_type" : "rate_limit_exceeded",
+        "limit" : err.limit,
+        "retry_after" : seconds,
+    })
+}
+func NewRateLimitExceededError(limit string, retryAfter time.Duration) CanopyRestError {
+    return &RateLimitExceededError{limit, retryAfter}
+}
+
+// TOTPRequiredError
+// Password was correct, but the account has two-factor authentication
+// enabled and a "totp_code" must also be provided.
+type TOTPRequiredError struct {}
+func (TOTPRequiredError) Details() ErrorDetails {
+    return ErrorDetails{
+        Status: http.StatusUnauthorized,
+        Code: "totp_required",
+        Message: "Two-factor authentication code required",
+        Fields: []FieldError{{"totp_code", "Two-factor authentication code required"}},
+    }
+}
+func (TOTPRequiredError) WriteTo(w http.ResponseWriter) {
+    writeV1(w, http.StatusUnauthorized, map[string]interface{}{
+        "result" : "error",
+        "error_type" : "totp_required",
+    })
+}
+func NewTOTPRequiredError() CanopyRestError {
+    return &TOTPRequiredError{}
+}
+
+// TooManyAttemptsError
+// Too many failed authentication attempts from this client or against this
+// account.  <retryAfter> is how long the client must wait.
+type TooManyAttemptsError struct {
+    retryAfter time.Duration
+    locked bool
+}
+func (err TooManyAttemptsError) Details() ErrorDetails {
+    seconds := retryAfterSeconds(err.retryAfter)
+    return ErrorDetails{
+        Status: http.StatusTooManyRequests,
+        Code: "too_many_attempts",
+        Message: "Too many failed attempts",
+        Headers: map[string]string{
+            "Retry-After" : strconv.Itoa(seconds),
+        },
+        Extra: map[string]interface{}{
+            "account_locked" : err.locked,
+            "retry_after" : seconds,
+        },
+    }
+}
+func (err TooManyAttemptsError) WriteTo(w http.ResponseWriter) {
+    seconds := retryAfterSeconds(err.retryAfter)
+    w.Header().Set("Retry-After", strconv.Itoa(seconds))
+    writeV1(w, http.StatusTooManyRequests, map[string]interface{}{
+        "result" : "error",
+        "error_type" : "too_many_attempts",
+        "account_locked" : err.locked,
+        "retry_after" : seconds,
+    })
+}
+func NewTooManyAttemptsError(retryAfter time.Duration, locked bool) CanopyRestError {
+    return &TooManyAttemptsError{retryAfter, locked}
+}
+
 // URLNotFoundError
 type URLNotFoundError struct {}
+func (URLNotFoundError) Details() ErrorDetails {
+    return ErrorDetails{
+        Status: http.StatusNotFound,
+        Code: "url_not_found",
+        Message: "Not found",
+    }
+}
 func (URLNotFoundError) WriteTo(w http.ResponseWriter) {
-    w.WriteHeader(http.StatusNotFound);
-    fmt.Fprintf(w, `{"result" : "error", "error_type" : "url_not_found"}`)
+    writeV1(w, http.StatusNotFound, map[string]interface{}{
+        "result" : "error",
+        "error_type" : "url_not_found",
+    })
 }
 func NewURLNotFoundError() CanopyRestError {
     return &URLNotFoundError{}
@@ -100,9 +432,18 @@ func NewURLNotFoundError() CanopyRestError {
 
 // UsernameTakenError
 type UsernameTakenError struct {}
+func (UsernameTakenError) Details() ErrorDetails {
+    return ErrorDetails{
+        Status: http.StatusConflict,
+        Code: "username_taken",
+        Message: "Username is already in use",
+    }
+}
 func (UsernameTakenError) WriteTo(w http.ResponseWriter) {
-    w.WriteHeader(http.StatusBadRequest);
-    fmt.Fprintf(w, `{"result" : "error", "error_type" : "username_taken"}`)
+    writeV1(w, http.StatusBadRequest, map[string]interface{}{
+        "result" : "error",
+        "error_type" : "username_taken",
+    })
 }
 func NewUsernameTakenError() CanopyRestError {
     return &UsernameTakenError{}
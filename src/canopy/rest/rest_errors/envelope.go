@@ -0,0 +1,96 @@
+// Copyright 2015 SimpleThings, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rest_errors
+
+import (
+    "encoding/json"
+    "net/http"
+    "time"
+)
+
+// Errors reported by /api/v2 all use the same envelope:
+//
+//  {
+//      "result" : "error",
+//      "error" : {
+//          "code" : <CODE>,
+//          "message" : <HUMAN_READABLE_MESSAGE>,
+//          "status" : <HTTP_STATUS>,
+//          "request_id" : <REQUEST_ID>,
+//          "fields" : [{"field" : <FIELD>, "message" : <MSG>}, ...],
+//          ...
+//      }
+//  }
+//
+// <CODE> is stable and is what clients should check; the message may change.
+// "fields" is only present for validation errors.  Some errors include
+// extra members, such as "retry_after".
+
+// FieldError describes a problem with one field of the request body.
+type FieldError struct {
+    Field string `json:"field"`
+    Message string `json:"message"`
+}
+
+// ErrorDetails is everything needed to report an error in the /api/v2
+// envelope.
+type ErrorDetails struct {
+    Status int
+    Code string
+    Message string
+    Fields []FieldError
+
+    // Response headers to set, such as Retry-After.
+    Headers map[string]string
+
+    // Additional members of the "error" object.
+    Extra map[string]interface{}
+}
+
+// Write <err> to <w> using the /api/v2 error envelope.
+func WriteV2(w http.ResponseWriter, err CanopyRestError, requestId string) {
+    details := err.Details()
+
+    errObj := map[string]interface{}{}
+    for k, v := range details.Extra {
+        errObj[k] = v
+    }
+    errObj["code"] = details.Code
+    errObj["message"] = details.Message
+    errObj["status"] = details.Status
+    errObj["request_id"] = requestId
+    if len(details.Fields) > 0 {
+        errObj["fields"] = details.Fields
+    }
+
+    out, jsonErr := json.MarshalIndent(map[string]interface{}{
+        "result" : "error",
+        "error" : errObj,
+    }, "", "    ")
+    if jsonErr != nil {
+        out = []byte(`{"result" : "error", "error" : {"code" : "internal_error"}}`)
+    }
+
+    for k, v := range details.Headers {
+        w.Header().Set(k, v)
+    }
+    w.WriteHeader(details.Status)
+    w.Write(out)
+}
+
+// Round up to whole seconds, for Retry-After.
+func retryAfterSeconds(d time.Duration) int {
+    return int((d + time.Second - 1) / time.Second)
+}
@@ -0,0 +1,143 @@
+// Copyright 2015 SimpleThings, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+// Package throttle protects password and secret-key checks against
+// brute-force guessing.
+package throttle
+
+import (
+    "canopy/util/limiter"
+    "net"
+    "sync"
+    "time"
+)
+
+const (
+    // Failed attempts are counted over this trailing window.
+    FailureWindow = 15*time.Minute
+
+    // Number of failures (per IP address, or per account) allowed before
+    // exponential backoff kicks in.
+    FreeFailures = 3
+
+    // Backoff starts at BackoffBase and doubles with each further failure,
+    // up to BackoffMax.
+    BackoffBase = 1*time.Second
+    BackoffMax = 5*time.Minute
+
+    // After this many failures against one account within FailureWindow,
+    // the account is locked for LockoutDuration.  Correct passwords are
+    // rejected during the lockout.
+    LockoutThreshold = 10
+    LockoutDuration = 30*time.Minute
+)
+
+// LoginThrottle tracks failed authentication attempts per client IP address
+// and per account.  It is safe for concurrent use.
+type LoginThrottle struct {
+    mu sync.Mutex
+    ipFailures *limiter.SlidingWindow
+    accountFailures *limiter.SlidingWindow
+    lockedUntil map[string]time.Time
+}
+
+func NewLoginThrottle() *LoginThrottle {
+    return &LoginThrottle{
+        ipFailures: limiter.NewSlidingWindow(FailureWindow),
+        accountFailures: limiter.NewSlidingWindow(FailureWindow),
+        lockedUntil: map[string]time.Time{},
+    }
+}
+
+// Get the IP address portion of an http.Request's RemoteAddr.
+func ClientIP(remoteAddr string) string {
+    host, _, err := net.SplitHostPort(remoteAddr)
+    if err != nil {
+        return remoteAddr
+    }
+    return host
+}
+
+// Remaining backoff delay for <key>, given its failure history.
+func backoffRemaining(counter *limiter.SlidingWindow, key string, now time.Time) time.Duration {
+    failures := counter.Count(key, now)
+    delay := limiter.Backoff(failures, FreeFailures, BackoffBase, BackoffMax)
+    if delay == 0 {
+        return 0
+    }
+    _, lastFailure := counter.Span(key, now)
+    remaining := lastFailure.Add(delay).Sub(now)
+    if remaining < 0 {
+        return 0
+    }
+    return remaining
+}
+
+// Check whether an authentication attempt from <ip> against <account> may
+// proceed.  <account> is the canonical username, or "" if not known or if
+// only the IP address should be checked.  Returns 0 if the attempt may
+// proceed, otherwise how long the client must wait, and whether that is
+// because the account is locked out.
+func (t *LoginThrottle) Check(ip, account string) (time.Duration, bool) {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    now := time.Now()
+
+    if account != "" {
+        until, ok := t.lockedUntil[account]
+        if ok {
+            if now.Before(until) {
+                return until.Sub(now), true
+            }
+            delete(t.lockedUntil, account)
+        }
+    }
+
+    wait := backoffRemaining(t.ipFailures, ip, now)
+    if account != "" {
+        accountWait := backoffRemaining(t.accountFailures, account, now)
+        if accountWait > wait {
+            wait = accountWait
+        }
+    }
+    return wait, false
+}
+
+// Record a failed attempt.  Returns true if this failure caused <account>
+// to be locked out, in which case the caller should notify the account
+// holder.
+func (t *LoginThrottle) RecordFailure(ip, account string) bool {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    now := time.Now()
+
+    t.ipFailures.Add(ip, now)
+    if account == "" {
+        return false
+    }
+    if t.accountFailures.Add(account, now) < LockoutThreshold {
+        return false
+    }
+    t.accountFailures.Reset(account)
+    t.lockedUntil[account] = now.Add(LockoutDuration)
+    return true
+}
+
+// Record a successful attempt, clearing the account's failure history.  The
+// IP address's history is kept, so that an attacker cannot reset their
+// backoff by logging in to their own account.
+func (t *LoginThrottle) RecordSuccess(ip, account string) {
+    t.accountFailures.Reset(account)
+}
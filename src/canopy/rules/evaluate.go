@@ -0,0 +1,128 @@
+// Copyright 2015 SimpleThings, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rules
+
+import (
+    "canopy/cloudvar"
+    "canopy/datalayer"
+    "time"
+)
+
+func compare(x float64, operator string, threshold float64) bool {
+    switch operator {
+    case ">":
+        return x > threshold
+    case ">=":
+        return x >= threshold
+    case "<":
+        return x < threshold
+    case "<=":
+        return x <= threshold
+    case "==":
+        return x == threshold
+    case "!=":
+        return x != threshold
+    }
+    return false
+}
+
+// Does <x> meet a threshold or rate rule's condition?  While the rule is
+// firing, the threshold is moved back by the rule's hysteresis, so that the
+// rule only clears once the value has moved clear of it.
+func meetsCondition(rule *datalayer.AlarmRule, x float64) bool {
+    threshold := rule.Threshold
+    if rule.Firing {
+        switch rule.Operator {
+        case ">", ">=":
+            threshold -= rule.Hysteresis
+        case "<", "<=":
+            threshold += rule.Hysteresis
+        }
+    }
+    return compare(x, rule.Operator, threshold)
+}
+
+// Fire <rule> if its condition has held for long enough.  Returns true if it
+// fired.
+func checkDuration(rule *datalayer.AlarmRule, now time.Time) bool {
+    if rule.Firing || rule.PendingSince.IsZero() || now.Sub(rule.PendingSince) < rule.Duration {
+        return false
+    }
+    rule.Firing = true
+    rule.LastFired = now
+    return true
+}
+
+// Update <rule>'s state for a sample of its Cloud Variable.  Returns true if
+// the rule fires.
+func onSample(rule *datalayer.AlarmRule, value interface{}, t time.Time) bool {
+    x, ok := cloudvar.ToFloat64(value)
+    prevValue, prevTime := rule.LastValue, rule.LastSampleTime
+    // LastSampleTime is the time of LastValue, so that rates are measured
+    // between numeric samples.  Stale data rules count every sample.
+    if ok {
+        rule.LastValue = x
+        rule.LastSampleTime = t
+    } else if rule.Type == datalayer.AlarmRuleStaleData {
+        rule.LastSampleTime = t
+    }
+
+    var active bool
+    switch rule.Type {
+    case datalayer.AlarmRuleThreshold:
+        active = ok && meetsCondition(rule, x)
+    case datalayer.AlarmRuleRateOfChange:
+        if !ok || prevTime.IsZero() || !t.After(prevTime) {
+            // Need two samples to measure a rate.  Leave the state as-is.
+            return false
+        }
+        active = meetsCondition(rule, (x - prevValue) / t.Sub(prevTime).Minutes())
+    case datalayer.AlarmRuleBoolean:
+        active = ok && (x != 0) == rule.BoolValue
+    default:
+        // Any sample clears a stale data rule.
+        active = false
+    }
+
+    if !active {
+        rule.Firing = false
+        rule.PendingSince = time.Time{}
+        return false
+    }
+    if rule.PendingSince.IsZero() {
+        rule.PendingSince = t
+    }
+    return checkDuration(rule, t)
+}
+
+// Update <rule>'s state for the passage of time.  Returns true if the rule
+// fires.
+func onTick(rule *datalayer.AlarmRule, now time.Time) bool {
+    if rule.Type != datalayer.AlarmRuleStaleData {
+        return checkDuration(rule, now)
+    }
+
+    lastSeen := rule.LastSampleTime
+    if lastSeen.IsZero() {
+        lastSeen = rule.Created
+    }
+    if rule.Firing || now.Sub(lastSeen) < rule.Duration {
+        return false
+    }
+    rule.PendingSince = lastSeen
+    rule.Firing = true
+    rule.LastFired = now
+    return true
+}
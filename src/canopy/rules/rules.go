@@ -0,0 +1,211 @@
+// Copyright 2015 SimpleThings, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+// Package rules evaluates alarm rules (see datalayer.AlarmRule) on the
+// server, so that users can be alerted about conditions that devices don't
+// report themselves, such as "temperature > 40 for 5 minutes" or "no data
+// for an hour".
+//
+// Rules are evaluated against every sample published on the events hub, and
+// once a minute for rules that fire after a duration, or when data is stale.
+// When a rule fires it raises a notification from its device through
+// notify.ProcessNotification, which also publishes it to SSE streams and
+// webhooks.  Rule state is kept in the database, so several servers can
+// evaluate the same rules and a rule only fires once.
+package rules
+
+import (
+    "canopy/canolog"
+    "canopy/config"
+    "canopy/datalayer"
+    "canopy/datalayer/cassandra_datalayer"
+    "canopy/events"
+    "canopy/notify"
+    "fmt"
+    "github.com/gocql/gocql"
+    "time"
+)
+
+// Valid values for AlarmRule fields.
+var (
+    Types = []string{
+        datalayer.AlarmRuleThreshold,
+        datalayer.AlarmRuleRateOfChange,
+        datalayer.AlarmRuleStaleData,
+        datalayer.AlarmRuleBoolean,
+    }
+    Operators = []string{">", ">=", "<", "<=", "==", "!="}
+)
+
+const (
+    // How often rules are checked for durations that have passed and for
+    // stale data.
+    tickInterval = time.Minute
+
+    // Number of samples waiting to be evaluated before new samples are
+    // dropped.
+    sampleQueueSize = 1000
+)
+
+// Engine evaluates alarm rules.  There should be one per server process.
+type Engine struct {
+    cfg config.Config
+    conn datalayer.Connection
+    hub *events.Hub
+    senders *notify.Senders
+    samples chan events.Event
+
+    // Time of the last successful check for due rules.
+    lastTick time.Time
+}
+
+func NewEngine(cfg config.Config, senders *notify.Senders) *Engine {
+    return &Engine{
+        cfg: cfg,
+        senders: senders,
+        samples: make(chan events.Event, sampleQueueSize),
+    }
+}
+
+// Connect to the database and start evaluating rules against the samples
+// published on <hub>.  Notifications raised by rules are published on
+// <hub> too.
+func (e *Engine) Start(hub *events.Hub) error {
+    dl := cassandra_datalayer.NewDatalayer(e.cfg)
+    conn, err := dl.Connect("canopy")
+    if err != nil {
+        return err
+    }
+    e.conn = conn
+    e.hub = hub
+    e.lastTick = time.Now().Add(-datalayer.DueIndexLookback)
+
+    go e.run()
+    hub.AddListener(e.enqueue)
+    return nil
+}
+
+// Hub listener.  Runs in the publisher's goroutine, so must not block.
+func (e *Engine) enqueue(event events.Event) {
+    if event.Type != events.TypeSample {
+        return
+    }
+    select {
+    case e.samples <- event:
+    default:
+        canolog.Warn("Alarm rule sample queue full.  Dropping event ", event.ID)
+    }
+}
+
+func (e *Engine) run() {
+    ticker := time.NewTicker(tickInterval)
+    for {
+        select {
+        case event := <-e.samples:
+            e.handleSample(event)
+        case now := <-ticker.C:
+            e.tick(now)
+        }
+    }
+}
+
+func (e *Engine) handleSample(event events.Event) {
+    deviceId, err := gocql.ParseUUID(event.DeviceID)
+    if err != nil {
+        return
+    }
+    varName, _ := event.Data["var"].(string)
+
+    rules, err := e.conn.AlarmRules(deviceId)
+    if err != nil {
+        canolog.Error("Error looking up alarm rules for device ", event.DeviceID, ": ", err)
+        return
+    }
+    for _, rule := range rules {
+        if rule.VarName != varName {
+            continue
+        }
+        before := rule
+        fire := onSample(&rule, event.Data["v"], event.Time)
+
+        // Most samples only move the rule's last sample, which needs no
+        // lightweight transaction.
+        if rule.LastValue != before.LastValue || !rule.LastSampleTime.Equal(before.LastSampleTime) {
+            e.conn.SaveAlarmRuleSample(rule)
+        }
+        if rule.Firing != before.Firing ||
+                !rule.PendingSince.Equal(before.PendingSince) ||
+                !rule.LastFired.Equal(before.LastFired) {
+            e.save(rule, before.Firing, fire)
+        }
+    }
+}
+
+func (e *Engine) tick(now time.Time) {
+    rules, err := e.conn.DueAlarmRules(e.lastTick, now)
+    if err != nil {
+        canolog.Error("Error reading alarm rules: ", err)
+        return
+    }
+    e.lastTick = now
+    for _, rule := range rules {
+        wasFiring := rule.Firing
+        if onTick(&rule, now) {
+            e.save(rule, wasFiring, true)
+        }
+    }
+}
+
+// Save <rule>'s new state, and raise its notification if it fired (and
+// another server didn't get there first).
+func (e *Engine) save(rule datalayer.AlarmRule, wasFiring, fire bool) {
+    applied, err := e.conn.SaveAlarmRuleState(rule, wasFiring)
+    if err != nil || !applied || !fire {
+        return
+    }
+
+    device, err := e.conn.LookupDevice(rule.DeviceID)
+    if err != nil {
+        canolog.Error("Error looking up device for alarm rule ", rule.ID, ": ", err)
+        return
+    }
+    canolog.Info("Alarm rule ", rule.ID, " fired for device ", device.IDString())
+    err = notify.ProcessNotification(e.cfg, e.conn, e.hub, e.senders, device, rule.NotifyType, Message(rule))
+    if err != nil {
+        canolog.Error("Error raising notification for alarm rule ", rule.ID, ": ", err)
+    }
+}
+
+// Get the notification message for <rule> firing.
+func Message(rule datalayer.AlarmRule) string {
+    if rule.Message != "" {
+        return rule.Message
+    }
+    name := rule.Name
+    if name == "" {
+        name = rule.VarName
+    }
+    switch rule.Type {
+    case datalayer.AlarmRuleThreshold:
+        return fmt.Sprintf("%s: %s is %g (alarm when %s %g)", name, rule.VarName, rule.LastValue, rule.Operator, rule.Threshold)
+    case datalayer.AlarmRuleRateOfChange:
+        return fmt.Sprintf("%s: %s is changing by %s %g per minute", name, rule.VarName, rule.Operator, rule.Threshold)
+    case datalayer.AlarmRuleStaleData:
+        return fmt.Sprintf("%s: no data for %s in %s", name, rule.VarName, rule.Duration)
+    case datalayer.AlarmRuleBoolean:
+        return fmt.Sprintf("%s: %s is %t", name, rule.VarName, rule.BoolValue)
+    }
+    return name
+}
@@ -0,0 +1,212 @@
+// Copyright 2015 SimpleThings, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+
+// Package scheduler makes scheduled writes to Cloud Variables (see
+// datalayer.Schedule), such as "turn the relay off at 22:00 every weekday"
+// or "set the thermostat to 18 in 2 hours".
+//
+// A scheduled write is delivered the same way as a POST /api/device/<id>
+// request: the values are stored as samples, and sent to the device over
+// its websocket if it is connected to this server.  Schedules are kept in
+// the database, so they survive restarts.  Several servers may run
+// schedulers; each run is claimed with a conditional update, so only one of
+// them delivers it.
+package scheduler
+
+import (
+    "canopy/canolog"
+    "canopy/cloudvar"
+    "canopy/config"
+    "canopy/datalayer"
+    "canopy/datalayer/cassandra_datalayer"
+    "canopy/events"
+    "canopy/pigeon"
+    "canopy/service"
+    "canopy/sddl"
+    "canopy/util/cron"
+    "fmt"
+    "time"
+)
+
+const (
+    // How often the scheduler looks for schedules that are due.
+    tickInterval = 15*time.Second
+
+    // Runs that are overdue by more than this, for example because no
+    // server was running at the time, are skipped rather than delivered
+    // late.
+    MissedRunLimit = time.Hour
+
+    // How long to wait for the device's websocket to accept a write.
+    sendTimeout = 100*time.Millisecond
+)
+
+// Scheduler runs due schedules.  There should be one per server process.
+type Scheduler struct {
+    cfg config.Config
+    conn datalayer.Connection
+    hub *events.Hub
+    pigeonSys *pigeon.PigeonSystem
+
+    // Time of the last successful check for due schedules.
+    lastTick time.Time
+}
+
+func NewScheduler(cfg config.Config, pigeonSys *pigeon.PigeonSystem) *Scheduler {
+    return &Scheduler{
+        cfg: cfg,
+        pigeonSys: pigeonSys,
+    }
+}
+
+// Connect to the database and start running schedules.  Samples written by
+// schedules are published on <hub>.
+func (s *Scheduler) Start(hub *events.Hub) error {
+    dl := cassandra_datalayer.NewDatalayer(s.cfg)
+    conn, err := dl.Connect("canopy")
+    if err != nil {
+        return err
+    }
+    s.conn = conn
+    s.hub = hub
+    s.lastTick = time.Now().Add(-datalayer.DueIndexLookback)
+
+    go s.run()
+    return nil
+}
+
+func (s *Scheduler) run() {
+    ticker := time.NewTicker(tickInterval)
+    for now := range ticker.C {
+        s.tick(now)
+    }
+}
+
+func (s *Scheduler) tick(now time.Time) {
+    schedules, err := s.conn.DueSchedules(s.lastTick, now)
+    if err != nil {
+        canolog.Error("Error reading schedules: ", err)
+        return
+    }
+    s.lastTick = now
+    for _, schedule := range schedules {
+        if schedule.NextRun.IsZero() || schedule.NextRun.After(now) {
+            continue
+        }
+        s.runDue(schedule, now)
+    }
+}
+
+// Claim and deliver the run of <schedule> that is due at schedule.NextRun.
+func (s *Scheduler) runDue(schedule datalayer.Schedule, now time.Time) {
+    nextRun, err := NextRun(schedule, now)
+    if err != nil {
+        // Shouldn't happen, since schedules are validated when saved.
+        // Stop the schedule rather than retrying it every tick.
+        canolog.Error("Invalid schedule ", schedule.ID, ": ", err)
+        nextRun = time.Time{}
+    }
+
+    claimed, err := s.conn.ClaimScheduleRun(schedule, nextRun, now)
+    if err != nil || !claimed {
+        return
+    }
+
+    errMsg := ""
+    if now.Sub(schedule.NextRun) > MissedRunLimit {
+        canolog.Warn("Skipping missed run of schedule ", schedule.ID, " due at ", schedule.NextRun)
+        errMsg = fmt.Sprintf("Run due at %s was missed", schedule.NextRun.Format(time.RFC3339))
+    } else if err = s.deliver(schedule, now); err != nil {
+        canolog.Error("Error running schedule ", schedule.ID, ": ", err)
+        errMsg = err.Error()
+    }
+    s.conn.RecordScheduleResult(schedule.DeviceID, schedule.ID, errMsg)
+}
+
+// Write <schedule>'s values to its device.
+func (s *Scheduler) deliver(schedule datalayer.Schedule, now time.Time) error {
+    device, err := s.conn.LookupDevice(schedule.DeviceID)
+    if err != nil {
+        return fmt.Errorf("Device lookup failed: %s", err)
+    }
+    canolog.Info("Running schedule ", schedule.ID, " for device ", device.IDString())
+
+    numStored, err := service.StoreCloudVars(s.hub, device, schedule.Vars, now)
+    if err != nil {
+        return err
+    }
+    if numStored != len(schedule.Vars) {
+        return fmt.Errorf("Stored %d of %d Cloud Variables", numStored, len(schedule.Vars))
+    }
+
+    msg := &pigeon.PigeonMessage {
+        Data : map[string]interface{} {
+            "vars" : schedule.Vars,
+        },
+    }
+    err = s.pigeonSys.SendMessage(device.IDString(), msg, sendTimeout)
+    if err != nil {
+        // The device may be offline, or connected to another server.  It
+        // can still read the stored values.
+        canolog.Warn("Problem sending WS message for schedule ", schedule.ID, ": ", err)
+    }
+    return nil
+}
+
+// Get the time of the first run of <schedule> after <after>, or zero for a
+// one-shot schedule, which has no further runs.
+func NextRun(schedule datalayer.Schedule, after time.Time) (time.Time, error) {
+    if schedule.Cron == "" {
+        return time.Time{}, nil
+    }
+    c, err := cron.Parse(schedule.Cron)
+    if err != nil {
+        return time.Time{}, err
+    }
+    loc, err := time.LoadLocation(schedule.TimeZone)
+    if err != nil {
+        return time.Time{}, fmt.Errorf("Unknown time zone: %s", schedule.TimeZone)
+    }
+    next := c.Next(after.In(loc))
+    if next.IsZero() {
+        return time.Time{}, fmt.Errorf("Cron expression never matches: %s", schedule.Cron)
+    }
+    return next.UTC(), nil
+}
+
+// Check that <vars> can be written to <device> by a schedule: each must be
+// an existing, non-derived "in" or "inout" Cloud Variable, and each value
+// must suit its datatype.
+func ValidateVars(device datalayer.Device, vars map[string]interface{}) error {
+    if len(vars) == 0 {
+        return fmt.Errorf("No Cloud Variables to set")
+    }
+    for varName, value := range vars {
+        varDef, err := device.LookupVarDef(varName)
+        if err != nil {
+            return fmt.Errorf("Cloud Variable not found: %s", varName)
+        }
+        direction := varDef.Direction()
+        if (direction != sddl.DIRECTION_IN && direction != sddl.DIRECTION_INOUT) || varDef.Expression() != "" {
+            return fmt.Errorf("Cloud Variable %s is not an \"in\" or \"inout\" variable", varName)
+        }
+        _, err = cloudvar.JsonToCloudVarValue(varDef, value)
+        if err != nil {
+            return fmt.Errorf("Invalid value for %s: %s", varName, err)
+        }
+    }
+    return nil
+}
@@ -16,9 +16,11 @@ package sddl
 
 import (
     "canopy/canolog"
+    "canopy/util/expr"
     "errors"
     "fmt"
     "encoding/json"
+    "sort"
     "strings"
 )
 
@@ -36,6 +38,7 @@ type SDDLVarDef struct {
     datatype DatatypeEnum
     optionality OptionalityEnum
     direction DirectionEnum
+    expression string
     maxValue float64
     minValue float64
     numericDisplayHint NumericDisplayHintEnum
@@ -49,6 +52,75 @@ type SDDLVarDef struct {
 
 type SDDLSys struct {}
 
+// CycleError is returned when derived Cloud Variables' expressions depend
+// on each other in a cycle.  <Vars> lists the cycle, starting and ending
+// with the same Cloud Variable.
+type CycleError struct {
+    Vars []string
+}
+
+func (err *CycleError) Error() string {
+    return "Expressions depend on each other in a cycle: " + strings.Join(err.Vars, " -> ")
+}
+
+// Check that the expressions of the derived Cloud Variables in <varDefs>
+// don't depend on each other in a cycle.  Returns a *CycleError if they do.
+func checkExpressionCycles(varDefs []VarDef) error {
+    deps := map[string][]string{}
+    names := []string{}
+    for _, varDef := range varDefs {
+        if varDef.Expression() == "" {
+            continue
+        }
+        parsed, err := expr.Parse(varDef.Expression())
+        if err != nil {
+            return fmt.Errorf("Invalid expression for %s: %s", varDef.Name(), err)
+        }
+        deps[varDef.Name()] = parsed.Vars()
+        names = append(names, varDef.Name())
+    }
+    sort.Strings(names)
+
+    // Depth-first search.  Cloud Variables on the current path are
+    // "visiting"; a dependency on one of them closes a cycle.
+    const (
+        unvisited = iota
+        visiting
+        done
+    )
+    state := map[string]int{}
+    path := []string{}
+    var visit func(name string) error
+    visit = func(name string) error {
+        switch state[name] {
+        case visiting:
+            for i := range path {
+                if path[i] == name {
+                    return &CycleError{append(append([]string{}, path[i:]...), name)}
+                }
+            }
+        case done:
+            return nil
+        }
+        state[name] = visiting
+        path = append(path, name)
+        for _, dependency := range deps[name] {
+            if err := visit(dependency); err != nil {
+                return err
+            }
+        }
+        path = path[:len(path)-1]
+        state[name] = done
+        return nil
+    }
+    for _, name := range names {
+        if err := visit(name); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
 // Helper routine for parsing defininition keywords
 func keyTokenFromString(s string) (string, int, error) {
     switch s {
@@ -162,6 +234,20 @@ func ParseVar(decl string, defJson map[string]interface{}) (VarDef, error) {
             if !ok {
                 return nil, errors.New("Expected string for description")
             }
+        } else if k == "expression" {
+            varDef.expression, ok = v.(string)
+            if !ok {
+                return nil, errors.New("Expected string for expression")
+            }
+            parsed, err := expr.Parse(varDef.expression)
+            if err != nil {
+                return nil, fmt.Errorf("Invalid expression for %s: %s", name, err)
+            }
+            for _, dependency := range parsed.Vars() {
+                if dependency == name {
+                    return nil, fmt.Errorf("Expression for %s refers to itself", name)
+                }
+            }
         } else if k == "max-value" {
             varDef.maxValue, ok = v.(float64)
             if !ok {
@@ -214,7 +300,7 @@ func (sys *SDDLSys) ParseDocumentString(doc string) (Document, error) {
     var jsn map[string]interface{}
     err := json.Unmarshal([]byte(doc), &jsn)
     if err != nil {
-        canolog.Error("Error JSON decoding SDDL docoument: %s %s", doc, err)
+        canolog.Errorf("Error JSON decoding SDDL docoument: %s %s", doc, err)
         return nil, err
     }
     return sys.ParseDocument(jsn)
@@ -240,6 +326,14 @@ func (varDef *SDDLVarDef) Declaration() string {
     return varDef.decl
 }
 
+func (varDef *SDDLVarDef) Direction() DirectionEnum {
+    return varDef.direction
+}
+
+func (varDef *SDDLVarDef) Expression() string {
+    return varDef.expression
+}
+
 func (varDef *SDDLVarDef) Fullname() string {
     return varDef.name // TODO: implement correctly
 }
@@ -266,6 +360,10 @@ func (varDef *SDDLVarDef) jsonEncode() (map[string]interface{}, error) {
     }
     jsn["datatype"] = datatype
 
+    if varDef.expression != "" {
+        jsn["expression"] = varDef.expression
+    }
+
     // TODO: Don't always have these?
     if varDef.IsNumeric() {
         jsn["max-value"] = varDef.maxValue
@@ -432,6 +530,43 @@ func (doc *SDDLDocument) Description() string {
 func (doc *SDDLDocument) Extend(jsn map[string]interface{}) error {
     var ok bool
 
+    // Check the new and changed Cloud Variables against the rest of the
+    // document before changing anything.
+    newVars := map[string]VarDef{}
+    for k, v := range jsn {
+        if k == "authors" || k == "description" {
+            continue
+        }
+        vObj, ok := v.(map[string]interface{})
+        if !ok {
+            return errors.New("Expected object for variable metadata")
+        }
+        varDef, err := ParseVar(k, vObj)
+        if err != nil {
+            return err
+        }
+        newVars[k] = varDef
+    }
+    merged := []VarDef{}
+    for _, varDef := range doc.vars {
+        replaced := false
+        for _, newVar := range newVars {
+            if newVar.Name() == varDef.Name() {
+                replaced = true
+            }
+        }
+        if !replaced {
+            merged = append(merged, varDef)
+        }
+    }
+    for _, newVar := range newVars {
+        merged = append(merged, newVar)
+    }
+    err := checkExpressionCycles(merged)
+    if err != nil {
+        return err
+    }
+
     for k, v := range jsn {
         if k == "authors" {
             authorsList, ok := v.([]interface{})
@@ -452,15 +587,7 @@ func (doc *SDDLDocument) Extend(jsn map[string]interface{}) error {
                 return errors.New("Expected string for description")
             }
         } else {
-            vObj, ok := v.(map[string]interface{})
-            if !ok {
-                return errors.New("Expected object for variable metadata")
-            }
-            varDef, err := ParseVar(k, vObj);
-            if (err != nil) {
-                return err;
-            }
-
+            varDef := newVars[k]
             doc.RemoveVarDef(varDef.Name()) // If var already exists, remove it first
             doc.vars = append(doc.vars, varDef);
             
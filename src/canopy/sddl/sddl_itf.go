@@ -82,6 +82,7 @@ type SDDL interface {
     //          "min-value" : -100,
     //          "max-value" : 150,
     //          "units" : "degrees_c",
+    //          "expression" : "(temperature_f - 32) * 5 / 9",
     //          ...
     //      }
     ParseVarDef(decl string, propsJson map[string]interface{}) (*VarDef, error)
@@ -110,6 +111,17 @@ type VarDef interface {
     // Get the full declaration string, ex: "optional out float32 temperature"
     Declaration() string
 
+    // Get the direction of this Cloud Variable, ex: DIRECTION_IN for a
+    // Cloud Variable that the cloud sets and the device reads.
+    Direction() DirectionEnum
+
+    // Get the "expression" property, ex: "temperature - (100 - humidity) / 5".
+    // Derived Cloud Variables have an expression (see package util/expr),
+    // and are computed by the server from the device's other Cloud
+    // Variables instead of being reported by the device.  Returns "" for
+    // ordinary Cloud Variables.
+    Expression() string
+
     // Get full name of this Cloud Variable, ex: "temperature", "gps.longitude"
     Fullname() string
 
@@ -21,6 +21,10 @@ import (
     "canopy/config"
     "canopy/datalayer"
     "canopy/datalayer/cassandra_datalayer"
+    "canopy/derived"
+    "canopy/events"
+    "canopy/notify"
+    "canopy/quota"
     "canopy/sddl"
     "time"
     "github.com/gocql/gocql"
@@ -48,10 +52,20 @@ type ServiceResponse struct {
 //                "latitude" : 38.0f;
 //                "longitude" : 38.0f;
 //            }
+//        },
+//        "notify" : {
+//            "type" : "high-priority",
+//            "msg" : "Smoke detected"
 //        }
 //    }
 //  }
 //
+//  <hub> receives events for the new samples, SDDL changes and
+//  notifications.  May be nil.
+//
+//  <senders> deliver notifications raised by the payload's "notify" field
+//  (see RaiseNotifications).  May be nil.
+//
 //  <conn> is an optional datalayer connection.  If provided, it is used.
 //  Otherwise, a datalayer connection is opened by this routine.
 //
@@ -69,6 +83,8 @@ type ServiceResponse struct {
 //  <payload> is a string containing the JSON payload.
 func ProcessDeviceComm(
         cfg config.Config,
+        hub *events.Hub,
+        senders *notify.Senders,
         conn datalayer.Connection, 
         device datalayer.Device, 
         deviceIdString string,
@@ -237,7 +253,14 @@ func ProcessDeviceComm(
             }
         }
         err = device.ExtendSDDL(updateMap)
-        if err != nil {
+        if _, ok := err.(*sddl.CycleError); ok {
+            return ServiceResponse{
+                HttpCode: http.StatusBadRequest,
+                Err: fmt.Errorf("Error updating device's SDDL: %s", err),
+                Response: `{"result" : "error", "error_type" : "bad_payload"}`,
+                Device: nil,
+            }
+        } else if err != nil {
             return ServiceResponse{
                 HttpCode: http.StatusInternalServerError,
                 Err: fmt.Errorf("Error updating device's SDDL: %s", err),
@@ -245,6 +268,9 @@ func ProcessDeviceComm(
                 Device: nil,
             }
         }
+        hub.Publish(device.IDString(), events.TypeSDDL, map[string]interface{}{
+            "sddl" : device.SDDLDocument().Json(),
+        })
     }
 
     // If "vars" is present, update value of all Cloud Variables (creating new
@@ -263,6 +289,24 @@ func ProcessDeviceComm(
             }
         }
         canolog.Info("varsMap: ", varsMap)
+
+        principal := quota.DevicePrincipal(device)
+        err = quota.CheckSamples(cfg, conn, principal, len(varsMap))
+        if _, ok := err.(*quota.LimitExceededError); ok {
+            return ServiceResponse{
+                HttpCode: http.StatusTooManyRequests,
+                Err: err,
+                Response: `{"result" : "error", "error_type" : "rate_limit_exceeded", "limit" : "daily_samples"}`,
+                Device: nil,
+            }
+        } else if err != nil {
+            canolog.Error("Problem checking sample quota: ", err)
+        }
+
+        // All samples in the payload, including derived ones, share the
+        // same timestamp.
+        now := time.Now()
+        stored := map[string]interface{}{}
         for varName, value := range varsMap {
             varDef, err := doc.LookupVarDef(varName)
             // TODO: an error doesn't necessarily mean prop should be created?
@@ -294,6 +338,14 @@ func ProcessDeviceComm(
                         Device: nil,
                     }
                 }
+                hub.Publish(device.IDString(), events.TypeSDDL, map[string]interface{}{
+                    "sddl" : doc.Json(),
+                })
+            }
+
+            if varDef.Expression() != "" {
+                canolog.Warn("Ignoring value reported for derived cloud variable ", varName)
+                continue
             }
 
             // Store property value.
@@ -308,7 +360,7 @@ func ProcessDeviceComm(
                 }
             }
             canolog.Info("InsertStample")
-            err = device.InsertSample(varDef, time.Now(), varVal)
+            err = device.InsertSample(varDef, now, varVal)
             if (err != nil) {
                 return ServiceResponse{
                     HttpCode: http.StatusInternalServerError,
@@ -317,6 +369,43 @@ func ProcessDeviceComm(
                     Device: nil,
                 }
             }
+            hub.Publish(device.IDString(), events.TypeSample, map[string]interface{}{
+                "var" : varName,
+                "v" : varVal,
+            })
+            stored[varName] = varVal
+        }
+        quota.RecordSamples(conn, principal, len(varsMap))
+
+        err = derived.Recompute(hub, device, stored, now)
+        if err != nil {
+            return ServiceResponse{
+                HttpCode: http.StatusInternalServerError,
+                Err: fmt.Errorf("Error storing derived cloud variables: %s", err),
+                Response: `{"result" : "error", "error_type" : "database_error"}`,
+                Device: nil,
+            }
+        }
+    }
+
+    // If "notify" is present, raise notifications.
+    notifyValue, ok := payloadObj["notify"]
+    if ok {
+        err = RaiseNotifications(cfg, conn, hub, senders, device, notifyValue)
+        if _, ok := err.(*quota.LimitExceededError); ok {
+            return ServiceResponse{
+                HttpCode: http.StatusTooManyRequests,
+                Err: err,
+                Response: `{"result" : "error", "error_type" : "rate_limit_exceeded", "limit" : "daily_notifications"}`,
+                Device: nil,
+            }
+        } else if err != nil {
+            return ServiceResponse{
+                HttpCode: http.StatusBadRequest,
+                Err: fmt.Errorf("Error raising notifications: %s", err),
+                Response: `{"result" : "error", "error_type" : "bad_payload"}`,
+                Device: nil,
+            }
         }
     }
 
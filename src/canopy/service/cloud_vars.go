@@ -0,0 +1,68 @@
+// Copyright 2015 SimpleThings, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+package service
+
+import (
+    "canopy/canolog"
+    "canopy/cloudvar"
+    "canopy/datalayer"
+    "canopy/derived"
+    "canopy/events"
+    "time"
+)
+
+// Store values for some of <device>'s Cloud Variables, as sent to the
+// device by a user or by a schedule.  <vars> maps Cloud Variable names to
+// JSON values.  Unknown and derived Cloud Variables, and values that don't
+// match their Cloud Variable's datatype, are skipped with a warning.  Each
+// stored value is published on <hub> (which may be nil), and derived Cloud
+// Variables that depend on them are recomputed.  All samples are stored with
+// time <t>.
+//
+// Returns the number of samples stored, not counting derived ones.
+func StoreCloudVars(hub *events.Hub, device datalayer.Device, vars map[string]interface{}, t time.Time) (int, error) {
+    stored := map[string]interface{}{}
+    for varName, valueJsonObj := range vars {
+        varDef, err := device.LookupVarDef(varName)
+        if err != nil {
+            canolog.Warn("Cloud variable not found: ", varName)
+            continue
+        }
+        if varDef.Expression() != "" {
+            canolog.Warn("Ignoring value for derived cloud variable: ", varName)
+            continue
+        }
+
+        varVal, err := cloudvar.JsonToCloudVarValue(varDef, valueJsonObj)
+        if err != nil {
+            canolog.Warn("Cloud variable value parsing problem: ", varName, err)
+            continue
+        }
+        err = device.InsertSample(varDef, t, varVal)
+        if err != nil {
+            canolog.Warn("Problem storing sample for ", varName, ": ", err)
+            continue
+        }
+        stored[varName] = varVal
+        hub.Publish(device.IDString(), events.TypeSample, map[string]interface{}{
+            "var" : varName,
+            "v" : varVal,
+        })
+    }
+
+    err := derived.Recompute(hub, device, stored, t)
+    return len(stored), err
+}
@@ -0,0 +1,109 @@
+// Copyright 2015 SimpleThings, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+package service
+
+import (
+    "canopy/canolog"
+    "canopy/config"
+    "canopy/datalayer"
+    "canopy/events"
+    "canopy/notify"
+    "canopy/quota"
+    "fmt"
+    "unicode/utf8"
+)
+
+// Limits on the "notify" field of a payload.  Each notification may be sent
+// by email, SMS or push to every account with access to the device.
+const (
+    MaxNotificationsPerPayload = 10
+    MaxNotificationMsgLength = 1000
+)
+
+// Raise the notifications in the "notify" field of a payload from <device>.
+// <value> is either a single notification or a list of them:
+//
+//      "notify" : {
+//          "type" : "high-priority",
+//          "msg" : "Smoke detected"
+//      }
+//
+// See notify.NotifyTypes for the types.  Every notification is checked
+// before any is raised.  Notifications count against the device's daily
+// quota; if it would be exceeded, none are raised and a
+// *quota.LimitExceededError is returned.
+func RaiseNotifications(cfg config.Config, conn datalayer.Connection, hub *events.Hub, senders *notify.Senders, device datalayer.Device, value interface{}) error {
+    var items []interface{}
+    switch v := value.(type) {
+    case map[string]interface{}:
+        items = []interface{}{v}
+    case []interface{}:
+        items = v
+    default:
+        return fmt.Errorf("Expected object or list for \"notify\" field")
+    }
+    if len(items) > MaxNotificationsPerPayload {
+        return fmt.Errorf("At most %d notifications may be raised at once", MaxNotificationsPerPayload)
+    }
+
+    types := make([]string, len(items))
+    msgs := make([]string, len(items))
+    for i, item := range items {
+        obj, ok := item.(map[string]interface{})
+        if !ok {
+            return fmt.Errorf("Expected objects in \"notify\" field")
+        }
+        types[i], _ = obj["type"].(string)
+        if !isNotifyType(types[i]) {
+            return fmt.Errorf("Unknown notification type: %s", types[i])
+        }
+        msgs[i], ok = obj["msg"].(string)
+        if !ok {
+            return fmt.Errorf("Expected string \"msg\" for notification")
+        }
+        if utf8.RuneCountInString(msgs[i]) > MaxNotificationMsgLength {
+            return fmt.Errorf("Notification \"msg\" must be at most %d characters", MaxNotificationMsgLength)
+        }
+    }
+
+    principal := quota.DevicePrincipal(device)
+    err := quota.CheckNotifications(cfg, conn, principal, len(items))
+    if _, ok := err.(*quota.LimitExceededError); ok {
+        return err
+    } else if err != nil {
+        // Don't drop notifications if usage can't be tracked.
+        canolog.Error("Problem checking notification quota: ", err)
+    }
+
+    for i := range items {
+        err = notify.ProcessNotification(cfg, conn, hub, senders, device, types[i], msgs[i])
+        if err != nil {
+            quota.RecordNotifications(conn, principal, i)
+            return err
+        }
+    }
+    quota.RecordNotifications(conn, principal, len(items))
+    return nil
+}
+
+func isNotifyType(s string) bool {
+    for _, notifyType := range notify.NotifyTypes {
+        if s == notifyType {
+            return true
+        }
+    }
+    return false
+}
@@ -0,0 +1,212 @@
+// Copyright 2015 SimpleThings, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+
+// Package cron parses five-field cron expressions and finds the times that
+// match them:
+//
+//      minute hour day-of-month month day-of-week
+//
+// Each field is "*", a number, a range "a-b", or a comma-separated list of
+// these, optionally followed by a step "/n".  Months and days of the week
+// may also be given by their three-letter English names.  Day-of-week 0 and
+// 7 are both Sunday.  As in standard cron, if both day-of-month and
+// day-of-week are restricted, a day matches if either matches.  For
+// example:
+//
+//      0 22 * * mon-fri        22:00 every weekday
+//      */15 * * * *           every 15 minutes
+//      30 6 1,15 * *           06:30 on the 1st and 15th of each month
+//
+// The shorthands @hourly, @daily, @weekly, @monthly and @yearly are also
+// accepted.
+package cron
+
+import (
+    "fmt"
+    "strconv"
+    "strings"
+    "time"
+)
+
+type Schedule struct {
+    minute, hour, dom, month, dow uint64
+    domRestricted, dowRestricted bool
+}
+
+type field struct {
+    name string
+    min, max int
+    names []string
+}
+
+var fields = []field{
+    {"minute", 0, 59, nil},
+    {"hour", 0, 23, nil},
+    {"day-of-month", 1, 31, nil},
+    {"month", 1, 12, []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}},
+    {"day-of-week", 0, 7, []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}},
+}
+
+var shorthands = map[string]string{
+    "@hourly" : "0 * * * *",
+    "@daily" : "0 0 * * *",
+    "@weekly" : "0 0 * * 0",
+    "@monthly" : "0 0 1 * *",
+    "@yearly" : "0 0 1 1 *",
+}
+
+// How far ahead Next looks before giving up on expressions that never
+// match, such as "0 0 30 2 *".
+const searchLimit = 5*366*24*time.Hour
+
+func Parse(spec string) (*Schedule, error) {
+    spec = strings.TrimSpace(strings.ToLower(spec))
+    if expanded, ok := shorthands[spec]; ok {
+        spec = expanded
+    }
+    parts := strings.Fields(spec)
+    if len(parts) != len(fields) {
+        return nil, fmt.Errorf("Expected %d fields in cron expression, got %d", len(fields), len(parts))
+    }
+
+    bits := make([]uint64, len(fields))
+    for i, part := range parts {
+        var err error
+        bits[i], err = parseField(part, fields[i])
+        if err != nil {
+            return nil, err
+        }
+    }
+
+    // Sunday may be written as 7.
+    dow := bits[4]
+    if dow & (1 << 7) != 0 {
+        dow = (dow | 1) &^ (1 << 7)
+    }
+    return &Schedule{
+        minute: bits[0],
+        hour: bits[1],
+        dom: bits[2],
+        month: bits[3],
+        dow: dow,
+        domRestricted: !strings.HasPrefix(parts[2], "*"),
+        dowRestricted: !strings.HasPrefix(parts[4], "*"),
+    }, nil
+}
+
+// Get the set of values, as a bitmask, that a field matches.
+func parseField(s string, f field) (uint64, error) {
+    var out uint64
+    for _, item := range strings.Split(s, ",") {
+        step := 1
+        if slash := strings.Index(item, "/"); slash >= 0 {
+            var err error
+            step, err = strconv.Atoi(item[slash+1:])
+            if err != nil || step <= 0 {
+                return 0, fmt.Errorf("Invalid step in cron %s field: %s", f.name, item)
+            }
+            item = item[:slash]
+        }
+
+        lo, hi := f.min, f.max
+        if item != "*" {
+            var err error
+            bounds := strings.SplitN(item, "-", 2)
+            lo, err = parseValue(bounds[0], f)
+            if err != nil {
+                return 0, err
+            }
+            hi = lo
+            if len(bounds) == 2 {
+                hi, err = parseValue(bounds[1], f)
+                if err != nil {
+                    return 0, err
+                }
+            } else if step != 1 {
+                // "a/n" means every n starting at a.
+                hi = f.max
+            }
+            if hi < lo {
+                return 0, fmt.Errorf("Invalid range in cron %s field: %s", f.name, item)
+            }
+        }
+        for v := lo; v <= hi; v += step {
+            out |= 1 << uint(v)
+        }
+    }
+    return out, nil
+}
+
+func parseValue(s string, f field) (int, error) {
+    for i, name := range f.names {
+        if s == name {
+            return i + f.min, nil
+        }
+    }
+    v, err := strconv.Atoi(s)
+    if err != nil || v < f.min || v > f.max {
+        return 0, fmt.Errorf("Invalid value in cron %s field: %s", f.name, s)
+    }
+    return v, nil
+}
+
+func (s *Schedule) dayMatches(t time.Time) bool {
+    domMatch := s.dom & (1 << uint(t.Day())) != 0
+    dowMatch := s.dow & (1 << uint(t.Weekday())) != 0
+    if s.domRestricted && s.dowRestricted {
+        return domMatch || dowMatch
+    }
+    return domMatch && dowMatch
+}
+
+// Move forward from <t> to <next>, a wall-clock time in <t>'s location.  If
+// <next> falls in a daylight saving gap, time.Date may put it before <t>, in
+// which case the time an hour later is used instead.
+func advance(t, next time.Time) time.Time {
+    if next.After(t) {
+        return next
+    }
+    return next.Add(time.Hour)
+}
+
+// Get the first time strictly after <t> that matches the schedule, in <t>'s
+// location.  Returns the zero time if there is none.
+func (s *Schedule) Next(t time.Time) time.Time {
+    loc := t.Location()
+    limit := t.Add(searchLimit)
+    t = t.Truncate(time.Minute).Add(time.Minute)
+
+    for t.Before(limit) {
+        if s.month & (1 << uint(t.Month())) == 0 {
+            t = advance(t, time.Date(t.Year(), t.Month() + 1, 1, 0, 0, 0, 0, loc))
+            continue
+        }
+        if !s.dayMatches(t) {
+            t = advance(t, time.Date(t.Year(), t.Month(), t.Day() + 1, 0, 0, 0, 0, loc))
+            continue
+        }
+        if s.hour & (1 << uint(t.Hour())) == 0 {
+            t = advance(t, time.Date(t.Year(), t.Month(), t.Day(), t.Hour() + 1, 0, 0, 0, loc))
+            continue
+        }
+        if s.minute & (1 << uint(t.Minute())) == 0 {
+            t = t.Add(time.Minute)
+            continue
+        }
+        return t
+    }
+    return time.Time{}
+}
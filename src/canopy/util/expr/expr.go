@@ -0,0 +1,551 @@
+// Copyright 2015 SimpleThings, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+// Package expr implements the expression language used by derived Cloud
+// Variables.  Expressions are arithmetic over the values of other Cloud
+// Variables of the same device:
+//
+//      temperature - (100 - humidity) / 5
+//      if(door_open && temperature > 30, 1, 0)
+//      avg(temperature, 600)
+//
+// Values are float64.  Booleans are 1 (true) or 0 (false).  Operators, from
+// lowest to highest precedence:
+//
+//      ||
+//      &&
+//      <  <=  >  >=  ==  !=
+//      +  -
+//      *  /  %
+//      unary -  !
+//      ^               (power, right associative)
+//
+// Functions:
+//
+//      abs(x) sqrt(x) exp(x) ln(x) log10(x) round(x) floor(x) ceil(x)
+//      pow(x, y) min(x, ...) max(x, ...) if(cond, then, else)
+//
+// Functions over a Cloud Variable's samples in the last <seconds>, where
+// <var> must be a Cloud Variable name and <seconds> a number:
+//
+//      avg(var, seconds) min_over(var, seconds) max_over(var, seconds)
+//
+// <seconds> may be at most MaxWindow.
+package expr
+
+import (
+    "fmt"
+    "math"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// Longest window allowed for avg, min_over and max_over.  Each evaluation
+// reads every sample in the window.
+const MaxWindow = 24*time.Hour
+
+// Env supplies Cloud Variable values to an expression.
+type Env interface {
+    // Get the values of Cloud Variable <name> in the last <window>.
+    History(name string, window time.Duration) ([]float64, error)
+
+    // Get the current value of Cloud Variable <name>.
+    Value(name string) (float64, error)
+}
+
+// Expr is a parsed expression.
+type Expr interface {
+    // Evaluate the expression.
+    Eval(env Env) (float64, error)
+
+    // Get the names of the Cloud Variables that the expression reads.
+    Vars() []string
+}
+
+type number float64
+
+type variable string
+
+type unaryOp struct {
+    op string
+    x Expr
+}
+
+type binaryOp struct {
+    op string
+    x, y Expr
+}
+
+type call struct {
+    fn string
+    args []Expr
+}
+
+type windowCall struct {
+    fn string
+    varName string
+    window time.Duration
+}
+
+// Math functions, and their number of arguments (-1 for one or more).
+var functions = map[string]int{
+    "abs" : 1,
+    "sqrt" : 1,
+    "exp" : 1,
+    "ln" : 1,
+    "log10" : 1,
+    "round" : 1,
+    "floor" : 1,
+    "ceil" : 1,
+    "pow" : 2,
+    "min" : -1,
+    "max" : -1,
+    "if" : 3,
+}
+
+var windowFunctions = map[string]bool{
+    "avg" : true,
+    "min_over" : true,
+    "max_over" : true,
+}
+
+func boolToFloat(b bool) float64 {
+    if b {
+        return 1
+    }
+    return 0
+}
+
+func (n number) Eval(env Env) (float64, error) {
+    return float64(n), nil
+}
+
+func (n number) Vars() []string {
+    return []string{}
+}
+
+func (v variable) Eval(env Env) (float64, error) {
+    return env.Value(string(v))
+}
+
+func (v variable) Vars() []string {
+    return []string{string(v)}
+}
+
+func (u *unaryOp) Eval(env Env) (float64, error) {
+    x, err := u.x.Eval(env)
+    if err != nil {
+        return 0, err
+    }
+    if u.op == "!" {
+        return boolToFloat(x == 0), nil
+    }
+    return -x, nil
+}
+
+func (u *unaryOp) Vars() []string {
+    return u.x.Vars()
+}
+
+func (b *binaryOp) Eval(env Env) (float64, error) {
+    x, err := b.x.Eval(env)
+    if err != nil {
+        return 0, err
+    }
+    // Short-circuit logical operators
+    if b.op == "&&" && x == 0 {
+        return 0, nil
+    }
+    if b.op == "||" && x != 0 {
+        return 1, nil
+    }
+    y, err := b.y.Eval(env)
+    if err != nil {
+        return 0, err
+    }
+
+    switch b.op {
+    case "&&", "||":
+        return boolToFloat(y != 0), nil
+    case "<":
+        return boolToFloat(x < y), nil
+    case "<=":
+        return boolToFloat(x <= y), nil
+    case ">":
+        return boolToFloat(x > y), nil
+    case ">=":
+        return boolToFloat(x >= y), nil
+    case "==":
+        return boolToFloat(x == y), nil
+    case "!=":
+        return boolToFloat(x != y), nil
+    case "+":
+        return x + y, nil
+    case "-":
+        return x - y, nil
+    case "*":
+        return x * y, nil
+    case "/":
+        return x / y, nil
+    case "%":
+        return math.Mod(x, y), nil
+    case "^":
+        return math.Pow(x, y), nil
+    }
+    return 0, fmt.Errorf("Unknown operator %s", b.op)
+}
+
+func (b *binaryOp) Vars() []string {
+    return append(b.x.Vars(), b.y.Vars()...)
+}
+
+func (c *call) Eval(env Env) (float64, error) {
+    // "if" only evaluates the branch it takes.
+    if c.fn == "if" {
+        cond, err := c.args[0].Eval(env)
+        if err != nil {
+            return 0, err
+        }
+        if cond != 0 {
+            return c.args[1].Eval(env)
+        }
+        return c.args[2].Eval(env)
+    }
+
+    args := []float64{}
+    for _, arg := range c.args {
+        x, err := arg.Eval(env)
+        if err != nil {
+            return 0, err
+        }
+        args = append(args, x)
+    }
+
+    switch c.fn {
+    case "abs":
+        return math.Abs(args[0]), nil
+    case "sqrt":
+        return math.Sqrt(args[0]), nil
+    case "exp":
+        return math.Exp(args[0]), nil
+    case "ln":
+        return math.Log(args[0]), nil
+    case "log10":
+        return math.Log10(args[0]), nil
+    case "round":
+        return math.Floor(args[0] + 0.5), nil
+    case "floor":
+        return math.Floor(args[0]), nil
+    case "ceil":
+        return math.Ceil(args[0]), nil
+    case "pow":
+        return math.Pow(args[0], args[1]), nil
+    case "min":
+        out := args[0]
+        for _, x := range args[1:] {
+            out = math.Min(out, x)
+        }
+        return out, nil
+    case "max":
+        out := args[0]
+        for _, x := range args[1:] {
+            out = math.Max(out, x)
+        }
+        return out, nil
+    }
+    return 0, fmt.Errorf("Unknown function %s", c.fn)
+}
+
+func (c *call) Vars() []string {
+    out := []string{}
+    for _, arg := range c.args {
+        out = append(out, arg.Vars()...)
+    }
+    return out
+}
+
+func (w *windowCall) Eval(env Env) (float64, error) {
+    values, err := env.History(w.varName, w.window)
+    if err != nil {
+        return 0, err
+    }
+    if len(values) == 0 {
+        return 0, fmt.Errorf("No samples of %s in the last %s", w.varName, w.window)
+    }
+
+    out := values[0]
+    for _, x := range values[1:] {
+        switch w.fn {
+        case "avg":
+            out += x
+        case "min_over":
+            out = math.Min(out, x)
+        case "max_over":
+            out = math.Max(out, x)
+        }
+    }
+    if w.fn == "avg" {
+        out /= float64(len(values))
+    }
+    return out, nil
+}
+
+func (w *windowCall) Vars() []string {
+    return []string{w.varName}
+}
+
+// Parse an expression.
+func Parse(s string) (Expr, error) {
+    tokens, err := tokenize(s)
+    if err != nil {
+        return nil, err
+    }
+    p := &parser{tokens: tokens}
+    e, err := p.parseBinary(0)
+    if err != nil {
+        return nil, err
+    }
+    if p.peek() != "" {
+        return nil, fmt.Errorf("Unexpected %q in expression", p.peek())
+    }
+    return e, nil
+}
+
+func isIdentStart(c byte) bool {
+    return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isDigit(c byte) bool {
+    return c >= '0' && c <= '9'
+}
+
+// Split <s> into numbers, identifiers, operators and punctuation.
+func tokenize(s string) ([]string, error) {
+    tokens := []string{}
+    for i := 0; i < len(s); {
+        c := s[i]
+        switch {
+        case c == ' ' || c == '\t' || c == '\n':
+            i++
+        case isDigit(c) || c == '.':
+            j := i
+            for j < len(s) && (isDigit(s[j]) || s[j] == '.') {
+                j++
+            }
+            // Exponent, as in 1e-3
+            if j < len(s) && (s[j] == 'e' || s[j] == 'E') {
+                j++
+                if j < len(s) && (s[j] == '+' || s[j] == '-') {
+                    j++
+                }
+                for j < len(s) && isDigit(s[j]) {
+                    j++
+                }
+            }
+            tokens = append(tokens, s[i:j])
+            i = j
+        case isIdentStart(c):
+            j := i
+            for j < len(s) && (isIdentStart(s[j]) || isDigit(s[j])) {
+                j++
+            }
+            tokens = append(tokens, s[i:j])
+            i = j
+        default:
+            if i + 1 < len(s) {
+                two := s[i:i+2]
+                if two == "<=" || two == ">=" || two == "==" || two == "!=" || two == "&&" || two == "||" {
+                    tokens = append(tokens, two)
+                    i += 2
+                    continue
+                }
+            }
+            if !strings.ContainsRune("+-*/%^<>!(),", rune(c)) {
+                return nil, fmt.Errorf("Unexpected character %q in expression", c)
+            }
+            tokens = append(tokens, string(c))
+            i++
+        }
+    }
+    return tokens, nil
+}
+
+type parser struct {
+    tokens []string
+    pos int
+}
+
+func (p *parser) peek() string {
+    if p.pos >= len(p.tokens) {
+        return ""
+    }
+    return p.tokens[p.pos]
+}
+
+func (p *parser) next() string {
+    tok := p.peek()
+    p.pos++
+    return tok
+}
+
+func (p *parser) expect(tok string) error {
+    if p.next() != tok {
+        return fmt.Errorf("Expected %q in expression", tok)
+    }
+    return nil
+}
+
+// Binary operators, by precedence level (lowest first).  "^" is handled
+// separately, because it is right associative and binds tighter than unary
+// operators.
+var binaryLevels = [][]string{
+    {"||"},
+    {"&&"},
+    {"<", "<=", ">", ">=", "==", "!="},
+    {"+", "-"},
+    {"*", "/", "%"},
+}
+
+func (p *parser) parseBinary(level int) (Expr, error) {
+    if level == len(binaryLevels) {
+        return p.parseUnary()
+    }
+    x, err := p.parseBinary(level + 1)
+    if err != nil {
+        return nil, err
+    }
+    for {
+        op := p.peek()
+        found := false
+        for _, levelOp := range binaryLevels[level] {
+            if op == levelOp {
+                found = true
+            }
+        }
+        if !found {
+            return x, nil
+        }
+        p.next()
+        y, err := p.parseBinary(level + 1)
+        if err != nil {
+            return nil, err
+        }
+        x = &binaryOp{op, x, y}
+    }
+}
+
+func (p *parser) parseUnary() (Expr, error) {
+    if op := p.peek(); op == "-" || op == "!" {
+        p.next()
+        x, err := p.parseUnary()
+        if err != nil {
+            return nil, err
+        }
+        return &unaryOp{op, x}, nil
+    }
+    return p.parsePower()
+}
+
+func (p *parser) parsePower() (Expr, error) {
+    x, err := p.parsePrimary()
+    if err != nil {
+        return nil, err
+    }
+    if p.peek() == "^" {
+        p.next()
+        y, err := p.parseUnary()
+        if err != nil {
+            return nil, err
+        }
+        return &binaryOp{"^", x, y}, nil
+    }
+    return x, nil
+}
+
+func (p *parser) parsePrimary() (Expr, error) {
+    tok := p.next()
+    switch {
+    case tok == "":
+        return nil, fmt.Errorf("Unexpected end of expression")
+    case tok == "(":
+        x, err := p.parseBinary(0)
+        if err != nil {
+            return nil, err
+        }
+        return x, p.expect(")")
+    case isDigit(tok[0]) || tok[0] == '.':
+        val, err := strconv.ParseFloat(tok, 64)
+        if err != nil {
+            return nil, fmt.Errorf("Invalid number %q in expression", tok)
+        }
+        return number(val), nil
+    case isIdentStart(tok[0]):
+        if p.peek() != "(" {
+            return variable(tok), nil
+        }
+        p.next()
+        return p.parseCall(tok)
+    }
+    return nil, fmt.Errorf("Unexpected %q in expression", tok)
+}
+
+// Parse the arguments of a call to <fn>, after the "(".
+func (p *parser) parseCall(fn string) (Expr, error) {
+    args := []Expr{}
+    if p.peek() != ")" {
+        for {
+            arg, err := p.parseBinary(0)
+            if err != nil {
+                return nil, err
+            }
+            args = append(args, arg)
+            if p.peek() != "," {
+                break
+            }
+            p.next()
+        }
+    }
+    if err := p.expect(")"); err != nil {
+        return nil, err
+    }
+
+    if windowFunctions[fn] {
+        if len(args) != 2 {
+            return nil, fmt.Errorf("%s expects a Cloud Variable name and a number of seconds", fn)
+        }
+        varName, ok := args[0].(variable)
+        if !ok {
+            return nil, fmt.Errorf("%s expects a Cloud Variable name and a number of seconds", fn)
+        }
+        seconds, ok := args[1].(number)
+        if !ok || seconds <= 0 {
+            return nil, fmt.Errorf("%s expects a positive number of seconds", fn)
+        }
+        if float64(seconds) > MaxWindow.Seconds() {
+            return nil, fmt.Errorf("%s window may be at most %d seconds", fn, int(MaxWindow.Seconds()))
+        }
+        return &windowCall{fn, string(varName), time.Duration(float64(seconds)*float64(time.Second))}, nil
+    }
+
+    numArgs, ok := functions[fn]
+    if !ok {
+        return nil, fmt.Errorf("Unknown function %s", fn)
+    }
+    if (numArgs == -1 && len(args) == 0) || (numArgs != -1 && len(args) != numArgs) {
+        return nil, fmt.Errorf("Wrong number of arguments to %s", fn)
+    }
+    return &call{fn, args}, nil
+}
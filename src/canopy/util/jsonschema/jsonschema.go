@@ -0,0 +1,224 @@
+// Copyright 2015 SimpleThings, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package jsonschema describes and validates JSON documents, using the
+// subset of JSON Schema that OpenAPI 3.0 supports.  Values are validated in
+// the form produced by encoding/json (map[string]interface{}, float64, ...).
+package jsonschema
+
+import (
+    "fmt"
+    "sort"
+    "strings"
+)
+
+type Schema struct {
+    Type string `json:"type,omitempty"`
+    Format string `json:"format,omitempty"`
+    Description string `json:"description,omitempty"`
+    Enum []interface{} `json:"enum,omitempty"`
+    Nullable bool `json:"nullable,omitempty"`
+
+    // For "object"
+    Properties map[string]*Schema `json:"properties,omitempty"`
+    Required []string `json:"required,omitempty"`
+    AdditionalProperties *Schema `json:"additionalProperties,omitempty"`
+
+    // For "array"
+    Items *Schema `json:"items,omitempty"`
+}
+
+// FieldError is a validation failure.  <Field> is the path to the offending
+// value, such as "redirect_uris[1]", or "" for the document itself.
+type FieldError struct {
+    Field string
+    Message string
+}
+
+func Any(description string) *Schema {
+    return &Schema{Description: description}
+}
+
+func Array(items *Schema, description string) *Schema {
+    return &Schema{Type: "array", Items: items, Description: description}
+}
+
+func Boolean(description string) *Schema {
+    return &Schema{Type: "boolean", Description: description}
+}
+
+func Integer(description string) *Schema {
+    return &Schema{Type: "integer", Description: description}
+}
+
+func Number(description string) *Schema {
+    return &Schema{Type: "number", Description: description}
+}
+
+// An object with the given properties, of which <required> must be present.
+func Object(properties map[string]*Schema, required ...string) *Schema {
+    return &Schema{Type: "object", Properties: properties, Required: required}
+}
+
+// An object whose keys are arbitrary, such as a map from cloud variable
+// name to value.
+func Map(values *Schema, description string) *Schema {
+    return &Schema{Type: "object", AdditionalProperties: values, Description: description}
+}
+
+func String(description string) *Schema {
+    return &Schema{Type: "string", Description: description}
+}
+
+// Like String, but restricted to <values>.
+func StringEnum(description string, values ...string) *Schema {
+    enum := make([]interface{}, len(values))
+    for i, v := range values {
+        enum[i] = v
+    }
+    return &Schema{Type: "string", Enum: enum, Description: description}
+}
+
+// Copy of <s> with a different description.
+func (s *Schema) Describe(description string) *Schema {
+    out := *s
+    out.Description = description
+    return &out
+}
+
+// Copy of <s> that also accepts null.
+func (s *Schema) OrNull() *Schema {
+    out := *s
+    out.Nullable = true
+    return &out
+}
+
+// How each type is referred to in error messages, matching the wording the
+// REST handlers have always used.
+var typeNames = map[string]string{
+    "array" : "List",
+    "boolean" : "Boolean",
+    "integer" : "Integer",
+    "number" : "Numeric",
+    "object" : "Object",
+    "string" : "String",
+}
+
+func typeError(s *Schema, field string) FieldError {
+    typeName := "Value"
+    if s != nil && typeNames[s.Type] != "" {
+        typeName = typeNames[s.Type]
+    }
+    if field == "" {
+        return FieldError{field, typeName + " expected"}
+    }
+    return FieldError{field, fmt.Sprintf("%s \"%s\" expected", typeName, field)}
+}
+
+func hasType(s *Schema, value interface{}) bool {
+    switch s.Type {
+    case "":
+        return true
+    case "array":
+        _, ok := value.([]interface{})
+        return ok
+    case "boolean":
+        _, ok := value.(bool)
+        return ok
+    case "integer":
+        f, ok := value.(float64)
+        return ok && f == float64(int64(f))
+    case "number":
+        _, ok := value.(float64)
+        return ok
+    case "object":
+        _, ok := value.(map[string]interface{})
+        return ok
+    case "string":
+        _, ok := value.(string)
+        return ok
+    }
+    return false
+}
+
+func childField(parent, name string) string {
+    if parent == "" {
+        return name
+    }
+    return parent + "." + name
+}
+
+func (s *Schema) validate(value interface{}, field string, errs []FieldError) []FieldError {
+    if value == nil {
+        if s.Nullable || s.Type == "" {
+            return errs
+        }
+        return append(errs, typeError(s, field))
+    }
+    if !hasType(s, value) {
+        return append(errs, typeError(s, field))
+    }
+
+    if len(s.Enum) > 0 {
+        found := false
+        allowed := []string{}
+        for _, e := range s.Enum {
+            if e == value {
+                found = true
+            }
+            allowed = append(allowed, fmt.Sprint(e))
+        }
+        if !found {
+            errs = append(errs, FieldError{field, fmt.Sprintf("\"%s\" must be one of: %s", field, strings.Join(allowed, ", "))})
+        }
+    }
+
+    switch v := value.(type) {
+    case []interface{}:
+        if s.Items != nil {
+            for i, item := range v {
+                errs = s.Items.validate(item, fmt.Sprintf("%s[%d]", field, i), errs)
+            }
+        }
+    case map[string]interface{}:
+        for _, name := range s.Required {
+            if _, ok := v[name]; !ok {
+                errs = append(errs, typeError(s.Properties[name], childField(field, name)))
+            }
+        }
+        // Sorted, so that the first error reported is deterministic.
+        names := []string{}
+        for name := range v {
+            names = append(names, name)
+        }
+        sort.Strings(names)
+        for _, name := range names {
+            propSchema, ok := s.Properties[name]
+            if !ok {
+                propSchema = s.AdditionalProperties
+            }
+            if propSchema != nil {
+                errs = propSchema.validate(v[name], childField(field, name), errs)
+            }
+        }
+    }
+    return errs
+}
+
+// Validate <value> against <s>.  Returns nil if it is valid.  Properties
+// that are not declared are allowed, unless AdditionalProperties says
+// otherwise.
+func (s *Schema) Validate(value interface{}) []FieldError {
+    return s.validate(value, "", nil)
+}
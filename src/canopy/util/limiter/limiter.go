@@ -0,0 +1,190 @@
+// Copyright 2015 SimpleThings, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+// Package limiter provides in-memory sliding-window event counters and rate
+// limiters, keyed by arbitrary strings (such as IP addresses or usernames).
+// State is per-process and is lost on restart.
+package limiter
+
+import (
+    "sync"
+    "time"
+)
+
+// Limiter decides whether an event for a given key may happen now.
+type Limiter interface {
+    // Record an event for <key> if it is allowed.  Returns true if allowed.
+    // Otherwise returns false and the time until the next event would be
+    // allowed.
+    Allow(key string) (bool, time.Duration)
+
+    // Number of events still allowed for <key> in the current window.
+    Remaining(key string) int
+
+    // Forget all events for <key>.
+    Reset(key string)
+
+    // Change the number of events allowed per window.
+    SetLimit(limit int)
+}
+
+// SlidingWindow counts events per key over a trailing time window.
+type SlidingWindow struct {
+    mu sync.Mutex
+    window time.Duration
+    events map[string][]time.Time
+    lastPrune time.Time
+}
+
+func NewSlidingWindow(window time.Duration) *SlidingWindow {
+    return &SlidingWindow{
+        window: window,
+        events: map[string][]time.Time{},
+    }
+}
+
+// Drop events for <key> that are older than the window.  Caller must hold
+// the lock.
+func (sw *SlidingWindow) expire(key string, now time.Time) []time.Time {
+    events := sw.events[key]
+    cutoff := now.Add(-sw.window)
+    i := 0
+    for i < len(events) && !events[i].After(cutoff) {
+        i++
+    }
+    events = events[i:]
+    if len(events) == 0 {
+        delete(sw.events, key)
+    } else {
+        sw.events[key] = events
+    }
+    return events
+}
+
+// Periodically drop keys that have no recent events, so that memory use is
+// bounded by the number of keys active within the window.  Caller must hold
+// the lock.
+func (sw *SlidingWindow) prune(now time.Time) {
+    if now.Sub(sw.lastPrune) < sw.window {
+        return
+    }
+    for key := range sw.events {
+        sw.expire(key, now)
+    }
+    sw.lastPrune = now
+}
+
+// Record an event for <key> at <now>.  Returns the number of events in the
+// window, including this one.
+func (sw *SlidingWindow) Add(key string, now time.Time) int {
+    sw.mu.Lock()
+    defer sw.mu.Unlock()
+    sw.prune(now)
+    events := append(sw.expire(key, now), now)
+    sw.events[key] = events
+    return len(events)
+}
+
+// Number of events for <key> in the window ending at <now>.
+func (sw *SlidingWindow) Count(key string, now time.Time) int {
+    sw.mu.Lock()
+    defer sw.mu.Unlock()
+    return len(sw.expire(key, now))
+}
+
+// Time of the oldest and newest events for <key> in the window ending at
+// <now>.  Returns zero times if there are none.
+func (sw *SlidingWindow) Span(key string, now time.Time) (oldest, newest time.Time) {
+    sw.mu.Lock()
+    defer sw.mu.Unlock()
+    events := sw.expire(key, now)
+    if len(events) == 0 {
+        return time.Time{}, time.Time{}
+    }
+    return events[0], events[len(events)-1]
+}
+
+func (sw *SlidingWindow) Reset(key string) {
+    sw.mu.Lock()
+    defer sw.mu.Unlock()
+    delete(sw.events, key)
+}
+
+// SlidingWindowLimiter allows at most <limit> events per key in any window
+// of length <window>.
+type SlidingWindowLimiter struct {
+    mu sync.Mutex
+    limit int
+    counter *SlidingWindow
+}
+
+func NewSlidingWindowLimiter(limit int, window time.Duration) *SlidingWindowLimiter {
+    return &SlidingWindowLimiter{
+        limit: limit,
+        counter: NewSlidingWindow(window),
+    }
+}
+
+func (l *SlidingWindowLimiter) Allow(key string) (bool, time.Duration) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    now := time.Now()
+    if l.counter.Count(key, now) >= l.limit {
+        oldest, _ := l.counter.Span(key, now)
+        return false, oldest.Add(l.counter.window).Sub(now)
+    }
+    l.counter.Add(key, now)
+    return true, 0
+}
+
+func (l *SlidingWindowLimiter) Remaining(key string) int {
+    l.mu.Lock()
+    limit := l.limit
+    l.mu.Unlock()
+    remaining := limit - l.counter.Count(key, time.Now())
+    if remaining < 0 {
+        return 0
+    }
+    return remaining
+}
+
+func (l *SlidingWindowLimiter) Reset(key string) {
+    l.counter.Reset(key)
+}
+
+// Change the number of events allowed per window.  Events already counted
+// still count against the new limit.
+func (l *SlidingWindowLimiter) SetLimit(limit int) {
+    l.mu.Lock()
+    l.limit = limit
+    l.mu.Unlock()
+}
+
+// Backoff returns the delay required after <failures> consecutive failures,
+// doubling from <base> once more than <free> failures have occurred, and
+// capped at <max>.
+func Backoff(failures, free int, base, max time.Duration) time.Duration {
+    if failures <= free {
+        return 0
+    }
+    delay := base
+    for i := free + 1; i < failures; i++ {
+        delay *= 2
+        if delay >= max {
+            return max
+        }
+    }
+    return delay
+}
@@ -27,3 +27,14 @@ func Base64String(numChars int) (string, error) {
     return base64.StdEncoding.EncodeToString(randBytes), nil
 }
 
+
+// Like Base64String, but uses the URL-safe alphabet without padding, so the
+// result can be placed in a URL or form field without escaping.
+func Base64URLString(numChars int) (string, error) {
+    randBytes := make([]byte, numChars)
+    _, err := rand.Read(randBytes)
+    if err != nil {
+        return "", err
+    }
+    return base64.RawURLEncoding.EncodeToString(randBytes), nil
+}
@@ -0,0 +1,65 @@
+// Copyright 2015 SimpleThings, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tlscert holds a server's TLS certificate so that it can be
+// replaced, for instance after renewal, without restarting the server.
+package tlscert
+
+import (
+    "crypto/tls"
+    "sync"
+)
+
+// Store holds the current certificate.  Use its GetCertificate method as
+// the tls.Config's GetCertificate.
+type Store struct {
+    lock sync.RWMutex
+    cert *tls.Certificate
+}
+
+// Create a Store holding the certificate and private key from the given
+// PEM files.
+func NewStore(certFile, keyFile string) (*Store, error) {
+    store := &Store{}
+    err := store.Load(certFile, keyFile)
+    if err != nil {
+        return nil, err
+    }
+    return store, nil
+}
+
+// Replace the certificate with the one in the given PEM files.  If they
+// can't be read, the old certificate is kept.  Connections already made
+// are not affected.
+func (store *Store) Load(certFile, keyFile string) error {
+    cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+    if err != nil {
+        return err
+    }
+    store.Set(cert)
+    return nil
+}
+
+// Replace the certificate with <cert>.
+func (store *Store) Set(cert tls.Certificate) {
+    store.lock.Lock()
+    store.cert = &cert
+    store.lock.Unlock()
+}
+
+func (store *Store) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+    store.lock.RLock()
+    defer store.lock.RUnlock()
+    return store.cert, nil
+}
@@ -0,0 +1,114 @@
+// Copyright 2015 SimpleThings, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package totp implements Time-Based One-Time Passwords (RFC 6238), as used
+// by Google Authenticator and similar apps, with the default parameters:
+// HMAC-SHA1, 30 second steps and 6 digit codes.
+package totp
+
+import (
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha1"
+    "crypto/subtle"
+    "encoding/base32"
+    "encoding/binary"
+    "fmt"
+    "net/url"
+    "strings"
+    "time"
+)
+
+const (
+    StepSeconds = 30
+    Digits = 6
+
+    // Number of steps either side of the current one that are accepted, to
+    // allow for clock drift.
+    skewSteps = 1
+)
+
+// Generate a new random 160-bit secret, base32 encoded.
+func GenerateSecret() (string, error) {
+    secretBytes := make([]byte, 20)
+    _, err := rand.Read(secretBytes)
+    if err != nil {
+        return "", err
+    }
+    return base32.StdEncoding.EncodeToString(secretBytes), nil
+}
+
+// Get the otpauth:// URI for <secret>.  Authenticator apps can scan this
+// when it is rendered as a QR code.
+func ProvisioningURI(secret, issuer, accountName string) string {
+    label := url.PathEscape(issuer + ":" + accountName)
+    params := url.Values{}
+    params.Set("secret", secret)
+    params.Set("issuer", issuer)
+    return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+// Get the time step number for <t>.
+func Step(t time.Time) int64 {
+    return t.Unix() / StepSeconds
+}
+
+func codeAtStep(secret string, step int64) (string, error) {
+    key, err := base32.StdEncoding.DecodeString(strings.ToUpper(secret))
+    if err != nil {
+        return "", err
+    }
+
+    msg := make([]byte, 8)
+    binary.BigEndian.PutUint64(msg, uint64(step))
+    mac := hmac.New(sha1.New, key)
+    mac.Write(msg)
+    sum := mac.Sum(nil)
+
+    // Dynamic truncation (RFC 4226 section 5.3)
+    offset := sum[len(sum)-1] & 0x0f
+    value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+    return fmt.Sprintf("%06d", value % 1000000), nil
+}
+
+// Get the code for <secret> at time <t>.
+func Code(secret string, t time.Time) (string, error) {
+    return codeAtStep(secret, Step(t))
+}
+
+// Verify <code> against <secret> at time <t>.  Codes from steps at or before
+// <lastUsedStep> are rejected so that a code cannot be replayed.  On success,
+// returns the step that matched, which the caller should save as the new
+// <lastUsedStep>.
+func Verify(secret, code string, t time.Time, lastUsedStep int64) (int64, bool) {
+    code = strings.Replace(code, " ", "", -1)
+    if len(code) != Digits {
+        return 0, false
+    }
+
+    now := Step(t)
+    for step := now - skewSteps; step <= now + skewSteps; step++ {
+        if step <= lastUsedStep {
+            continue
+        }
+        expected, err := codeAtStep(secret, step)
+        if err != nil {
+            return 0, false
+        }
+        if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+            return step, true
+        }
+    }
+    return 0, false
+}
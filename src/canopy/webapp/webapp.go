@@ -23,6 +23,7 @@ import (
 
 func AddRoutes(r *mux.Router) {
     r.HandleFunc("/device/{id}", GET_device__id).Methods("GET")
+    r.HandleFunc("/oauth/authorize", GET_oauth_authorize).Methods("GET")
 }
 
 func GET_device__id(w http.ResponseWriter, r *http.Request) {
@@ -72,3 +73,98 @@ $(function() {
 </html>`)
 }
 
+// OAuth2 consent screen.  Third-party apps send the user's browser here with
+// the standard authorization request query parameters (client_id,
+// redirect_uri, scope, state, code_challenge, ...).  The page asks the
+// logged-in user to approve or deny, then follows the redirect returned by
+// POST /api/oauth/authorize.
+func GET_oauth_authorize(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "text/html; charset=utf-8")
+    // Prevent other sites from framing the consent screen (clickjacking).
+    w.Header().Set("X-Frame-Options", "DENY")
+    fmt.Fprint(w, `<!DOCTYPE html>
+<meta charset="utf-8">
+<html>
+<head>
+    <title>Authorize application - Canopy</title>
+    <script src="http://ajax.googleapis.com/ajax/libs/jquery/1.11.0/jquery.min.js"></script>
+    <link href='http://fonts.googleapis.com/css?family=Source+Sans+Pro:200,300,400,700' rel='stylesheet' type='text/css'>
+    <link href='../mgr/canoweb.css' rel='stylesheet' type='text/css'>
+</head>
+
+<body style='font-family: "Source Sans Pro", sans-serif'>
+    <div id="main" style="width: 480px; margin: 64px auto;">
+        <h2>Authorize <span id="client_name"></span></h2>
+        <p id="message"></p>
+        <div id="consent" style="display: none">
+            <p>
+                <b id="client_name2"></b> would like to access your Canopy
+                account:
+            </p>
+            <ul id="scopes"></ul>
+            <button id="approve">Allow</button>
+            <button id="deny">Deny</button>
+        </div>
+    </div>
+</body>
+
+<script>
+var SCOPE_DESCRIPTIONS = {
+    "read" : "View your devices and their Cloud Variables",
+    "write" : "Modify your devices and control their Cloud Variables"
+};
+
+function queryParam(name) {
+    var match = new RegExp("[?&]" + name + "=([^&]*)").exec(window.location.search);
+    return match ? decodeURIComponent(match[1].replace(/\+/g, " ")) : "";
+}
+
+function authorize(approve) {
+    $.ajax({
+        type: "POST",
+        url: "/api/oauth/authorize",
+        contentType: "application/json",
+        xhrFields: { withCredentials: true },
+        data: JSON.stringify({
+            "response_type" : queryParam("response_type"),
+            "client_id" : queryParam("client_id"),
+            "redirect_uri" : queryParam("redirect_uri"),
+            "scope" : queryParam("scope"),
+            "state" : queryParam("state"),
+            "code_challenge" : queryParam("code_challenge"),
+            "code_challenge_method" : queryParam("code_challenge_method"),
+            "approve" : approve
+        })
+    }).done(function(data) {
+        window.location = data.redirect_uri;
+    }).fail(function(xhr) {
+        if (xhr.status == 401) {
+            $("#message").html("You must <a href='/mgr/index.html'>sign in</a> to Canopy first, then reload this page.");
+        } else {
+            $("#message").text("This authorization request is invalid.");
+        }
+        $("#consent").hide();
+    });
+}
+
+$(function() {
+    $.getJSON("/api/oauth/client/" + encodeURIComponent(queryParam("client_id"))).done(function(client) {
+        $("#client_name").text(client.name);
+        $("#client_name2").text(client.name);
+        var scopes = queryParam("scope").split(" ").filter(function(s) { return s != ""; });
+        if (scopes.length == 0) {
+            scopes = ["read"];
+        }
+        $.each(scopes, function(i, scope) {
+            $("<li>").text(SCOPE_DESCRIPTIONS[scope] || scope).appendTo("#scopes");
+        });
+        $("#consent").show();
+    }).fail(function() {
+        $("#message").text("Unknown application.");
+    });
+    $("#approve").click(function() { authorize(true); });
+    $("#deny").click(function() { authorize(false); });
+});
+</script>
+</html>`)
+}
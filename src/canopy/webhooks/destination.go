@@ -0,0 +1,130 @@
+// Copyright 2015 SimpleThings, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+package webhooks
+
+import (
+    "errors"
+    "fmt"
+    "net"
+    "net/http"
+    "net/url"
+    "syscall"
+    "time"
+)
+
+// Webhooks must not be able to reach the server's own network, such as
+// loopback services, private networks or cloud metadata endpoints.
+var nonPublicNetworks = []*net.IPNet{}
+
+func init() {
+    for _, cidr := range []string{
+        "0.0.0.0/8",        // "This" network
+        "10.0.0.0/8",       // Private
+        "100.64.0.0/10",    // Carrier-grade NAT
+        "127.0.0.0/8",      // Loopback
+        "169.254.0.0/16",   // Link-local, including cloud metadata
+        "172.16.0.0/12",    // Private
+        "192.0.0.0/24",     // IETF protocol assignments
+        "192.168.0.0/16",   // Private
+        "198.18.0.0/15",    // Benchmarking
+        "224.0.0.0/3",      // Multicast and reserved
+        "::/128",           // Unspecified
+        "::1/128",          // Loopback
+        "64:ff9b::/96",     // NAT64, which can map to any IPv4 address
+        "fc00::/7",         // Unique local
+        "fe80::/10",        // Link-local
+        "ff00::/8",         // Multicast
+    } {
+        _, network, err := net.ParseCIDR(cidr)
+        if err != nil {
+            panic(err)
+        }
+        nonPublicNetworks = append(nonPublicNetworks, network)
+    }
+}
+
+var errRedirect = errors.New("Webhook redirects are not followed")
+
+// Is <ip> an address on the public internet?
+func isPublicIP(ip net.IP) bool {
+    // IPv4-mapped IPv6 addresses are checked as IPv4.
+    if ip4 := ip.To4(); ip4 != nil {
+        ip = ip4
+    }
+    for _, network := range nonPublicNetworks {
+        if network.Contains(ip) {
+            return false
+        }
+    }
+    return true
+}
+
+// Check that <rawURL> can be used as a webhook: it must be an absolute http
+// or https URL whose host resolves only to public addresses.  Addresses are
+// checked again whenever a delivery connects, in case DNS changes.
+func CheckURL(rawURL string) error {
+    parsed, err := url.Parse(rawURL)
+    if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+        return errors.New("URL must be absolute, using http or https")
+    }
+    host := parsed.Hostname()
+    ips, err := net.LookupIP(host)
+    if err != nil {
+        return fmt.Errorf("Cannot resolve host %s", host)
+    }
+    for _, ip := range ips {
+        if !isPublicIP(ip) {
+            return fmt.Errorf("URL must not point to a private or local address")
+        }
+    }
+    return nil
+}
+
+// Refuse connections to non-public addresses.  Called with the resolved
+// address, so it can't be bypassed with DNS tricks.
+func checkDialAddress(network, address string, c syscall.RawConn) error {
+    host, _, err := net.SplitHostPort(address)
+    if err != nil {
+        return err
+    }
+    ip := net.ParseIP(host)
+    if ip == nil || !isPublicIP(ip) {
+        return fmt.Errorf("Refusing to connect to non-public address %s", host)
+    }
+    return nil
+}
+
+// Create the client used for deliveries.  It only connects to public
+// addresses and doesn't follow redirects, which could point anywhere.  It
+// ignores proxy settings, because the proxy's address would be checked
+// rather than the webhook's.
+func newClient() *http.Client {
+    dialer := &net.Dialer{
+        Timeout: RequestTimeout,
+        Control: checkDialAddress,
+    }
+    return &http.Client{
+        Timeout: RequestTimeout,
+        Transport: &http.Transport{
+            DialContext: dialer.DialContext,
+            TLSHandshakeTimeout: RequestTimeout,
+            IdleConnTimeout: 90*time.Second,
+        },
+        CheckRedirect: func(req *http.Request, via []*http.Request) error {
+            return errRedirect
+        },
+    }
+}
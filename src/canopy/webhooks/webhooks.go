@@ -0,0 +1,340 @@
+// Copyright 2015 SimpleThings, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+// Package webhooks delivers device events to the URLs that accounts have
+// subscribed with webhooks.  Sample, notification and connectivity events
+// from devices that an account has access to are POSTed, as JSON, to each of
+// the account's webhooks whose filters they pass.
+//
+// Each request carries these headers:
+//
+//      X-Canopy-Event: <EVENT_TYPE>
+//      X-Canopy-Delivery: <DELIVERY_ID>
+//      X-Canopy-Timestamp: <UNIX_TIME>
+//      X-Canopy-Signature: sha256=<HEX_HMAC>
+//
+// where the signature is the HMAC-SHA256, keyed with the webhook's secret, of
+// the timestamp, a ".", and the request body.  Receivers should check it (see
+// Sign) and reject stale timestamps.
+//
+// Webhooks may only point to public addresses (see CheckURL), and redirects
+// are not followed.  A delivery fails if no 2xx response is received within
+// RequestTimeout.
+// Failed deliveries are retried with exponential backoff, and after
+// MaxAttempts are added to the webhook's dead-letter log.  Every attempt is
+// recorded in the webhook's delivery history.  Pending retries are held in
+// memory, so they are lost if the server restarts.
+package webhooks
+
+import (
+    "bytes"
+    "canopy/canolog"
+    "canopy/config"
+    "canopy/datalayer"
+    "canopy/datalayer/cassandra_datalayer"
+    "canopy/events"
+    "canopy/util/limiter"
+    "canopy/util/random"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "net/http"
+    "strconv"
+    "sync"
+    "time"
+)
+
+// Event types that can be delivered to webhooks.
+var EventTypes = []string{
+    events.TypeSample,
+    events.TypeNotification,
+    events.TypeConnected,
+    events.TypeDisconnected,
+}
+
+const (
+    MaxAttempts = 6
+    RequestTimeout = 10*time.Second
+
+    // Delay before the first retry, doubling with each further failure.
+    retryBase = 30*time.Second
+    retryMax = time.Hour
+
+    // Number of events waiting to be matched against webhooks before new
+    // events are dropped.
+    eventQueueSize = 1000
+
+    // Number of concurrent deliveries.
+    numWorkers = 4
+
+    // How long a device's webhooks are cached.  Changes to webhooks and
+    // device permissions take up to this long to take effect.
+    hookCacheLifetime = 30*time.Second
+)
+
+type delivery struct {
+    id string
+    hook datalayer.Webhook
+    event events.Event
+    payload []byte
+    attempt int
+}
+
+type cachedHooks struct {
+    hooks []datalayer.Webhook
+    expiry time.Time
+}
+
+// Dispatcher matches events against webhooks and delivers them.  There
+// should be one per server process.
+type Dispatcher struct {
+    cfg config.Config
+    conn datalayer.Connection
+    client *http.Client
+    events chan events.Event
+    deliveries chan *delivery
+
+    mu sync.Mutex
+    cache map[string]cachedHooks
+}
+
+func NewDispatcher(cfg config.Config) *Dispatcher {
+    return &Dispatcher{
+        cfg: cfg,
+        client: newClient(),
+        events: make(chan events.Event, eventQueueSize),
+        deliveries: make(chan *delivery, eventQueueSize),
+        cache: map[string]cachedHooks{},
+    }
+}
+
+// Connect to the database and start delivering the events published on
+// <hub>.
+func (d *Dispatcher) Start(hub *events.Hub) error {
+    dl := cassandra_datalayer.NewDatalayer(d.cfg)
+    conn, err := dl.Connect("canopy")
+    if err != nil {
+        return err
+    }
+    d.conn = conn
+
+    go d.route()
+    for i := 0; i < numWorkers; i++ {
+        go d.work()
+    }
+    hub.AddListener(d.enqueue)
+    return nil
+}
+
+// Compute the X-Canopy-Signature header value for a request.
+func Sign(secret string, timestamp int64, body []byte) string {
+    mac := hmac.New(sha256.New, []byte(secret))
+    mac.Write([]byte(strconv.FormatInt(timestamp, 10) + "."))
+    mac.Write(body)
+    return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Can events of type <eventType> be delivered to webhooks?
+func IsEventType(eventType string) bool {
+    return contains(EventTypes, eventType)
+}
+
+func contains(list []string, s string) bool {
+    for _, item := range list {
+        if item == s {
+            return true
+        }
+    }
+    return false
+}
+
+// Does <event> pass all of <hook>'s filters?
+func matches(hook datalayer.Webhook, event events.Event) bool {
+    if len(hook.EventTypes) > 0 && !contains(hook.EventTypes, event.Type) {
+        return false
+    }
+    if len(hook.DeviceIDs) > 0 && !contains(hook.DeviceIDs, event.DeviceID) {
+        return false
+    }
+    switch event.Type {
+    case events.TypeSample:
+        varName, _ := event.Data["var"].(string)
+        if len(hook.VarNames) > 0 && !contains(hook.VarNames, varName) {
+            return false
+        }
+    case events.TypeNotification:
+        notifyType, _ := event.Data["notify_type"].(string)
+        if len(hook.NotifyTypes) > 0 && !contains(hook.NotifyTypes, notifyType) {
+            return false
+        }
+    }
+    return true
+}
+
+// Hub listener.  Runs in the publisher's goroutine, so must not block.
+func (d *Dispatcher) enqueue(event events.Event) {
+    if !IsEventType(event.Type) {
+        return
+    }
+    select {
+    case d.events <- event:
+    default:
+        canolog.Warn("Webhook event queue full.  Dropping event ", event.ID)
+    }
+}
+
+// Get the webhooks of every account with access to a device.
+func (d *Dispatcher) hooksForDevice(deviceId string) ([]datalayer.Webhook, error) {
+    d.mu.Lock()
+    cached, ok := d.cache[deviceId]
+    d.mu.Unlock()
+    if ok && time.Now().Before(cached.expiry) {
+        return cached.hooks, nil
+    }
+
+    device, err := d.conn.LookupDeviceByStringID(deviceId)
+    if err != nil {
+        return nil, err
+    }
+    access, err := device.AccountAccess()
+    if err != nil {
+        return nil, err
+    }
+    hooks := []datalayer.Webhook{}
+    for username := range access {
+        accountHooks, err := d.conn.Webhooks(username)
+        if err != nil {
+            return nil, err
+        }
+        hooks = append(hooks, accountHooks...)
+    }
+
+    d.mu.Lock()
+    d.cache[deviceId] = cachedHooks{hooks, time.Now().Add(hookCacheLifetime)}
+    d.mu.Unlock()
+    return hooks, nil
+}
+
+// Match events against webhooks, queueing a delivery for each match.
+func (d *Dispatcher) route() {
+    for event := range d.events {
+        hooks, err := d.hooksForDevice(event.DeviceID)
+        if err != nil {
+            canolog.Error("Error looking up webhooks for device ", event.DeviceID, ": ", err)
+            continue
+        }
+        for _, hook := range hooks {
+            if !matches(hook, event) {
+                continue
+            }
+            id, err := random.Base64URLString(12)
+            if err != nil {
+                canolog.Error("Error generating webhook delivery ID: ", err)
+                continue
+            }
+            payload, err := json.Marshal(map[string]interface{}{
+                "delivery_id" : id,
+                "webhook_id" : hook.ID,
+                "event_id" : event.ID,
+                "event" : event.JsonObj(),
+            })
+            if err != nil {
+                canolog.Error("Error encoding webhook payload: ", err)
+                continue
+            }
+            d.deliveries <- &delivery{
+                id: id,
+                hook: hook,
+                event: event,
+                payload: payload,
+            }
+        }
+    }
+}
+
+func (d *Dispatcher) work() {
+    for del := range d.deliveries {
+        d.attempt(del)
+    }
+}
+
+// POST <del> to its webhook.  Returns the response code, or 0 if there was
+// no response.
+func (d *Dispatcher) post(del *delivery) (int, error) {
+    req, err := http.NewRequest("POST", del.hook.URL, bytes.NewReader(del.payload))
+    if err != nil {
+        return 0, err
+    }
+    timestamp := time.Now().Unix()
+    req.Header.Set("Content-Type", "application/json")
+    req.Header.Set("User-Agent", "Canopy-Webhooks/1.0")
+    req.Header.Set("X-Canopy-Event", del.event.Type)
+    req.Header.Set("X-Canopy-Delivery", del.id)
+    req.Header.Set("X-Canopy-Timestamp", strconv.FormatInt(timestamp, 10))
+    req.Header.Set("X-Canopy-Signature", Sign(del.hook.Secret, timestamp, del.payload))
+
+    resp, err := d.client.Do(req)
+    if err != nil {
+        return 0, err
+    }
+    defer resp.Body.Close()
+    io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+
+    if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+        return resp.StatusCode, fmt.Errorf("Unexpected response: %s", resp.Status)
+    }
+    return resp.StatusCode, nil
+}
+
+// Make one attempt at <del>, scheduling a retry if it fails.
+func (d *Dispatcher) attempt(del *delivery) {
+    del.attempt++
+    code, err := d.post(del)
+
+    record := datalayer.WebhookDelivery{
+        DeliveryID: del.id,
+        WebhookID: del.hook.ID,
+        DeviceID: del.event.DeviceID,
+        EventType: del.event.Type,
+        Payload: string(del.payload),
+        Attempt: del.attempt,
+        ResponseCode: code,
+        Time: time.Now(),
+    }
+    switch {
+    case err == nil:
+        record.Status = datalayer.WebhookDelivered
+    case del.attempt < MaxAttempts:
+        record.Status = datalayer.WebhookDeliveryRetrying
+        record.Error = err.Error()
+        delay := limiter.Backoff(del.attempt, 0, retryBase, retryMax)
+        time.AfterFunc(delay, func() {
+            d.deliveries <- del
+        })
+    default:
+        record.Status = datalayer.WebhookDeliveryDead
+        record.Error = err.Error()
+        canolog.Warn("Giving up on webhook delivery ", del.id, " to ", del.hook.URL, ": ", err)
+    }
+
+    err = d.conn.RecordWebhookDelivery(record)
+    if err != nil {
+        canolog.Error("Error recording webhook delivery ", del.id, ": ", err)
+    }
+}
@@ -26,19 +26,25 @@ import (
     "canopy/config"
     "canopy/datalayer"
     "canopy/datalayer/cassandra_datalayer"
+    "canopy/events"
+    "canopy/notify"
     "canopy/pigeon"
+    "canopy/quota"
     "canopy/service"
 )
 
+var logger = canolog.Subsystem("ws")
+
 func IsDeviceConnected(pigeonSys *pigeon.PigeonSystem, deviceIdString string) bool {
     return (pigeonSys.Mailbox(deviceIdString) != nil)
 }
 
-func NewCanopyWebsocketServer(cfg config.Config, pigeonSys *pigeon.PigeonSystem) func(ws *websocket.Conn) {
+func NewCanopyWebsocketServer(cfg config.Config, hub *events.Hub, senders *notify.Senders, pigeonSys *pigeon.PigeonSystem, quotas *quota.Enforcer) func(ws *websocket.Conn) {
     // Main websocket server routine.
     // This event loop runs until the websocket connection is broken.
     return func(ws *websocket.Conn) {
-        canolog.Websocket("Websocket connection established")
+        connLogger := logger.With("remote", ws.Request().RemoteAddr)
+        connLogger.Trace("Websocket connection established")
 
         var mailbox *pigeon.PigeonMailbox
         var cnt int32
@@ -51,11 +57,18 @@ func NewCanopyWebsocketServer(cfg config.Config, pigeonSys *pigeon.PigeonSystem)
         dl := cassandra_datalayer.NewDatalayer(cfg)
         conn, err := dl.Connect("canopy")
         if err != nil {
-            canolog.Error("Could not connect to database: ", err)
+            connLogger.Error("Could not connect to database: ", err)
             return
         }
         defer conn.Close()
 
+        closeMailbox := func() {
+            if mailbox != nil {
+                mailbox.Close()
+                hub.Publish(device.IDString(), events.TypeDisconnected, nil)
+            }
+        }
+
         for {
             var in string
 
@@ -65,27 +78,39 @@ func NewCanopyWebsocketServer(cfg config.Config, pigeonSys *pigeon.PigeonSystem)
             if err == nil {
                 // success, payload received
                 cnt++;
-                resp := service.ProcessDeviceComm(cfg, conn, device, "", "", in)
-                if resp.Device == nil{
-                    canolog.Error("Error processing device communications: ", resp.Err)
+
+                // The first message identifies the device, so rate limits
+                // apply from the second message on.
+                var limitErr error
+                if device != nil {
+                    _, limitErr = quotas.CheckRequest(conn, quota.DevicePrincipal(device))
+                }
+                if _, ok := limitErr.(*quota.LimitExceededError); ok {
+                    connLogger.Trace("Dropping message: ", limitErr)
+                    websocket.Message.Send(ws, `{"result" : "error", "error_type" : "rate_limit_exceeded"}`)
                 } else {
-                    device = resp.Device
-                    if mailbox == nil {
-                        deviceIdString := device.ID().String()
-                        mailbox = pigeonSys.CreateMailbox(deviceIdString)
+                    resp := service.ProcessDeviceComm(config.Snapshot(cfg), hub, senders, conn, device, "", "", in)
+                    if resp.Device == nil{
+                        connLogger.Error("Error processing device communications: ", resp.Err)
+                    } else {
+                        device = resp.Device
+                        if mailbox == nil {
+                            deviceIdString := device.ID().String()
+                            connLogger = connLogger.With("device", deviceIdString)
+                            mailbox = pigeonSys.CreateMailbox(deviceIdString)
+                            hub.Publish(deviceIdString, events.TypeConnected, nil)
+                        }
                     }
                 }
             } else if err == io.EOF {
-                canolog.Websocket("Websocket connection closed")
+                connLogger.Trace("Websocket connection closed")
                 // connection closed
-                if mailbox != nil {
-                    mailbox.Close()
-                }
+                closeMailbox()
                 return;
             } else if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
                 // timeout reached, no data for me this time
             } else {
-                canolog.Error("Unexpected error: ", err)
+                connLogger.Error("Unexpected error: ", err)
             }
 
 
@@ -93,14 +118,12 @@ func NewCanopyWebsocketServer(cfg config.Config, pigeonSys *pigeon.PigeonSystem)
             if time.Now().After(lastPingTime.Add(30*time.Second)) {
                 err := websocket.Message.Send(ws, "{}")
                 if err != nil {
-                    canolog.Websocket("Websocket connection closed during ping")
+                    connLogger.Trace("Websocket connection closed during ping")
                     // connection closed
-                    if mailbox != nil {
-                        mailbox.Close()
-                    }
+                    closeMailbox()
                     return;
                 }
-                canolog.Info("Pinging WS")
+                connLogger.Info("Pinging WS")
                 lastPingTime = time.Now()
             }
 
@@ -110,11 +133,11 @@ func NewCanopyWebsocketServer(cfg config.Config, pigeonSys *pigeon.PigeonSystem)
                     msgString, err := json.Marshal(msg.Data)
 
                     if err != nil {
-                        canolog.Error("Unexpected error: ", err)
+                        connLogger.Error("Unexpected error: ", err)
                     }
                     
-                    canolog.Info("Websocket sending", msgString)
-                    canolog.Websocket("Websocket sending: ", msgString)
+                    connLogger.Info("Websocket sending", msgString)
+                    connLogger.Trace("Websocket sending: ", msgString)
                     websocket.Message.Send(ws, msgString)
                 }
             }